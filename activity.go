@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// activityRetention is how long the events of the activity log are
+	// kept
+	activityRetention = 90 * 24 * time.Hour
+	// activityLimit is the default and maximum number of events returned
+	// by the activity api
+	activityLimit = 500
+	// activityFeedEntries is the number of entries of the atom feeds
+	activityFeedEntries = 50
+	// activityGroupWindow is how close photos added to the same album must
+	// be to be shown as a single entry of the feeds
+	activityGroupWindow = time.Hour
+)
+
+// activityEvent is an event of the activity log: a photo added to the
+// gallery, or rated by a user
+type activityEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is "photo" or "rating"
+	Kind string `json:"kind"`
+	// Path is relative to the gallery, such as "family/2020/photo.jpg"
+	Path   string `json:"path"`
+	User   string `json:"user,omitempty"`
+	Rating int    `json:"rating,omitempty"`
+}
+
+// album returns the album of the photo of the event
+func (ev activityEvent) album() string {
+	if album := path.Dir(ev.Path); album != "." {
+		return album
+	}
+	return ""
+}
+
+// activityStore persists the activity log, in the database if one is
+// configured and in activityfile otherwise
+type activityStore interface {
+	record(ev activityEvent) error
+	// events returns the events of the photos of album and of its sub
+	// albums since a time that are selected by keep, most recent first.
+	// The limit counts the selected events only.
+	events(album string, since time.Time, limit int, keep func(ev activityEvent) bool) ([]activityEvent, error)
+	// prune removes the events older than a time
+	prune(before time.Time) error
+}
+
+var activity activityStore
+
+// initActivity selects the store of the activity log, and removes the events
+// older than activityRetention every day
+func initActivity() error {
+	if db != nil {
+		activity = dbActivityStore{}
+	} else {
+		path := conf.ActivityFile
+		if path == "" {
+			path = "activity.jsonl"
+		}
+		activity = &fileActivityStore{path: path}
+	}
+	if err := activity.prune(time.Now().Add(-activityRetention)); err != nil {
+		return fmt.Errorf("activity: %v", err)
+	}
+	go func() {
+		for range time.Tick(24 * time.Hour) {
+			if err := activity.prune(time.Now().Add(-activityRetention)); err != nil {
+				logErrorf("activity: failed to prune the activity log: %v", err)
+			}
+		}
+	}()
+	registerRenderHooks(nil, activityLink)
+	return nil
+}
+
+// recordActivity adds an event to the activity log, about the photo at path,
+// such as "gallery/family/photo.jpg"
+func recordActivity(kind, path, username string, rating int) {
+	if activity == nil {
+		return
+	}
+	ev := activityEvent{
+		Time:   time.Now().UTC(),
+		Kind:   kind,
+		Path:   strings.TrimPrefix(filepath.ToSlash(path), "gallery/"),
+		User:   username,
+		Rating: rating,
+	}
+	if err := activity.record(ev); err != nil {
+		logErrorf("activity: failed to record the %s of %q: %v", kind, path, err)
+	}
+}
+
+// albumActivity returns the events of the album of the galpath route
+// variable that the user of the request can see, or replies to the request
+// if it fails
+func albumActivity(w http.ResponseWriter, r *http.Request, since time.Time, limit int) (string, []activityEvent, bool) {
+	album := strings.Trim(filepath.ToSlash(filepath.Clean("/"+mux.Vars(r)["galpath"])), "/")
+	if fi, err := os.Stat(filepath.Join("gallery", album)); err != nil || !fi.IsDir() {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return "", nil, false
+	}
+	// the roles and network rules apply to the roots of the gallery, which
+	// the activity of the whole gallery spans, and are applied before the
+	// limit so restricted users still get full pages
+	visible := reachableFilter(r)
+	events, err := activity.events(album, since, limit, func(ev activityEvent) bool {
+		return visible(filepath.Join("gallery", filepath.FromSlash(ev.Path)))
+	})
+	if err != nil {
+		logErrorf("activity: failed to read the activity of %q: %v", album, err)
+		writeError(w, r, http.StatusInternalServerError, "activity_failed")
+		return "", nil, false
+	}
+	return album, events, true
+}
+
+// apiActivity returns the events of an album and of its sub albums as json,
+// most recent first, filtered with the optional `since` (RFC3339 timestamp)
+// and `limit` query parameters
+func apiActivity(w http.ResponseWriter, r *http.Request) {
+	var (
+		q     = r.URL.Query()
+		since time.Time
+		limit = activityLimit
+		err   error
+	)
+	if q.Get("since") != "" {
+		since, err = time.Parse(time.RFC3339, q.Get("since"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+	}
+	if q.Get("limit") != "" {
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		if limit > activityLimit {
+			limit = activityLimit
+		}
+	}
+	_, events, ok := albumActivity(w, r, since, limit)
+	if !ok {
+		return
+	}
+	if events == nil {
+		events = []activityEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// atomFeed, atomEntry, atomPerson and atomLink are the elements of an Atom
+// feed
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Link    atomLink    `xml:"link"`
+	Summary string      `xml:"summary"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+// activityFeed returns the activity of an album and of its sub albums as an
+// Atom feed, for feed readers to follow. The photos added to an album
+// within activityGroupWindow are grouped in a single entry.
+func activityFeed(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	album, events, ok := albumActivity(w, r, time.Time{}, activityLimit)
+	if !ok {
+		return
+	}
+	base := "https://" + conf.Host
+	title := album
+	if title == "" {
+		title = "/"
+	}
+	feed := atomFeed{
+		ID:      base + link(path.Join("/activity", album)+"/"),
+		Title:   fmt.Sprintf(tr(locale, "activity_of"), title),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: conf.Host},
+		Link: []atomLink{
+			{Rel: "self", Href: base + link(path.Join("/activity", album)+"/")},
+			{Rel: "alternate", Href: base + link(path.Join("/gallery", album)+"/")},
+		},
+	}
+	for i := 0; i < len(events) && len(feed.Entries) < activityFeedEntries; i++ {
+		ev := events[i]
+		if i == 0 {
+			feed.Updated = ev.Time.Format(time.RFC3339)
+		}
+		entry := atomEntry{
+			Updated: ev.Time.Format(time.RFC3339),
+			Link:    atomLink{Href: base + link(path.Join("/gallery", ev.album())+"/")},
+		}
+		switch ev.Kind {
+		case "photo":
+			// events are the most recent first, the group ends with the
+			// first photo added
+			names := []string{path.Base(ev.Path)}
+			for i+1 < len(events) && events[i+1].Kind == "photo" && events[i+1].album() == ev.album() &&
+				ev.Time.Sub(events[i+1].Time) < activityGroupWindow {
+				i++
+				names = append(names, path.Base(events[i].Path))
+			}
+			// the group keeps its id as photos are added to it
+			entry.ID = fmt.Sprintf("%s#photo-%d", feed.ID, events[i].Time.UnixNano())
+			entry.Title = fmt.Sprintf(tr(locale, "activity_photos"), formatCount(locale, int64(len(names))), "/"+ev.album())
+			entry.Summary = strings.Join(names, ", ")
+		case "rating":
+			entry.Title = fmt.Sprintf(tr(locale, "activity_rating"), ev.User, path.Base(ev.Path), ev.Rating)
+			entry.Summary = ev.Path
+			entry.Author = &atomPerson{Name: ev.User}
+			entry.ID = fmt.Sprintf("%s#rating-%d", feed.ID, ev.Time.UnixNano())
+		default:
+			continue
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		logErrorf("activity: failed to write the feed of %q: %v", album, err)
+	}
+}
+
+// activityLink adds the link of the activity feed of an album to the head of
+// its pages, for browsers and feed readers to discover it
+func activityLink(r *http.Request, name string, page []byte) []byte {
+	galpath, ok := mux.Vars(r)["galpath"]
+	if !ok || (name != "album" && name != "index") {
+		return page
+	}
+	album := strings.Trim(filepath.ToSlash(filepath.Clean("/"+galpath)), "/")
+	feed := `<link rel="alternate" type="application/atom+xml" title="` +
+		html.EscapeString(fmt.Sprintf(tr(requestLocale(r), "activity_of"), "/"+album)) + `" href="` +
+		html.EscapeString(link(path.Join("/activity", album)+"/")) + `">`
+	return bytes.Replace(page, []byte("</head>"), []byte(feed+"</head>"), 1)
+}
+
+// inActivityAlbum returns true if the event is about a photo of album or of
+// its sub albums, "" being the whole gallery
+func inActivityAlbum(ev activityEvent, album string) bool {
+	return album == "" || strings.HasPrefix(ev.Path, album+"/")
+}
+
+// fileActivityStore appends the events of the activity log to a file, one
+// json encoded event per line, which is read again by every query
+type fileActivityStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileActivityStore) record(ev activityEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fd, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(append(line, '\n'))
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// read returns the events of the file, oldest first. The caller must hold
+// the lock.
+func (s *fileActivityStore) read() ([]activityEvent, error) {
+	fd, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var events []activityEvent
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var ev activityEvent
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			logWarnf("activity: skipping malformed event %q: %v", scanner.Text(), err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+func (s *fileActivityStore) events(album string, since time.Time, limit int, keep func(ev activityEvent) bool) ([]activityEvent, error) {
+	s.mu.Lock()
+	all, err := s.read()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var events []activityEvent
+	for i := len(all) - 1; i >= 0 && len(events) < limit; i-- {
+		if inActivityAlbum(all[i], album) && !all[i].Time.Before(since) && keep(all[i]) {
+			events = append(events, all[i])
+		}
+	}
+	return events, nil
+}
+
+// prune rewrites the file without the events older than before, if it has
+// any
+func (s *fileActivityStore) prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	kept := 0
+	for _, ev := range all {
+		if ev.Time.Before(before) {
+			continue
+		}
+		line, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+		kept++
+	}
+	if kept == len(all) {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// dbActivityStore keeps the activity log in the activity table of the
+// database, with the times of the events in nanoseconds since the epoch
+type dbActivityStore struct{}
+
+func (dbActivityStore) record(ev activityEvent) error {
+	_, err := db.Exec(rebind(`INSERT INTO activity (time, kind, path, username, rating) VALUES (?, ?, ?, ?, ?)`),
+		ev.Time.UnixNano(), ev.Kind, ev.Path, ev.User, ev.Rating)
+	return err
+}
+
+func (dbActivityStore) events(album string, since time.Time, limit int, keep func(ev activityEvent) bool) ([]activityEvent, error) {
+	query := `SELECT time, kind, path, username, rating FROM activity WHERE time >= ?`
+	args := []interface{}{since.UnixNano()}
+	if album != "" {
+		// the prefix is compared exactly, as album names may contain the
+		// wildcards of LIKE
+		query += ` AND SUBSTR(path, 1, ?) = ?`
+		args = append(args, utf8.RuneCountInString(album)+1, album+"/")
+	}
+	// the rows are read until limit of them are kept, as the events the
+	// user cannot see are not counted
+	query += ` ORDER BY time DESC`
+	rows, err := db.Query(rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []activityEvent
+	for len(events) < limit && rows.Next() {
+		var (
+			ev       activityEvent
+			t        int64
+			username sql.NullString
+		)
+		if err = rows.Scan(&t, &ev.Kind, &ev.Path, &username, &ev.Rating); err != nil {
+			return nil, err
+		}
+		ev.Time, ev.User = time.Unix(0, t).UTC(), username.String
+		if keep(ev) {
+			events = append(events, ev)
+		}
+	}
+	return events, rows.Err()
+}
+
+func (dbActivityStore) prune(before time.Time) error {
+	_, err := db.Exec(rebind(`DELETE FROM activity WHERE time < ?`), before.UnixNano())
+	return err
+}
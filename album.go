@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// albumImage describes an image in the json listing of an album
+type albumImage struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Thumb       string    `json:"thumb"`
+	Placeholder string    `json:"placeholder,omitempty"`
+	Captured    time.Time `json:"captured,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Caption     string    `json:"caption,omitempty"`
+	Rating      int       `json:"rating,omitempty"`
+	Place       string    `json:"place,omitempty"`
+	// Companions are the urls of the raw versions and live photo videos
+	// of the image
+	Companions []string `json:"companions,omitempty"`
+}
+
+// albumAudio describes an audio file in the json listing of an album
+type albumAudio struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Cover is the url of the thumbnail of the picture embedded in the
+	// file, if any
+	Cover string `json:"cover,omitempty"`
+}
+
+// albumListing is returned as json by the album endpoint
+type albumListing struct {
+	Albums []string     `json:"albums"`
+	Images []albumImage `json:"images"`
+	// Documents are the urls of the PDF documents of the album, when
+	// documents are enabled for it
+	Documents []string `json:"documents,omitempty"`
+	// Files are the urls of the other files of the album whose extension
+	// is allowed, such as gpx tracks
+	Files []string     `json:"files,omitempty"`
+	Audio []albumAudio `json:"audio,omitempty"`
+	// Total is the number of images of the album, of which Images is a
+	// page when offset or limit are set
+	Total int `json:"total"`
+	// Seed is the seed of the order of the images when they are shuffled
+	Seed int64 `json:"seed,omitempty"`
+	// Download is the download policy of the album, when it is not the
+	// default, in which case the urls of the images are those of their
+	// largest resized versions
+	Download string `json:"download,omitempty"`
+}
+
+// albumInfo lists the sub-albums and images of the album designated by the
+// galpath route variable, along with the placeholders of the images. The
+// tag and place query parameters restrict the listing to the images of a
+// tag or taken at a place, and min_rating to those rated at least that
+// many stars. shuffle and seed set a random order, and offset and limit
+// select a page of the images. Clients accepting application/ld+json get
+// the album as a schema.org ImageGallery instead.
+func albumInfo(w http.ResponseWriter, r *http.Request) {
+	albumDir := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	listing, err := listAlbum(albumDir, normalizeTag(r.URL.Query().Get("tag")), strings.TrimSpace(r.URL.Query().Get("place")), minRating(r))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		writeImageGallery(w, r, albumDir, listing)
+		return
+	}
+	writeAlbumListing(w, r, listing)
+}
+
+// listAlbum lists the album dir, restricted to the images of tag, taken at
+// place, and rated at least min stars, when they are set
+func listAlbum(albumDir, tag, place string, min int) (albumListing, error) {
+	entries, err := readAlbum(albumDir)
+	if err != nil {
+		return albumListing{}, err
+	}
+	listing := albumListing{Albums: []string{}, Images: []albumImage{}}
+	policy := albumPolicy(albumDir)
+	if !policy.originals() {
+		listing.Download = policy.Download
+	}
+	companions := albumCompanions(entries)
+	captions := albumCaptions(albumDir, entries)
+	for _, f := range albumFileViews(albumDir, entries) {
+		listing.Files = append(listing.Files, link("/"+f.Path))
+	}
+	for _, a := range albumAudioViews(albumDir, entries) {
+		audio := albumAudio{Name: a.Name, URL: link("/" + a.Path)}
+		if a.Cover {
+			audio.Cover = link("/" + a.Path + "?width=300")
+		}
+		listing.Audio = append(listing.Audio, audio)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			listing.Albums = append(listing.Albums, entry.Name())
+			continue
+		}
+		path := filepath.Join(albumDir, entry.Name())
+		if entry.Mode().IsRegular() && isDocument(path) {
+			listing.Documents = append(listing.Documents, link("/"+path))
+			continue
+		}
+		if !isImage(path) {
+			continue
+		}
+		img := albumImage{
+			Name:  entry.Name(),
+			URL:   link("/" + path),
+			Thumb: link("/" + path + "?width=300" + editQuery(path)),
+		}
+		if policy.originals() {
+			for _, name := range companions[entry.Name()] {
+				img.Companions = append(img.Companions, link("/"+filepath.Join(albumDir, name)))
+			}
+		} else {
+			img.URL = link("/" + path + "?width=" + strconv.Itoa(int(policy.maxSize())) + editQuery(path))
+		}
+		img.Title, img.Caption = captions[entry.Name()].Title, captions[entry.Name()].Caption
+		e, ok := index.get(path)
+		if ok {
+			img.Placeholder = e.Placeholder
+			img.Captured = e.Captured
+			img.Tags = e.allTags()
+			img.Rating, img.Place = e.Rating, e.Place
+			// titles and captions set in the gallery override those
+			// of sidecar files
+			if e.Title != "" {
+				img.Title = e.Title
+			}
+			if e.Caption != "" {
+				img.Caption = e.Caption
+			}
+		}
+		if tag != "" && !e.hasTag(tag) {
+			continue
+		}
+		if place != "" && !e.inPlace(place) {
+			continue
+		}
+		if img.Rating < min {
+			continue
+		}
+		listing.Images = append(listing.Images, img)
+	}
+	return listing, nil
+}
+
+// writeAlbumListing writes a listing as json, after shuffling its images and
+// selecting the page of the shuffle, seed, offset and limit parameters
+func writeAlbumListing(w http.ResponseWriter, r *http.Request, listing albumListing) {
+	listing.Total = len(listing.Images)
+	if seed, ok := shuffleSeed(r); ok {
+		listing.Seed = seed
+		shuffle(seed, len(listing.Images), func(i, j int) {
+			listing.Images[i], listing.Images[j] = listing.Images[j], listing.Images[i]
+		})
+	}
+	if offset, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && offset > 0 {
+		if offset > len(listing.Images) {
+			offset = len(listing.Images)
+		}
+		listing.Images = listing.Images[offset:]
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(listing.Images) {
+		listing.Images = listing.Images[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveFile is the name of the manifest that freezes an album
+const archiveFile = ".archive.json"
+
+// archiveManifest records the content of an archived album, along with its
+// sub albums, which are read only for as long as the manifest exists
+type archiveManifest struct {
+	Archived time.Time `json:"archived"`
+	User     string    `json:"user"`
+	// Files maps the paths of the files, relative to the album, to the
+	// sha256 of their content
+	Files map[string]string `json:"files"`
+}
+
+// archiveCheck is the result of the verification of an archived album
+// against its manifest
+type archiveCheck struct {
+	Album    string    `json:"album"`
+	Checked  time.Time `json:"checked"`
+	Missing  []string  `json:"missing"`
+	Modified []string  `json:"modified"`
+	// Added files are not in the manifest, they were added despite the
+	// album being read only, such as directly on disk
+	Added []string `json:"added"`
+}
+
+func (c archiveCheck) ok() bool {
+	return len(c.Missing)+len(c.Modified)+len(c.Added) == 0
+}
+
+var (
+	// archiveChecks are the last verifications of the archived albums
+	archiveChecks = make(map[string]archiveCheck)
+	archiveLock   sync.Mutex
+)
+
+// archivedAlbum returns the directory of the archived album containing path,
+// or an empty string if path is not part of an archived album
+func archivedAlbum(path string) string {
+	for dir := filepath.Clean(path); strings.HasPrefix(dir, "gallery/"); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, archiveFile)); err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// isArchived returns true if path is part of an archived album, which no
+// upload, edit or publication can modify
+func isArchived(path string) bool {
+	return archivedAlbum(path) != ""
+}
+
+// albumFiles returns the sha256 of the files of an album and of its sub
+// albums, by path relative to the album, without the manifest and the
+// settings
+func albumFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Name() == archiveFile || fi.Name() == albumFile {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)], err = hashFile(path)
+		return err
+	})
+	return files, err
+}
+
+// readArchive returns the manifest of an archived album
+func readArchive(dir string) (m archiveManifest, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, archiveFile))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &m)
+	return
+}
+
+// archiveAlbum freezes an album, by writing the manifest of its files
+func archiveAlbum(dir, username string) error {
+	if outer := archivedAlbum(dir); outer != "" {
+		return fmt.Errorf("%q is already archived", outer)
+	}
+	files, err := albumFiles(dir)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(archiveManifest{Archived: time.Now().UTC(), User: username, Files: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the manifest only appears once complete
+	tmp := filepath.Join(dir, archiveFile+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0444); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, archiveFile))
+}
+
+// verifyArchive compares the files of an archived album with its manifest
+func verifyArchive(dir string) (archiveCheck, error) {
+	check := archiveCheck{
+		Album:    dir,
+		Checked:  time.Now(),
+		Missing:  []string{},
+		Modified: []string{},
+		Added:    []string{},
+	}
+	m, err := readArchive(dir)
+	if err != nil {
+		return check, err
+	}
+	files, err := albumFiles(dir)
+	if err != nil {
+		return check, err
+	}
+	for name, sum := range m.Files {
+		if current, ok := files[name]; !ok {
+			check.Missing = append(check.Missing, name)
+		} else if current != sum {
+			check.Modified = append(check.Modified, name)
+		}
+	}
+	for name := range files {
+		if _, ok := m.Files[name]; !ok {
+			check.Added = append(check.Added, name)
+		}
+	}
+	sort.Strings(check.Missing)
+	sort.Strings(check.Modified)
+	sort.Strings(check.Added)
+	archiveLock.Lock()
+	archiveChecks[dir] = check
+	archiveLock.Unlock()
+	return check, nil
+}
+
+// archivedAlbums returns the directories of the archived albums
+func archivedAlbums() (albums []string) {
+	filepath.Walk("gallery", func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.Name() == archiveFile {
+			albums = append(albums, filepath.Dir(path))
+		}
+		return nil
+	})
+	sort.Strings(albums)
+	return
+}
+
+// archivesView lists the archived albums with the result of their last
+// verification, and lets admins archive, verify and unarchive albums
+func archivesView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	var archivesHtml string
+	for _, dir := range archivedAlbums() {
+		m, err := readArchive(dir)
+		if err != nil {
+			logErrorf("archive: invalid manifest of %q: %v", dir, err)
+		}
+		archiveLock.Lock()
+		check, checked := archiveChecks[dir]
+		archiveLock.Unlock()
+		status := tr(locale, "archive_unchecked")
+		if checked && check.ok() {
+			status = fmt.Sprintf(tr(locale, "archive_intact"), formatDate(locale, check.Checked, true))
+		} else if checked {
+			status = fmt.Sprintf(tr(locale, "archive_damaged"), formatDate(locale, check.Checked, true),
+				len(check.Missing), len(check.Modified), len(check.Added))
+		}
+		album := html.EscapeString(strings.TrimPrefix(dir, "gallery/"))
+		archivesHtml += fmt.Sprintf(`<li><a href="%s/">%s</a>, %s, %s %s: %s
+	<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="album" value="%s"/><button type="submit" name="action" value="verify">%s</button> <button type="submit" name="action" value="unarchive">%s</button></form>
+</li>
+`, html.EscapeString(link("/"+dir)), album, fmt.Sprintf(tr(locale, "archive_files"), formatCount(locale, int64(len(m.Files)))), html.EscapeString(m.User), formatDate(locale, m.Archived, true), html.EscapeString(status),
+			link("/admin/archives"), album, tr(locale, "verify"), tr(locale, "unarchive"))
+	}
+	if archivesHtml == "" {
+		archivesHtml = "<p>" + tr(locale, "none_found") + "</p>"
+	} else {
+		archivesHtml = "<ul>\n" + archivesHtml + "</ul>"
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "archives")+`</h1>
+		<form method="POST" action="`+link("/admin/archives")+`"><input type="text" name="album" placeholder="album/subalbum"/> <button type="submit" name="action" value="archive">`+tr(locale, "archive")+`</button></form>
+`+archivesHtml+`
+	</body>
+</html>`))
+}
+
+// archiveAction archives, verifies or unarchives the album of the form
+func archiveAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	dir := filepath.Join("gallery", filepath.Clean("/"+r.FormValue("album")))
+	if fi, err := os.Stat(dir); dir == "gallery" || err != nil || !fi.IsDir() {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	var err error
+	switch r.FormValue("action") {
+	case "archive":
+		if err = archiveAlbum(dir, username); err == nil {
+			logInfof("archive: user %q archived %q", username, dir)
+		}
+	case "verify":
+		var check archiveCheck
+		if check, err = verifyArchive(dir); err == nil && !check.ok() {
+			logWarnf("archive: %q has %d missing, %d modified and %d added files",
+				dir, len(check.Missing), len(check.Modified), len(check.Added))
+		}
+	case "unarchive":
+		if err = os.Remove(filepath.Join(dir, archiveFile)); err == nil {
+			logInfof("archive: user %q unarchived %q", username, dir)
+			archiveLock.Lock()
+			delete(archiveChecks, dir)
+			archiveLock.Unlock()
+		}
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if err != nil {
+		logErrorf("archive: failed to %s %q: %v", r.FormValue("action"), dir, err)
+		writeError(w, r, http.StatusInternalServerError, "archive_failed")
+		return
+	}
+	http.Redirect(w, r, link("/admin/archives"), http.StatusSeeOther)
+}
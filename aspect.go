@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// aspect is how a resized image fits in the box of the width and height
+// parameters of its request, as set by the mode parameter:
+//
+//   - fit, the default, keeps the whole image, which is smaller than the box
+//     along one of its sides
+//   - fill covers the box, and cuts the image on the side of the gravity
+//     parameter: center, north, south, east, west, northeast, northwest,
+//     southeast or southwest
+//   - pad keeps the whole image, centered on a box filled with the
+//     background parameter, a hex color such as ffffff
+//
+// The box is a square when there is no height. The crop parameter, which
+// cuts square thumbnails, takes precedence. The enhancement of the image,
+// see parseEnhancement, applies to every mode and to square thumbnails.
+type aspect struct {
+	mode string
+	// height is the height of the box, 0 if it is a square
+	height     uint
+	gravity    string
+	background color.RGBA
+	enhance    enhancement
+}
+
+// gravities are the sides the fill mode cuts towards, in clockwise order
+var gravities = []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest"}
+
+// parseAspect returns the aspect of the parameters of an image request
+func parseAspect(r *http.Request) (a aspect, err error) {
+	query := r.URL.Query()
+	a.mode = query.Get("mode")
+	switch a.mode {
+	case "", "fit", "fill", "pad":
+	default:
+		return a, fmt.Errorf("unknown mode %q", a.mode)
+	}
+	if h := query.Get("height"); h != "" {
+		height, err := strconv.ParseUint(h, 10, 32)
+		if err != nil || height == 0 {
+			return a, fmt.Errorf("invalid height %q", h)
+		}
+		a.height = uint(height)
+	}
+	if g := query.Get("gravity"); a.mode == "fill" && g != "center" {
+		if g != "" && indexOf(gravities, g) < 0 {
+			return a, fmt.Errorf("unknown gravity %q", g)
+		}
+		a.gravity = g
+	}
+	a.background = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if bg := query.Get("background"); a.mode == "pad" && bg != "" {
+		if a.background, err = parseHexColor(bg); err != nil {
+			return a, err
+		}
+	}
+	a.enhance, err = parseEnhancement(query)
+	return a, err
+}
+
+// parseHexColor parses a color such as #336699, #369 or 336699
+func parseHexColor(s string) (color.RGBA, error) {
+	h := strings.TrimPrefix(s, "#")
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+	rgb, err := hex.DecodeString(h)
+	if err != nil || len(rgb) != 3 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}, nil
+}
+
+// boxHeight returns the height of the box of an image resized to width
+func (a aspect) boxHeight(width uint) uint {
+	if a.height == 0 {
+		return width
+	}
+	return a.height
+}
+
+// within returns the width and the aspect of an image whose box is shrunk,
+// keeping its shape, so neither of its sides is larger than max
+func (a aspect) within(width, max uint) (uint, aspect) {
+	// a box without height is a square, which only needs its width capped
+	if width > max {
+		if a.height != 0 {
+			a.height = atLeastOne(a.height * max / width)
+		}
+		width = max
+	}
+	if a.height > max {
+		width = atLeastOne(width * max / a.height)
+		a.height = max
+	}
+	return width, a
+}
+
+func atLeastOne(n uint) uint {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// version identifies the aspect in cache keys, it is empty for the default
+// one so the keys of the thumbnails do not change
+func (a aspect) version() string {
+	if (a.mode == "" || a.mode == "fit") && a.height == 0 {
+		return ""
+	}
+	mode := a.mode
+	if mode == "" {
+		mode = "fit"
+	}
+	v := mode
+	if a.height != 0 {
+		v += "x" + strconv.Itoa(int(a.height))
+	}
+	switch mode {
+	case "fill":
+		if a.gravity != "" {
+			v += "_" + a.gravity
+		}
+	case "pad":
+		v += "_" + hex.EncodeToString([]byte{a.background.R, a.background.G, a.background.B})
+	}
+	return v
+}
+
+// rotateGravity returns the side of an image that becomes the gravity once
+// it is rotated clockwise by the given degrees
+func rotateGravity(gravity string, degrees int) string {
+	i := indexOf(gravities, gravity)
+	if i < 0 {
+		return gravity
+	}
+	n := len(gravities)
+	return gravities[((i-degrees/45)%n+n)%n]
+}
+
+// resizeTo resizes src to the box of width pixels. Images that are rotated
+// after they are resized, by the given degrees, are resized to the turned
+// box.
+func (a aspect) resizeTo(src image.Image, width uint, degrees int) image.Image {
+	height := a.boxHeight(width)
+	if degrees == 90 || degrees == 270 {
+		width, height = height, width
+	}
+	switch a.mode {
+	case "fill":
+		gravity := rotateGravity(a.gravity, degrees)
+		return resize.Resize(width, height, cropAspect(src, width, height, gravity), resize.NearestNeighbor)
+	case "pad":
+		m := resize.Thumbnail(width, height, src, resize.NearestNeighbor)
+		canvas := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+		draw.Draw(canvas, canvas.Bounds(), &image.Uniform{a.background}, image.Point{}, draw.Src)
+		b := m.Bounds()
+		offset := image.Pt((int(width)-b.Dx())/2, (int(height)-b.Dy())/2)
+		draw.Draw(canvas, b.Sub(b.Min).Add(offset), m, b.Min, draw.Over)
+		return canvas
+	}
+	return resize.Thumbnail(width, height, src, resize.NearestNeighbor)
+}
+
+// cropAspect returns the largest region of img with the aspect ratio of a
+// box of width by height pixels, on the side of the gravity
+func cropAspect(img image.Image, width, height uint, gravity string) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w*int(height) > h*int(width) {
+		w = h * int(width) / int(height)
+	} else {
+		h = w * int(height) / int(width)
+	}
+	if w == 0 || h == 0 {
+		return img
+	}
+	x, y := (b.Dx()-w)/2, (b.Dy()-h)/2
+	switch {
+	case strings.HasSuffix(gravity, "west"):
+		x = 0
+	case strings.HasSuffix(gravity, "east"):
+		x = b.Dx() - w
+	}
+	switch {
+	case strings.HasPrefix(gravity, "north"):
+		y = 0
+	case strings.HasPrefix(gravity, "south"):
+		y = b.Dy() - h
+	}
+	return subImage(img, image.Rect(b.Min.X+x, b.Min.Y+y, b.Min.X+x+w, b.Min.Y+y+h))
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// audiore matches the audio files shown in the albums, with a player. Their
+// content types are registered by initFiles.
+var audiore = regexp.MustCompile(`(?i)\.(mp3|flac|m4a)$`)
+
+// maxCoverSize caps the size of the thumbnails of the covers of audio files
+const maxCoverSize = 1200
+
+// maxCoverBytes is the largest picture read from an audio file
+const maxCoverBytes = 16 << 20
+
+// errNoCover is returned for the audio files without an embedded picture
+var errNoCover = errors.New("no embedded picture")
+
+// isAudio returns true if the file at path is an audio file
+func isAudio(path string) bool {
+	return audiore.MatchString(path)
+}
+
+// coverState records whether an audio file has a cover, as long as the file
+// keeps its size and modification time
+type coverState struct {
+	size    int64
+	modtime time.Time
+	cover   bool
+}
+
+var (
+	coverLock   sync.Mutex
+	coverStates = make(map[string]coverState)
+	// audioLock serializes the rendering of the thumbnails of covers
+	audioLock sync.Mutex
+)
+
+// hasCover returns true if the audio file at path embeds a picture
+func hasCover(path string, fi os.FileInfo) bool {
+	coverLock.Lock()
+	s, ok := coverStates[path]
+	coverLock.Unlock()
+	if ok && s.size == fi.Size() && s.modtime.Equal(fi.ModTime()) {
+		return s.cover
+	}
+	_, err := audioCover(path)
+	if err != nil && err != errNoCover {
+		logWarnf("audio: failed to read the cover of %q: %v", path, err)
+	}
+	coverLock.Lock()
+	coverStates[path] = coverState{size: fi.Size(), modtime: fi.ModTime(), cover: err == nil}
+	coverLock.Unlock()
+	return err == nil
+}
+
+// albumAudioViews returns the audio files of the album dir, given the
+// entries of the album directory. Albums whose originals cannot be
+// downloaded list no audio files, as they cannot be played.
+func albumAudioViews(dir string, entries []os.FileInfo) (audio []photoView) {
+	if !albumPolicy(dir).originals() {
+		return nil
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.Mode().IsRegular() && isAudio(path) {
+			audio = append(audio, photoView{Name: e.Name(), Path: path, Size: e.Size(), Cover: hasCover(path, e)})
+		}
+	}
+	return audio
+}
+
+// serveAudio streams the audio file at path, with range requests so players
+// can seek into it, or returns the thumbnail of its cover when a width is
+// requested
+func serveAudio(w http.ResponseWriter, r *http.Request, path string) {
+	width, err := strconv.Atoi(r.URL.Query().Get("width"))
+	if err != nil || width <= 0 {
+		streamOriginal(w, r, path)
+		return
+	}
+	if width > maxCoverSize {
+		width = maxCoverSize
+	}
+	thumb, modtime, err := coverThumbnail(path, width)
+	if err != nil {
+		if os.IsNotExist(err) || err == errNoCover {
+			writeError(w, r, http.StatusNotFound, "not_found")
+		} else {
+			logErrorf("audio: failed to render the cover of %q: %v", path, err)
+			writeError(w, r, http.StatusInternalServerError, "image_failed")
+		}
+		return
+	}
+	defer thumb.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	conf.Caching.Thumbnails.setHeaders(w)
+	http.ServeContent(w, r, path+".jpg", modtime, thumb)
+}
+
+// coverThumbnail returns the cover of the audio file at path, as a jpeg
+// image of at most size pixels, from the cache or decoded from the file
+func coverThumbnail(path string, size int) (cachedFile, time.Time, error) {
+	hash, err := contentHash(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cacheKey := thumbnailKey(hash, strconv.Itoa(size), ".jpg")
+	audioLock.Lock()
+	defer audioLock.Unlock()
+	if thumb, modtime, err := imgCache.get(cacheKey); err == nil {
+		return thumb, modtime, nil
+	}
+	data, err := audioCover(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cover, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, resize.Thumbnail(uint(size), uint(size), cover, resize.Bilinear), nil); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err = imgCache.put(cacheKey, buf.Bytes()); err != nil {
+		logErrorf("cache: failed to store %q: %v", cacheKey, err)
+	}
+	return memFile{bytes.NewReader(buf.Bytes())}, time.Now(), nil
+}
+
+// audioCover returns the picture embedded in the audio file at path, the
+// front cover if it has several, or errNoCover
+func audioCover(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		return id3Cover(fd)
+	case ".flac":
+		return flacCover(fd)
+	case ".m4a":
+		return mp4Cover(fd)
+	}
+	return nil, errNoCover
+}
+
+// syncsafe decodes the 28 bits integers of id3v2 headers, whose bytes have
+// their high bit unset
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Cover returns the attached picture of the id3v2 tag at the start of r
+func id3Cover(r io.Reader) ([]byte, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		return nil, errNoCover
+	}
+	version, flags, size := header[3], header[5], syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > maxCoverBytes {
+		return nil, errNoCover
+	}
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, err
+	}
+	// before version 4, the whole tag is unsynchronised
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.Replace(tag, []byte{0xff, 0x00}, []byte{0xff}, -1)
+	}
+	if flags&0x40 != 0 && version > 2 && len(tag) >= 4 {
+		// the extended header counts its size in version 4 only
+		skip := int(binary.BigEndian.Uint32(tag)) + 4
+		if version == 4 {
+			skip = syncsafe(tag)
+		}
+		if skip > len(tag) {
+			return nil, errNoCover
+		}
+		tag = tag[skip:]
+	}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	var cover []byte
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var frameSize int
+		var frameFlags byte
+		switch version {
+		case 2:
+			frameSize = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[4:8]))
+			frameFlags = tag[9]
+		case 4:
+			frameSize = syncsafe(tag[4:8])
+			frameFlags = tag[9]
+		}
+		if frameSize > len(tag)-headerLen {
+			break
+		}
+		frame := tag[headerLen : headerLen+frameSize]
+		tag = tag[headerLen+frameSize:]
+		if id != "APIC" && id != "PIC" {
+			continue
+		}
+		if version == 4 {
+			// compressed and encrypted frames are skipped
+			if frameFlags&0x0c != 0 {
+				continue
+			}
+			if frameFlags&0x01 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+			if frameFlags&0x02 != 0 {
+				frame = bytes.Replace(frame, []byte{0xff, 0x00}, []byte{0xff}, -1)
+			}
+		} else if version == 3 && frameFlags&0xc0 != 0 {
+			continue
+		}
+		picture, front := id3Picture(frame, version == 2)
+		if picture != nil && (front || cover == nil) {
+			cover = picture
+			if front {
+				break
+			}
+		}
+	}
+	if cover == nil {
+		return nil, errNoCover
+	}
+	return cover, nil
+}
+
+// id3Picture returns the data of an APIC frame, or of a PIC frame of
+// version 2, and true if it is the front cover
+func id3Picture(frame []byte, pic bool) ([]byte, bool) {
+	if len(frame) < 2 {
+		return nil, false
+	}
+	encoding := frame[0]
+	rest := frame[1:]
+	if pic {
+		// an image format of three characters, such as JPG
+		if len(rest) < 3 {
+			return nil, false
+		}
+		rest = rest[3:]
+	} else {
+		i := bytes.IndexByte(rest, 0)
+		if i < 0 {
+			return nil, false
+		}
+		rest = rest[i+1:]
+	}
+	if len(rest) < 1 {
+		return nil, false
+	}
+	front := rest[0] == 3
+	rest = rest[1:]
+	// the description ends with a null character, of two bytes in the
+	// utf-16 encodings
+	if encoding == 1 || encoding == 2 {
+		for i := 0; i+1 < len(rest); i += 2 {
+			if rest[i] == 0 && rest[i+1] == 0 {
+				return rest[i+2:], front
+			}
+		}
+		return nil, false
+	}
+	i := bytes.IndexByte(rest, 0)
+	if i < 0 {
+		return nil, false
+	}
+	return rest[i+1:], front
+}
+
+// flacCover returns the picture of the metadata blocks of a flac stream
+func flacCover(r io.Reader) ([]byte, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "fLaC" {
+		return nil, errNoCover
+	}
+	var cover []byte
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if kind != 6 {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return nil, err
+			}
+		} else {
+			block := make([]byte, size)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return nil, err
+			}
+			picture, front := flacPicture(block)
+			if picture != nil && (front || cover == nil) {
+				cover = picture
+				if front {
+					return cover, nil
+				}
+			}
+		}
+		if last {
+			break
+		}
+	}
+	if cover == nil {
+		return nil, errNoCover
+	}
+	return cover, nil
+}
+
+// flacPicture returns the data of a PICTURE metadata block, and true if it
+// is the front cover
+func flacPicture(block []byte) ([]byte, bool) {
+	field := func(n int) ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		size := int(binary.BigEndian.Uint32(block))
+		if n >= 0 {
+			size = n
+		} else {
+			block = block[4:]
+		}
+		if size > len(block) {
+			return nil, false
+		}
+		value := block[:size]
+		block = block[size:]
+		return value, true
+	}
+	kind, ok := field(4)
+	if !ok {
+		return nil, false
+	}
+	// the mime type and the description, then the width, height, color
+	// depth and number of colors
+	if _, ok = field(-1); !ok {
+		return nil, false
+	}
+	if _, ok = field(-1); !ok {
+		return nil, false
+	}
+	if _, ok = field(16); !ok {
+		return nil, false
+	}
+	data, ok := field(-1)
+	if !ok {
+		return nil, false
+	}
+	return data, binary.BigEndian.Uint32(kind) == 3
+}
+
+// mp4Cover returns the cover of the itunes metadata of an mp4 file, in its
+// moov.udta.meta.ilst.covr.data atom
+func mp4Cover(r io.ReaderAt) ([]byte, error) {
+	start, end := int64(0), int64(1<<62)
+	for _, name := range []string{"moov", "udta", "meta", "ilst", "covr", "data"} {
+		var err error
+		if start, end, err = mp4Atom(r, start, end, name); err != nil {
+			return nil, err
+		}
+		if name == "meta" {
+			// meta is a full atom, with a version and flags
+			start += 4
+		}
+	}
+	// the data starts with its type and locale
+	start += 8
+	if end-start <= 0 || end-start > maxCoverBytes {
+		return nil, errNoCover
+	}
+	data := make([]byte, end-start)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// mp4Atom returns the start and end of the content of the first atom of type
+// name between start and end
+func mp4Atom(r io.ReaderAt, start, end int64, name string) (int64, int64, error) {
+	header := make([]byte, 16)
+	for start+8 <= end {
+		if _, err := r.ReadAt(header[:8], start); err == io.EOF {
+			return 0, 0, errNoCover
+		} else if err != nil {
+			return 0, 0, err
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header)), int64(8)
+		switch size {
+		case 0:
+			// the atom extends to the end of the file
+			size = end - start
+		case 1:
+			if _, err := r.ReadAt(header[8:16], start+8); err != nil {
+				return 0, 0, err
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize {
+			return 0, 0, errNoCover
+		}
+		if string(header[4:8]) == name {
+			return start + headerSize, start + size, nil
+		}
+		start += size
+	}
+	return 0, 0, errNoCover
+}
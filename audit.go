@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// auditEntry records a single download of an original file
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	// Token is the id of the api token the file was downloaded with, or
+	// the label of the link, see tokenLabel
+	Token string `json:"token,omitempty"`
+}
+
+// auditLog is an append-only file of json encoded audit entries, one per line
+var auditLog struct {
+	sync.Mutex
+	fd *os.File
+}
+
+// openAuditLog opens the audit log file for appending, creating it if needed
+func openAuditLog(path string) (err error) {
+	auditLog.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return
+}
+
+// recordDownload appends an entry to the audit log, if one is configured.
+// Every handler that sends the bytes of an original calls it. The downloads
+// of the requests without a user, such as those of share links, are
+// recorded under the label of their token.
+func recordDownload(r *http.Request, path string) {
+	if auditLog.fd == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:       time.Now().UTC(),
+		User:       requestUser(r),
+		Path:       path,
+		RemoteAddr: r.RemoteAddr,
+	}
+	entry.Token, _ = context.Get(r, tokenKey).(string)
+	if entry.Token == "" && mux.Vars(r)["token"] != "" {
+		entry.Token = tokenLabel(mux.Vars(r)["token"])
+	}
+	if entry.User == "" && entry.Token != "" {
+		entry.User = "token:" + entry.Token
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logErrorf("audit: failed to encode entry: %v", err)
+		return
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if _, err = auditLog.fd.Write(append(line, '\n')); err != nil {
+		logErrorf("audit: failed to write entry: %v", err)
+	}
+}
+
+// tokenLabel returns the label a link token is recorded under in the audit
+// log, which must not hold the token itself as anyone reading the log could
+// use it: the album of its drop box, such as dropbox:wedding, or the start
+// of the sha256 of the token
+func tokenLabel(token string) string {
+	if db, ok := findDropbox(token); ok {
+		return "dropbox:" + db.Album
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// auditQuery returns the audit log entries matching the optional `user`,
+// `path` (prefix) and `since` (RFC3339 timestamp) query parameters as json,
+// most recent last. `limit` caps the number of returned entries.
+func auditQuery(w http.ResponseWriter, r *http.Request) {
+	var (
+		q       = r.URL.Query()
+		since   time.Time
+		limit   int
+		err     error
+		entries = []auditEntry{}
+	)
+	if q.Get("since") != "" {
+		since, err = time.Parse(time.RFC3339, q.Get("since"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "audit_invalid_since")
+			return
+		}
+	}
+	if q.Get("limit") != "" {
+		limit, err = strconv.Atoi(q.Get("limit"))
+		if err != nil || limit < 0 {
+			writeError(w, r, http.StatusBadRequest, "audit_invalid_limit")
+			return
+		}
+	}
+	if conf.AuditLog == "" {
+		writeError(w, r, http.StatusNotFound, "audit_disabled")
+		return
+	}
+	fd, err := os.Open(conf.AuditLog)
+	if err != nil {
+		logErrorf("audit: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "audit_read_failed")
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logWarnf("audit: skipping malformed entry %q: %v", scanner.Text(), err)
+			continue
+		}
+		if q.Get("user") != "" && entry.User != q.Get("user") {
+			continue
+		}
+		if q.Get("path") != "" && !strings.HasPrefix(entry.Path, q.Get("path")) {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
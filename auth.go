@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// handler defines the type of the functions that process http requests
+type handler func(w http.ResponseWriter, r *http.Request)
+
+// middleware wraps a handler with additional processing. A middleware that
+// rejects a request must return without calling the wrapped handler.
+type middleware func(pass handler) handler
+
+// chain wraps a handler into a list of middlewares, the first middleware of
+// the list being the first to process incoming requests
+func chain(h handler, mws ...middleware) handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// authProvider is implemented by the various ways a client can prove its
+// identity
+type authProvider interface {
+	// Authenticate returns the name of the user making the request, and
+	// false if the request does not carry valid credentials for this provider
+	Authenticate(r *http.Request) (username string, ok bool)
+}
+
+// basicAuth authenticates users against the usernames and passwords listed
+// in the configuration
+type basicAuth struct {
+	users map[string]string
+}
+
+func (b basicAuth) Authenticate(r *http.Request) (username string, ok bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		logDebugf("auth failed: basic auth header not found")
+		return "", false
+	}
+	expected, listed := b.users[username]
+	// the password is compared even if the user is not listed, so the time
+	// taken to reject a request does not reveal which users exist. Users who
+	// changed their password on their profile page are checked against its
+	// hash instead, as are those listed with a hash by the setup wizard.
+	valid := equalSecrets(password, expected)
+	if hash := profilePassword(username); listed && hash != "" {
+		valid = checkPassword(hash, password)
+	} else if listed && isPasswordHash(expected) {
+		valid = checkPassword(expected, password)
+	}
+	if !valid || !listed {
+		if !listed {
+			authFailed(r, username, "user is not listed as authorized")
+		} else {
+			authFailed(r, username, "invalid password")
+		}
+		return "", false
+	}
+	return username, true
+}
+
+// equalSecrets compares two secrets in constant time. The secrets are hashed
+// first, as subtle.ConstantTimeCompare returns early when their lengths
+// differ.
+func equalSecrets(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// authFailed logs a rejected authentication attempt. Submitted passwords are
+// never logged, and with authlogminimal only the username and the source
+// address of the client are.
+func authFailed(r *http.Request, username, reason string) {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if conf.AuthLogMinimal {
+		logWarnf("auth failed: user %q from %s", username, ip)
+		return
+	}
+	logWarnf("auth failed: %s for user %q from %s", reason, username, ip)
+}
+
+// authRealm returns the realm of the basic auth challenge of a request. When
+// the request carries the credentials of a user who has a realm of their own,
+// they are challenged in that realm, so browsers keep the credentials of
+// different realms apart.
+func authRealm(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		if realm, ok := conf.UserRealms[username]; ok {
+			return realm
+		}
+	}
+	if conf.Realm != "" {
+		return conf.Realm
+	}
+	return conf.Host
+}
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	// scopeKey holds the scope of the api token of the request, if it was
+	// authenticated by one
+	scopeKey
+	// tokenKey holds the id of the api token of the request, if it was
+	// authenticated by one
+	tokenKey
+	// csrfKey holds the csrf token of the request, which its forms submit
+	csrfKey
+)
+
+// requestUser returns the name of the user authenticated for the request, or
+// an empty string if the request is anonymous
+func requestUser(r *http.Request) string {
+	username, _ := context.Get(r, userKey).(string)
+	return username
+}
+
+// securityHeaders sets the headers that protect clients of the gallery
+func securityHeaders(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Add("X-Content-Type-Options", "nosniff")
+		if hstsHeader != "" {
+			w.Header().Add("Strict-Transport-Security", hstsHeader)
+		}
+		if hpkpHeader != "" {
+			w.Header().Add("Public-Key-Pins", hpkpHeader)
+		}
+		pass(w, r)
+	}
+}
+
+// statusRecorder keeps track of the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	// informational responses, such as early hints, precede the status
+	// of the response
+	if code >= 200 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Flush sends the part of the response written so far, such as the images
+// streamed while they are encoded
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logRequests logs every request once it has been processed
+func logRequests(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if debugLogging() {
+			logDebugf("%s %s %s headers: %v", r.RemoteAddr, r.Method, r.URL.Path, redactHeaders(r.Header))
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		pass(rec, r)
+		logInfof("%s %s %s %d %s", r.RemoteAddr, r.Method, r.URL.Path, rec.status, time.Since(start))
+	}
+}
+
+// rateLimit returns a middleware that limits each client address to perSec
+// requests per second, with bursts of up to perSec requests. A zero limit
+// disables rate limiting.
+func rateLimit(perSec float64) middleware {
+	var (
+		mu      sync.Mutex
+		buckets = make(map[string]*tokenBucket)
+	)
+	return func(pass handler) handler {
+		if perSec <= 0 {
+			return pass
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			mu.Lock()
+			b, ok := buckets[ip]
+			if !ok {
+				// forget about clients whose bucket has refilled entirely
+				for addr, old := range buckets {
+					if time.Since(old.last).Seconds()*perSec > perSec {
+						delete(buckets, addr)
+					}
+				}
+				b = &tokenBucket{tokens: perSec, last: time.Now()}
+				buckets[ip] = b
+			}
+			allowed := b.take(perSec)
+			mu.Unlock()
+			if !allowed {
+				logWarnf("rate limit exceeded for %s", ip)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusTooManyRequests, "too_many_requests")
+				return
+			}
+			pass(w, r)
+		}
+	}
+}
+
+// tokenBucket is refilled at a constant rate and emptied by one token per
+// request
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(rate float64) bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// requireAuth returns a middleware that only lets requests through if one of
+// the providers authenticates them. The name of the authenticated user is
+// stored in the request context, alongside the mux variables.
+func requireAuth(providers ...authProvider) middleware {
+	return func(pass handler) handler {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !conf.Authenticate || conf.Demo {
+				pass(w, r)
+				return
+			}
+			for _, p := range providers {
+				if username, ok := p.Authenticate(r); ok {
+					context.Set(r, userKey, username)
+					pass(w, r)
+					return
+				}
+			}
+			w.Header().Set("Cache-Control", "no-cache")
+			if conf.AuthMode != "proxy" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q`, authRealm(r)))
+			}
+			writeError(w, r, http.StatusUnauthorized, "please_auth")
+		}
+	}
+}
+
+// isAdmin returns true if the user is an admin of the whole gallery. There
+// are no admins when authentication is disabled.
+func isAdmin(username string) bool {
+	return userRole(username, "") == roleAdmin
+}
+
+// requireAdmin restricts access to a handler to the admins of the whole
+// gallery. Admin handlers are unavailable when authentication
+// is disabled.
+func requireAdmin(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := requestUser(r)
+		if isAdmin(username) {
+			pass(w, r)
+			return
+		}
+		logWarnf("access denied: user %q is not an admin", username)
+		writeError(w, r, http.StatusForbidden, "forbidden")
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// imageBackend resizes the photos of the gallery. The pure Go backend is
+// always available, and the vips backend runs the vips command of libvips,
+// which is much faster and uses less memory on large photos.
+type imageBackend interface {
+	// resize returns the version of the photo at path, read from
+	// original, that is cut to a square of size pixels if crop is set, or
+	// that fits in the box of size pixels of its aspect, with the edits of
+	// the photo applied. It is encoded in format, one of outputFormats,
+	// jpeg if it is empty, and written to w as it is encoded.
+	resize(ctx context.Context, w io.Writer, path string, original io.Reader, size uint, crop string, a aspect, format string, edit photoEdit) error
+}
+
+// imageProcessor is the backend of the image_backend configuration
+var imageProcessor imageBackend = goBackend{}
+
+// outputFormat is an encoding of resized images
+type outputFormat struct {
+	ctype, ext string
+	// vips is true for the formats that only the vips backend encodes
+	vips bool
+}
+
+// outputFormats are the encodings of resized images, by the name of the
+// format parameter of image requests
+var outputFormats = map[string]outputFormat{
+	"jpeg": {ctype: "image/jpeg", ext: ".jpg"},
+	"png":  {ctype: "image/png", ext: ".png"},
+	"webp": {ctype: "image/webp", ext: ".webp", vips: true},
+	"avif": {ctype: "image/avif", ext: ".avif", vips: true},
+}
+
+// allowedFormats are the formats of outputformats, which image requests can
+// ask for. jpeg is always allowed, as it is the default format.
+var allowedFormats = map[string]bool{"jpeg": true}
+
+// initOutputFormats allows the formats of the configuration. webp and avif
+// are left out when the vips backend is not available, like vips falls back
+// to the go backend. It has to be called after initImageBackend.
+func initOutputFormats() error {
+	_, isVips := imageProcessor.(vipsBackend)
+	for _, name := range conf.OutputFormats {
+		f, ok := outputFormats[name]
+		if !ok {
+			return fmt.Errorf("outputformats: unknown format %q", name)
+		}
+		if f.vips && !isVips {
+			logWarnf("image backend: %s requires the vips backend, it is not allowed", name)
+			continue
+		}
+		allowedFormats[name] = true
+	}
+	return nil
+}
+
+// initImageBackend selects the image backend. The pure Go backend is used
+// when vips is not installed.
+func initImageBackend() error {
+	switch conf.ImageBackend {
+	case "", "go":
+	case "vips":
+		bin, err := exec.LookPath("vips")
+		if err != nil {
+			logWarnf("image backend: vips is not installed, falling back to the go backend: %v", err)
+			return nil
+		}
+		imageProcessor = vipsBackend{bin: bin}
+		logInfof("image backend: resizing images with %q", bin)
+	default:
+		return fmt.Errorf("unknown image_backend %q", conf.ImageBackend)
+	}
+	return nil
+}
+
+// goBackend decodes, resizes and encodes images in pure Go
+type goBackend struct{}
+
+func (goBackend) resize(ctx context.Context, w io.Writer, path string, original io.Reader, size uint, crop string, a aspect, format string, edit photoEdit) error {
+	// decode the original into image.Image, whatever its format. reads
+	// fail as soon as the request is canceled, which interrupts the
+	// decoding of large images.
+	decodeOp := startOp("decode", path)
+	src, _, err := image.Decode(ctxReader{ctx: ctx, r: original})
+	if err != nil {
+		return err
+	}
+	decodeOp.done(src.Bounds())
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	src = edit.cropImage(src)
+
+	// resize using nearest neighbor resampling and preserve aspect ratio
+	var m image.Image
+	resizeOp := startOp("resize", path)
+	if crop != "" {
+		// square thumbnails are cut from the original first
+		m = resize.Resize(size, size, cropSquare(src, crop), resize.NearestNeighbor)
+	} else {
+		m = a.resizeTo(src, size, edit.Rotate)
+	}
+	m = edit.rotateImage(m)
+	m = a.enhance.apply(m)
+	resizeOp.done(src.Bounds())
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return writeImage(ctx, w, path, m, format)
+}
+
+// encodeImage encodes m in format, jpeg if it is empty
+func encodeImage(ctx context.Context, path string, m image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeImage(ctx, &buf, path, m, format)
+	return buf.Bytes(), err
+}
+
+// writeImage encodes m in format, jpeg if it is empty, and writes it to w.
+// JPEG images are written as they are encoded, in baseline mode, the only
+// one of the Go encoder. The formats that Go cannot encode are converted by
+// vips from a lossless png.
+func writeImage(ctx context.Context, w io.Writer, path string, m image.Image, format string) error {
+	lossless := format == "png" || outputFormats[format].vips
+	var buf bytes.Buffer
+	var err error
+	encodeOp := startOp("encode", path)
+	if lossless {
+		err = png.Encode(&buf, m)
+	} else {
+		err = jpeg.Encode(w, m, nil)
+	}
+	encodeOp.done(m.Bounds())
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil || !lossless {
+		return err
+	}
+	data := buf.Bytes()
+	if outputFormats[format].vips {
+		v, ok := imageProcessor.(vipsBackend)
+		if !ok {
+			return fmt.Errorf("%s images can only be encoded by the vips backend", format)
+		}
+		if data, err = v.convert(ctx, path, data, format); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// vipsBackend resizes images with `vips thumbnail`, which shrinks JPEG
+// photos while decoding them. Edited photos, which vips cannot crop and
+// rotate like the go backend, padded images and images filled towards a
+// side, enhanced images, and photos vips fails to process, are resized by
+// the go backend.
+type vipsBackend struct {
+	bin string
+}
+
+// vipsCrops are the vips equivalents of the crop modes
+var vipsCrops = map[string]string{
+	"center": "centre",
+	"smart":  "attention",
+}
+
+func (v vipsBackend) resize(ctx context.Context, w io.Writer, path string, original io.Reader, size uint, crop string, a aspect, format string, edit photoEdit) error {
+	if !edit.isZero() || !a.enhance.isZero() || (crop == "" && (a.mode == "pad" || a.gravity != "")) {
+		return goBackend{}.resize(ctx, w, path, original, size, crop, a, format, edit)
+	}
+	data, err := v.thumbnail(ctx, path, size, crop, a, format)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logWarnf("image backend: vips failed to resize %q, using the go backend: %v", path, err)
+		return goBackend{}.resize(ctx, w, path, original, size, crop, a, format, edit)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// convert converts the png image data, a version of the photo at path, to
+// format
+func (v vipsBackend) convert(ctx context.Context, path string, data []byte, format string) ([]byte, error) {
+	in, err := ioutil.TempFile("", "galilego-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(in.Name())
+	_, err = in.Write(data)
+	if cerr := in.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.run(ctx, path, format, "", "copy", in.Name())
+}
+
+// thumbnail runs vips on the photo at path
+func (v vipsBackend) thumbnail(ctx context.Context, path string, size uint, crop string, a aspect, format string) ([]byte, error) {
+	dim, height := strconv.Itoa(int(size)), strconv.Itoa(int(a.boxHeight(size)))
+	if crop != "" {
+		height = dim
+	}
+	// like the go backend, the exif orientation is not applied, and only
+	// square thumbnails and filled images are enlarged
+	args := []string{"thumbnail", path, dim, "--height", height, "--no-rotate"}
+	if crop != "" {
+		args = append(args, "--crop", vipsCrops[crop])
+	} else if a.mode == "fill" {
+		args = append(args, "--crop", "centre")
+	} else {
+		args = append(args, "--size", "down")
+	}
+	// large jpeg images are progressive, browsers render a coarse version
+	// of them before they are entirely received
+	options := ""
+	if streamed(size, format) {
+		options = "[interlace]"
+	}
+	return v.run(ctx, path, format, options, args...)
+}
+
+// run runs a vips operation, whose output file is inserted after its first
+// two arguments. vips writes its output to a temporary file, whose
+// extension selects the format, followed by the save options.
+func (v vipsBackend) run(ctx context.Context, path, format, options string, args ...string) ([]byte, error) {
+	ext := ".jpg"
+	if f, ok := outputFormats[format]; ok {
+		ext = f.ext
+	}
+	out, err := ioutil.TempFile("", "galilego-*"+ext)
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	args = append([]string{args[0], args[1], out.Name() + options}, args[2:]...)
+	op := startOp("vips", path)
+	cmd := exec.CommandContext(ctx, v.bin, args...)
+	logDebugf("image backend: running %s %s", v.bin, strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		op.done(image.Rect(0, 0, cfg.Width, cfg.Height))
+	}
+	return data, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// initBasePath normalizes the base_path of the configuration, the path under
+// which galilego is served when it shares a host with another site, such as
+// /photos. It is empty when galilego is served at the root of the host.
+func initBasePath() error {
+	base := strings.Trim(conf.BasePath, "/")
+	if base == "" {
+		conf.BasePath = ""
+		return nil
+	}
+	if strings.ContainsAny(base, "?#%\"'<> ") {
+		return fmt.Errorf("invalid base_path %q", conf.BasePath)
+	}
+	conf.BasePath = "/" + base
+	return nil
+}
+
+// link returns the url of a path of galilego, such as /timeline, under the
+// base path. Every link of the pages, redirect and url of the api goes
+// through it.
+func link(path string) string {
+	return conf.BasePath + path
+}
+
+// mountBasePath serves the routes of h under the base path. The routes
+// themselves do not include it, as it is removed from requests before they
+// are routed.
+func mountBasePath(h http.Handler) http.Handler {
+	if conf.BasePath == "" {
+		return h
+	}
+	strip := http.StripPrefix(conf.BasePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == conf.BasePath {
+			http.Redirect(w, r, conf.BasePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, conf.BasePath+"/") {
+			writeError(w, r, http.StatusNotFound, "not_found")
+			return
+		}
+		strip.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultImageMaxAge is how long browsers keep thumbnails and originals when
+// the caching configuration sets no max age
+const defaultImageMaxAge = 8760 * time.Hour
+
+// cachingConf sets the Cache-Control and Expires headers of each type of
+// response. HTML pages and api responses are revalidated by default, while
+// images are kept a year.
+//
+//	caching:
+//	  thumbnails:
+//	    maxage: 720h
+//	  originals:
+//	    visibility: private
+//	    maxage: 24h
+//	  html:
+//	    visibility: no-store
+//	  api:
+//	    maxage: 0s
+type cachingConf struct {
+	Thumbnails, Originals cachePolicy
+	HTML                  cachePolicy `yaml:"html"`
+	API                   cachePolicy `yaml:"api"`
+}
+
+// cachePolicy is the caching of one type of response
+type cachePolicy struct {
+	// Visibility is public to let shared caches, such as proxies and
+	// CDNs, keep the response, private to restrict it to the cache of the
+	// browser, or no-store to not cache it at all. It defaults to private
+	// when authentication is enabled, so the photos of the gallery do not
+	// leak through shared caches, and to public otherwise.
+	Visibility string
+	// MaxAge is how long the response is fresh. Responses without a max
+	// age are revalidated on every use.
+	MaxAge *time.Duration
+}
+
+// initCaching verifies the caching configuration and sets its defaults. In
+// development mode, pages and api responses are not cached, and images are
+// revalidated on every use, whatever the configuration.
+func initCaching() error {
+	maxAge := defaultImageMaxAge
+	if conf.DevMode {
+		var revalidate time.Duration
+		conf.Caching = cachingConf{
+			Thumbnails: cachePolicy{Visibility: "private", MaxAge: &revalidate},
+			Originals:  cachePolicy{Visibility: "private", MaxAge: &revalidate},
+			HTML:       cachePolicy{Visibility: "no-store"},
+			API:        cachePolicy{Visibility: "no-store"},
+		}
+		logWarnf("caching: development mode, responses are not cached")
+	}
+	for name, p := range map[string]*cachePolicy{
+		"thumbnails": &conf.Caching.Thumbnails,
+		"originals":  &conf.Caching.Originals,
+		"html":       &conf.Caching.HTML,
+		"api":        &conf.Caching.API,
+	} {
+		switch p.Visibility {
+		case "":
+			p.Visibility = "public"
+			if conf.Authenticate && !conf.Demo {
+				p.Visibility = "private"
+			}
+		case "public", "private", "no-store":
+		default:
+			return fmt.Errorf("caching: unknown visibility %q for %s", p.Visibility, name)
+		}
+		if p.MaxAge == nil && (name == "thumbnails" || name == "originals") {
+			p.MaxAge = &maxAge
+		}
+		if p.MaxAge != nil && *p.MaxAge < 0 {
+			return fmt.Errorf("caching: negative max age for %s", name)
+		}
+	}
+	return nil
+}
+
+// setHeaders sets the caching headers of a response according to the policy
+func (p cachePolicy) setHeaders(w http.ResponseWriter) {
+	if p.Visibility == "no-store" {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Del("Expires")
+		return
+	}
+	if p.MaxAge == nil || *p.MaxAge == 0 {
+		w.Header().Set("Cache-Control", p.Visibility+", no-cache")
+		w.Header().Del("Expires")
+		return
+	}
+	w.Header().Set("Cache-Control", p.Visibility+", max-age="+strconv.Itoa(int(p.MaxAge.Seconds())))
+	w.Header().Set("Expires", time.Now().Add(*p.MaxAge).UTC().Format(http.TimeFormat))
+}
+
+// cacheHeaders sets the caching policy of HTML pages or api responses on
+// every response. Handlers that return images replace it with the policy of
+// thumbnails or originals.
+func cacheHeaders(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAPIRequest(r) {
+			conf.Caching.API.setHeaders(w)
+		} else {
+			conf.Caching.HTML.setHeaders(w)
+		}
+		pass(w, r)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxCaptionSize is the size beyond which caption files are truncated
+const maxCaptionSize = 4096
+
+var (
+	xmpTitle       = regexp.MustCompile(`(?s)<dc:title>(.*?)</dc:title>`)
+	xmpDescription = regexp.MustCompile(`(?s)<dc:description>(.*?)</dc:description>`)
+)
+
+// photoCaption is the title and caption of a photo read from its sidecar
+// files
+type photoCaption struct {
+	Title, Caption string
+}
+
+// albumCaptions returns the captions of the photos of an album, given the
+// entries of the album directory, from their sidecar files. A photo such as
+// IMG_1234.jpg is captioned by the text of IMG_1234.jpg.txt, or else by the
+// description of its XMP sidecar, IMG_1234.jpg.xmp or IMG_1234.xmp, which
+// also sets its title.
+func albumCaptions(dir string, entries []os.FileInfo) map[string]photoCaption {
+	names := make(map[string]bool)
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			names[e.Name()] = true
+		}
+	}
+	captions := make(map[string]photoCaption)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || !isImage(filepath.Join(dir, e.Name())) {
+			continue
+		}
+		var c photoCaption
+		for _, xmp := range []string{e.Name() + ".xmp", xmpSidecarPath(e.Name())} {
+			if names[xmp] {
+				c.Title, c.Caption = readXMPCaption(filepath.Join(dir, xmp))
+				break
+			}
+		}
+		if names[e.Name()+".txt"] {
+			if text := readCaptionFile(filepath.Join(dir, e.Name()+".txt")); text != "" {
+				c.Caption = text
+			}
+		}
+		if c.Title != "" || c.Caption != "" {
+			captions[e.Name()] = c
+		}
+	}
+	return captions
+}
+
+// readCaptionFile returns the text of a caption file
+func readCaptionFile(path string) string {
+	fd, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+	text, err := ioutil.ReadAll(io.LimitReader(fd, maxCaptionSize))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(text), "\ufeff"))
+}
+
+// readXMPCaption returns the title and description of an XMP sidecar file
+func readXMPCaption(path string) (title, caption string) {
+	packet, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return xmpAltText(xmpTitle, packet), xmpAltText(xmpDescription, packet)
+}
+
+// xmpAltText returns the first item of the language alternatives of an XMP
+// property, which is its default language
+func xmpAltText(property *regexp.Regexp, packet []byte) string {
+	value := property.FindSubmatch(packet)
+	if value == nil {
+		return ""
+	}
+	item := xmpListItem.FindSubmatch(value[1])
+	if item == nil {
+		return ""
+	}
+	return strings.TrimSpace(html.UnescapeString(string(item[1])))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is the time between two checks of the certificate
+// files of the listeners
+const certCheckInterval = time.Minute
+
+// certReloader serves a certificate and its key to TLS handshakes, and loads
+// them again when their files change, so certificates renewed by certbot or
+// another ACME client are used without restarting the gallery
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	// certMod and keyMod are the modification times of the files the
+	// certificate was loaded from
+	certMod, keyMod time.Time
+}
+
+// certReloaders are shared by the listeners that use the same files
+var (
+	certReloadersMu sync.Mutex
+	certReloaders   = make(map[[2]string]*certReloader)
+)
+
+// reloadingCertificate returns the reloader of a certificate and its key,
+// which are loaded immediately and then checked every certCheckInterval
+func reloadingCertificate(certFile, keyFile string) (*certReloader, error) {
+	certReloadersMu.Lock()
+	defer certReloadersMu.Unlock()
+	if cr, ok := certReloaders[[2]string{certFile, keyFile}]; ok {
+		return cr, nil
+	}
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	certReloaders[[2]string{certFile, keyFile}] = cr
+	go cr.watch()
+	return cr, nil
+}
+
+// getCertificate is the GetCertificate function of the tls.Config of the
+// listeners
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// reload loads the certificate and its key if either file changed, and
+// returns true if they were. The current certificate is kept when the new
+// files cannot be loaded, such as when the certificate was renewed but not
+// its key yet.
+func (cr *certReloader) reload() (bool, error) {
+	cfi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false, err
+	}
+	kfi, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && cfi.ModTime().Equal(cr.certMod) && kfi.ModTime().Equal(cr.keyMod)
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	cr.mu.Lock()
+	cr.cert, cr.certMod, cr.keyMod = &cert, cfi.ModTime(), kfi.ModTime()
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// watch checks the files of the certificate until the gallery stops
+func (cr *certReloader) watch() {
+	for range time.Tick(certCheckInterval) {
+		reloaded, err := cr.reload()
+		if err != nil {
+			logErrorf("tls: failed to reload certificate %q: %v", cr.certFile, err)
+		} else if reloaded {
+			logInfof("tls: reloaded certificate %q", cr.certFile)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// unknownField matches the errors of the keys of the configuration that are
+// not fields of their section
+var unknownField = regexp.MustCompile(`field (\S+) not found in type (\S+)`)
+
+// configSection is a section of the configuration, such as listeners, with
+// its keys
+type configSection struct {
+	name string
+	keys []string
+}
+
+// configSections returns the sections of the configuration by the name of
+// their type, such as "main.listenerConf"
+func configSections() map[string]*configSection {
+	sections := make(map[string]*configSection)
+	var walk func(t reflect.Type, name string)
+	walk = func(t reflect.Type, name string) {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			walk(t.Elem(), name)
+			return
+		case reflect.Struct:
+		default:
+			return
+		}
+		if _, ok := sections[t.String()]; ok {
+			return
+		}
+		section := &configSection{name: name}
+		sections[t.String()] = section
+		var fields func(t reflect.Type)
+		fields = func(t reflect.Type) {
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				if f.PkgPath != "" {
+					continue
+				}
+				tag := strings.Split(f.Tag.Get("yaml"), ",")
+				if tag[0] == "-" {
+					continue
+				}
+				if indexOf(tag[1:], "inline") >= 0 {
+					fields(f.Type)
+					continue
+				}
+				key := tag[0]
+				if key == "" {
+					key = strings.ToLower(f.Name)
+				}
+				section.keys = append(section.keys, key)
+				walk(f.Type, key)
+			}
+		}
+		fields(t)
+	}
+	walk(reflect.TypeOf(conf), "the configuration")
+	return sections
+}
+
+// closestKey returns the key of keys that is the closest to name, if it is a
+// likely typo of it
+func closestKey(name string, keys []string) string {
+	best, distance := "", len(name)/2+1
+	for _, key := range keys {
+		if d := editDistance(strings.ToLower(name), key); d < distance {
+			best, distance = key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the number of insertions, deletions and substitutions
+// of characters that turn a into b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// configErrors returns the errors of the yaml decoding of a configuration,
+// with the key meant by the unknown keys that look like typos of one
+func configErrors(err error) []string {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	sections := configSections()
+	var errs []string
+	for _, e := range te.Errors {
+		if m := unknownField.FindStringSubmatch(e); m != nil {
+			section, ok := sections[m[2]]
+			if !ok {
+				section = &configSection{name: m[2]}
+			}
+			e = strings.Replace(e, m[0], fmt.Sprintf("unknown key %q in %s", m[1], section.name), 1)
+			if key := closestKey(m[1], section.keys); key != "" {
+				e += fmt.Sprintf(", did you mean %q?", key)
+			}
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// checkListener returns the errors of the address and of the certificate of
+// a listener
+func checkListener(lc listenerConf) (errs []string) {
+	if strings.HasPrefix(lc.Address, unixPrefix) {
+		dir := filepath.Dir(strings.TrimPrefix(lc.Address, unixPrefix))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Sprintf("listen %q: the directory of the socket does not exist", lc.Address))
+		}
+	} else if _, port, err := net.SplitHostPort(lc.Address); err != nil {
+		errs = append(errs, fmt.Sprintf("listen %q: invalid address, expected host:port such as 0.0.0.0:8064: %v", lc.Address, err))
+	} else if _, err = net.LookupPort("tcp", port); err != nil {
+		errs = append(errs, fmt.Sprintf("listen %q: invalid port %q", lc.Address, port))
+	}
+	// the server builds the tls configuration of the listener, with its
+	// certificate, so the checks are those of the server
+	if _, err := lc.server(nil); err != nil {
+		if lc.CertFile == "" || lc.KeyFile == "" {
+			errs = append(errs, fmt.Sprintf("listen %q: missing certfile or keyfile, set them or generate a certificate with `galilego gencert`", lc.Address))
+		} else if _, terr := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile); terr != nil {
+			errs = append(errs, fmt.Sprintf("listen %q: cannot load certificate %q and key %q: %v", lc.Address, lc.CertFile, lc.KeyFile, terr))
+		} else {
+			errs = append(errs, fmt.Sprintf("listen %q: %v", lc.Address, err))
+		}
+	}
+	return errs
+}
+
+// checkConfig returns the errors of the configuration that would stop the
+// server from starting, or make it serve nothing. It runs from the root of
+// the configuration.
+func checkConfig() (errs []string) {
+	if conf.Root != "" {
+		if err := os.Chdir(conf.Root); err != nil {
+			return []string{fmt.Sprintf("root %q: %v", conf.Root, err)}
+		}
+	}
+	wd, _ := os.Getwd()
+	if fi, err := os.Stat("gallery"); err != nil || !fi.IsDir() {
+		errs = append(errs, fmt.Sprintf("root %q: missing gallery directory, which holds the albums", wd))
+	}
+	listeners := conf.Listeners
+	if conf.Listen != "" {
+		listeners = append([]listenerConf{{Address: conf.Listen}}, listeners...)
+	}
+	if len(listeners) == 0 {
+		errs = append(errs, "listen: no listen address configured")
+	}
+	for _, lc := range listeners {
+		errs = append(errs, checkListener(lc)...)
+	}
+	if conf.Authenticate && len(conf.Users) == 0 && conf.AuthMode == "" {
+		errs = append(errs, "authenticate: no users configured, add some with `galilego passwd`")
+	}
+	for _, check := range []func() error{
+		initBasePath,
+		initImageLimits,
+		initRoles,
+		initNetwork,
+		initCaching,
+		initDateRouting,
+		initSecurityHeaders,
+		checkMailIngest,
+	} {
+		if err := check(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// checkconfigCmd verifies a configuration file without starting the server,
+// and prints what is wrong with it
+func checkconfigCmd(args []string) {
+	fs := flag.NewFlagSet("checkconfig", flag.ExitOnError)
+	config := fs.String("c", "config.yaml", "Load configuration from file")
+	fs.Parse(args)
+	var errs []string
+	if err := loadConfig(*config); err != nil {
+		errs = configErrors(err)
+	} else {
+		errs = checkConfig()
+	}
+	if len(errs) == 0 {
+		fmt.Printf("%s: ok\n", *config)
+		return
+	}
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *config, e)
+	}
+	os.Exit(1)
+}
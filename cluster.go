@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// scanLockTTL is the time after which the scan lock of a crashed instance
+// is considered stale and can be taken over
+const scanLockTTL = 30 * time.Minute
+
+// instanceID identifies this instance in the scan lock
+var instanceID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}()
+
+// lockScan tries to take the lock that designates the instance scanning the
+// gallery, when several instances share the same storage and index. The
+// lock is a file holding the owner and expiration of the lock, created with
+// a hard link so that only one instance can succeed, even over NFS.
+// Scanning twice is harmless, the lock only avoids redundant work.
+func lockScan(path string) bool {
+	tmp := path + "." + instanceID
+	content := fmt.Sprintf("%s %d\n", instanceID, time.Now().Add(scanLockTTL).Unix())
+	if err := ioutil.WriteFile(tmp, []byte(content), 0640); err != nil {
+		logErrorf("index: failed to create scan lock: %v", err)
+		return false
+	}
+	defer os.Remove(tmp)
+	if os.Link(tmp, path) == nil {
+		return true
+	}
+	// take over the lock of an instance that did not release it in time
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() < expires {
+		return false
+	}
+	logWarnf("index: taking over stale scan lock of %s", fields[0])
+	stale := path + ".stale." + instanceID
+	if os.Rename(path, stale) != nil {
+		return false
+	}
+	os.Remove(stale)
+	return os.Link(tmp, path) == nil
+}
+
+// unlockScan releases the scan lock, if it is still held by this instance
+func unlockScan(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(data), instanceID+" ") {
+		return
+	}
+	os.Remove(path)
+}
+
+// draining is set once the instance received a signal to stop, so load
+// balancers stop sending it new requests while it completes the current ones
+var draining int32
+
+// healthCheck tells load balancers whether the instance accepts requests
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if atomic.LoadInt32(&draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
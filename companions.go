@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// companionre matches the files that accompany a photo of the same name,
+// such as the raw version of a RAW+JPEG pair, or the video of a live photo.
+// These files cannot be displayed, and are offered as downloads of the photo.
+var companionre = regexp.MustCompile(`(?i)\.(cr2|cr3|crw|nef|nrw|arw|srf|sr2|dng|orf|rw2|raf|pef|srw|x3f|heic|heif|mov|mp4)$`)
+
+// videore and heifre match the companion files that are videos, and the
+// HEIF originals of photos converted to jpeg
+var (
+	videore = regexp.MustCompile(`(?i)\.(mov|mp4)$`)
+	heifre  = regexp.MustCompile(`(?i)\.(heic|heif)$`)
+)
+
+// stem returns the name of a file without its extension, in lower case, so
+// IMG_0001.CR2 and IMG_0001.jpg share the same stem
+func stem(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// albumCompanions returns the names of the companion files of each photo of
+// an album, given the entries of the album directory
+func albumCompanions(entries []os.FileInfo) map[string][]string {
+	byStem := make(map[string][]string)
+	for _, e := range entries {
+		if e.Mode().IsRegular() && companionre.MatchString(e.Name()) {
+			byStem[stem(e.Name())] = append(byStem[stem(e.Name())], e.Name())
+		}
+	}
+	companions := make(map[string][]string)
+	if len(byStem) == 0 {
+		return companions
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && imgre.MatchString(e.Name()) {
+			if names, ok := byStem[stem(e.Name())]; ok {
+				companions[e.Name()] = names
+			}
+		}
+	}
+	return companions
+}
+
+// isCompanion returns true if the file at path accompanies a photo of its
+// album
+func isCompanion(path string) bool {
+	if !companionre.MatchString(path) {
+		return false
+	}
+	entries, err := readAlbum(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && imgre.MatchString(e.Name()) && stem(e.Name()) == stem(filepath.Base(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// companionLinks returns the download links of the companion files of the
+// photo at path
+func companionLinks(path string, names []string, locale string) string {
+	if len(names) == 0 || !downloadPolicy(path).originals() {
+		return ""
+	}
+	links := `<div style="position: absolute; bottom: 0px; left: 0px; background: white; padding: 2px;">`
+	for _, name := range names {
+		label := "download_raw"
+		if videore.MatchString(name) {
+			label = "download_video"
+		} else if heifre.MatchString(name) {
+			label = "download_heif"
+		}
+		links += `<a href="` + html.EscapeString(link("/"+filepath.Join(filepath.Dir(path), name))) + `" download>` +
+			tr(locale, label) + ` (` + html.EscapeString(name) + `)</a> `
+	}
+	return links + `</div>`
+}
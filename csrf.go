@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/context"
+)
+
+const (
+	// csrfCookie holds the csrf token of a browser, which its forms submit
+	// back in the csrf field, or scripts in the X-CSRF-Token header
+	csrfCookie = "galilego_csrf"
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// requireCSRF protects the routes that change the gallery against cross site
+// request forgery, with a double submit cookie: browsers get a random token
+// in a cookie, which other sites cannot read, and the requests that are not
+// GET, HEAD or OPTIONS must carry the same token in a form field or a
+// header. Requests authenticated by an api token are exempt, as browsers do
+// not send bearer tokens on their own.
+func requireCSRF(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := context.Get(r, scopeKey).(role); ok {
+			pass(w, r)
+			return
+		}
+		var token string
+		if c, err := r.Cookie(csrfCookie); err == nil && validCSRFToken(c.Value) {
+			token = c.Value
+		}
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			if token == "" {
+				token = newCSRFToken()
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    token,
+					Path:     link("/"),
+					Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+					HttpOnly: true,
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+		default:
+			submitted := r.Header.Get(csrfHeader)
+			if submitted == "" {
+				submitted = r.FormValue(csrfField)
+			}
+			if token == "" || !equalSecrets(submitted, token) {
+				logWarnf("access denied: missing or invalid csrf token for user %q on %s %s", requestUser(r), r.Method, r.URL.Path)
+				writeError(w, r, http.StatusForbidden, "csrf_failed")
+				return
+			}
+		}
+		context.Set(r, csrfKey, token)
+		pass(w, r)
+	}
+}
+
+// newCSRFToken returns a random token of 32 bytes, hex encoded
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("csrf: failed to read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validCSRFToken returns true if token is a token of newCSRFToken
+func validCSRFToken(token string) bool {
+	b, err := hex.DecodeString(token)
+	return err == nil && len(b) == 32
+}
+
+// csrfInput returns the hidden field of the csrf token of the request, which
+// every POST form of the gallery includes
+func csrfInput(r *http.Request) string {
+	token, _ := context.Get(r, csrfKey).(string)
+	if token == "" {
+		return ""
+	}
+	return `<input type="hidden" name="` + csrfField + `" value="` + html.EscapeString(token) + `"/>`
+}
+
+// postForm matches the opening tag of the POST forms of rendered pages
+var postForm = regexp.MustCompile(`(?i)<form[^>]*method="post"[^>]*>`)
+
+// csrfForms adds the csrf field to the POST forms of the pages rendered by
+// the templates, including those of themes and the edit toolbar of photos
+func csrfForms(r *http.Request, name string, page []byte) []byte {
+	input := csrfInput(r)
+	if input == "" {
+		return page
+	}
+	return postForm.ReplaceAllFunc(page, func(form []byte) []byte {
+		return append(append([]byte(nil), form...), input...)
+	})
+}
+
+// csrfPage adds the csrf field to the POST forms of a page that is written
+// without the templates
+func csrfPage(r *http.Request, page string) string {
+	return string(csrfForms(r, "", []byte(page)))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultRoutingPattern = "{year}/{month}-{day}-{event}"
+
+// dateRoutingConf sorts the files uploaded to albums into sub albums named
+// after the date the photos were taken, so the dumps of cameras and phones
+// organize themselves. In pattern, the path of the sub albums under the
+// album, {year}, {month} and {day} are replaced by the EXIF capture date of
+// the photo, or by the date of the upload for files that have none, and
+// {event} by the event parameter of the upload. The dashes, underscores and
+// spaces left around an empty event are removed, so photos uploaded without
+// one go to sub albums such as 2019/07-14.
+//
+//	daterouting:
+//	  albums: [camera, phones/alice]
+//	  pattern: "{year}/{month}-{day}-{event}"
+type dateRoutingConf struct {
+	Albums  []string
+	Pattern string
+}
+
+// initDateRouting checks the routed albums and the pattern of their sub
+// albums
+func initDateRouting() error {
+	dr := &conf.DateRouting
+	for i, album := range dr.Albums {
+		album = strings.Trim(filepath.ToSlash(filepath.Clean("/"+album)), "/")
+		if album == "" {
+			return fmt.Errorf("daterouting: missing album")
+		}
+		dr.Albums[i] = album
+	}
+	if dr.Pattern == "" {
+		dr.Pattern = defaultRoutingPattern
+	}
+	// the sub albums must stay within their album, whatever the event
+	sample := routePath(dr.Pattern, time.Now(), "event")
+	if sample == "" || filepath.Clean("/"+sample) != "/"+sample {
+		return fmt.Errorf("daterouting: invalid pattern %q", dr.Pattern)
+	}
+	return nil
+}
+
+// routesUploads returns true if the files uploaded to the album at albumDir
+// are sorted by date
+func routesUploads(albumDir string) bool {
+	album := strings.TrimPrefix(filepath.ToSlash(albumDir), "gallery/")
+	return indexOf(conf.DateRouting.Albums, album) >= 0
+}
+
+// routePath expands the pattern of the sub albums for a date and an event
+func routePath(pattern string, date time.Time, event string) string {
+	path := strings.NewReplacer(
+		"{year}", date.Format("2006"),
+		"{month}", date.Format("01"),
+		"{day}", date.Format("02"),
+		"{event}", event,
+	).Replace(pattern)
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part = strings.Trim(part, "-_ "); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// routeUpload returns the path where a file uploaded to dest is stored. If
+// its album routes uploads, it is the sub album of the date of the photo,
+// read from the content returned by open, which is created.
+func routeUpload(dest string, open func() (io.ReadCloser, error), event string) (string, error) {
+	albumDir := filepath.Dir(dest)
+	if !routesUploads(albumDir) {
+		return dest, nil
+	}
+	date := time.Now()
+	rd, err := open()
+	if err != nil {
+		return "", err
+	}
+	data, err := exifFrom(rd)
+	rd.Close()
+	if err == nil && !data.DateTimeOriginal.IsZero() {
+		date = data.DateTimeOriginal
+	}
+	event = strings.Trim(unsafeNameChars.ReplaceAllString(event, "_"), "._")
+	dir := filepath.Join(albumDir, routePath(conf.DateRouting.Pattern, date, event))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// the listings of the new sub albums, and of the album, are outdated
+	for d := dir; d != filepath.Dir(albumDir); d = filepath.Dir(d) {
+		invalidateListing(d)
+	}
+	return filepath.Join(dir, filepath.Base(dest)), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSameRow(t *testing.T) {
+	saved := mediaEntry{
+		Path:     "gallery/album/photo.jpg",
+		Size:     1234,
+		ModTime:  time.Unix(1600000000, 0),
+		Tags:     []string{"beach"},
+		Keywords: []string{"summer", "sea"},
+		Title:    "Sunset",
+		Rating:   4,
+		Ratings:  map[string]int{"bob": 4},
+	}
+	tests := []struct {
+		name   string
+		change func(e *mediaEntry)
+		same   bool
+	}{
+		{"unchanged", func(e *mediaEntry) {}, true},
+		{"size", func(e *mediaEntry) { e.Size++ }, false},
+		{"modtime", func(e *mediaEntry) { e.ModTime = e.ModTime.Add(time.Second) }, false},
+		{"tags", func(e *mediaEntry) { e.Tags = []string{"beach", "family"} }, false},
+		{"keywords", func(e *mediaEntry) { e.Keywords = []string{"summer"} }, false},
+		{"keywords only reordered", func(e *mediaEntry) { e.Keywords = []string{"sea", "summer"} }, false},
+		{"title", func(e *mediaEntry) { e.Title = "Sunrise" }, false},
+		{"caption", func(e *mediaEntry) { e.Caption = "At the beach" }, false},
+		{"ratings", func(e *mediaEntry) { e.Ratings = map[string]int{"bob": 4, "eve": 2} }, false},
+		{"hash", func(e *mediaEntry) { e.Hash = "abcd" }, false},
+		{"place", func(e *mediaEntry) { e.Place = "Brest" }, false},
+	}
+	for _, tt := range tests {
+		e := saved
+		e.Tags = append([]string(nil), saved.Tags...)
+		e.Keywords = append([]string(nil), saved.Keywords...)
+		tt.change(&e)
+		if got := sameRow(saved, e); got != tt.same {
+			t.Errorf("%s: sameRow = %v, want %v", tt.name, got, tt.same)
+		}
+	}
+}
+
+// TestMySQLMigrations verifies that mysql can tell whether each statement of
+// the migrations was applied, so failed migrations can be resumed
+func TestMySQLMigrations(t *testing.T) {
+	for i, migration := range migrations {
+		for _, stmt := range migration("mysql") {
+			if !createTableStmt.MatchString(stmt) && !createIndexStmt.MatchString(stmt) &&
+				!addColumnStmt.MatchString(stmt) && !insertStmt.MatchString(stmt) {
+				t.Errorf("migration %d: cannot check whether %q was applied", i+1, stmt)
+			}
+		}
+	}
+}
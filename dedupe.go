@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// nearDupeDistance is the maximum number of differing bits between
+	// two perceptual hashes for the images to be considered
+	// near-duplicates
+	nearDupeDistance = 6
+	// nearDupeBands is the number of bands the perceptual hashes are cut
+	// into. Hashes that differ by nearDupeDistance bits at most have at
+	// least one identical band, so only the images sharing a band are
+	// compared.
+	nearDupeBands = nearDupeDistance + 1
+)
+
+// dupeReport lists groups of files that are exact duplicates (same content)
+// or near-duplicates (visually similar, as measured by a perceptual hash)
+type dupeReport struct {
+	Exact [][]string
+	Near  [][]string
+}
+
+// duplicates is the report of the admin page, computed in the background
+// from the index rather than while the page is requested
+var duplicates struct {
+	sync.Mutex
+	report dupeReport
+	// computed is the time the index was read for the report, which is
+	// computed again after the next scan of the gallery
+	computed time.Time
+	running  bool
+	// dhashes are the difference hashes of the images, by the sha256 of
+	// their content, so the next report only decodes the new images
+	dhashes map[string]uint64
+}
+
+// findDuplicates walks the gallery tree under root and returns a report of
+// duplicate candidates. Exact duplicates are found by hashing the content of
+// each image, near-duplicates by comparing the difference hash of each
+// distinct image.
+func findDuplicates(root string) (report dupeReport, err error) {
+	byContent := make(map[string][]string)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !isImage(path) {
+			return nil
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			logErrorf("dedupe: failed to hash %q: %v", path, err)
+			return nil
+		}
+		byContent[sum] = append(byContent[sum], path)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return groupDuplicates(byContent, func(sum, path string) (uint64, error) {
+		return dhashFile(path)
+	}), nil
+}
+
+// groupDuplicates returns the report of the images grouped by the sha256 of
+// their content. Only the first copy of identical images is compared
+// visually, with the difference hash returned by dhash.
+func groupDuplicates(byContent map[string][]string, dhash func(sum, path string) (uint64, error)) (report dupeReport) {
+	type phashed struct {
+		path string
+		hash uint64
+	}
+	var distinct []phashed
+	for sum, paths := range byContent {
+		sort.Strings(paths)
+		if len(paths) > 1 {
+			report.Exact = append(report.Exact, paths)
+		}
+		hash, err := dhash(sum, paths[0])
+		if err != nil {
+			logErrorf("dedupe: failed to compute perceptual hash of %q: %v", paths[0], err)
+			continue
+		}
+		distinct = append(distinct, phashed{path: paths[0], hash: hash})
+	}
+	sort.Slice(distinct, func(i, j int) bool { return distinct[i].path < distinct[j].path })
+	// candidates are the images sharing a band of their hash
+	buckets := make(map[[2]uint64][]int)
+	for i, d := range distinct {
+		for b := 0; b < nearDupeBands; b++ {
+			key := [2]uint64{uint64(b), hashBand(d.hash, b)}
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+	grouped := make([]bool, len(distinct))
+	for i := range distinct {
+		if grouped[i] {
+			continue
+		}
+		var near []int
+		for b := 0; b < nearDupeBands; b++ {
+			for _, j := range buckets[[2]uint64{uint64(b), hashBand(distinct[i].hash, b)}] {
+				if j <= i || grouped[j] || hammingDistance(distinct[i].hash, distinct[j].hash) > nearDupeDistance {
+					continue
+				}
+				grouped[j] = true
+				near = append(near, j)
+			}
+		}
+		if len(near) == 0 {
+			continue
+		}
+		sort.Ints(near)
+		group := []string{distinct[i].path}
+		for _, j := range near {
+			group = append(group, distinct[j].path)
+		}
+		report.Near = append(report.Near, group)
+	}
+	sort.Slice(report.Exact, func(i, j int) bool { return report.Exact[i][0] < report.Exact[j][0] })
+	return
+}
+
+// hashBand returns the bits of band b of a perceptual hash, the last band
+// taking the bits left over by the others
+func hashBand(hash uint64, b int) uint64 {
+	width := uint(64 / nearDupeBands)
+	shift := uint(b) * width
+	if b == nearDupeBands-1 {
+		width = 64 - shift
+	}
+	return (hash >> shift) & (1<<width - 1)
+}
+
+// currentDuplicates returns the duplicate report of the admin page, and
+// false if none was computed yet. A new report is computed in the
+// background when the gallery was scanned since the last one, or when it is
+// older than the rescan interval, as instances that load the index saved by
+// another one do not scan it.
+func currentDuplicates() (dupeReport, bool) {
+	index.RLock()
+	scanned := index.scanned
+	index.RUnlock()
+	interval := conf.RescanInterval
+	if interval <= 0 {
+		interval = defaultRescanInterval
+	}
+	duplicates.Lock()
+	defer duplicates.Unlock()
+	stale := duplicates.computed.Before(scanned) || time.Since(duplicates.computed) > interval
+	if !duplicates.running && stale {
+		duplicates.running = true
+		go computeDuplicates()
+	}
+	return duplicates.report, !duplicates.computed.IsZero()
+}
+
+// computeDuplicates finds the duplicates among the images of the index,
+// whose content is already hashed
+func computeDuplicates() {
+	start := time.Now()
+	byContent := make(map[string][]string)
+	index.RLock()
+	for path, e := range index.entries {
+		if e.Hash != "" {
+			byContent[e.Hash] = append(byContent[e.Hash], path)
+		}
+	}
+	index.RUnlock()
+	// only the computation that is running uses the hashes
+	duplicates.Lock()
+	known := duplicates.dhashes
+	duplicates.Unlock()
+	dhashes := make(map[string]uint64)
+	report := groupDuplicates(byContent, func(sum, path string) (uint64, error) {
+		hash, ok := known[sum]
+		if !ok {
+			var err error
+			if hash, err = dhashFile(path); err != nil {
+				return 0, err
+			}
+		}
+		dhashes[sum] = hash
+		return hash, nil
+	})
+	duplicates.Lock()
+	duplicates.report, duplicates.dhashes = report, dhashes
+	duplicates.computed, duplicates.running = start, false
+	duplicates.Unlock()
+	logInfof("dedupe: compared %d images in %s", len(byContent), time.Since(start))
+}
+
+// hashFile returns the hex encoded sha256 checksum of the file at path
+func hashFile(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dhashFile computes the 64 bits difference hash of an image: the image is
+// reduced to 9x8 pixels and each bit records whether a pixel is brighter
+// than its right neighbor. Similar images produce similar hashes.
+func dhashFile(path string) (hash uint64, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	if err = checkImageLimits(fd); err != nil {
+		return
+	}
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		return
+	}
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return
+}
+
+func luminance(img image.Image, x, y int) uint32 {
+	b := img.Bounds()
+	r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+	return (299*r + 587*g + 114*bl) / 1000
+}
+
+func hammingDistance(a, b uint64) (dist int) {
+	for x := a ^ b; x != 0; x &= x - 1 {
+		dist++
+	}
+	return
+}
+
+// linkDuplicates replaces every copy of an exact duplicate group with a hard
+// link to the first file of the group
+func linkDuplicates(groups [][]string) error {
+	for _, group := range groups {
+		orig, err := os.Stat(group[0])
+		if err != nil {
+			return err
+		}
+		for _, dup := range group[1:] {
+			if fi, err := os.Stat(dup); err == nil && os.SameFile(orig, fi) {
+				continue
+			}
+			if isArchived(dup) {
+				logInfof("dedupe: %q is archived, not linking it", dup)
+				continue
+			}
+			tmp := dup + ".galilego-link"
+			if err := os.Link(group[0], tmp); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, dup); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+			logInfof("dedupe: %q is now a hard link to %q", dup, group[0])
+		}
+	}
+	return nil
+}
+
+// dedupeCmd implements the `galilego dedupe` subcommand
+func dedupeCmd(args []string) {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	var (
+		root = fs.String("root", "gallery", "Root of the gallery tree to scan")
+		link = fs.Bool("link", false, "Replace exact duplicates with hard links")
+	)
+	fs.Parse(args)
+	report, err := findDuplicates(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, group := range report.Exact {
+		fmt.Println("exact duplicates:")
+		for _, path := range group {
+			fmt.Println("\t" + path)
+		}
+	}
+	for _, group := range report.Near {
+		fmt.Println("near duplicates:")
+		for _, path := range group {
+			fmt.Println("\t" + path)
+		}
+	}
+	if *link {
+		if err := linkDuplicates(report.Exact); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// dedupeView renders the duplicate report of the gallery as an HTML page.
+// The report is computed in the background, see currentDuplicates.
+func dedupeView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	report, ok := currentDuplicates()
+	if !ok {
+		io.WriteString(w, `<html lang="`+locale+`">
+	<head><meta charset="utf-8"><meta http-equiv="refresh" content="10"><title>`+tr(locale, "title")+`</title>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "duplicates")+`</h1>
+		<p>`+tr(locale, "duplicates_pending")+`</p>
+	</body></html>`)
+		return
+	}
+	io.WriteString(w, `<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "duplicates")+`</h1>
+		<h2 style="font-size: 1.2em;">`+tr(locale, "exact_duplicates")+`</h2>
+`+dupeGroupsHtml(report.Exact, locale)+`
+		<h2 style="font-size: 1.2em;">`+tr(locale, "near_duplicates")+`</h2>
+`+dupeGroupsHtml(report.Near, locale)+`
+	</body></html>`)
+}
+
+func dupeGroupsHtml(groups [][]string, locale string) (groupsHtml string) {
+	if len(groups) == 0 {
+		return "<p>" + tr(locale, "none_found") + "</p>"
+	}
+	for _, group := range groups {
+		groupsHtml += "<div>"
+		for _, path := range group {
+			groupsHtml += fmt.Sprintf(`<a href="%s"><img src="%s?width=300" title="%s"/></a>`,
+				html.EscapeString(link("/"+path)), html.EscapeString(link("/"+path)), html.EscapeString(path))
+		}
+		groupsHtml += "</div>\n"
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// initDemo checks the configuration of the demo mode, in which anonymous
+// visitors browse the top level album demoroot, read only, under a banner.
+// Every other album is hidden, and the routes that write to the gallery or
+// administer it are not served.
+func initDemo() error {
+	if !conf.Demo {
+		return nil
+	}
+	root := strings.Trim(conf.DemoRoot, "/")
+	if root == "" || strings.Contains(root, "/") {
+		return fmt.Errorf("demo: demoroot must be a top level album of the gallery")
+	}
+	if fi, err := os.Stat(filepath.Join("gallery", root)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("demo: album %q not found", root)
+	}
+	conf.DemoRoot = root
+	registerRenderHooks(nil, demoBanner)
+	logInfof("demo: serving %q read only, without authentication", root)
+	return nil
+}
+
+// demoBanner inserts the demo banner at the top of the rendered pages
+func demoBanner(r *http.Request, name string, page []byte) []byte {
+	banner := `<body>
+		<div style="background: #ffd; padding: 4px; text-align: center;">` + tr(requestLocale(r), "demo_banner") + `</div>`
+	return bytes.Replace(page, []byte("<body>"), []byte(banner), 1)
+}
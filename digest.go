@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDigestInterval sends weekly digests
+	defaultDigestInterval = 7 * 24 * time.Hour
+	// digestThumbnails is the number of photos of a digest shown as
+	// thumbnails, the others are counted
+	digestThumbnails = 24
+	digestThumbSize  = 200
+)
+
+// digestConf mails a digest of the photos added to some albums, with their
+// thumbnails, to a list of recipients at a regular interval, weekly by
+// default. The photos waiting for the next digest are kept in digestfile,
+// digests.json by default, so they are not lost when galilego restarts.
+//
+//	digests:
+//	  - albums: [family]
+//	    email: [grandma@example.net, carol@example.net]
+//	  - albums: [travels, "family/2023"]
+//	    email: [bob@example.net]
+//	    every: 720h
+type digestConf struct {
+	// Albums are watched along with their sub albums, "/" watches the
+	// whole gallery
+	Albums []string
+	Email  []string
+	Every  time.Duration
+}
+
+// digestState is the state of a digest kept in the digest file
+type digestState struct {
+	// Sent is the time the last digest was due
+	Sent time.Time `json:"sent"`
+	// Photos are the photos added since, relative to the gallery
+	Photos []string `json:"photos,omitempty"`
+}
+
+// digestNotifier collects the photos added to the albums of a digest, and
+// mails them once the digest is due
+type digestNotifier struct {
+	// key identifies the digest in the digest file
+	key   string
+	to    []string
+	every time.Duration
+}
+
+var (
+	digestLock   sync.Mutex
+	digestPath   string
+	digestStates map[string]*digestState
+)
+
+// initDigests registers the digests of the configuration, and starts sending
+// them once they are due
+func initDigests() error {
+	if len(conf.Digests) == 0 {
+		return nil
+	}
+	if conf.SMTP.Address == "" || conf.SMTP.From == "" {
+		return fmt.Errorf("digests: email requires the address and from of the smtp server")
+	}
+	digestPath = conf.DigestFile
+	if digestPath == "" {
+		digestPath = "digests.json"
+	}
+	digestStates = make(map[string]*digestState)
+	data, err := ioutil.ReadFile(digestPath)
+	if err == nil {
+		if err = json.Unmarshal(data, &digestStates); err != nil {
+			return fmt.Errorf("digests: invalid digest file %q: %v", digestPath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	var digests []digestNotifier
+	for _, dc := range conf.Digests {
+		if len(dc.Albums) == 0 || len(dc.Email) == 0 {
+			return fmt.Errorf("digests: a digest needs albums to watch and email recipients")
+		}
+		d := digestNotifier{
+			key:   strings.Join(dc.Albums, ",") + " to " + strings.Join(dc.Email, ","),
+			to:    dc.Email,
+			every: dc.Every,
+		}
+		if d.every <= 0 {
+			d.every = defaultDigestInterval
+		}
+		// the first digest is due after a full interval
+		if _, ok := digestStates[d.key]; !ok {
+			digestStates[d.key] = &digestState{Sent: time.Now()}
+		}
+		registerNotifier(dc.Albums, d)
+		digests = append(digests, d)
+	}
+	if err = saveDigests(); err != nil {
+		return err
+	}
+	go sendDigests(digests)
+	return nil
+}
+
+// notify queues the photos of a notification for the next digest
+func (d digestNotifier) notify(n notification) error {
+	digestLock.Lock()
+	defer digestLock.Unlock()
+	state := digestStates[d.key]
+	state.Photos = append(state.Photos, n.Photos...)
+	return saveDigests()
+}
+
+// saveDigests writes the digest file. The caller must hold digestLock, or
+// be the only goroutine using the digests.
+func saveDigests() error {
+	data, err := json.MarshalIndent(digestStates, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := digestPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, digestPath)
+}
+
+// sendDigests mails the digests that are due. Digests with no new photos are
+// not sent, and those that fail are sent again at the next check.
+func sendDigests(digests []digestNotifier) {
+	for range time.Tick(notifyDelay) {
+		for _, d := range digests {
+			digestLock.Lock()
+			state := digestStates[d.key]
+			if time.Since(state.Sent) < d.every {
+				digestLock.Unlock()
+				continue
+			}
+			photos := state.Photos
+			digestLock.Unlock()
+			if len(photos) > 0 {
+				if err := d.send(photos); err != nil {
+					logErrorf("digest: failed to send the digest of %d photos to %s: %v", len(photos), strings.Join(d.to, ", "), err)
+					continue
+				}
+				logInfof("digest: sent the digest of %d photos to %s", len(photos), strings.Join(d.to, ", "))
+			}
+			digestLock.Lock()
+			// photos added while the digest was sent wait for the next one
+			state.Photos = state.Photos[len(photos):]
+			state.Sent = time.Now()
+			if err := saveDigests(); err != nil {
+				logErrorf("digest: failed to save %q: %v", digestPath, err)
+			}
+			digestLock.Unlock()
+		}
+	}
+}
+
+// send mails a digest of photos, as an html message whose thumbnails are
+// attached, as mail clients cannot fetch them from the gallery without the
+// credentials of the recipient
+func (d digestNotifier) send(photos []string) error {
+	// photos removed since they were added are left out
+	var existing []string
+	for _, photo := range photos {
+		if _, err := os.Stat(filepath.Join("gallery", filepath.FromSlash(photo))); err == nil {
+			existing = append(existing, photo)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	// photos are grouped by album
+	sort.Slice(existing, func(i, j int) bool {
+		di, dj := filepath.Dir(existing[i]), filepath.Dir(existing[j])
+		if di != dj {
+			return di < dj
+		}
+		return existing[i] < existing[j]
+	})
+	locale := conf.Locale
+	if locale == "" {
+		locale = defaultLocale
+	}
+	base := "https://" + conf.Host + link("/gallery/")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var page strings.Builder
+	page.WriteString(`<!DOCTYPE html>
+<html lang="` + locale + `">
+	<head><meta charset="utf-8"><title>` + html.EscapeString(tr(locale, "digest_subject")) + `</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">` + fmt.Sprintf(tr(locale, "digest_intro"), formatCount(locale, int64(len(existing)))) + `</h1>
+`)
+	var thumbs [][]byte
+	album := ""
+	for i, photo := range existing {
+		if i == digestThumbnails {
+			page.WriteString(`		<p>` + fmt.Sprintf(tr(locale, "digest_more"), formatCount(locale, int64(len(existing)-i))) + `</p>
+`)
+			break
+		}
+		if dir := filepath.ToSlash(filepath.Dir(photo)); dir != album {
+			album = dir
+			albumURL := base
+			if album != "." {
+				albumURL += album + "/"
+			}
+			page.WriteString(`		<h2 style="font-size: 1.2em;"><a href="` + html.EscapeString(albumURL) + `">` + html.EscapeString(strings.TrimPrefix(album, ".")+"/") + `</a></h2>
+`)
+		}
+		thumb, err := digestThumbnail(filepath.Join("gallery", filepath.FromSlash(photo)))
+		if err != nil {
+			logErrorf("digest: failed to generate the thumbnail of %q: %v", photo, err)
+			continue
+		}
+		thumbs = append(thumbs, thumb)
+		page.WriteString(`		<a href="` + html.EscapeString(base+photo) + `"><img src="cid:photo` + strconv.Itoa(len(thumbs)) + `" alt="` + html.EscapeString(filepath.Base(photo)) + `" width="` + strconv.Itoa(digestThumbSize) + `" height="` + strconv.Itoa(digestThumbSize) + `"/></a>
+`)
+	}
+	page.WriteString(`	</body>
+</html>`)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	writeBase64(part, []byte(page.String()))
+	for i, thumb := range thumbs {
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<photo" + strconv.Itoa(i+1) + ">"},
+			"Content-Disposition":       {`inline; filename="photo` + strconv.Itoa(i+1) + `.jpg"`},
+		})
+		if err != nil {
+			return err
+		}
+		writeBase64(part, thumb)
+	}
+	if err = mw.Close(); err != nil {
+		return err
+	}
+	msg := "From: " + conf.SMTP.From + "\r\n" +
+		"To: " + strings.Join(d.to, ", ") + "\r\n" +
+		"Subject: " + tr(locale, "digest_subject") + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=" + mw.Boundary() + "; type=\"text/html\"\r\n" +
+		"\r\n" + body.String()
+	return smtp.SendMail(conf.SMTP.Address, smtpAuth(), conf.SMTP.From, d.to, []byte(msg))
+}
+
+// digestThumbnail returns the square thumbnail of a photo, from the cache of
+// the gallery, in which it is generated if needed
+func digestThumbnail(path string) ([]byte, error) {
+	img := Image{
+		ctx:        context.Background(),
+		path:       path,
+		size:       digestThumbSize,
+		crop:       "center",
+		returnchan: make(chan Image),
+	}
+	reqimage <- img
+	img = <-img.returnchan
+	close(img.returnchan)
+	if img.err != nil {
+		return nil, img.err
+	}
+	defer img.fd.Close()
+	return ioutil.ReadAll(img.fd)
+}
+
+// writeBase64 writes data in base64, in lines of 76 characters as mail
+// requires
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
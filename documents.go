@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// maxDocumentThumbSize caps the size of the first page rendered as the
+// thumbnail of a document
+const maxDocumentThumbSize = 1600
+
+// documentsConf lists the albums that show PDF documents, such as scanned
+// letters, next to their photos.
+//
+//	documents:
+//	  roots:
+//	    - archives
+//	    - family/letters
+//	  thumbnailer: pdftoppm
+type documentsConf struct {
+	// Roots are albums, relative to the gallery, whose documents are
+	// listed, along with the documents of their sub albums. "/" enables
+	// documents in the whole gallery.
+	Roots []string
+	// Thumbnailer renders the first page of documents as their thumbnail.
+	// It is pdftoppm, from poppler, or ghostscript, which must be
+	// installed. Documents have no thumbnail when it is not set.
+	Thumbnailer string
+}
+
+// pdfre matches the documents that can be shown in albums
+var pdfre = regexp.MustCompile(`(?i)\.pdf$`)
+
+// documentLock serializes the rendering of document thumbnails, like the
+// resizing of images
+var documentLock sync.Mutex
+
+// initDocuments verifies the thumbnailer of documents is installed
+func initDocuments() error {
+	var bin string
+	switch conf.Documents.Thumbnailer {
+	case "":
+		return nil
+	case "pdftoppm":
+		bin = "pdftoppm"
+	case "ghostscript":
+		bin = "gs"
+	default:
+		return fmt.Errorf("documents: unknown thumbnailer %q", conf.Documents.Thumbnailer)
+	}
+	if _, err := exec.LookPath(bin); err != nil {
+		return fmt.Errorf("documents: thumbnailer %q is not installed: %v", conf.Documents.Thumbnailer, err)
+	}
+	return nil
+}
+
+// documentsEnabled returns true if path, such as "gallery/archives/a.pdf",
+// is in one of the roots of documents
+func documentsEnabled(path string) bool {
+	return inAlbums(path, conf.Documents.Roots)
+}
+
+// isDocument returns true if the file at path is a document shown in its
+// album
+func isDocument(path string) bool {
+	return pdfre.MatchString(path) && documentsEnabled(path)
+}
+
+// serveDocument opens a document in the browser, or returns the thumbnail
+// of its first page when a width is requested
+func serveDocument(w http.ResponseWriter, r *http.Request, path string) {
+	width, err := strconv.Atoi(r.URL.Query().Get("width"))
+	if err != nil || width <= 0 {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filepath.Base(path)))
+		streamOriginal(w, r, path)
+		return
+	}
+	if conf.Documents.Thumbnailer == "" {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if width > maxDocumentThumbSize {
+		width = maxDocumentThumbSize
+	}
+	thumb, modtime, err := documentThumbnail(r.Context(), path, width)
+	if err != nil {
+		logErrorf("documents: failed to render thumbnail of %q: %v", path, err)
+		if os.IsNotExist(err) {
+			writeError(w, r, http.StatusNotFound, "not_found")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, "image_failed")
+		}
+		return
+	}
+	defer thumb.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	conf.Caching.Thumbnails.setHeaders(w)
+	http.ServeContent(w, r, path+".jpg", modtime, thumb)
+}
+
+// documentThumbnail returns the first page of the document at path, as a
+// jpeg image of at most size pixels, from the cache or rendered by the
+// thumbnailer
+func documentThumbnail(ctx context.Context, path string, size int) (cachedFile, time.Time, error) {
+	hash, err := contentHash(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cacheKey := thumbnailKey(hash, strconv.Itoa(size), ".jpg")
+	documentLock.Lock()
+	defer documentLock.Unlock()
+	if thumb, modtime, err := imgCache.get(cacheKey); err == nil {
+		return thumb, modtime, nil
+	}
+	var cmd *exec.Cmd
+	if conf.Documents.Thumbnailer == "ghostscript" {
+		cmd = exec.CommandContext(ctx, "gs", "-q", "-dSAFER", "-dBATCH", "-dNOPAUSE",
+			"-sDEVICE=png16m", "-dFirstPage=1", "-dLastPage=1", "-r150",
+			"-sOutputFile=-", path)
+	} else {
+		// without an output root, pdftoppm writes the page to stdout
+		cmd = exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-singlefile",
+			"-png", "-scale-to", strconv.Itoa(size), path)
+	}
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v: %s", conf.Documents.Thumbnailer, err, strings.TrimSpace(stderr.String()))
+	}
+	page, _, err := image.Decode(&out)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, resize.Thumbnail(uint(size), uint(size), page, resize.Bilinear), nil); err != nil {
+		return nil, time.Time{}, err
+	}
+	if err = imgCache.put(cacheKey, buf.Bytes()); err != nil {
+		logErrorf("cache: failed to store %q: %v", cacheKey, err)
+	}
+	return memFile{bytes.NewReader(buf.Bytes())}, time.Now(), nil
+}
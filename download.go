@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+// albumFile is the name of the settings of an album, which also apply to
+// its sub albums that have none
+const albumFile = ".album.yaml"
+
+// defaultDownloadSize is the largest width and height of the photos of the
+// albums whose originals cannot be downloaded, when their settings set none
+const defaultDownloadSize = 2048
+
+// albumSettings are the settings of an album, read from its .album.yaml:
+//
+//	download: resized
+//	maxsize: 1600
+//
+// Download is the download policy of the album. Its originals can be
+// downloaded with "original", the default, and only resized versions up to
+// MaxSize pixels wide and high with "resized". With "view", the pages of the
+// album also keep the photos from being saved by right clicking or dragging
+// them, which only deters casual visitors.
+type albumSettings struct {
+	Download string `yaml:"download,omitempty"`
+	MaxSize  uint   `yaml:"maxsize,omitempty"`
+}
+
+// downloadPolicies are the download policies, in the order of the admin
+// page
+var downloadPolicies = []string{"original", "resized", "view"}
+
+// originals returns true if the originals of the album can be downloaded
+func (s albumSettings) originals() bool {
+	return s.Download == "" || s.Download == "original"
+}
+
+// maxSize returns the largest width and height of the photos served by an
+// album whose originals cannot be downloaded
+func (s albumSettings) maxSize() uint {
+	if s.MaxSize == 0 {
+		return defaultDownloadSize
+	}
+	return s.MaxSize
+}
+
+// readAlbumSettings returns the settings of the album dir, or os.ErrNotExist
+// if it has none
+func readAlbumSettings(dir string) (s albumSettings, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, albumFile))
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(data, &s)
+	return
+}
+
+// downloadPolicy returns the settings of the album containing path, or of
+// the closest album above it that sets a download policy
+func downloadPolicy(path string) albumSettings {
+	for dir := filepath.Dir(filepath.Clean(path)); strings.HasPrefix(dir, "gallery/"); dir = filepath.Dir(dir) {
+		s, err := readAlbumSettings(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			// originals are not given out because of a typo
+			logErrorf("download: invalid settings of %q: %v", dir, err)
+			return albumSettings{Download: "view"}
+		}
+		if s.Download != "" {
+			return s
+		}
+	}
+	return albumSettings{}
+}
+
+// albumPolicy returns the download policy of the photos of the album dir
+func albumPolicy(dir string) albumSettings {
+	return downloadPolicy(filepath.Join(dir, albumFile))
+}
+
+// downloadLink returns the url the photo at path is downloaded from, its
+// original or its largest resized version
+func downloadLink(path string) string {
+	s := downloadPolicy(path)
+	if s.originals() {
+		return link("/" + filepath.ToSlash(path))
+	}
+	return link("/" + filepath.ToSlash(path) + "?width=" + strconv.Itoa(int(s.maxSize())) + editQuery(path))
+}
+
+// downloadBlocked refuses the download of the original at path
+func downloadBlocked(w http.ResponseWriter, r *http.Request, path string) {
+	logInfof("download: refusing the original of %q to user %q", path, requestUser(r))
+	writeError(w, r, http.StatusForbidden, "download_blocked")
+}
+
+// viewOnlyStyle keeps the photos of view only albums from being dragged
+// out of the page, or saved from their context menu
+const viewOnlyStyle = `<style>img { -webkit-user-drag: none; user-select: none; -webkit-touch-callout: none; }</style>
+		<script>
+			document.addEventListener("contextmenu", function(e) { if (e.target.tagName == "IMG") e.preventDefault(); });
+			document.addEventListener("dragstart", function(e) { if (e.target.tagName == "IMG") e.preventDefault(); });
+		</script>
+	</head>`
+
+// viewOnlyPages adds viewOnlyStyle to the pages of view only albums
+func viewOnlyPages(r *http.Request, name string, page []byte) []byte {
+	if name != "album" && name != "index" && name != "browse" {
+		return page
+	}
+	galpath, ok := mux.Vars(r)["galpath"]
+	if !ok || albumPolicy(filepath.Join("gallery", filepath.Clean("/"+galpath))).Download != "view" {
+		return page
+	}
+	return bytes.Replace(page, []byte("</head>"), []byte(viewOnlyStyle), 1)
+}
+
+// initDownloads protects the pages of the view only albums
+func initDownloads() {
+	registerRenderHooks(nil, viewOnlyPages)
+}
+
+// albumsWithSettings returns the directories of the albums with settings
+func albumsWithSettings() (albums []string) {
+	filepath.Walk("gallery", func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.Name() == albumFile {
+			albums = append(albums, filepath.Dir(path))
+		}
+		return nil
+	})
+	sort.Strings(albums)
+	return
+}
+
+// downloadsView lists the download policies of the albums, and lets admins
+// change them
+func downloadsView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	var options string
+	for _, policy := range downloadPolicies {
+		options += `<option value="` + policy + `">` + tr(locale, "download_"+policy) + `</option>`
+	}
+	var policiesHtml string
+	for _, dir := range albumsWithSettings() {
+		s, err := readAlbumSettings(dir)
+		if err != nil {
+			logErrorf("download: invalid settings of %q: %v", dir, err)
+		}
+		if s.Download == "" {
+			continue
+		}
+		policy := tr(locale, "download_"+s.Download)
+		if !s.originals() {
+			policy += fmt.Sprintf(" (%d px)", s.maxSize())
+		}
+		album := html.EscapeString(strings.TrimPrefix(dir, "gallery/"))
+		policiesHtml += fmt.Sprintf(`<li><a href="%s/">%s</a>: %s
+	<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="album" value="%s"/><button type="submit" name="download" value="">%s</button></form>
+</li>
+`, html.EscapeString(link("/"+dir)), album, html.EscapeString(policy), link("/admin/downloads"), album, tr(locale, "download_inherit"))
+	}
+	if policiesHtml == "" {
+		policiesHtml = "<p>" + tr(locale, "none_found") + "</p>"
+	} else {
+		policiesHtml = "<ul>\n" + policiesHtml + "</ul>"
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "downloads")+`</h1>
+		<form method="POST" action="`+link("/admin/downloads")+`"><input type="text" name="album" placeholder="album/subalbum"/> <select name="download">`+options+`</select> <input type="number" name="maxsize" min="1" placeholder="`+strconv.Itoa(defaultDownloadSize)+`"/> px <button type="submit">`+tr(locale, "save")+`</button></form>
+`+policiesHtml+`
+	</body>
+</html>`))
+}
+
+// downloadsAction sets the download policy of the album of the form, or
+// removes it when the policy is empty, so the album inherits the one of
+// the album above it
+func downloadsAction(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join("gallery", filepath.Clean("/"+r.FormValue("album")))
+	if fi, err := os.Stat(dir); dir == "gallery" || err != nil || !fi.IsDir() {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	s, err := readAlbumSettings(dir)
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf("download: invalid settings of %q: %v", dir, err)
+		writeError(w, r, http.StatusInternalServerError, "settings_failed")
+		return
+	}
+	s.Download, s.MaxSize = r.FormValue("download"), 0
+	switch s.Download {
+	case "", "original", "resized", "view":
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if v := r.FormValue("maxsize"); v != "" && !s.originals() {
+		size, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || size == 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		s.MaxSize = uint(size)
+	}
+	if err = writeAlbumSettings(dir, s); err != nil {
+		logErrorf("download: failed to save the settings of %q: %v", dir, err)
+		writeError(w, r, http.StatusInternalServerError, "settings_failed")
+		return
+	}
+	logInfof("download: user %q set the download policy of %q to %q", requestUser(r), dir, s.Download)
+	http.Redirect(w, r, link("/admin/downloads"), http.StatusSeeOther)
+}
+
+// writeAlbumSettings saves the settings of the album dir, or removes them
+// if they are all empty
+func writeAlbumSettings(dir string, s albumSettings) error {
+	path := filepath.Join(dir, albumFile)
+	if s == (albumSettings{}) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// dropboxConf is a share link that lets guests upload photos into an album.
+// Uploads wait in a review queue until an admin publishes them.
+//
+// dropboxes:
+//   - album: weddings/2016
+//     token: 5f0c9d7a8e1b
+//     password: confetti
+//     maxsize: 20971520
+//     maxfiles: 500
+//     types: [jpg, jpeg, png]
+type dropboxConf struct {
+	// Album is the path of the destination album, relative to the gallery
+	Album string
+	// Token identifies the drop box in its share link: /dropbox/{token}
+	Token string
+	// Password, if set, must be provided by guests along with their photos
+	Password string
+	// MaxSize is the maximum size of a single file, in bytes
+	MaxSize int64
+	// MaxFiles is the maximum number of files waiting for review
+	MaxFiles int
+	// Types lists the accepted file extensions
+	Types []string
+}
+
+const (
+	defaultDropboxMaxSize  = 20 << 20
+	defaultDropboxMaxFiles = 500
+)
+
+var defaultDropboxTypes = []string{"jpg", "jpeg", "png", "gif"}
+
+// unsafeNameChars matches the characters replaced in uploaded file names
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// findDropbox returns the drop box identified by token
+func findDropbox(token string) (dropboxConf, bool) {
+	for _, db := range conf.Dropboxes {
+		if db.Token != "" && subtle.ConstantTimeCompare([]byte(db.Token), []byte(token)) == 1 {
+			if db.MaxSize == 0 {
+				db.MaxSize = defaultDropboxMaxSize
+			}
+			if db.MaxFiles == 0 {
+				db.MaxFiles = defaultDropboxMaxFiles
+			}
+			if len(db.Types) == 0 {
+				db.Types = defaultDropboxTypes
+			}
+			return db, true
+		}
+	}
+	return dropboxConf{}, false
+}
+
+// pendingDir returns the directory holding the review queue of a drop box
+func (db dropboxConf) pendingDir() string {
+	dir := conf.PendingDir
+	if dir == "" {
+		dir = "uploads-pending"
+	}
+	return filepath.Join(dir, db.Token)
+}
+
+// pending returns the names of the files waiting for review in a drop box
+func (db dropboxConf) pending() (names []string) {
+	entries, err := ioutil.ReadDir(db.pendingDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return
+}
+
+// accepts returns true if the extension of name is allowed in the drop box
+func (db dropboxConf) accepts(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	for _, t := range db.Types {
+		if ext == strings.ToLower(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropboxForm renders the upload form of a drop box
+func dropboxForm(w http.ResponseWriter, r *http.Request) {
+	db, ok := findDropbox(mux.Vars(r)["token"])
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	writeDropboxPage(w, r, db, "")
+}
+
+func writeDropboxPage(w http.ResponseWriter, r *http.Request, db dropboxConf, message string) {
+	locale := requestLocale(r)
+	var passwordHtml string
+	if db.Password != "" {
+		passwordHtml = `<p><label>` + tr(locale, "password") + ` <input type="password" name="password"/></label></p>`
+	}
+	if message != "" {
+		message = "<p><b>" + html.EscapeString(message) + "</b></p>"
+	}
+	var resizeAttr string
+	if conf.UploadResize.MaxDimension > 0 {
+		resizeAttr = ` data-max-dimension="` + strconv.Itoa(conf.UploadResize.MaxDimension) + `"`
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "dropbox_title")+` `+html.EscapeString(db.Album)+`</h1>
+		`+message+`
+		<p>`+fmt.Sprintf(tr(locale, "dropbox_limits"), formatSize(locale, db.MaxSize), strings.Join(db.Types, ", "))+`</p>
+		<form method="POST" enctype="multipart/form-data"`+resizeAttr+`>
+			`+passwordHtml+`
+			<p><input type="file" name="photos" multiple/></p>
+			<p><input type="submit" value="`+tr(locale, "upload")+`"/></p>
+		</form>
+		`+uploadResizeScript()+`
+	</body>
+</html>`)
+}
+
+// dropboxUpload receives photos sent by guests to a drop box and stores them
+// in its review queue
+func dropboxUpload(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	db, ok := findDropbox(mux.Vars(r)["token"])
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	left := db.MaxFiles - len(db.pending())
+	if left <= 0 {
+		w.WriteHeader(http.StatusForbidden)
+		writeDropboxPage(w, r, db, tr(locale, "dropbox_full"))
+		return
+	}
+	// bound the size of the whole request to the files the drop box can
+	// still take
+	r.Body = http.MaxBytesReader(w, r.Body, db.MaxSize*int64(left)+uploadFormOverhead)
+	invalid := func(err error) {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		writeDropboxPage(w, r, db, tr(locale, "upload_invalid"))
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		invalid(err)
+		return
+	}
+	// the password comes before the photos in the form, and is checked
+	// before any of them is read, so guests without it cannot spool files
+	// to disk
+	if db.Password != "" && !dropboxPassword(mr, db) {
+		logWarnf("dropbox: invalid password for drop box of album %q", db.Album)
+		w.WriteHeader(http.StatusForbidden)
+		writeDropboxPage(w, r, db, tr(locale, "invalid_password"))
+		return
+	}
+	form, err := mr.ReadForm(32 << 20)
+	if err != nil {
+		invalid(err)
+		return
+	}
+	defer form.RemoveAll()
+	files := form.File["photos"]
+	if len(files) > left {
+		w.WriteHeader(http.StatusForbidden)
+		writeDropboxPage(w, r, db, tr(locale, "dropbox_full"))
+		return
+	}
+	if err := os.MkdirAll(db.pendingDir(), 0750); err != nil {
+		logErrorf("dropbox: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "upload_failed")
+		return
+	}
+	var accepted, rejected []string
+	for _, fh := range files {
+		name := unsafeNameChars.ReplaceAllString(filepath.Base(fh.Filename), "_")
+		if !db.accepts(name) || fh.Size > db.MaxSize {
+			rejected = append(rejected, name)
+			continue
+		}
+		if err := savePending(db, fh, name); err != nil {
+			logErrorf("dropbox: failed to save %q: %v", name, err)
+			rejected = append(rejected, name)
+			continue
+		}
+		accepted = append(accepted, name)
+	}
+	logWarnf("dropbox: received %d files for album %q, rejected %d", len(accepted), db.Album, len(rejected))
+	message := fmt.Sprintf(tr(locale, "upload_done"), formatCount(locale, int64(len(accepted))))
+	if len(rejected) > 0 {
+		message += " " + tr(locale, "upload_rejected") + " " + strings.Join(rejected, ", ")
+	}
+	writeDropboxPage(w, r, db, message)
+}
+
+// dropboxPassword returns true if the first field of the form read by mr is
+// the password of the drop box
+func dropboxPassword(mr *multipart.Reader, db dropboxConf) bool {
+	part, err := mr.NextPart()
+	if err != nil || part.FormName() != "password" {
+		return false
+	}
+	password, err := ioutil.ReadAll(io.LimitReader(part, 1024))
+	return err == nil && subtle.ConstantTimeCompare(password, []byte(db.Password)) == 1
+}
+
+// savePending copies an uploaded file into the review queue
+func savePending(db dropboxConf, fh *multipart.FileHeader, name string) error {
+	// prefix uploads with their arrival time to avoid name collisions
+	dest := filepath.Join(db.pendingDir(), fmt.Sprintf("%d-%s", time.Now().UnixNano(), name))
+	return saveUpload(fh, dest, db.MaxSize)
+}
+
+// dropboxReview lists the files waiting for review in every drop box
+func dropboxReview(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	var queueHtml string
+	for _, db := range conf.Dropboxes {
+		queueHtml += `<h2 style="font-size: 1.2em;">` + html.EscapeString(db.Album) + `</h2>`
+		names := db.pending()
+		if len(names) == 0 {
+			queueHtml += "<p>" + tr(locale, "none_found") + "</p>"
+		}
+		for _, name := range names {
+			action := html.EscapeString(link(fmt.Sprintf("/admin/dropbox/%s/%s", db.Token, name)))
+			queueHtml += fmt.Sprintf(`<div><a href="%s"><img src="%s" style="max-width: 300px; max-height: 300px;"/></a>
+	<form method="POST" action="%s/publish" style="display: inline;"><input type="submit" value="%s"/></form>
+	<form method="POST" action="%s/reject" style="display: inline;"><input type="submit" value="%s"/></form>
+</div>
+`, action, action, action, tr(locale, "publish"), action, tr(locale, "reject"))
+		}
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "review_queue")+`</h1>
+`+queueHtml+`
+	</body>
+</html>`))
+}
+
+// pendingFile returns the drop box and path of a file of a review queue
+// designated by the token and name route variables
+func pendingFile(r *http.Request) (db dropboxConf, path string, ok bool) {
+	vars := mux.Vars(r)
+	db, ok = findDropbox(vars["token"])
+	if !ok || vars["name"] != filepath.Base(vars["name"]) {
+		return db, "", false
+	}
+	path = filepath.Join(db.pendingDir(), vars["name"])
+	if _, err := os.Stat(path); err != nil {
+		return db, "", false
+	}
+	return db, path, true
+}
+
+// servePending returns a file waiting for review
+func servePending(w http.ResponseWriter, r *http.Request) {
+	db, path, ok := pendingFile(r)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	http.ServeFile(w, r, path)
+	// the directory of the queue is named after the token of the drop box,
+	// which is kept out of the audit log
+	recordDownload(r, filepath.Join("dropbox", db.Album, filepath.Base(path)))
+}
+
+// reviewPending publishes a file of a review queue into the album of its
+// drop box, or deletes it, depending on the action route variable
+func reviewPending(w http.ResponseWriter, r *http.Request) {
+	db, path, ok := pendingFile(r)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	var err error
+	switch mux.Vars(r)["action"] {
+	case "publish":
+		albumDir := filepath.Join("gallery", filepath.Clean("/"+db.Album))
+		if isArchived(albumDir) {
+			err = fmt.Errorf("%q is archived", albumDir)
+		} else if err = os.MkdirAll(albumDir, 0755); err == nil {
+			// drop the arrival time prefix added on upload
+			name := filepath.Base(path)
+			if i := strings.Index(name, "-"); i > 0 {
+				name = name[i+1:]
+			}
+			dest := filepath.Join(albumDir, name)
+			if _, serr := os.Stat(dest); serr == nil {
+				dest = filepath.Join(albumDir, filepath.Base(path))
+			}
+			if err = os.Rename(path, dest); err == nil {
+				invalidateListing(albumDir)
+				queueWarm(dest)
+				notifyAdded(dest)
+			}
+			logInfof("dropbox: published %q to %q", path, dest)
+		}
+	case "reject":
+		err = os.Remove(path)
+		logWarnf("dropbox: rejected %q", path)
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if err != nil {
+		logErrorf("dropbox: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "review_failed")
+		return
+	}
+	http.Redirect(w, r, link("/admin/dropbox"), http.StatusSeeOther)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// photoEdit is a non destructive edit of a photo, stored in a sidecar file
+// next to it and applied when resized versions are generated. Originals are
+// never modified.
+type photoEdit struct {
+	// Rotate is the clockwise rotation, in degrees: 0, 90, 180 or 270
+	Rotate int `json:"rotate,omitempty"`
+	// Crop is the region of the original that is kept, in fractions of
+	// its dimensions, before rotation
+	Crop *cropRect `json:"crop,omitempty"`
+}
+
+type cropRect struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"width"`
+	H float64 `json:"height"`
+}
+
+// editPath returns the path of the sidecar file holding the edit of a photo
+func editPath(path string) string {
+	return path + ".edit.json"
+}
+
+// readEdit returns the edit of the photo at path, if any
+func readEdit(path string) (e photoEdit) {
+	data, err := ioutil.ReadFile(editPath(path))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &e); err != nil {
+		logWarnf("edit: invalid sidecar %q: %v", editPath(path), err)
+		return photoEdit{}
+	}
+	return
+}
+
+// writeEdit saves the edit of the photo at path, and removes its sidecar
+// when the photo is back to its original state
+func writeEdit(path string, e photoEdit) error {
+	if e.isZero() {
+		err := os.Remove(editPath(path))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(editPath(path), data, 0644)
+}
+
+func (e photoEdit) isZero() bool {
+	return e.Rotate == 0 && e.Crop == nil
+}
+
+// version identifies the edit in cache keys and urls, so that resized
+// versions are generated again, and reloaded by browsers, after an edit
+func (e photoEdit) version() string {
+	if e.isZero() {
+		return ""
+	}
+	data, _ := json.Marshal(e)
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:4])
+}
+
+// editQuery returns the query parameter that versions the urls of resized
+// versions of the photo at path, to append to a query string
+func editQuery(path string) string {
+	if v := readEdit(path).version(); v != "" {
+		return "&e=" + v
+	}
+	return ""
+}
+
+// editToolbar returns the forms of the edit actions of a photo
+func editToolbar(path, locale string) string {
+	action := html.EscapeString(link("/edit/photo/" + strings.TrimPrefix(path, "gallery/")))
+	button := func(name string) string {
+		return `<form method="POST" action="` + action + `" style="display: inline;"><button type="submit" name="action" value="` +
+			name + `">` + tr(locale, "edit_"+name) + `</button></form>`
+	}
+	return `<div style="position: absolute; top: 0px; left: 0px; background: white; padding: 2px;">` +
+		button("rotate-left") + button("rotate-right") + button("reset") +
+		`<form method="POST" action="` + action + `" style="display: inline;"> ` + tr(locale, "edit_crop_region") +
+		` <input type="number" name="x" min="0" max="100" value="0" style="width: 4em;"/>` +
+		` <input type="number" name="y" min="0" max="100" value="0" style="width: 4em;"/>` +
+		` <input type="number" name="width" min="1" max="100" value="100" style="width: 4em;"/>` +
+		` <input type="number" name="height" min="1" max="100" value="100" style="width: 4em;"/>` +
+		` <button type="submit" name="action" value="crop">` + tr(locale, "edit_crop") + `</button></form></div>`
+}
+
+// cropImage returns the region of img kept by the edit. It is applied to
+// the original, before resizing.
+func (e photoEdit) cropImage(img image.Image) image.Image {
+	rect := e.cropBounds(img.Bounds())
+	if rect == img.Bounds() {
+		return img
+	}
+	return subImage(img, rect)
+}
+
+// cropBounds returns the region kept by the edit of an image of bounds b
+func (e photoEdit) cropBounds(b image.Rectangle) image.Rectangle {
+	if e.Crop == nil {
+		return b
+	}
+	rect := image.Rect(
+		b.Min.X+int(e.Crop.X*float64(b.Dx())),
+		b.Min.Y+int(e.Crop.Y*float64(b.Dy())),
+		b.Min.X+int((e.Crop.X+e.Crop.W)*float64(b.Dx())),
+		b.Min.Y+int((e.Crop.Y+e.Crop.H)*float64(b.Dy())),
+	).Intersect(b)
+	if rect.Empty() {
+		return b
+	}
+	return rect
+}
+
+// size returns the size of a photo of width by height pixels once edited
+func (e photoEdit) size(width, height int) (int, int) {
+	rect := e.cropBounds(image.Rect(0, 0, width, height))
+	if e.Rotate == 90 || e.Rotate == 270 {
+		return rect.Dy(), rect.Dx()
+	}
+	return rect.Dx(), rect.Dy()
+}
+
+// rotateImage returns img rotated by the edit. It is applied after
+// resizing, which makes it cheap.
+func (e photoEdit) rotateImage(img image.Image) image.Image {
+	if e.Rotate%360 == 0 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	var dst *image.RGBA
+	if e.Rotate == 180 {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch e.Rotate {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// toOriginal converts a region of the photo as displayed, after rotation,
+// into a region of the original
+func (e photoEdit) toOriginal(c cropRect) cropRect {
+	switch e.Rotate {
+	case 90:
+		return cropRect{X: c.Y, Y: 1 - c.X - c.W, W: c.H, H: c.W}
+	case 180:
+		return cropRect{X: 1 - c.X - c.W, Y: 1 - c.Y - c.H, W: c.W, H: c.H}
+	case 270:
+		return cropRect{X: 1 - c.Y - c.H, Y: c.X, W: c.H, H: c.W}
+	}
+	return c
+}
+
+// editPhoto applies the action of the form to the photo designated by the
+// galpath route variable: rotate-left, rotate-right, crop or reset. Crops
+// are given in percents of the photo as displayed, by the x, y, width and
+// height form values.
+func editPhoto(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	path := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if !canEdit(username, path) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() || !isImage(path) {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	e := readEdit(path)
+	switch r.FormValue("action") {
+	case "rotate-left":
+		e.Rotate = (e.Rotate + 270) % 360
+	case "rotate-right":
+		e.Rotate = (e.Rotate + 90) % 360
+	case "crop":
+		var c [4]float64
+		for i, name := range []string{"x", "y", "width", "height"} {
+			v, err := strconv.ParseFloat(r.FormValue(name), 64)
+			if err != nil || v < 0 || v > 100 {
+				writeError(w, r, http.StatusBadRequest, "invalid_request")
+				return
+			}
+			c[i] = v
+		}
+		if c[2] == 0 || c[3] == 0 || c[0]+c[2] > 100 || c[1]+c[3] > 100 {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		crop := e.toOriginal(cropRect{X: c[0] / 100, Y: c[1] / 100, W: c[2] / 100, H: c[3] / 100})
+		if e.Crop != nil {
+			// crops apply to the region already kept by the previous crop
+			crop = cropRect{
+				X: e.Crop.X + crop.X*e.Crop.W,
+				Y: e.Crop.Y + crop.Y*e.Crop.H,
+				W: crop.W * e.Crop.W,
+				H: crop.H * e.Crop.H,
+			}
+		}
+		e.Crop = &crop
+	case "reset":
+		e = photoEdit{}
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if err := writeEdit(path, e); err != nil {
+		logErrorf("edit: failed to save edit of %q: %v", path, err)
+		writeError(w, r, http.StatusInternalServerError, "edit_failed")
+		return
+	}
+	if err := index.refresh(path); err != nil {
+		logErrorf("edit: failed to refresh index of %q: %v", path, err)
+	}
+	// edited versions have their own thumbnails
+	queueWarm(path)
+	logInfof("edit: user %q applied %s to %q", username, r.FormValue("action"), path)
+	http.Redirect(w, r, link("/"+filepath.Dir(path)+"/"), http.StatusSeeOther)
+}
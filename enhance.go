@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"net/url"
+	"strconv"
+)
+
+// defaultSharpen and defaultClip are the strength of the sharpening and the
+// percentage of the darkest and lightest pixels clipped by the levels of
+// enhanced images, when the configuration sets none
+const (
+	defaultSharpen = 0.6
+	defaultClip    = 0.5
+)
+
+// maxSharpen is the strongest sharpening of the sharpen parameter
+const maxSharpen = 3
+
+// enhanceConf sets the strength of the enhancements of resized images,
+// requested with enhance=1. Sharpen is the amount of the unsharp mask applied
+// after resizing, which brings back the details softened by downsampling,
+// and clip the percentage of the darkest and of the lightest pixels that
+// become black and white when the levels of the image are stretched.
+//
+//	enhance:
+//	  sharpen: 0.8
+//	  clip: 1
+type enhanceConf struct {
+	Sharpen float64
+	Clip    float64
+}
+
+// enhancement is the processing of a resized image after it is resized:
+// sharpening with the amount of sharpen, and automatic levels if levels is
+// set
+type enhancement struct {
+	sharpen float64
+	levels  bool
+}
+
+// parseEnhancement returns the enhancement of the parameters of an image
+// request. enhance=1 sharpens the image and stretches its levels with the
+// strength of the configuration, and sharpen sets the amount of sharpening,
+// alone or with enhance.
+func parseEnhancement(query url.Values) (e enhancement, err error) {
+	if v := query.Get("enhance"); v != "" {
+		if e.levels, err = strconv.ParseBool(v); err != nil {
+			return e, fmt.Errorf("invalid enhance %q", v)
+		}
+		if e.levels {
+			e.sharpen = conf.Enhance.Sharpen
+			if e.sharpen <= 0 {
+				e.sharpen = defaultSharpen
+			}
+		}
+	}
+	if v := query.Get("sharpen"); v != "" {
+		if e.sharpen, err = strconv.ParseFloat(v, 64); err != nil || e.sharpen < 0 || e.sharpen > maxSharpen {
+			return e, fmt.Errorf("invalid sharpen %q", v)
+		}
+	}
+	return e, nil
+}
+
+func (e enhancement) isZero() bool {
+	return e.sharpen == 0 && !e.levels
+}
+
+// version identifies the enhancement in cache keys, such as "s0.6l0.5", or is
+// empty when the image is not enhanced
+func (e enhancement) version() string {
+	var v string
+	if e.sharpen > 0 {
+		v = "s" + strconv.FormatFloat(e.sharpen, 'f', -1, 64)
+	}
+	if e.levels {
+		// the images of each clip are cached apart
+		clip := conf.Enhance.Clip
+		if clip <= 0 {
+			clip = defaultClip
+		}
+		v += "l" + strconv.FormatFloat(clip, 'f', -1, 64)
+	}
+	return v
+}
+
+// apply returns the enhanced version of the resized image m
+func (e enhancement) apply(m image.Image) image.Image {
+	if e.isZero() {
+		return m
+	}
+	b := m.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), m, b.Min, draw.Src)
+	if e.levels {
+		stretchLevels(img)
+	}
+	if e.sharpen > 0 {
+		img = unsharpMask(img, e.sharpen)
+	}
+	return img
+}
+
+// stretchLevels stretches the levels of img, so the darkest pixels become
+// black and the lightest white, except for the clip percentage of each,
+// which are clipped. The same levels apply to every channel, which keeps
+// the colors of the image.
+func stretchLevels(img *image.RGBA) {
+	clip := conf.Enhance.Clip
+	if clip <= 0 {
+		clip = defaultClip
+	}
+	var histogram [256]int
+	for i := 0; i < len(img.Pix); i += 4 {
+		histogram[img.Pix[i]]++
+		histogram[img.Pix[i+1]]++
+		histogram[img.Pix[i+2]]++
+	}
+	clipped := int(float64(len(img.Pix)/4*3) * clip / 100)
+	low, high := 0, 255
+	for n := histogram[0]; low < 255 && n <= clipped; n += histogram[low] {
+		low++
+	}
+	for n := histogram[255]; high > 0 && n <= clipped; n += histogram[high] {
+		high--
+	}
+	if high-low < 16 {
+		// flat images, such as a page of text, are left alone
+		return
+	}
+	var levels [256]uint8
+	for v := range levels {
+		switch {
+		case v <= low:
+			levels[v] = 0
+		case v >= high:
+			levels[v] = 255
+		default:
+			levels[v] = uint8((v - low) * 255 / (high - low))
+		}
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = levels[img.Pix[i]]
+		img.Pix[i+1] = levels[img.Pix[i+1]]
+		img.Pix[i+2] = levels[img.Pix[i+2]]
+	}
+}
+
+// unsharpMask sharpens img by adding amount times its difference with a
+// blurred version of itself, blurred with a 3x3 gaussian kernel
+func unsharpMask(img *image.RGBA, amount float64) *image.RGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	out := image.NewRGBA(img.Rect)
+	weights := [3]int{1, 2, 1}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [3]int
+			for dy := -1; dy <= 1; dy++ {
+				// the pixels of the edges are repeated
+				yy := clampInt(y+dy, 0, h-1)
+				for dx := -1; dx <= 1; dx++ {
+					xx := clampInt(x+dx, 0, w-1)
+					weight := weights[dy+1] * weights[dx+1]
+					i := yy*img.Stride + xx*4
+					sum[0] += int(img.Pix[i]) * weight
+					sum[1] += int(img.Pix[i+1]) * weight
+					sum[2] += int(img.Pix[i+2]) * weight
+				}
+			}
+			i := y*img.Stride + x*4
+			for c := 0; c < 3; c++ {
+				v := float64(img.Pix[i+c])
+				blurred := float64(sum[c]) / 16
+				out.Pix[i+c] = uint8(clampInt(int(v+amount*(v-blurred)+0.5), 0, 255))
+			}
+			out.Pix[i+3] = img.Pix[i+3]
+		}
+	}
+	return out
+}
+
+// clampInt returns v within lo and hi
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+var errNotAlbum = errors.New("not an album")
+
+// apiError is the json envelope of the errors returned by api routes
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>{{.Title}}</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">{{.Status}} {{.Message}}</h1>
+		<p><a href="{{.HomeURL}}">{{.Home}}</a></p>
+	</body>
+</html>`))
+
+// isAPIRequest returns true if the request targets a route that returns json
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/admin/api/")
+}
+
+// writeError replies with the translated message designated by key, as a
+// json envelope on api routes and as an HTML page everywhere else. Messages
+// never contain details of the underlying error, such as file paths, which
+// callers log instead.
+func writeError(w http.ResponseWriter, r *http.Request, status int, key string) {
+	writeErrorMessage(w, r, status, tr(requestLocale(r), key))
+}
+
+// writeErrorMessage is like writeError, with an already translated message
+func writeErrorMessage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	locale := requestLocale(r)
+	w.Header().Set("Cache-Control", "no-cache")
+	if isAPIRequest(r) {
+		var e apiError
+		e.Error.Status = status
+		e.Error.Message = message
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(e)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorPage.Execute(w, map[string]interface{}{
+		"Locale":  locale,
+		"Title":   tr(locale, "title"),
+		"Status":  status,
+		"Message": message,
+		"Home":    tr(locale, "back_home"),
+		"HomeURL": link("/"),
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// exifData contains the EXIF tags used by the gallery
+type exifData struct {
+	// DateTimeOriginal is the time the photo was taken, in the local time
+	// of the camera
+	DateTimeOriginal time.Time
+	// Latitude and Longitude are the GPS coordinates of the photo, in
+	// degrees, when HasGPS is set
+	Latitude, Longitude float64
+	HasGPS              bool
+}
+
+const (
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTime         = 0x0132
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+var errNoExif = errors.New("no exif data found")
+
+// exifDateLayout is the format of EXIF date tags
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// readExif extracts EXIF tags from a JPEG or TIFF file
+func readExif(path string) (data exifData, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return exifFrom(fd)
+}
+
+// exifFrom extracts EXIF tags from the content of a JPEG or TIFF file
+func exifFrom(rd io.Reader) (data exifData, err error) {
+	r := bufio.NewReader(rd)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return data, errNoExif
+	}
+	var tiff []byte
+	switch {
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		tiff, err = jpegExifSegment(r)
+	case bytes.Equal(magic, []byte("II*\x00")) || bytes.Equal(magic, []byte("MM\x00*")):
+		// TIFF files are EXIF containers, only the start of the file is
+		// needed to find the tags
+		tiff, err = ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	default:
+		err = errNoExif
+	}
+	if err != nil {
+		return
+	}
+	return parseExif(tiff)
+}
+
+// jpegExifSegment returns the TIFF structure stored in the APP1 segment of
+// a JPEG stream
+func jpegExifSegment(r *bufio.Reader) ([]byte, error) {
+	// skip the SOI marker
+	if _, err := r.Discard(2); err != nil {
+		return nil, err
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, errNoExif
+		}
+		if marker[0] != 0xff {
+			return nil, errNoExif
+		}
+		// metadata segments precede the start of scan
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, errNoExif
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, errNoExif
+		}
+		if marker[1] != 0xe1 {
+			if _, err := r.Discard(length); err != nil {
+				return nil, errNoExif
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, errNoExif
+		}
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+	}
+}
+
+// parseExif reads the tags of a TIFF structure
+func parseExif(tiff []byte) (data exifData, err error) {
+	if len(tiff) < 8 {
+		return data, errNoExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return data, errNoExif
+	}
+	ifd0 := readIFD(tiff, order, order.Uint32(tiff[4:]))
+	if off, ok := ifd0[tagExifIFD]; ok {
+		exifIFD := readIFD(tiff, order, off.value(order))
+		data.DateTimeOriginal = exifDate(tiff, exifIFD[tagDateTimeOriginal], order)
+	}
+	if data.DateTimeOriginal.IsZero() {
+		data.DateTimeOriginal = exifDate(tiff, ifd0[tagDateTime], order)
+	}
+	if off, ok := ifd0[tagGPSIFD]; ok {
+		gpsIFD := readIFD(tiff, order, off.value(order))
+		lat, latOK := exifCoordinate(tiff, gpsIFD[tagGPSLatitude], gpsIFD[tagGPSLatitudeRef], order)
+		lon, lonOK := exifCoordinate(tiff, gpsIFD[tagGPSLongitude], gpsIFD[tagGPSLongitudeRef], order)
+		data.Latitude, data.Longitude, data.HasGPS = lat, lon, latOK && lonOK
+	}
+	return
+}
+
+// ifdEntry is a raw tag of an image file directory
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	raw   [4]byte
+}
+
+func (e ifdEntry) value(order binary.ByteOrder) uint32 {
+	if e.typ == 3 {
+		return uint32(order.Uint16(e.raw[:]))
+	}
+	return order.Uint32(e.raw[:])
+}
+
+// readIFD returns the entries of the image file directory at offset
+func readIFD(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16]ifdEntry {
+	entries := make(map[uint16]ifdEntry)
+	if int(offset)+2 > len(tiff) {
+		return entries
+	}
+	n := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < n; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		var e ifdEntry
+		e.typ = order.Uint16(tiff[start+2:])
+		e.count = order.Uint32(tiff[start+4:])
+		copy(e.raw[:], tiff[start+8:start+12])
+		entries[order.Uint16(tiff[start:])] = e
+	}
+	return entries
+}
+
+// exifString returns the content of an ASCII tag
+func exifString(tiff []byte, e ifdEntry, order binary.ByteOrder) string {
+	if e.typ != 2 || e.count == 0 {
+		return ""
+	}
+	var raw []byte
+	if e.count <= 4 {
+		raw = e.raw[:e.count]
+	} else {
+		off := order.Uint32(e.raw[:])
+		if uint64(off)+uint64(e.count) > uint64(len(tiff)) {
+			return ""
+		}
+		raw = tiff[off : off+e.count]
+	}
+	return strings.TrimRight(string(raw), "\x00 ")
+}
+
+// exifCoordinate parses a GPS coordinate, stored as degrees, minutes and
+// seconds rationals, with the N, S, E or W reference of its hemisphere
+func exifCoordinate(tiff []byte, e, ref ifdEntry, order binary.ByteOrder) (float64, bool) {
+	if e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	off := uint64(order.Uint32(e.raw[:]))
+	if off+24 > uint64(len(tiff)) {
+		return 0, false
+	}
+	var coord float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num := order.Uint32(tiff[off+uint64(i)*8:])
+		den := order.Uint32(tiff[off+uint64(i)*8+4:])
+		// some cameras leave the unused seconds as 0/0
+		if den != 0 {
+			coord += float64(num) / float64(den) / unit
+		}
+	}
+	switch exifString(tiff, ref, order) {
+	case "S", "W":
+		coord = -coord
+	case "N", "E":
+	default:
+		return 0, false
+	}
+	return coord, true
+}
+
+// exifDate parses a date tag, returning the zero time if it is invalid
+func exifDate(tiff []byte, e ifdEntry, order binary.ByteOrder) time.Time {
+	t, err := time.Parse(exifDateLayout, exifString(tiff, e, order))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
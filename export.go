@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// exportThumbSize and exportLargeSize are the maximum dimensions of the
+	// thumbnails and of the photos of an exported album
+	exportThumbSize = 300
+	exportLargeSize = 1200
+)
+
+// exporter renders albums of the gallery into a static html site
+type exporter struct {
+	root, out string
+	locale    string
+	originals bool
+}
+
+// exportAlbum renders the album at rel, relative to the root of the gallery,
+// and its sub albums into the output directory
+func (x exporter) exportAlbum(rel string) error {
+	src := filepath.Join(x.root, rel)
+	dst := filepath.Join(x.out, rel)
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	var albums, photos []string
+	for _, e := range entries {
+		if e.IsDir() && (e.Name() == "thumbs" || e.Name() == "large") {
+			// these names hold the resized photos of the export
+			logWarnf("export: skipping album %q, its name is reserved", filepath.Join(src, e.Name()))
+		} else if e.IsDir() {
+			albums = append(albums, e.Name())
+		} else if e.Mode().IsRegular() && isImage(filepath.Join(src, e.Name())) {
+			photos = append(photos, e.Name())
+		}
+	}
+	sort.Strings(albums)
+	sort.Strings(photos)
+	for _, dir := range []string{dst, filepath.Join(dst, "thumbs"), filepath.Join(dst, "large")} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	var body string
+	if rel != "." {
+		body += `<p><a href="../index.html">&larr;</a></p>` + "\n"
+	}
+	for _, album := range albums {
+		body += fmt.Sprintf(`<div><a href="%s/index.html">%s</a></div>`+"\n",
+			html.EscapeString(url.PathEscape(album)), html.EscapeString(album))
+	}
+	for i, name := range photos {
+		path := filepath.Join(src, name)
+		edit := readEdit(path)
+		if err = exportResized(path, filepath.Join(dst, "thumbs", name+".jpg"), exportThumbSize, edit); err != nil {
+			logWarnf("export: skipping %q: %v", path, err)
+			continue
+		}
+		if err = exportResized(path, filepath.Join(dst, "large", name+".jpg"), exportLargeSize, edit); err != nil {
+			logWarnf("export: skipping %q: %v", path, err)
+			continue
+		}
+		if x.originals {
+			if err = exportCopy(path, filepath.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+		if err = x.writePhotoPage(dst, photos, i); err != nil {
+			return err
+		}
+		escaped := html.EscapeString(url.PathEscape(name))
+		body += fmt.Sprintf(`<a href="%s.html"><img src="thumbs/%s.jpg" alt="%s" loading="lazy"/></a>`+"\n",
+			escaped, escaped, html.EscapeString(name))
+	}
+	if len(albums) == 0 && len(photos) == 0 {
+		body += "<p>" + tr(x.locale, "no_images") + "</p>\n"
+	}
+	title := tr(x.locale, "content_of") + " " + filepath.ToSlash(filepath.Join(filepath.Base(x.root), rel))
+	if err = x.writePage(filepath.Join(dst, "index.html"), title, body); err != nil {
+		return err
+	}
+	for _, album := range albums {
+		if err = x.exportAlbum(filepath.Join(rel, album)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePhotoPage writes the page of the i-th photo of an album, which links
+// to the previous and next photos
+func (x exporter) writePhotoPage(dst string, photos []string, i int) error {
+	name := photos[i]
+	escaped := html.EscapeString(url.PathEscape(name))
+	body := `<p><a href="index.html">` + tr(x.locale, "export_album") + `</a>`
+	if i > 0 {
+		body += fmt.Sprintf(` <a href="%s.html">&larr;</a>`, html.EscapeString(url.PathEscape(photos[i-1])))
+	}
+	if i < len(photos)-1 {
+		body += fmt.Sprintf(` <a href="%s.html">&rarr;</a>`, html.EscapeString(url.PathEscape(photos[i+1])))
+	}
+	body += "</p>\n"
+	img := fmt.Sprintf(`<img src="large/%s.jpg" alt="%s" style="max-width: 100%%;"/>`, escaped, html.EscapeString(name))
+	if x.originals {
+		// the photo links to the original, as in the slideshow
+		img = fmt.Sprintf(`<a href="%s">%s</a>`, escaped, img)
+	}
+	body += "<p>" + img + "</p>\n"
+	return x.writePage(filepath.Join(dst, name+".html"), name, body)
+}
+
+// writePage writes a complete html page. Pages only use relative links, so
+// the site can be opened from a local directory or served from any path.
+func (x exporter) writePage(path, title, body string) error {
+	return ioutil.WriteFile(path, []byte(`<!DOCTYPE html>
+<html lang="`+x.locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+html.EscapeString(title)+`</title>
+	</head>
+	<body style="font-family: sans-serif;">
+		<h1 style="font-size: 1.5em;">`+html.EscapeString(title)+`</h1>
+`+body+`	</body>
+</html>
+`), 0644)
+}
+
+// exportResized writes a resized jpeg version of the photo at src, with its
+// edits applied. Versions that are newer than the photo and its edits are
+// kept, so exporting an album again only renders the photos that changed.
+func exportResized(src, dst string, size uint, edit photoEdit) error {
+	if upToDate(dst, src, editPath(src)) {
+		return nil
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	err = checkImageLimits(fd)
+	var img image.Image
+	if err == nil {
+		img, _, err = image.Decode(fd)
+	}
+	fd.Close()
+	if err != nil {
+		return err
+	}
+	m := resize.Thumbnail(size, size, edit.cropImage(img), resize.NearestNeighbor)
+	m = edit.rotateImage(m)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, m, nil); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf.Bytes(), 0644)
+}
+
+// exportCopy copies the original photo at src to dst, unless dst is newer
+func exportCopy(src, dst string) error {
+	if upToDate(dst, src) {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// upToDate returns true if dst exists and is newer than every existing file
+// of sources
+func upToDate(dst string, sources ...string) bool {
+	out, err := os.Stat(dst)
+	if err != nil {
+		return false
+	}
+	for _, src := range sources {
+		if in, err := os.Stat(src); err == nil && in.ModTime().After(out.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+// exportCmd renders an album into a static html site, with pre-resized
+// photos, that can be browsed without the server
+func exportCmd(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		root      = fs.String("root", "gallery", "Root of the gallery tree")
+		locale    = fs.String("locale", defaultLocale, "Language of the exported pages")
+		originals = fs.Bool("originals", false, "Copy the original photos into the export")
+	)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s export [-root gallery] [-locale en] [-originals] <album> <dir>\n", os.Args[0])
+		os.Exit(2)
+	}
+	album := filepath.Clean("/" + fs.Arg(0))[1:]
+	if album == "" {
+		album = "."
+	}
+	if fi, err := os.Stat(filepath.Join(*root, album)); err != nil || !fi.IsDir() {
+		log.Fatalf("export: album %q not found in %q", fs.Arg(0), *root)
+	}
+	if _, ok := catalogs[*locale]; !ok {
+		log.Fatalf("export: unsupported locale %q", *locale)
+	}
+	x := exporter{
+		root:      filepath.Join(*root, album),
+		out:       fs.Arg(1),
+		locale:    *locale,
+		originals: *originals,
+	}
+	if err := x.exportAlbum("."); err != nil {
+		log.Fatal(err)
+	}
+	logInfof("export: album %q exported to %q", strings.TrimPrefix(filepath.Join(*root, album), "./"), fs.Arg(1))
+}
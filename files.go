@@ -0,0 +1,118 @@
+package main
+
+import (
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filesConf lists the extensions of the other files shown in the albums of
+// each root, and in their sub albums, such as the gpx tracks of hikes, text
+// notes or audio recordings. "/" applies to the whole gallery. These files
+// are listed under the photos, with an icon of their type, and opened or
+// downloaded as they are.
+//
+//	files:
+//	  "/": [txt, md]
+//	  hikes: [gpx, kml]
+//	  family: [mp3, m4a]
+type filesConf map[string][]string
+
+// fileTypes are the content types of the extensions that Go and the system
+// may not know, which files are served with
+var fileTypes = map[string]string{
+	".gpx":     "application/gpx+xml",
+	".kml":     "application/vnd.google-earth.kml+xml",
+	".kmz":     "application/vnd.google-earth.kmz",
+	".geojson": "application/geo+json",
+	".md":      "text/markdown; charset=utf-8",
+	".txt":     "text/plain; charset=utf-8",
+	".mp3":     "audio/mpeg",
+	".m4a":     "audio/mp4",
+	".ogg":     "audio/ogg",
+	".opus":    "audio/ogg",
+	".flac":    "audio/flac",
+	".wav":     "audio/wav",
+}
+
+// initFiles registers the content types of the files
+func initFiles() error {
+	for ext, ctype := range fileTypes {
+		if err := mime.AddExtensionType(ext, ctype); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isFile returns true if the file at path is listed in its album, as its
+// extension is allowed for one of the roots containing it, and it is
+// neither a photo, a document nor an audio file
+func isFile(path string) bool {
+	name := filepath.Base(path)
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	if ext == "" || strings.HasPrefix(name, ".") || isImage(path) || isDocument(path) || isAudio(path) {
+		return false
+	}
+	for root, exts := range conf.Files {
+		if !inAlbums(path, []string{root}) {
+			continue
+		}
+		for _, allowed := range exts {
+			if strings.ToLower(strings.TrimPrefix(allowed, ".")) == ext {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// albumFileViews returns the files listed in the album dir, given the
+// entries of the album directory, leaving out the companions of its photos,
+// which are offered with them. Albums whose originals cannot be downloaded
+// list no files.
+func albumFileViews(dir string, entries []os.FileInfo) (files []photoView) {
+	if len(conf.Files) == 0 || !albumPolicy(dir).originals() {
+		return nil
+	}
+	companions := make(map[string]bool)
+	for _, names := range albumCompanions(entries) {
+		for _, name := range names {
+			companions[name] = true
+		}
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if e.Mode().IsRegular() && !companions[e.Name()] && isFile(path) {
+			files = append(files, photoView{Name: e.Name(), Path: path, Size: e.Size()})
+		}
+	}
+	return files
+}
+
+// fileIcon returns the icon of the kind of the file at path, as an html
+// entity
+func fileIcon(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	ctype := extensionType(path)
+	switch {
+	case ext == ".gpx" || ext == ".kml" || ext == ".kmz" || ext == ".geojson":
+		// world map
+		return "&#128506;"
+	case strings.HasPrefix(ctype, "text/"):
+		// memo
+		return "&#128221;"
+	case strings.HasPrefix(ctype, "audio/"):
+		// musical note
+		return "&#127925;"
+	case strings.HasPrefix(ctype, "video/"):
+		// film frames
+		return "&#127902;"
+	case ext == ".zip" || ext == ".tar" || ext == ".gz" || ext == ".7z":
+		// package
+		return "&#128230;"
+	}
+	// page
+	return "&#128196;"
+}
@@ -0,0 +1,13 @@
+package main
+
+// the image formats that can be decoded to generate previews. Formats that
+// browsers do not display, like TIFF and BMP, are only served resized,
+// converted to JPEG.
+import (
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
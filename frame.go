@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frameStateTTL is the time after which the position of a frame that stopped
+// polling is forgotten
+const frameStateTTL = 7 * 24 * time.Hour
+
+const (
+	// frameMaxDevice is the length of the longest device name
+	frameMaxDevice = 64
+	// frameMaxStates is the number of cycles kept for each user, by
+	// device and album, after which the least recently used is forgotten
+	frameMaxStates = 32
+)
+
+// frameState is the position of a frame in the cycle of its album
+type frameState struct {
+	// last is the photo the frame showed last, and position its place in
+	// the cycle, from which the cycle resumes if the photo is gone
+	last     string
+	position int
+	// seed is the order of the current cycle of shuffled frames, which
+	// changes at the end of every cycle
+	seed int64
+	user string
+	used time.Time
+}
+
+// frames are the positions of the frames, by user, device and album
+var frames = struct {
+	sync.Mutex
+	states map[string]*frameState
+}{states: make(map[string]*frameState)}
+
+// nextFramePhoto returns the photo that follows the last one shown by the
+// frame of key of the user in photos, in the order of the capture dates, or
+// shuffled once per cycle
+func nextFramePhoto(username, key string, photos []string, shuffled bool) string {
+	frames.Lock()
+	defer frames.Unlock()
+	now := time.Now()
+	var (
+		count  int
+		oldest string
+	)
+	for k, s := range frames.states {
+		if now.Sub(s.used) > frameStateTTL {
+			delete(frames.states, k)
+		} else if s.user == username {
+			count++
+			if oldest == "" || s.used.Before(frames.states[oldest].used) {
+				oldest = k
+			}
+		}
+	}
+	s, ok := frames.states[key]
+	if !ok {
+		if count >= frameMaxStates {
+			delete(frames.states, oldest)
+		}
+		s = &frameState{position: -1, seed: rand.Int63(), user: username}
+		frames.states[key] = s
+	}
+	s.used = now
+	cycle := func() []string {
+		if !shuffled {
+			return photos
+		}
+		order := append([]string{}, photos...)
+		shuffle(s.seed, len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		return order
+	}
+	order := cycle()
+	next := s.position + 1
+	if i := indexOf(order, s.last); i >= 0 {
+		next = i + 1
+	}
+	if next >= len(order) {
+		next = 0
+		if shuffled {
+			s.seed++
+			order = cycle()
+		}
+	}
+	s.last, s.position = order[next], next
+	return s.last
+}
+
+// frameNext redirects a photo frame to the next photo of the album
+// parameter, or of the whole gallery, resized to exactly the w and h
+// parameters of its screen. Each frame, set by the device parameter, and
+// user have their own cycle through the album, which is kept by the server
+// so frames only need to poll the same url on a timer. The mode parameter
+// sets how photos fill the screen: fill, the default, cuts them to its shape,
+// and pad keeps them whole on a background, black or the hex color of the
+// background parameter. The photos are in the order of their capture dates,
+// or shuffled with order=shuffle.
+func frameNext(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	width, werr := strconv.ParseUint(query.Get("w"), 10, 32)
+	height, herr := strconv.ParseUint(query.Get("h"), 10, 32)
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "fill"
+	}
+	order := query.Get("order")
+	device := query.Get("device")
+	if werr != nil || herr != nil || width == 0 || height == 0 || (mode != "fill" && mode != "pad") || (order != "" && order != "date" && order != "shuffle") || len(device) > frameMaxDevice {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	username := requestUser(r)
+	album := strings.Trim(filepath.Clean("/"+query.Get("album")), "/")
+	prefix := "gallery/"
+	if album != "" {
+		prefix += album + "/"
+	}
+	var photos []string
+	// the albums restricted to other networks are left out, as on the
+	// home page
+	visible := reachableFilter(r)
+	for _, e := range index.byCaptureDate(prefix) {
+		if visible(e.Path) {
+			photos = append(photos, e.Path)
+		}
+	}
+	if len(photos) == 0 {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	path := nextFramePhoto(username, username+"\x00"+device+"\x00"+prefix+"\x00"+order, photos, order == "shuffle")
+	params := url.Values{
+		"width":  {strconv.FormatUint(width, 10)},
+		"height": {strconv.FormatUint(height, 10)},
+		"mode":   {mode},
+	}
+	if mode == "pad" {
+		background := query.Get("background")
+		if background == "" {
+			background = "000000"
+		}
+		params.Set("background", background)
+	}
+	logDebugf("frame: showing %q to device %q of user %q", path, device, username)
+	// each poll gets the next photo, while the resized photos are cached
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link(fmt.Sprintf("/%s?%s%s", path, params.Encode(), editQuery(path))), http.StatusSeeOther)
+}
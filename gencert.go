@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfSignedValidity is the lifetime of the certificates generated by
+// `galilego gencert` and by the setup wizard
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// certificateTemplate returns the template of a certificate valid for
+// selfSignedValidity, with a random serial number
+func certificateTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// serverTemplate returns the template of the certificate of a server known
+// by hosts, which are hostnames or ip addresses
+func serverTemplate(hosts []string) (*x509.Certificate, error) {
+	template, err := certificateTemplate(hosts[0])
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return template, nil
+}
+
+// writeCertificate generates a key and a certificate from template, signed
+// by parent and its key or self-signed when parent is nil, and writes them
+// in pem files. The key is returned so the certificate can sign others.
+func writeCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+}
+
+// selfSignedCertificate generates a key and a self-signed certificate for
+// host, and writes them in pem files
+func selfSignedCertificate(host, certFile, keyFile string) error {
+	template, err := serverTemplate([]string{host})
+	if err != nil {
+		return err
+	}
+	_, err = writeCertificate(template, nil, nil, certFile, keyFile)
+	return err
+}
+
+// localCA loads the local certificate authority from its files, or creates
+// it when they do not exist yet, so the certificates of several hosts can be
+// signed by the same authority and trusted at once
+func localCA(certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		template, err := certificateTemplate("galilego local CA")
+		if err != nil {
+			return nil, nil, err
+		}
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		if _, err = writeCertificate(template, nil, nil, certFile, keyFile); err != nil {
+			return nil, nil, err
+		}
+		logInfof("gencert: created the local CA %q", certFile)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !cert.IsCA {
+		return nil, nil, fmt.Errorf("%q is not a CA generated by gencert", certFile)
+	}
+	return cert, key, nil
+}
+
+// gencertCmd implements the `galilego gencert` subcommand, which generates
+// a certificate and its key for the hosts of the gallery, to run it over TLS
+// before obtaining certificates from a real authority. The certificate is
+// self-signed, or signed by a local CA with -ca, which browsers and devices
+// can then trust once for all the certificates it signs.
+func gencertCmd(args []string) {
+	fs := flag.NewFlagSet("gencert", flag.ExitOnError)
+	var (
+		hosts = fs.String("host", "", "Comma separated hostnames and ip addresses of the certificate")
+		out   = fs.String("out", ".", "Directory the certificate and key are written to")
+		ca    = fs.Bool("ca", false, "Sign the certificate with a local CA, created in the directory if needed")
+		force = fs.Bool("force", false, "Replace an existing certificate")
+	)
+	fs.Parse(args)
+	var names []string
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if fs.NArg() != 0 || len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s gencert -host example.net[,www.example.net] [-out dir] [-ca] [-force]\n", os.Args[0])
+		os.Exit(2)
+	}
+	certFile, keyFile := filepath.Join(*out, "server.crt"), filepath.Join(*out, "server.key")
+	if _, err := os.Stat(certFile); err == nil && !*force {
+		log.Fatalf("gencert: %q already exists, pass -force to replace it", certFile)
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatal(err)
+	}
+	template, err := serverTemplate(names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var (
+		parent    *x509.Certificate
+		parentKey *ecdsa.PrivateKey
+	)
+	if *ca {
+		parent, parentKey, err = localCA(filepath.Join(*out, "ca.crt"), filepath.Join(*out, "ca.key"))
+		if err != nil {
+			log.Fatalf("gencert: %v", err)
+		}
+	}
+	if _, err = writeCertificate(template, parent, parentKey, certFile, keyFile); err != nil {
+		log.Fatalf("gencert: %v", err)
+	}
+	logInfof("gencert: wrote %q and %q for %s, valid until %s", certFile, keyFile,
+		strings.Join(names, ", "), template.NotAfter.Format("2006-01-02"))
+	fmt.Printf("certfile: %s\nkeyfile: %s\n", certFile, keyFile)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxPlaceDistance is the distance in kilometers beyond which the
+// nearest place of a dataset does not name the location of a photo
+const defaultMaxPlaceDistance = 50
+
+// geocodingConf resolves the GPS coordinates of photos to the name of the
+// nearest town when they are indexed, from an offline dataset, or from a
+// Nominatim compatible service for the photos the dataset does not cover.
+//
+//	geocoding:
+//	  dataset: cities1000.txt
+//	  maxdistance: 30
+//	  url: https://nominatim.openstreetmap.org/reverse
+type geocodingConf struct {
+	// Dataset is a GeoNames cities file, such as cities1000.txt from
+	// https://download.geonames.org/export/dump/
+	Dataset string
+	// MaxDistance is in kilometers, 50 by default
+	MaxDistance float64
+	// URL is the reverse geocoding endpoint of a Nominatim compatible
+	// service, which is queried at most once per second
+	URL string
+}
+
+// geocoder resolves coordinates to the name of a place. The dataset and
+// Nominatim geocoders are built in, and others can be added with
+// registerGeocoder.
+type geocoder interface {
+	// reverse returns the name of the place at the coordinates, or an
+	// empty string if it does not know it
+	reverse(lat, lon float64) (string, error)
+}
+
+// geocoders are tried in order until one of them names the place
+var geocoders []geocoder
+
+// registerGeocoder adds a geocoder, tried after those already registered
+func registerGeocoder(g geocoder) {
+	geocoders = append(geocoders, g)
+}
+
+// initGeocoding registers the geocoders of the configuration
+func initGeocoding() error {
+	if conf.Geocoding.Dataset != "" {
+		g, err := loadPlaces(conf.Geocoding.Dataset, conf.Geocoding.MaxDistance)
+		if err != nil {
+			return fmt.Errorf("geocoding: %v", err)
+		}
+		logInfof("geocoding: loaded %d places from %q", g.count, conf.Geocoding.Dataset)
+		registerGeocoder(g)
+	}
+	if conf.Geocoding.URL != "" {
+		if _, err := url.Parse(conf.Geocoding.URL); err != nil {
+			return fmt.Errorf("geocoding: invalid url: %v", err)
+		}
+		registerGeocoder(&nominatimGeocoder{url: conf.Geocoding.URL, cache: make(map[string]string)})
+	}
+	return nil
+}
+
+// photoPlace returns the name of the place a photo was taken at, from its
+// GPS coordinates, or an empty string if it has none or no geocoder knows
+// the place
+func photoPlace(path string, data exifData) string {
+	if !data.HasGPS {
+		return ""
+	}
+	for _, g := range geocoders {
+		place, err := g.reverse(data.Latitude, data.Longitude)
+		if err != nil {
+			logErrorf("geocoding: failed to locate %q: %v", path, err)
+			continue
+		}
+		if place != "" {
+			return place
+		}
+	}
+	return ""
+}
+
+// geoPlace is a named location of a dataset
+type geoPlace struct {
+	name     string
+	lat, lon float64
+}
+
+// datasetGeocoder finds the nearest place of an offline dataset. Places are
+// bucketed by degree of latitude and longitude, so only the places around
+// the coordinates are compared.
+type datasetGeocoder struct {
+	cells       map[[2]int][]geoPlace
+	count       int
+	maxDistance float64
+}
+
+// loadPlaces reads a GeoNames file, whose tab separated columns hold the
+// name of each place in the second column, and its latitude and longitude
+// in the fifth and sixth
+func loadPlaces(path string, maxDistance float64) (*datasetGeocoder, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if maxDistance <= 0 {
+		maxDistance = defaultMaxPlaceDistance
+	}
+	g := &datasetGeocoder{cells: make(map[[2]int][]geoPlace), maxDistance: maxDistance}
+	scanner := bufio.NewScanner(fd)
+	// the alternate names of large cities make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 || fields[1] == "" {
+			continue
+		}
+		lat, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			continue
+		}
+		lon, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			continue
+		}
+		cell := geoCell(lat, lon)
+		g.cells[cell] = append(g.cells[cell], geoPlace{name: fields[1], lat: lat, lon: lon})
+		g.count++
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if g.count == 0 {
+		return nil, fmt.Errorf("no places found in %q", path)
+	}
+	return g, nil
+}
+
+func geoCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+func (g *datasetGeocoder) reverse(lat, lon float64) (string, error) {
+	// a degree of latitude is about 111km, and one of longitude shrinks
+	// toward the poles
+	latCells := int(math.Ceil(g.maxDistance / 111))
+	lonCells := latCells
+	if c := math.Cos(lat * math.Pi / 180); c > 0.01 {
+		lonCells = int(math.Ceil(g.maxDistance / (111 * c)))
+	}
+	if lonCells > 180 {
+		lonCells = 180
+	}
+	center := geoCell(lat, lon)
+	nearest, best := "", g.maxDistance
+	for i := -latCells; i <= latCells; i++ {
+		for j := -lonCells; j <= lonCells; j++ {
+			// wrap around the antimeridian
+			cellLon := (center[1]+j+180+360)%360 - 180
+			for _, p := range g.cells[[2]int{center[0] + i, cellLon}] {
+				if d := distance(lat, lon, p.lat, p.lon); d <= best {
+					nearest, best = p.name, d
+				}
+			}
+		}
+	}
+	return nearest, nil
+}
+
+// distance returns the great circle distance between two coordinates, in
+// kilometers
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// nominatimGeocoder queries the reverse endpoint of a Nominatim compatible
+// service. Requests are spaced by a second, as the usage policy of the
+// public service requires, and their results are kept for the other photos
+// taken nearby.
+type nominatimGeocoder struct {
+	url   string
+	mu    sync.Mutex
+	last  time.Time
+	cache map[string]string
+}
+
+func (g *nominatimGeocoder) reverse(lat, lon float64) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// about a kilometer
+	key := fmt.Sprintf("%.2f,%.2f", lat, lon)
+	if place, ok := g.cache[key]; ok {
+		return place, nil
+	}
+	if wait := time.Second - time.Since(g.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.last = time.Now()
+	query := url.Values{}
+	query.Set("format", "jsonv2")
+	query.Set("lat", strconv.FormatFloat(lat, 'f', 6, 64))
+	query.Set("lon", strconv.FormatFloat(lon, 'f', 6, 64))
+	// the level of towns and cities
+	query.Set("zoom", "10")
+	sep := "?"
+	if strings.Contains(g.url, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequest("GET", g.url+sep+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "galilego")
+	if conf.Locale != "" {
+		req.Header.Set("Accept-Language", conf.Locale)
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+	var result struct {
+		Address map[string]string `json:"address"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	var place string
+	for _, field := range []string{"city", "town", "village", "municipality", "county"} {
+		if place = result.Address[field]; place != "" {
+			break
+		}
+	}
+	g.cache[key] = place
+	return place, nil
+}
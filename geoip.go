@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// geoipMetadataMarker starts the metadata section at the end of a MaxMind
+// database
+var geoipMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errGeoIPFormat = errors.New("invalid maxmind database")
+
+// geoipDB reads the countries of addresses in a MaxMind database, such as
+// GeoLite2-Country.mmdb, which is loaded in memory. The database is a binary
+// search tree over the bits of the addresses, whose leaves point to records
+// in a data section, see https://maxmind.github.io/MaxMind-DB/
+type geoipDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section
+	dataStart uint
+	// ipv4Start is the node of ::/96, under which IPv4 addresses are
+	// stored in IPv6 databases
+	ipv4Start uint
+}
+
+// openGeoIP loads the MaxMind database at path
+func openGeoIP(path string) (*geoipDB, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, geoipMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: no metadata in %q", errGeoIPFormat, path)
+	}
+	metaStart := uint(i + len(geoipMetadataMarker))
+	meta, _, err := geoipDecoder{data: data[metaStart:]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errGeoIPFormat, err)
+	}
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errGeoIPFormat)
+	}
+	db := &geoipDB{
+		data:       data[:i],
+		nodeCount:  geoipUint(m["node_count"]),
+		recordSize: geoipUint(m["record_size"]),
+		ipVersion:  geoipUint(m["ip_version"]),
+	}
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", errGeoIPFormat, db.recordSize)
+	}
+	// the tree is followed by 16 zero bytes, then by the data section
+	db.dataStart = db.nodeCount*db.recordSize/4 + 16
+	if db.dataStart > uint(len(db.data)) {
+		return nil, fmt.Errorf("%w: truncated search tree", errGeoIPFormat)
+	}
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node
+func (db *geoipDB) record(node, bit uint) uint {
+	b := db.data
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off:]))
+	}
+}
+
+// lookup returns the record of an address, or nil if it has none
+func (db *geoipDB) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil {
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	}
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		// node_count itself is the empty record
+		return nil, nil
+	}
+	off := node - db.nodeCount - 16
+	if db.dataStart+off >= uint(len(db.data)) {
+		return nil, fmt.Errorf("%w: record out of the data section", errGeoIPFormat)
+	}
+	v, _, err := geoipDecoder{data: db.data[db.dataStart:]}.decode(off)
+	return v, err
+}
+
+// country returns the ISO code of the country of an address, such as "FR",
+// or an empty string if it is not known
+func (db *geoipDB) country(ip net.IP) (string, error) {
+	v, err := db.lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	m, _ := v.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// geoipDecoder decodes the values of a data section, whose pointers are
+// relative to its start
+type geoipDecoder struct {
+	data []byte
+}
+
+// decode returns the value at off, and the offset that follows it
+func (d geoipDecoder) decode(off uint) (interface{}, uint, error) {
+	if off >= uint(len(d.data)) {
+		return nil, 0, errors.New("value out of bounds")
+	}
+	ctrl := d.data[off]
+	off++
+	kind := uint(ctrl >> 5)
+	if kind == 1 {
+		// pointers have their own size encoding, and point to the value
+		// to decode in their place
+		size := uint(ctrl>>3) & 3
+		if off+size+1 > uint(len(d.data)) {
+			return nil, 0, errors.New("pointer out of bounds")
+		}
+		p := uint(ctrl & 7)
+		switch size {
+		case 0:
+			p = p<<8 | uint(d.data[off])
+		case 1:
+			p = (p<<16 | uint(d.data[off])<<8 | uint(d.data[off+1])) + 2048
+		case 2:
+			p = (p<<24 | uint(d.data[off])<<16 | uint(d.data[off+1])<<8 | uint(d.data[off+2])) + 526336
+		case 3:
+			p = uint(binary.BigEndian.Uint32(d.data[off:]))
+		}
+		v, _, err := d.decode(p)
+		return v, off + size + 1, err
+	}
+	if kind == 0 {
+		if off >= uint(len(d.data)) {
+			return nil, 0, errors.New("extended type out of bounds")
+		}
+		kind = 7 + uint(d.data[off])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(d.data)) {
+			return nil, 0, errors.New("size out of bounds")
+		}
+		ext := uint(0)
+		for _, b := range d.data[off : off+n] {
+			ext = ext<<8 | uint(b)
+		}
+		off += n
+		switch n {
+		case 1:
+			size = 29 + ext
+		case 2:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+	}
+	switch kind {
+	case 7:
+		// maps
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			var v interface{}
+			if v, off, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, off, nil
+	case 11:
+		// arrays
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var (
+				v   interface{}
+				err error
+			)
+			if v, off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case 14:
+		// booleans have no payload
+		return size != 0, off, nil
+	}
+	if off+size > uint(len(d.data)) {
+		return nil, 0, errors.New("value out of bounds")
+	}
+	payload := d.data[off : off+size]
+	off += size
+	switch kind {
+	case 2:
+		return string(payload), off, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), off, nil
+	case 4:
+		return payload, off, nil
+	case 5, 6, 9, 10:
+		// unsigned integers, uint128 are truncated as they are not used
+		// for countries
+		n := uint64(0)
+		for _, b := range payload {
+			n = n<<8 | uint64(b)
+		}
+		return n, off, nil
+	case 8:
+		n := int32(0)
+		for _, b := range payload {
+			n = n<<8 | int32(b)
+		}
+		return n, off, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// geoipUint returns an unsigned integer of the metadata
+func geoipUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHSTSMaxAge is the time browsers only connect to the gallery over
+// https, when the configuration sets none
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// defaultHPKPMaxAge is the time browsers remember the pins of the gallery,
+// when the configuration sets none
+const defaultHPKPMaxAge = 15 * 24 * time.Hour
+
+// hstsConf sets the Strict-Transport-Security header, which tells browsers
+// to only connect to the gallery over https for maxage, a year by default.
+// includesubdomains extends it to every subdomain of the host, and preload
+// allows the host to be submitted to the preload lists of browsers, from
+// which it is slow to remove, so both are off unless set.
+//
+//	hsts:
+//	  maxage: 8760h
+//	  includesubdomains: true
+//	  preload: true
+type hstsConf struct {
+	Disabled          bool
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	Preload           bool
+}
+
+// hpkpConf sets the Public-Key-Pins header, which tells browsers to refuse
+// the certificates of the gallery whose keys do not match one of the pins
+// for maxage, 15 days by default. Pins are the base64 sha256 of the subject
+// public key info of a key, such as printed by
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+// At least one of them must be the pin of a backup key that is not used yet,
+// as visitors cannot reach the gallery after a change of keys that are all
+// pinned. Most browsers no longer enforce pins, which are only sent when the
+// pins are configured.
+//
+//	hpkp:
+//	  pins:
+//	    - YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg=
+//	    - 5C8kvU039KouVrl52D0eZSGf4Onjo4Khs8tmyTlV3nU=
+//	  maxage: 360h
+//	  reporturi: https://example.report-uri.com/r/d/hpkp/enforce
+type hpkpConf struct {
+	Pins              []string
+	MaxAge            time.Duration
+	IncludeSubdomains bool
+	ReportURI         string `yaml:"reporturi"`
+}
+
+// hstsHeader and hpkpHeader are the values of the Strict-Transport-Security
+// and Public-Key-Pins headers, or empty if they are not sent
+var hstsHeader, hpkpHeader string
+
+// initSecurityHeaders builds the transport security headers of the
+// configuration
+func initSecurityHeaders() error {
+	if !conf.HSTS.Disabled {
+		maxAge := conf.HSTS.MaxAge
+		if maxAge <= 0 {
+			maxAge = defaultHSTSMaxAge
+		}
+		hstsHeader = "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+		if conf.HSTS.IncludeSubdomains {
+			hstsHeader += "; includeSubDomains"
+		}
+		if conf.HSTS.Preload {
+			if maxAge < defaultHSTSMaxAge || !conf.HSTS.IncludeSubdomains {
+				logWarnf("hsts: preload requires includesubdomains and a maxage of at least a year")
+			}
+			hstsHeader += "; preload"
+		}
+	}
+	c := conf.HPKP
+	if len(c.Pins) == 0 {
+		return nil
+	}
+	if len(c.Pins) < 2 {
+		return fmt.Errorf("hpkp: at least two pins are required, one of them for a backup key")
+	}
+	maxAge := c.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultHPKPMaxAge
+	}
+	header := "max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if c.IncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+	for _, pin := range c.Pins {
+		if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != 32 {
+			return fmt.Errorf("hpkp: invalid pin %q, not the base64 of a sha256", pin)
+		}
+		header += `; pin-sha256="` + pin + `"`
+	}
+	if c.ReportURI != "" {
+		header += `; report-uri="` + strings.Replace(c.ReportURI, `"`, "%22", -1) + `"`
+	}
+	hpkpHeader = header
+	return nil
+}
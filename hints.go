@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+)
+
+// hintedSlides is the number of slides of an album page whose images are
+// preloaded
+const hintedSlides = 2
+
+// sliderScripts are the scripts of the slideshow of the album pages
+var sliderScripts = []string{"/statics/jquery-2.2.3.min.js", "/statics/jssor.slider.mini.js"}
+
+// albumHints returns the preload links of the scripts of an album page, and
+// of the images of its first slides
+func albumHints(view *albumView) []string {
+	var links []string
+	for _, script := range sliderScripts {
+		links = append(links, "<"+link(script)+">; rel=preload; as=script")
+	}
+	for i := 0; i < len(view.Photos) && i < hintedSlides; i++ {
+		path := view.Photos[i].Path
+		links = append(links, "<"+link("/"+filepath.ToSlash(path)+"?width=1200"+editQuery(path))+">; rel=preload; as=image")
+	}
+	return links
+}
+
+// sendEarlyHints sends the preload links to the browser before the page is
+// rendered, in a 103 Early Hints response over HTTP/2 and later, and in
+// the Link headers of the response. The 103 response carries no other
+// header, such as the cookies set by the middlewares. HTTP/1 clients, and
+// the reverse proxies of unix sockets, only get the Link headers, as some
+// of them do not expect informational responses.
+func sendEarlyHints(w http.ResponseWriter, r *http.Request, links []string) {
+	if len(links) == 0 {
+		return
+	}
+	h := w.Header()
+	if r.ProtoMajor >= 2 {
+		saved := h.Clone()
+		for name := range h {
+			delete(h, name)
+		}
+		h["Link"] = links
+		w.WriteHeader(http.StatusEarlyHints)
+		delete(h, "Link")
+		for name, values := range saved {
+			h[name] = values
+		}
+	}
+	for _, l := range links {
+		h.Add("Link", l)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// homeLayout arranges the albums of the home page. Pinned albums come
+// first, in the order they are listed, followed by the other albums sorted
+// by name, or by their most recently added photo when order is "newest".
+// Hidden albums are left out of the home page, but can still be reached by
+// their url. The layout of the configuration is combined with the one set by
+// the admins on /admin/home.
+//
+//	homealbums:
+//	  order: newest
+//	  pinned: [family, travels]
+//	  hidden: [drafts]
+type homeLayout struct {
+	Order  string   `json:"order,omitempty"`
+	Pinned []string `json:"pinned,omitempty"`
+	Hidden []string `json:"hidden,omitempty"`
+}
+
+var homeOrders = map[string]bool{"": true, "name": true, "newest": true}
+
+// homeStore persists the layout set by the admins, in the database if one is
+// configured and in homefile otherwise
+type homeStore interface {
+	layout() (homeLayout, error)
+	save(l homeLayout) error
+}
+
+var homeLayouts homeStore
+
+// initHomeLayout checks the layout of the configuration, and selects the
+// store of the one set by the admins
+func initHomeLayout() error {
+	if !homeOrders[conf.HomeAlbums.Order] {
+		return fmt.Errorf("homealbums: unknown order %q", conf.HomeAlbums.Order)
+	}
+	if db != nil {
+		homeLayouts = dbHomeStore{}
+		return nil
+	}
+	path := conf.HomeFile
+	if path == "" {
+		path = "home.json"
+	}
+	homeLayouts = &fileHomeStore{path: path}
+	return nil
+}
+
+// currentHomeLayout returns the layout of the configuration combined with
+// the one of the admins, whose order prevails
+func currentHomeLayout() homeLayout {
+	stored, err := homeLayouts.layout()
+	if err != nil {
+		logErrorf("home: failed to load the layout of the home page: %v", err)
+	}
+	l := homeLayout{
+		Order:  conf.HomeAlbums.Order,
+		Pinned: appendMissing(append([]string(nil), conf.HomeAlbums.Pinned...), stored.Pinned...),
+		Hidden: appendMissing(append([]string(nil), conf.HomeAlbums.Hidden...), stored.Hidden...),
+	}
+	if stored.Order != "" {
+		l.Order = stored.Order
+	}
+	return l
+}
+
+// appendMissing appends the values that list does not contain yet
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		if indexOf(list, v) < 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func indexOf(list []string, v string) int {
+	for i, s := range list {
+		if s == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// arrange returns the albums of the home page in the order of the layout,
+// without the hidden ones
+func (l homeLayout) arrange(albums []albumLink) []albumLink {
+	var newest map[string]time.Time
+	if l.Order == "newest" {
+		newest = index.newestByRoot()
+	}
+	arranged := make([]albumLink, 0, len(albums))
+	for _, a := range albums {
+		if indexOf(l.Hidden, a.Name) >= 0 {
+			continue
+		}
+		a.Pinned = indexOf(l.Pinned, a.Name) >= 0
+		arranged = append(arranged, a)
+	}
+	sort.SliceStable(arranged, func(i, j int) bool {
+		a, b := arranged[i], arranged[j]
+		if a.Pinned || b.Pinned {
+			if !b.Pinned {
+				return true
+			}
+			return a.Pinned && indexOf(l.Pinned, a.Name) < indexOf(l.Pinned, b.Name)
+		}
+		if newest != nil {
+			ta, tb := newest[rootOf(a.Path)], newest[rootOf(b.Path)]
+			if !ta.Equal(tb) {
+				return ta.After(tb)
+			}
+		}
+		return a.Name < b.Name
+	})
+	return arranged
+}
+
+// homeAlbums returns the top level albums and the remotes of the gallery
+func homeAlbums(locale string) ([]albumLink, error) {
+	view, err := genGalleryData("gallery", locale, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, rc := range conf.Remotes {
+		view.Albums = append(view.Albums, albumLink{Name: rc.Name, Path: "remote/" + rc.Name})
+	}
+	return view.Albums, nil
+}
+
+// homeView lists the albums of the home page, and lets admins pin and hide
+// them, and choose their order
+func homeView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	albums, err := homeAlbums(locale)
+	if err != nil {
+		galleryError(w, r, err)
+		return
+	}
+	layout := currentHomeLayout()
+	button := func(name, action string) string {
+		return fmt.Sprintf(`<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="name" value="%s"/><button type="submit" name="action" value="%s">%s</button></form>`,
+			link("/admin/home"), html.EscapeString(name), action, tr(locale, action))
+	}
+	var albumsHtml string
+	for _, a := range albums {
+		albumsHtml += "<li>" + html.EscapeString(a.Name)
+		for _, state := range []struct {
+			list, configured   []string
+			label, add, remove string
+		}{
+			{layout.Pinned, conf.HomeAlbums.Pinned, "pinned", "pin", "unpin"},
+			{layout.Hidden, conf.HomeAlbums.Hidden, "hidden", "hide", "show"},
+		} {
+			switch {
+			case indexOf(state.configured, a.Name) >= 0:
+				albumsHtml += " " + tr(locale, state.label) + " (" + tr(locale, "configured") + ")"
+			case indexOf(state.list, a.Name) >= 0:
+				albumsHtml += " " + tr(locale, state.label) + " " + button(a.Name, state.remove)
+			default:
+				albumsHtml += " " + button(a.Name, state.add)
+			}
+		}
+		albumsHtml += "</li>\n"
+	}
+	var orderHtml string
+	for _, order := range []string{"name", "newest"} {
+		selected := ""
+		if layout.Order == order || (layout.Order == "" && order == "name") {
+			selected = ` selected="selected"`
+		}
+		orderHtml += fmt.Sprintf(`<option value="%s"%s>%s</option>`, order, selected, tr(locale, "sort_"+order))
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "home_layout")+`</h1>
+		<form method="POST" action="`+link("/admin/home")+`">`+tr(locale, "album_order")+` <select name="order">`+orderHtml+`</select> <button type="submit" name="action" value="order">`+tr(locale, "save")+`</button></form>
+		<ul>
+`+albumsHtml+`		</ul>
+	</body>
+</html>`))
+}
+
+// homeAction pins, unpins, hides or shows the album of the form, or sets the
+// order of the albums
+func homeAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	action := r.FormValue("action")
+	layout, err := homeLayouts.layout()
+	if err != nil {
+		logErrorf("home: failed to load the layout of the home page: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "home_failed")
+		return
+	}
+	// albums that no longer exist can still be unpinned and shown
+	if action == "pin" || action == "hide" {
+		albums, err := homeAlbums(requestLocale(r))
+		if err != nil {
+			galleryError(w, r, err)
+			return
+		}
+		found := false
+		for _, a := range albums {
+			found = found || a.Name == name
+		}
+		if !found {
+			writeError(w, r, http.StatusNotFound, "album_not_found")
+			return
+		}
+	}
+	switch action {
+	case "pin":
+		layout.Pinned = appendMissing(layout.Pinned, name)
+	case "unpin":
+		layout.Pinned = removeValue(layout.Pinned, name)
+	case "hide":
+		layout.Hidden = appendMissing(layout.Hidden, name)
+	case "show":
+		layout.Hidden = removeValue(layout.Hidden, name)
+	case "order":
+		name = r.FormValue("order")
+		if name == "" || !homeOrders[name] {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		layout.Order = name
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if err = homeLayouts.save(layout); err != nil {
+		logErrorf("home: failed to save the layout of the home page: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "home_failed")
+		return
+	}
+	logInfof("home: user %q applied %s to %q", username, action, name)
+	http.Redirect(w, r, link("/admin/home"), http.StatusSeeOther)
+}
+
+// removeValue returns list without v
+func removeValue(list []string, v string) []string {
+	var kept []string
+	for _, s := range list {
+		if s != v {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// fileHomeStore keeps the layout in a json file, which is read again when it
+// changes
+type fileHomeStore struct {
+	path    string
+	mu      sync.Mutex
+	modtime time.Time
+	current homeLayout
+}
+
+func (s *fileHomeStore) layout() (homeLayout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.current, s.modtime = homeLayout{}, time.Time{}
+		return s.current, nil
+	} else if err != nil {
+		return s.current, err
+	}
+	if fi.ModTime().Equal(s.modtime) {
+		return s.current, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return s.current, err
+	}
+	var l homeLayout
+	if err = json.Unmarshal(data, &l); err != nil {
+		return s.current, fmt.Errorf("invalid home file %q: %v", s.path, err)
+	}
+	s.current, s.modtime = l, fi.ModTime()
+	return l, nil
+}
+
+func (s *fileHomeStore) save(l homeLayout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.modtime = time.Time{}
+	return nil
+}
+
+// dbHomeStore keeps the layout as a json document under the name "home" of
+// the settings table of the database
+type dbHomeStore struct{}
+
+func (dbHomeStore) layout() (l homeLayout, err error) {
+	var data string
+	err = db.QueryRow(rebind(`SELECT data FROM settings WHERE name = ?`), "home").Scan(&data)
+	if err == sql.ErrNoRows {
+		return l, nil
+	} else if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal([]byte(data), &l)
+	return l, err
+}
+
+func (dbHomeStore) save(l homeLayout) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(rebind(`DELETE FROM settings WHERE name = ?`), "home"); err == nil {
+		_, err = tx.Exec(rebind(`INSERT INTO settings (name, data) VALUES (?, ?)`), "home", string(data))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
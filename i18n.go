@@ -0,0 +1,605 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultLocale is used when neither the configuration nor the client
+// select a supported locale
+const defaultLocale = "en"
+
+// catalogs contains the translations of the user interface messages, indexed
+// by locale then by message key
+var catalogs = map[string]map[string]string{
+	"en": {
+		"title":               "Galilego HTTP/2 web gallery",
+		"content_of":          "Content of",
+		"navigation":          "Navigation:",
+		"slider_help":         "Use the arrows to navigate. Click on an image to download the original version.",
+		"index":               "Index",
+		"slideshow":           "Slideshow",
+		"no_images":           "No images to display.",
+		"duplicates":          "Duplicate photos",
+		"exact_duplicates":    "Exact duplicates",
+		"near_duplicates":     "Near duplicates",
+		"none_found":          "None found.",
+		"duplicates_pending":  "The duplicates are being searched, this page reloads until they are found.",
+		"please_auth":         "please authenticate",
+		"forbidden":           "forbidden",
+		"too_many_requests":   "too many requests",
+		"scan_failed":         "failed to scan gallery",
+		"sprite_failed":       "failed to generate sprite sheet",
+		"old_http_title":      "Galilego is a HTTP/2 web gallery.",
+		"old_http_body":       `Unfortunately, you're <b>not</b> using HTTP/2 right now. To do so download and install the latest Firefox from <a href="https://www.mozilla.org">https://www.mozilla.org</a>.`,
+		"audit_disabled":      "audit log is not enabled",
+		"audit_read_failed":   "failed to read audit log",
+		"audit_invalid_since": "invalid since parameter, expected RFC3339 timestamp",
+		"audit_invalid_limit": "invalid limit parameter",
+		"password":            "Password:",
+		"dropbox_title":       "Share your photos in",
+		"dropbox_limits":      "Files of up to %s are accepted, of types %s. Photos are published once reviewed.",
+		"upload":              "Upload",
+		"upload_invalid":      "The upload is invalid or too large.",
+		"invalid_password":    "Invalid password.",
+		"dropbox_full":        "This drop box is full, no more photos can be accepted.",
+		"upload_failed":       "failed to store uploaded files",
+		"upload_done":         "%s photos received, thank you!",
+		"upload_rejected":     "Rejected files:",
+		"review_queue":        "Photos waiting for review",
+		"publish":             "Publish",
+		"reject":              "Reject",
+		"review_failed":       "failed to review file",
+		"album_not_found":     "album not found",
+		"over_quota":          "upload refused: storage quota exceeded, %s used of %s",
+		"upload_exists":       "a file of the same name already exists in the album",
+		"upload_busy":         "the upload is already being written by another request",
+		"upload_bad_offset":   "the offset does not match the data received",
+		"upload_bad_checksum": "the data does not match its checksum",
+		"tus_version":         "unsupported version of the tus protocol",
+		"timeline":            "Timeline",
+		"month_1":             "January",
+		"month_2":             "February",
+		"month_3":             "March",
+		"month_4":             "April",
+		"month_5":             "May",
+		"month_6":             "June",
+		"month_7":             "July",
+		"month_8":             "August",
+		"month_9":             "September",
+		"month_10":            "October",
+		"month_11":            "November",
+		"month_12":            "December",
+		"not_found":           "page not found",
+		"image_failed":        "failed to process image",
+		"back_home":           "Back to the gallery",
+		"tags":                "Tags",
+		"tagged":              "Photos tagged",
+		"no_tags":             "no tagged photos",
+		"add_tags":            "Add to selected photos",
+		"remove_tags":         "Remove from selected photos",
+		"tag_failed":          "failed to save tags",
+		"invalid_request":     "invalid request",
+		"edit_rotate-left":    "Rotate left",
+		"edit_rotate-right":   "Rotate right",
+		"edit_reset":          "Undo edits",
+		"edit_crop_region":    "Keep x, y, width, height (%):",
+		"edit_crop":           "Crop",
+		"edit_failed":         "failed to save edit",
+		"export_album":        "Back to the album",
+		"download_raw":        "Download RAW",
+		"download_video":      "Download video",
+		"download_heif":       "Download HEIF",
+		"render_failed":       "failed to render page",
+		"metadata_failed":     "failed to save metadata",
+		"remote_failed":       "failed to reach remote gallery",
+		"shuffle":             "Shuffle",
+		"documents":           "Documents",
+		"notify_subject":      "New photos in %s",
+		"notify_body":         "%d new photos were added to the album %s:",
+		"digest_subject":      "New photos in the gallery",
+		"digest_intro":        "%s new photos were added to the gallery",
+		"digest_more":         "and %s more photos",
+		"places":              "Places",
+		"no_places":           "no photos with a place",
+		"photos_in":           "Photos taken in",
+		"search":              "Search",
+		"demo_banner":         "This is a demo gallery, showing sample photos.",
+		"archives":            "Archived albums",
+		"archive":             "Archive",
+		"unarchive":           "Unarchive",
+		"verify":              "Verify",
+		"archive_files":       "%s files",
+		"archive_unchecked":   "not verified yet",
+		"archive_intact":      "intact on %s",
+		"archive_damaged":     "damaged on %s: %d missing, %d modified and %d added files",
+		"archive_failed":      "the album could not be archived or verified",
+		"album_archived":      "this album is archived and read only",
+		"api_tokens":          "API tokens",
+		"create":              "Create",
+		"revoke":              "Revoke",
+		"token_created":       "New token, copy it now as it will not be shown again:",
+		"token_scope":         "the scope of this token does not allow this request",
+		"token_failed":        "the token could not be created or revoked",
+		"profile":             "Profile of",
+		"display_name":        "Display name:",
+		"theme":               "Theme:",
+		"theme_light":         "Light",
+		"theme_dark":          "Dark",
+		"sort_order":          "Order of the photos:",
+		"sort_name":           "By name",
+		"sort_date":           "By date",
+		"sort_shuffle":        "Shuffled",
+		"slide_seconds":       "Seconds per slide:",
+		"save":                "Save",
+		"change_password":     "Change password",
+		"current_password":    "Current password:",
+		"new_password":        "New password:",
+		"confirm_password":    "Confirm the new password:",
+		"profile_saved":       "Your preferences were saved.",
+		"profile_failed":      "the profile could not be saved",
+		"wrong_password":      "The current password is invalid.",
+		"password_too_short":  "The new password must have at least %d characters.",
+		"password_mismatch":   "The new passwords do not match.",
+		"password_changed":    "Your password was changed.",
+		"csrf_failed":         "the form expired, reload the page and try again",
+		"virtual_albums":      "Virtual albums",
+		"configured":          "configuration",
+		"remove":              "Remove",
+		"invalid_search":      "invalid search, see the syntax of the virtual albums",
+		"virtual_failed":      "the virtual album could not be created or removed",
+		"queue_full":          "too many images are being resized, try again later",
+		"streams_busy":        "too many downloads are in progress, try again later",
+		"unshuffle":           "Sort by name",
+		"shuffle_link":        "Link to this order",
+		"image_too_large":     "image too large to be resized, download the original instead",
+		"home_layout":         "Albums of the home page",
+		"album_order":         "Order of the albums:",
+		"sort_newest":         "Newest photos first",
+		"pinned":              "pinned",
+		"hidden":              "hidden",
+		"pin":                 "Pin",
+		"unpin":               "Unpin",
+		"hide":                "Hide",
+		"show":                "Show",
+		"home_failed":         "the albums of the home page could not be arranged",
+		"rate_stars":          "%d stars",
+		"clear_rating":        "Clear",
+		"average_rating":      "average: %d/5",
+		"offline":             "You are offline, and this page was not viewed before",
+		"share_photos":        "%s photos",
+		"preview_failed":      "the preview of the album could not be generated",
+		"rescan":              "Rescan",
+		"rescan_thumbnails":   "generate the missing thumbnails",
+		"start_rescan":        "Start",
+		"cancel_rescan":       "Cancel",
+		"scan_running":        "running",
+		"scan_canceled":       "canceled",
+		"scan_finished":       "finished in %s",
+		"files_scanned":       "images scanned",
+		"files_indexed":       "images indexed",
+		"files_removed":       "images removed",
+		"thumbs_generated":    "thumbnails generated",
+		"scan_errors":         "errors",
+		"no_scan":             "no scan is running",
+		"scan_busy":           "a scan is already running",
+		"format_not_allowed":  "this image format is not available",
+		"download_zip":        "Download as ZIP",
+		"add_favorites":       "Add to favorites",
+		"remove_favorites":    "Remove from favorites",
+		"share_selection":     "Share the selection",
+		"favorites":           "Favorites",
+		"empty_selection":     "no photo is selected",
+		"selection_of":        "selection of %s photos, expires %s",
+		"setup_title":         "Setup of galilego",
+		"setup_intro":         "There is no configuration file at %s yet. This wizard creates it, then galilego starts with it.",
+		"setup_root":          "Directory of galilego, whose gallery sub directory holds the albums:",
+		"setup_host":          "Host name:",
+		"setup_listen":        "Listen address:",
+		"setup_admin":         "Admin username:",
+		"setup_password":      "Password:",
+		"setup_tls":           "TLS certificate:",
+		"tls_selfsigned":      "Generate a self-signed certificate",
+		"tls_acme":            "Use the certificate of certbot, or of another ACME client",
+		"tls_files":           "Use the certificate and key files:",
+		"setup_create":        "Create the configuration",
+		"setup_missing":       "The directory, the host name and the TLS certificate are required.",
+		"setup_bad_listen":    "The listen address must be a host and a port, such as 0.0.0.0:8064.",
+		"setup_bad_username":  "The username can only contain letters, digits and . _ @ -",
+		"setup_bad_cert":      "The certificate cannot be loaded: %v",
+		"setup_failed":        "The configuration could not be created: %v",
+		"setup_done":          "The configuration was written to %s.",
+		"setup_starting":      "galilego is starting, and will serve the gallery on %s.",
+		"setup_acme":          "Obtain the certificate of %s, for example with %s, then start galilego again.",
+		"activity_of":         "Activity of %s",
+		"activity_photos":     "%s new photos in %s",
+		"activity_rating":     "%s rated %s with %d stars",
+		"activity_failed":     "Failed to read the activity of the album",
+		"move_albums":         "Move albums",
+		"move_album":          "Move",
+		"merge_albums":        "merge into an existing album",
+		"merge_collisions":    "%d files of the album already exist in the destination album",
+		"album_exists":        "the destination album already exists",
+		"move_failed":         "the album could not be moved",
+		"trash":               "Deleted photos",
+		"trash_item":          "%s, deleted on %s, can be restored until %s",
+		"trash_restore":       "Restore",
+		"trash_failed":        "the photo could not be deleted or restored",
+		"upload_infected":     "the file was rejected by the virus scan",
+		"date_layout":         "January 2, 2006",
+		"datetime_layout":     "January 2, 2006, 3:04 PM",
+		"thousands_separator": ",",
+		"decimal_separator":   ".",
+		"size_units":          "B KiB MiB GiB TiB PiB EiB",
+		"view_of":             "view of %s, without %s hidden photos",
+		"create_view":         "Create a view of the album",
+		"hide_photos":         "Hidden photos",
+		"content_mismatch":    "the content of the file does not match its type",
+		"download_blocked":    "the originals of this album cannot be downloaded",
+		"downloads":           "Download policies",
+		"download_original":   "originals",
+		"download_resized":    "resized only",
+		"download_view":       "view only",
+		"download_inherit":    "Inherit",
+		"settings_failed":     "the settings of the album could not be saved",
+		"files":               "Files",
+		"audio":               "Audio",
+		"upload_oversized":    "the photo is larger than the largest accepted dimension",
+		"replication_failed":  "the index could not be replicated",
+		"random_photo":        "Random photo",
+		"another_photo":       "Another one",
+		"on_this_day":         "On this day",
+		"year_ago":            "one year ago",
+		"years_ago":           "%d years ago",
+		"browse":              "Browse",
+	},
+	"fr": {
+		"title":               "Galilego, galerie web HTTP/2",
+		"content_of":          "Contenu de",
+		"navigation":          "Navigation :",
+		"slider_help":         "Utilisez les flèches pour naviguer. Cliquez sur une image pour télécharger la version originale.",
+		"index":               "Index",
+		"slideshow":           "Diaporama",
+		"no_images":           "Aucune image à afficher.",
+		"duplicates":          "Photos en double",
+		"exact_duplicates":    "Doublons exacts",
+		"near_duplicates":     "Photos similaires",
+		"none_found":          "Aucun trouvé.",
+		"duplicates_pending":  "Les doublons sont en cours de recherche, cette page se recharge jusqu'à ce qu'ils soient trouvés.",
+		"please_auth":         "veuillez vous authentifier",
+		"forbidden":           "accès refusé",
+		"too_many_requests":   "trop de requêtes",
+		"scan_failed":         "échec de l'analyse de la galerie",
+		"sprite_failed":       "échec de la génération de la planche de miniatures",
+		"old_http_title":      "Galilego est une galerie web HTTP/2.",
+		"old_http_body":       `Malheureusement, vous n'utilisez <b>pas</b> HTTP/2. Pour cela, téléchargez et installez la dernière version de Firefox depuis <a href="https://www.mozilla.org">https://www.mozilla.org</a>.`,
+		"audit_disabled":      "le journal d'audit n'est pas activé",
+		"audit_read_failed":   "échec de la lecture du journal d'audit",
+		"audit_invalid_since": "paramètre since invalide, horodatage RFC3339 attendu",
+		"audit_invalid_limit": "paramètre limit invalide",
+		"password":            "Mot de passe :",
+		"dropbox_title":       "Partagez vos photos dans",
+		"dropbox_limits":      "Les fichiers de %s maximum sont acceptés, de types %s. Les photos sont publiées après validation.",
+		"upload":              "Envoyer",
+		"upload_invalid":      "L'envoi est invalide ou trop volumineux.",
+		"invalid_password":    "Mot de passe invalide.",
+		"dropbox_full":        "Cette boîte de dépôt est pleine, aucune photo supplémentaire ne peut être acceptée.",
+		"upload_failed":       "échec de l'enregistrement des fichiers envoyés",
+		"upload_done":         "%s photos reçues, merci !",
+		"upload_rejected":     "Fichiers refusés :",
+		"review_queue":        "Photos en attente de validation",
+		"publish":             "Publier",
+		"reject":              "Refuser",
+		"review_failed":       "échec de la validation du fichier",
+		"album_not_found":     "album introuvable",
+		"over_quota":          "envoi refusé : quota de stockage dépassé, %s utilisés sur %s",
+		"upload_exists":       "un fichier du même nom existe déjà dans l'album",
+		"upload_busy":         "l'envoi est déjà en cours d'écriture par une autre requête",
+		"upload_bad_offset":   "la position ne correspond pas aux données reçues",
+		"upload_bad_checksum": "les données ne correspondent pas à leur somme de contrôle",
+		"tus_version":         "version du protocole tus non prise en charge",
+		"timeline":            "Chronologie",
+		"month_1":             "janvier",
+		"month_2":             "février",
+		"month_3":             "mars",
+		"month_4":             "avril",
+		"month_5":             "mai",
+		"month_6":             "juin",
+		"month_7":             "juillet",
+		"month_8":             "août",
+		"month_9":             "septembre",
+		"month_10":            "octobre",
+		"month_11":            "novembre",
+		"month_12":            "décembre",
+		"not_found":           "page introuvable",
+		"image_failed":        "échec du traitement de l'image",
+		"back_home":           "Retour à la galerie",
+		"tags":                "Mots-clés",
+		"tagged":              "Photos avec le mot-clé",
+		"no_tags":             "aucune photo avec mot-clé",
+		"add_tags":            "Ajouter aux photos sélectionnées",
+		"remove_tags":         "Retirer des photos sélectionnées",
+		"tag_failed":          "échec de l'enregistrement des mots-clés",
+		"invalid_request":     "requête invalide",
+		"edit_rotate-left":    "Pivoter à gauche",
+		"edit_rotate-right":   "Pivoter à droite",
+		"edit_reset":          "Annuler les retouches",
+		"edit_crop_region":    "Garder x, y, largeur, hauteur (%) :",
+		"edit_crop":           "Recadrer",
+		"edit_failed":         "échec de l'enregistrement de la retouche",
+		"export_album":        "Retour à l'album",
+		"download_raw":        "Télécharger le RAW",
+		"download_video":      "Télécharger la vidéo",
+		"download_heif":       "Télécharger le HEIF",
+		"render_failed":       "échec de l'affichage de la page",
+		"metadata_failed":     "échec de l'enregistrement des métadonnées",
+		"remote_failed":       "galerie distante injoignable",
+		"shuffle":             "Ordre aléatoire",
+		"documents":           "Documents",
+		"notify_subject":      "Nouvelles photos dans %s",
+		"notify_body":         "%d nouvelles photos ont été ajoutées à l'album %s :",
+		"digest_subject":      "Nouvelles photos dans la galerie",
+		"digest_intro":        "%s nouvelles photos ont été ajoutées à la galerie",
+		"digest_more":         "et %s autres photos",
+		"places":              "Lieux",
+		"no_places":           "aucune photo avec un lieu",
+		"photos_in":           "Photos prises à",
+		"search":              "Rechercher",
+		"demo_banner":         "Ceci est une galerie de démonstration, avec des photos d'exemple.",
+		"archives":            "Albums archivés",
+		"archive":             "Archiver",
+		"unarchive":           "Désarchiver",
+		"verify":              "Vérifier",
+		"archive_files":       "%s fichiers",
+		"archive_unchecked":   "pas encore vérifié",
+		"archive_intact":      "intact le %s",
+		"archive_damaged":     "endommagé le %s : %d fichiers manquants, %d modifiés et %d ajoutés",
+		"archive_failed":      "l'album n'a pas pu être archivé ou vérifié",
+		"album_archived":      "cet album est archivé et en lecture seule",
+		"api_tokens":          "Jetons d'API",
+		"create":              "Créer",
+		"revoke":              "Révoquer",
+		"token_created":       "Nouveau jeton, copiez-le maintenant car il ne sera plus affiché :",
+		"token_scope":         "la portée de ce jeton ne permet pas cette requête",
+		"token_failed":        "le jeton n'a pas pu être créé ou révoqué",
+		"profile":             "Profil de",
+		"display_name":        "Nom affiché :",
+		"theme":               "Thème :",
+		"theme_light":         "Clair",
+		"theme_dark":          "Sombre",
+		"sort_order":          "Ordre des photos :",
+		"sort_name":           "Par nom",
+		"sort_date":           "Par date",
+		"sort_shuffle":        "Aléatoire",
+		"slide_seconds":       "Secondes par photo :",
+		"save":                "Enregistrer",
+		"change_password":     "Changer de mot de passe",
+		"current_password":    "Mot de passe actuel :",
+		"new_password":        "Nouveau mot de passe :",
+		"confirm_password":    "Confirmez le nouveau mot de passe :",
+		"profile_saved":       "Vos préférences ont été enregistrées.",
+		"profile_failed":      "le profil n'a pas pu être enregistré",
+		"wrong_password":      "Le mot de passe actuel est invalide.",
+		"password_too_short":  "Le nouveau mot de passe doit comporter au moins %d caractères.",
+		"password_mismatch":   "Les nouveaux mots de passe ne correspondent pas.",
+		"password_changed":    "Votre mot de passe a été changé.",
+		"csrf_failed":         "le formulaire a expiré, rechargez la page et réessayez",
+		"virtual_albums":      "Albums virtuels",
+		"configured":          "configuration",
+		"remove":              "Supprimer",
+		"invalid_search":      "recherche invalide, voir la syntaxe des albums virtuels",
+		"virtual_failed":      "l'album virtuel n'a pas pu être créé ou supprimé",
+		"queue_full":          "trop d'images sont en cours de redimensionnement, réessayez plus tard",
+		"streams_busy":        "trop de téléchargements sont en cours, réessayez plus tard",
+		"unshuffle":           "Trier par nom",
+		"shuffle_link":        "Lien vers cet ordre",
+		"image_too_large":     "image trop grande pour être redimensionnée, téléchargez l'original",
+		"home_layout":         "Albums de la page d'accueil",
+		"album_order":         "Ordre des albums :",
+		"sort_newest":         "Photos récentes d'abord",
+		"pinned":              "épinglé",
+		"hidden":              "masqué",
+		"pin":                 "Épingler",
+		"unpin":               "Désépingler",
+		"hide":                "Masquer",
+		"show":                "Afficher",
+		"home_failed":         "les albums de la page d'accueil n'ont pas pu être organisés",
+		"rate_stars":          "%d étoiles",
+		"clear_rating":        "Effacer",
+		"average_rating":      "moyenne : %d/5",
+		"offline":             "Vous êtes hors ligne, et cette page n'a pas encore été consultée",
+		"share_photos":        "%s photos",
+		"preview_failed":      "l'aperçu de l'album n'a pas pu être généré",
+		"rescan":              "Réindexation",
+		"rescan_thumbnails":   "générer les miniatures manquantes",
+		"start_rescan":        "Démarrer",
+		"cancel_rescan":       "Annuler",
+		"scan_running":        "en cours",
+		"scan_canceled":       "annulée",
+		"scan_finished":       "terminée en %s",
+		"files_scanned":       "images parcourues",
+		"files_indexed":       "images indexées",
+		"files_removed":       "images retirées",
+		"thumbs_generated":    "miniatures générées",
+		"scan_errors":         "erreurs",
+		"no_scan":             "aucune réindexation en cours",
+		"scan_busy":           "une réindexation est déjà en cours",
+		"format_not_allowed":  "ce format d'image n'est pas disponible",
+		"download_zip":        "Télécharger en ZIP",
+		"add_favorites":       "Ajouter aux favoris",
+		"remove_favorites":    "Retirer des favoris",
+		"share_selection":     "Partager la sélection",
+		"favorites":           "Favoris",
+		"empty_selection":     "aucune photo n'est sélectionnée",
+		"selection_of":        "sélection de %s photos, expire le %s",
+		"setup_title":         "Installation de galilego",
+		"setup_intro":         "Il n'y a pas encore de fichier de configuration %s. Cet assistant le crée, puis galilego démarre avec.",
+		"setup_root":          "Répertoire de galilego, dont le sous-répertoire gallery contient les albums :",
+		"setup_host":          "Nom d'hôte :",
+		"setup_listen":        "Adresse d'écoute :",
+		"setup_admin":         "Nom de l'administrateur :",
+		"setup_password":      "Mot de passe :",
+		"setup_tls":           "Certificat TLS :",
+		"tls_selfsigned":      "Générer un certificat auto-signé",
+		"tls_acme":            "Utiliser le certificat de certbot, ou d'un autre client ACME",
+		"tls_files":           "Utiliser les fichiers du certificat et de la clé :",
+		"setup_create":        "Créer la configuration",
+		"setup_missing":       "Le répertoire, le nom d'hôte et le certificat TLS sont requis.",
+		"setup_bad_listen":    "L'adresse d'écoute doit être un hôte et un port, comme 0.0.0.0:8064.",
+		"setup_bad_username":  "Le nom ne peut contenir que des lettres, des chiffres et . _ @ -",
+		"setup_bad_cert":      "Le certificat ne peut pas être chargé : %v",
+		"setup_failed":        "La configuration n'a pas pu être créée : %v",
+		"setup_done":          "La configuration a été écrite dans %s.",
+		"setup_starting":      "galilego démarre, et servira la galerie sur %s.",
+		"setup_acme":          "Obtenez le certificat de %s, par exemple avec %s, puis démarrez galilego à nouveau.",
+		"activity_of":         "Activité de %s",
+		"activity_photos":     "%s nouvelles photos dans %s",
+		"activity_rating":     "%s a noté %s de %d étoiles",
+		"activity_failed":     "Échec de la lecture de l'activité de l'album",
+		"move_albums":         "Déplacer des albums",
+		"move_album":          "Déplacer",
+		"merge_albums":        "fusionner avec un album existant",
+		"merge_collisions":    "%d fichiers de l'album existent déjà dans l'album de destination",
+		"album_exists":        "l'album de destination existe déjà",
+		"move_failed":         "l'album n'a pas pu être déplacé",
+		"trash":               "Photos supprimées",
+		"trash_item":          "%s, supprimée le %s, peut être restaurée jusqu'au %s",
+		"trash_restore":       "Restaurer",
+		"trash_failed":        "la photo n'a pas pu être supprimée ou restaurée",
+		"upload_infected":     "le fichier a été rejeté par l'antivirus",
+		"date_layout":         "2 January 2006",
+		"datetime_layout":     "2 January 2006 à 15:04",
+		"thousands_separator": "\u202f",
+		"decimal_separator":   ",",
+		"size_units":          "o Kio Mio Gio Tio Pio Eio",
+		"view_of":             "vue de %s, sans %s photos masquées",
+		"create_view":         "Créer une vue de l'album",
+		"hide_photos":         "Photos masquées",
+		"content_mismatch":    "le contenu du fichier ne correspond pas à son type",
+		"download_blocked":    "les originaux de cet album ne peuvent pas être téléchargés",
+		"downloads":           "Politiques de téléchargement",
+		"download_original":   "originaux",
+		"download_resized":    "redimensionnées seulement",
+		"download_view":       "consultation seule",
+		"download_inherit":    "Hériter",
+		"settings_failed":     "les réglages de l'album n'ont pas pu être enregistrés",
+		"files":               "Fichiers",
+		"audio":               "Audio",
+		"upload_oversized":    "la photo dépasse la plus grande dimension acceptée",
+		"replication_failed":  "l'index n'a pas pu être répliqué",
+		"random_photo":        "Photo au hasard",
+		"another_photo":       "Une autre",
+		"on_this_day":         "Ce jour-là",
+		"year_ago":            "il y a un an",
+		"years_ago":           "il y a %d ans",
+		"browse":              "Parcourir",
+	},
+}
+
+// tr returns the message identified by key in the given locale, falling back
+// to the default locale, then to the key itself
+func tr(locale, key string) string {
+	if msg, ok := catalogs[locale][key]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[defaultLocale][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// formatDate returns the date of t in the given locale, such as
+// "July 14, 2019" or "14 juillet 2019", followed by the time of day if
+// withTime is set, or nothing if t is zero
+func formatDate(locale string, t time.Time, withTime bool) string {
+	if t.IsZero() {
+		return ""
+	}
+	layout := tr(locale, "date_layout")
+	if withTime {
+		layout = tr(locale, "datetime_layout")
+	}
+	// layouts spell months in english, which are then translated
+	return strings.Replace(t.Format(layout), t.Month().String(), tr(locale, "month_"+strconv.Itoa(int(t.Month()))), 1)
+}
+
+// formatCount returns n with the thousands separator of the locale, such
+// as "12,345" or "12 345"
+func formatCount(locale string, n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	sep := tr(locale, "thousands_separator")
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + sep + digits[i:]
+	}
+	return sign + digits
+}
+
+// formatSize returns a number of bytes with a binary unit of the locale,
+// such as "1.5 MiB" or "1,5 Mio"
+func formatSize(locale string, n int64) string {
+	units := strings.Fields(tr(locale, "size_units"))
+	if n < 1024 {
+		return formatCount(locale, n) + " " + units[0]
+	}
+	size, exp := float64(n)/1024, 1
+	for ; size >= 1024 && exp < len(units)-1; exp++ {
+		size /= 1024
+	}
+	return strings.Replace(strconv.FormatFloat(size, 'f', 1, 64), ".", tr(locale, "decimal_separator"), 1) + " " + units[exp]
+}
+
+// requestLocale returns the locale used to respond to a request: the locale
+// set in the configuration if any, otherwise the preferred supported
+// language listed in the Accept-Language header of the client
+func requestLocale(r *http.Request) string {
+	if _, ok := catalogs[conf.Locale]; ok {
+		return conf.Locale
+	}
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// negotiateLocale parses an Accept-Language header such as
+// "fr-CH, fr;q=0.9, en;q=0.8" and returns the supported locale with the
+// highest quality value
+func negotiateLocale(header string) string {
+	type langq struct {
+		lang string
+		q    float64
+	}
+	var prefs []langq
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// only the primary language subtag is matched against catalogs
+		if i := strings.Index(lang, "-"); i > 0 {
+			lang = lang[:i]
+		}
+		prefs = append(prefs, langq{lang, q})
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, pref := range prefs {
+		if _, ok := catalogs[pref.lang]; ok && pref.q > 0 {
+			return pref.lang
+		}
+	}
+	return defaultLocale
+}
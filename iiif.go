@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+)
+
+const (
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	// iiifTileSize is the size of the tiles viewers request, at every
+	// scale factor
+	iiifTileSize = 512
+)
+
+// iiifQualities are the qualities of the IIIF Image API, color being the
+// default one
+var iiifQualities = map[string]bool{"default": true, "color": true, "gray": true, "bitonal": true}
+
+// iiifRequest is an image request of the IIIF Image API, such as
+// /iiif/3/album%2Fphoto.jpg/full/max/0/default.jpg. Its region and size are
+// in pixels of the photo as displayed, with its edits applied.
+type iiifRequest struct {
+	region        image.Rectangle
+	width, height int
+	mirror        bool
+	rotation      int
+	quality       string
+	// format is the name of one of outputFormats
+	format string
+}
+
+// version identifies the request in cache keys. Requests that produce the
+// same image, such as those for the full region and its coordinates, share
+// it.
+func (q iiifRequest) version() string {
+	mirror := ""
+	if q.mirror {
+		mirror = "m"
+	}
+	return fmt.Sprintf("iiif_%d,%d,%d,%d_%dx%d_%s%d_%s", q.region.Min.X, q.region.Min.Y, q.region.Dx(), q.region.Dy(),
+		q.width, q.height, mirror, q.rotation, q.quality)
+}
+
+// iiifPath returns the path of the image of an IIIF identifier, the url
+// escaped path of a photo in the gallery, and false if there is no such
+// image. The photos whose originals cannot be downloaded are left out, as
+// viewers load them at full size.
+func iiifPath(id string) (string, bool) {
+	galpath := filepath.Join("gallery", filepath.Clean("/"+id))
+	if !isImage(galpath) || isDocument(galpath) {
+		return "", false
+	}
+	// image requests also look like paths, the policy is only read for
+	// the photos that exist
+	if fi, err := os.Stat(galpath); err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	return galpath, downloadPolicy(galpath).originals()
+}
+
+// iiifID returns the url of the image service of the photo at galpath
+func iiifID(galpath string) string {
+	return "https://" + conf.Host + link("/iiif/3/"+url.PathEscape(strings.TrimPrefix(filepath.ToSlash(galpath), "gallery/")))
+}
+
+// iiifSize returns the size of the photo at galpath as displayed, with its
+// edits applied
+func iiifSize(galpath string) (width, height int, err error) {
+	fd, err := os.Open(galpath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+	cfg, _, err := image.DecodeConfig(fd)
+	if err != nil {
+		return 0, 0, err
+	}
+	width, height = readEdit(galpath).size(cfg.Width, cfg.Height)
+	return width, height, nil
+}
+
+// serveIIIF implements the IIIF Image API 3.0 on the photos of the gallery,
+// so IIIF viewers can show them. The galpath route variable is the
+// identifier of a photo followed by the parameters of an image request, or
+// by info.json for its image information. Identifiers alone are redirected
+// to their image information.
+func serveIIIF(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	rest := mux.Vars(r)["galpath"]
+	if _, ok := iiifPath(rest); ok {
+		http.Redirect(w, r, link("/iiif/3/"+url.PathEscape(rest)+"/info.json"), http.StatusSeeOther)
+		return
+	}
+	if id := strings.TrimSuffix(rest, "/info.json"); id != rest {
+		iiifInfo(w, r, id)
+		return
+	}
+	params := strings.Split(rest, "/")
+	if len(params) < 5 {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	iiifImage(w, r, strings.Join(params[:len(params)-4], "/"), params[len(params)-4:])
+}
+
+// iiifInfo returns the image information of the photo of an identifier,
+// which tells viewers its size and the features of the image requests
+func iiifInfo(w http.ResponseWriter, r *http.Request, id string) {
+	galpath, ok := iiifPath(id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	width, height, err := iiifSize(galpath)
+	if err != nil {
+		logErrorf("iiif: failed to read the size of %q: %v", galpath, err)
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	// viewers zoom out by halving the size of the photo until it fits in
+	// a tile
+	var scaleFactors []int
+	for sf := 1; ; sf *= 2 {
+		scaleFactors = append(scaleFactors, sf)
+		if width/sf <= iiifTileSize && height/sf <= iiifTileSize {
+			break
+		}
+	}
+	var formats []string
+	for name := range allowedFormats {
+		if name != "jpeg" {
+			formats = append(formats, strings.TrimPrefix(outputFormats[name].ext, "."))
+		}
+	}
+	sort.Strings(formats)
+	info := map[string]interface{}{
+		"@context": iiifContext,
+		"id":       iiifID(galpath),
+		"type":     "ImageService3",
+		"protocol": iiifProtocol,
+		"profile":  iiifProfile(),
+		"width":    width,
+		"height":   height,
+		"maxArea":  int64(maxPixels()),
+		"tiles": []map[string]interface{}{
+			{"width": iiifTileSize, "scaleFactors": scaleFactors},
+		},
+		"extraQualities": []string{"color", "gray", "bitonal"},
+		"extraFeatures": []string{"baseUriRedirect", "cors", "jsonldMediaType", "mirroring",
+			"regionByPct", "regionByPx", "regionSquare", "rotationBy90s", "sizeByConfinedWh",
+			"sizeByH", "sizeByPct", "sizeByW", "sizeByWh", "sizeUpscaling"},
+	}
+	if len(formats) > 0 {
+		info["extraFormats"] = formats
+	}
+	ctype := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		ctype = `application/ld+json;profile="` + iiifContext + `"`
+	}
+	conf.Caching.API.setHeaders(w)
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Link", `<`+iiifProtocol+`/3/`+iiifProfile()+`.json>;rel="profile"`)
+	json.NewEncoder(w).Encode(info)
+}
+
+// iiifProfile returns the compliance level of the image requests, which is
+// level 2 when png images can be requested
+func iiifProfile() string {
+	if allowedFormats["png"] {
+		return "level2"
+	}
+	return "level1"
+}
+
+// iiifImage returns the image of the photo of an identifier that is
+// described by the region, size, rotation and quality.format parameters,
+// resized through the queue like the thumbnails
+func iiifImage(w http.ResponseWriter, r *http.Request, id string, params []string) {
+	galpath, ok := iiifPath(id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	width, height, err := iiifSize(galpath)
+	if err != nil {
+		logErrorf("iiif: failed to read the size of %q: %v", galpath, err)
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	q, err := parseIIIF(params, width, height)
+	if err != nil {
+		logWarnf("iiif: invalid request for %q: %v", galpath, err)
+		if err == errFormatNotAllowed {
+			writeError(w, r, http.StatusBadRequest, "format_not_allowed")
+		} else {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+		}
+		return
+	}
+	img := Image{
+		ctx:        r.Context(),
+		path:       galpath,
+		iiif:       &q,
+		returnchan: make(chan Image),
+	}
+	defer close(img.returnchan)
+	if !queueImage(img) {
+		logWarnf("resize queue is full, refusing %s", galpath)
+		queueFull(w, r)
+		return
+	}
+	img = <-img.returnchan
+	if errors.Is(img.err, context.Canceled) {
+		logDebugf("request for %s canceled while queued", galpath)
+		return
+	}
+	if img.err != nil {
+		logErrorf("iiif: failed to render %q: %v", galpath, img.err)
+		if errors.Is(img.err, errImageTooLarge) {
+			writeError(w, r, http.StatusUnprocessableEntity, "image_too_large")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, "image_failed")
+		}
+		return
+	}
+	defer img.fd.Close()
+	w.Header().Set("Content-Type", outputFormats[q.format].ctype)
+	w.Header().Set("Link", `<`+iiifProtocol+`/3/`+iiifProfile()+`.json>;rel="profile"`)
+	conf.Caching.Thumbnails.setHeaders(w)
+	http.ServeContent(w, r, galpath, img.modtime, img.fd)
+	// the full region at full size is the original, in another encoding
+	if q.region == image.Rect(0, 0, width, height) && q.width >= width && q.height >= height {
+		recordDownload(r, galpath)
+	}
+}
+
+var errFormatNotAllowed = errors.New("format not allowed")
+
+// parseIIIF parses the region, size, rotation and quality.format
+// parameters of an image request on a photo of width by height pixels
+func parseIIIF(params []string, width, height int) (q iiifRequest, err error) {
+	if q.region, err = parseIIIFRegion(params[0], width, height); err != nil {
+		return q, err
+	}
+	if q.width, q.height, err = parseIIIFSize(params[1], q.region.Dx(), q.region.Dy()); err != nil {
+		return q, err
+	}
+	rotation := params[2]
+	if strings.HasPrefix(rotation, "!") {
+		q.mirror, rotation = true, rotation[1:]
+	}
+	degrees, err := strconv.ParseFloat(rotation, 64)
+	if err != nil || degrees < 0 || degrees > 360 || math.Mod(degrees, 90) != 0 {
+		return q, fmt.Errorf("invalid or unsupported rotation %q", params[2])
+	}
+	q.rotation = int(degrees) % 360
+	i := strings.LastIndex(params[3], ".")
+	if i < 0 {
+		return q, fmt.Errorf("missing format in %q", params[3])
+	}
+	q.quality = params[3][:i]
+	if !iiifQualities[q.quality] {
+		return q, fmt.Errorf("invalid quality %q", q.quality)
+	}
+	if q.quality == "color" {
+		q.quality = "default"
+	}
+	q.format = params[3][i+1:]
+	if q.format == "jpg" {
+		q.format = "jpeg"
+	}
+	if !allowedFormats[q.format] {
+		return q, errFormatNotAllowed
+	}
+	return q, nil
+}
+
+// parseIIIFRegion parses the region of an image request: full, square,
+// x,y,w,h in pixels or pct:x,y,w,h in percents. Regions that extend beyond
+// the photo are cut to it.
+func parseIIIFRegion(s string, width, height int) (image.Rectangle, error) {
+	full := image.Rect(0, 0, width, height)
+	switch s {
+	case "full":
+		return full, nil
+	case "square":
+		side := width
+		if height < side {
+			side = height
+		}
+		x, y := (width-side)/2, (height-side)/2
+		return image.Rect(x, y, x+side, y+side), nil
+	}
+	pct := strings.HasPrefix(s, "pct:")
+	values := strings.Split(strings.TrimPrefix(s, "pct:"), ",")
+	if len(values) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q", s)
+	}
+	var v [4]float64
+	for i, value := range values {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || (!pct && f != math.Trunc(f)) {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q", s)
+		}
+		v[i] = f
+	}
+	if pct {
+		v[0], v[2] = v[0]*float64(width)/100, v[2]*float64(width)/100
+		v[1], v[3] = v[1]*float64(height)/100, v[3]*float64(height)/100
+	}
+	rect := image.Rect(int(math.Round(v[0])), int(math.Round(v[1])),
+		int(math.Round(v[0]+v[2])), int(math.Round(v[1]+v[3]))).Intersect(full)
+	if rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("region %q is outside of the image", s)
+	}
+	return rect, nil
+}
+
+// parseIIIFSize parses the size of an image request, for a region of width
+// by height pixels: max, w,h w, ,h !w,h or pct:n, prefixed with ^ to allow
+// sizes larger than the region. Sizes are limited by the maximum number of
+// pixels of decoded images.
+func parseIIIFSize(s string, width, height int) (int, int, error) {
+	upscale := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+	var w, h float64
+	switch {
+	case s == "max":
+		w, h = float64(width), float64(height)
+		if area := w * h; area > maxPixels() {
+			ratio := math.Sqrt(maxPixels() / area)
+			w, h = w*ratio, h*ratio
+		}
+	case strings.HasPrefix(s, "pct:"):
+		n, err := strconv.ParseFloat(s[4:], 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid size %q", s)
+		}
+		w, h = float64(width)*n/100, float64(height)*n/100
+	default:
+		confined := strings.HasPrefix(s, "!")
+		values := strings.Split(strings.TrimPrefix(s, "!"), ",")
+		if len(values) != 2 || (confined && (values[0] == "" || values[1] == "")) {
+			return 0, 0, fmt.Errorf("invalid size %q", s)
+		}
+		var v [2]float64
+		for i, value := range values {
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return 0, 0, fmt.Errorf("invalid size %q", s)
+			}
+			v[i] = float64(n)
+		}
+		switch {
+		case confined:
+			ratio := math.Min(v[0]/float64(width), v[1]/float64(height))
+			w, h = float64(width)*ratio, float64(height)*ratio
+		case v[0] == 0 && v[1] == 0:
+			return 0, 0, fmt.Errorf("invalid size %q", s)
+		case v[1] == 0:
+			w, h = v[0], float64(height)*v[0]/float64(width)
+		case v[0] == 0:
+			w, h = float64(width)*v[1]/float64(height), v[1]
+		default:
+			w, h = v[0], v[1]
+		}
+	}
+	iw, ih := int(math.Round(w)), int(math.Round(h))
+	if iw < 1 || ih < 1 {
+		return 0, 0, fmt.Errorf("size %q is empty", s)
+	}
+	if !upscale && (iw > width || ih > height) {
+		return 0, 0, fmt.Errorf("size %q is larger than the region without ^", s)
+	}
+	if float64(iw)*float64(ih) > maxPixels() {
+		return 0, 0, fmt.Errorf("size %q exceeds the maximum area", s)
+	}
+	return iw, ih, nil
+}
+
+// IIIF returns the image of an IIIF image request on the photo at path, and
+// the time it was generated. Images are cached like resized versions.
+func (s *ImageService) IIIF(ctx context.Context, path string, q iiifRequest) (cachedFile, time.Time, error) {
+	edit := readEdit(path)
+	hash, err := contentHash(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	version := q.version()
+	if v := edit.version(); v != "" {
+		version += "_e" + v
+	}
+	key := thumbnailKey(hash, version, outputFormats[q.format].ext)
+	fd, modtime, err := s.cache.get(key)
+	if err == nil {
+		logDebugf("iiif: %s found in the cache", key)
+		return fd, modtime, nil
+	}
+	if !os.IsNotExist(err) {
+		logErrorf("cache: failed to read %q: %v", key, err)
+	}
+	start := time.Now()
+	data, err := renderIIIF(ctx, path, q, edit)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	logDebugf("iiif: rendered %s from %s in %s, %d bytes", key, path, time.Since(start), len(data))
+	if err := s.cache.put(key, data); err != nil {
+		logErrorf("cache: failed to store %q: %v", key, err)
+	}
+	return memFile{bytes.NewReader(data)}, time.Now(), nil
+}
+
+// renderIIIF applies an image request to the photo at path in pure Go: the
+// edits of the photo are applied first, then the region is cut, resized,
+// mirrored, rotated and converted to the quality of the request
+func renderIIIF(ctx context.Context, path string, q iiifRequest, edit photoEdit) ([]byte, error) {
+	original, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+	if err = checkImageLimits(original); err != nil {
+		return nil, err
+	}
+	decodeOp := startOp("decode", path)
+	src, _, err := image.Decode(ctxReader{ctx: ctx, r: original})
+	if err != nil {
+		return nil, err
+	}
+	decodeOp.done(src.Bounds())
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	src = edit.rotateImage(edit.cropImage(src))
+
+	resizeOp := startOp("resize", path)
+	m := subImage(src, q.region.Add(src.Bounds().Min))
+	if b := m.Bounds(); b.Dx() != q.width || b.Dy() != q.height {
+		m = resize.Resize(uint(q.width), uint(q.height), m, resize.NearestNeighbor)
+	}
+	if q.mirror {
+		m = mirrorImage(m)
+	}
+	m = photoEdit{Rotate: q.rotation}.rotateImage(m)
+	switch q.quality {
+	case "gray", "bitonal":
+		b := m.Bounds()
+		gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(gray, gray.Bounds(), m, b.Min, draw.Src)
+		if q.quality == "bitonal" {
+			for i, y := range gray.Pix {
+				if y < 128 {
+					gray.Pix[i] = 0
+				} else {
+					gray.Pix[i] = 255
+				}
+			}
+		}
+		m = gray
+	}
+	resizeOp.done(src.Bounds())
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return encodeImage(ctx, path, m, q.format)
+}
+
+// mirrorImage returns img flipped horizontally
+func mirrorImage(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(b.Dx()-1-x, y, color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ImageService returns the images of the gallery, either as is or resized.
+// Resized versions are looked up in the memory cache for small thumbnails,
+// then in the cache backend, and are generated by the image backend when
+// neither has them.
+type ImageService struct {
+	cache     cacheBackend
+	processor imageBackend
+	// memory keeps the small thumbnails, see inMemory, it is optional
+	memory *memoryCache
+}
+
+// images is the image service of the configured backends
+var images *ImageService
+
+// newImageService returns an image service storing resized images in cache,
+// and generating them with processor
+func newImageService(cache cacheBackend, processor imageBackend, memory *memoryCache) *ImageService {
+	return &ImageService{cache: cache, processor: processor, memory: memory}
+}
+
+// Original returns the file at path, and the time it was last modified
+func (s *ImageService) Original(path string) (cachedFile, time.Time, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, time.Time{}, err
+	}
+	return fd, fi.ModTime(), nil
+}
+
+// Resized returns the photo at path resized to width pixels, or cut to a
+// square of width pixels if crop is set, fitting in the box of its aspect
+// otherwise, encoded in format, jpeg if it is empty, and the time it was
+// generated
+func (s *ImageService) Resized(ctx context.Context, path string, width uint, crop string, a aspect, format string) (cachedFile, time.Time, error) {
+	key, edit, err := s.key(path, width, crop, a, format)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// small thumbnails are served from memory, without opening a file
+	// for each request
+	small := s.memory != nil && inMemory(width)
+	if small {
+		if data, modtime, ok := s.memory.get(key); ok {
+			logDebugf("image: %s found in the memory cache", key)
+			return memFile{bytes.NewReader(data)}, modtime, nil
+		}
+	}
+	fd, modtime, err := s.cache.get(key)
+	if err == nil {
+		logDebugf("image: %s found in the cache", key)
+		if !small {
+			return fd, modtime, nil
+		}
+		data, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		s.memory.put(key, data, modtime)
+		return memFile{bytes.NewReader(data)}, modtime, nil
+	}
+	if !os.IsNotExist(err) {
+		logErrorf("cache: failed to read %q: %v", key, err)
+	}
+	if streamed(width, format) {
+		return s.stream(ctx, key, path, width, crop, a, format, edit)
+	}
+	start := time.Now()
+	data, err := s.generate(ctx, path, width, crop, a, format, edit)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	logDebugf("image: generated %s from %s in %s, %d bytes", key, path, time.Since(start), len(data))
+	// a failure to store the image in the cache does not prevent
+	// returning it
+	if err := s.cache.put(key, data); err != nil {
+		logErrorf("cache: failed to store %q: %v", key, err)
+	}
+	modtime = time.Now()
+	if small {
+		s.memory.put(key, data, modtime)
+	}
+	return memFile{bytes.NewReader(data)}, modtime, nil
+}
+
+// key returns the key of the cache entry of a resized version of the photo
+// at path, and the edits applied to it
+func (s *ImageService) key(path string, width uint, crop string, a aspect, format string) (string, photoEdit, error) {
+	// photos edited from the web ui are cropped before resizing and
+	// rotated after
+	edit := readEdit(path)
+	// versions are cached under the hash of the original, along with
+	// their size, crop, aspect, enhancement and edits, and the extension
+	// of their format
+	hash, err := contentHash(path)
+	if err != nil {
+		return "", edit, err
+	}
+	version := strconv.Itoa(int(width))
+	if crop != "" {
+		version += "_" + crop
+	} else if v := a.version(); v != "" {
+		version += "_" + v
+	}
+	if v := a.enhance.version(); v != "" {
+		version += "_" + v
+	}
+	if v := edit.version(); v != "" {
+		version += "_e" + v
+	}
+	ext := ".jpg"
+	if f, ok := outputFormats[format]; ok {
+		ext = f.ext
+	}
+	return thumbnailKey(hash, version, ext), edit, nil
+}
+
+// Cached returns true if the resized version of the photo at path is in the
+// memory cache or in the cache backend
+func (s *ImageService) Cached(path string, width uint, crop string, a aspect, format string) bool {
+	key, _, err := s.key(path, width, crop, a, format)
+	if err != nil {
+		return false
+	}
+	if s.memory != nil && inMemory(width) {
+		if _, _, ok := s.memory.get(key); ok {
+			return true
+		}
+	}
+	fd, _, err := s.cache.get(key)
+	if err != nil {
+		return false
+	}
+	fd.Close()
+	return true
+}
+
+// open opens the photo at path to resize it. Huge images are refused before
+// they are decoded.
+func (s *ImageService) open(path string) (*os.File, error) {
+	original, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkImageLimits(original); err != nil {
+		original.Close()
+		return nil, err
+	}
+	return original, nil
+}
+
+// generate resizes the photo at path with the image backend
+func (s *ImageService) generate(ctx context.Context, path string, width uint, crop string, a aspect, format string, edit photoEdit) ([]byte, error) {
+	original, err := s.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer original.Close()
+	var buf bytes.Buffer
+	err = s.processor.resize(ctx, &buf, path, original, width, crop, a, format, edit)
+	return buf.Bytes(), err
+}
+
+// stream resizes the photo at path in the background, and returns it while
+// it is encoded. It is stored in the cache once complete. The photo is
+// opened before, so missing and huge photos fail like the others.
+func (s *ImageService) stream(ctx context.Context, key, path string, width uint, crop string, a aspect, format string, edit photoEdit) (cachedFile, time.Time, error) {
+	original, err := s.open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	stream := newImageStream()
+	go func() {
+		defer original.Close()
+		start := time.Now()
+		stream.finish(s.processor.resize(ctx, stream, path, original, width, crop, a, format, edit))
+		data, err := stream.wait()
+		if err != nil {
+			if ctx.Err() == nil {
+				logErrorf("image: failed to generate %s from %s: %v", key, path, err)
+			}
+			return
+		}
+		logDebugf("image: streamed %s from %s in %s, %d bytes", key, path, time.Since(start), len(data))
+		if err := s.cache.put(key, data); err != nil {
+			logErrorf("cache: failed to store %q: %v", key, err)
+		}
+	}()
+	return &streamReader{stream: stream}, time.Now(), nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mapCache is a cache backend keeping its entries in a map
+type mapCache struct {
+	entries map[string][]byte
+	puts    int
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{entries: make(map[string][]byte)}
+}
+
+func (c *mapCache) get(key string) (cachedFile, time.Time, error) {
+	data, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	return memFile{bytes.NewReader(data)}, time.Unix(1600000000, 0), nil
+}
+
+func (c *mapCache) put(key string, data []byte) error {
+	c.puts++
+	c.entries[key] = data
+	return nil
+}
+
+func (c *mapCache) size(prefix string) int64 {
+	return 0
+}
+
+// fakeBackend is an image backend that writes the size it is asked for
+type fakeBackend struct {
+	calls int
+	err   error
+}
+
+func (b *fakeBackend) resize(ctx context.Context, w io.Writer, path string, original io.Reader, size uint, crop string, a aspect, format string, edit photoEdit) error {
+	b.calls++
+	if b.err != nil {
+		return b.err
+	}
+	_, err := fmt.Fprintf(w, "resized:%d", size)
+	return err
+}
+
+func newTestMemory() *memoryCache {
+	return &memoryCache{max: 1 << 20, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// writeTestImage writes a jpeg of 64x48 pixels to dir, and returns its path
+// and the hash of its content
+func writeTestImage(t *testing.T, dir, name string) (string, string) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 48)), nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return path, hex.EncodeToString(sum[:])
+}
+
+// useTestCache replaces the cache backend of the manifest, which records
+// the hashes of the files that are not indexed, for the test
+func useTestCache(t *testing.T) {
+	oldCache, oldManifest := imgCache, manifest
+	imgCache = newMapCache()
+	manifest = &cacheManifest{files: make(map[string]manifestEntry)}
+	t.Cleanup(func() {
+		imgCache, manifest = oldCache, oldManifest
+	})
+}
+
+func TestImageServiceKey(t *testing.T) {
+	useTestCache(t)
+	dir := t.TempDir()
+	path, hash := writeTestImage(t, dir, "photo.jpg")
+	prefix := thumbnailPrefix(hash)
+	tests := []struct {
+		name   string
+		width  uint
+		crop   string
+		a      aspect
+		format string
+		key    string
+	}{
+		{"default", 300, "", aspect{}, "", prefix + "300.jpg"},
+		{"jpeg", 300, "", aspect{}, "jpeg", prefix + "300.jpg"},
+		{"webp", 300, "", aspect{}, "webp", prefix + "300.webp"},
+		{"crop", 200, "smart", aspect{}, "", prefix + "200_smart.jpg"},
+		{"crop over aspect", 200, "center", aspect{mode: "fill", height: 100}, "", prefix + "200_center.jpg"},
+		{"box", 300, "", aspect{height: 200}, "", prefix + "300_fitx200.jpg"},
+		{"fill", 300, "", aspect{mode: "fill", height: 200, gravity: "north"}, "png", prefix + "300_fillx200_north.png"},
+	}
+	s := newImageService(newMapCache(), &fakeBackend{}, nil)
+	for _, tt := range tests {
+		key, _, err := s.key(path, tt.width, tt.crop, tt.a, tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if key != tt.key {
+			t.Errorf("%s: key = %q, want %q", tt.name, key, tt.key)
+		}
+	}
+	// copies of a photo share their resized versions
+	copied, _ := writeTestImage(t, dir, "copy.jpg")
+	a, _, _ := s.key(path, 300, "", aspect{}, "")
+	b, _, _ := s.key(copied, 300, "", aspect{}, "")
+	if a != b {
+		t.Errorf("copies have different keys %q and %q", a, b)
+	}
+	if _, _, err := s.key(filepath.Join(dir, "missing.jpg"), 300, "", aspect{}, ""); !os.IsNotExist(err) {
+		t.Errorf("missing photo: err = %v, want a not exist error", err)
+	}
+}
+
+func TestImageServiceOriginal(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeTestImage(t, dir, "photo.jpg")
+	want, _ := ioutil.ReadFile(path)
+	fi, _ := os.Stat(path)
+	s := newImageService(newMapCache(), &fakeBackend{}, nil)
+	tests := []struct {
+		name     string
+		path     string
+		notExist bool
+	}{
+		{"existing", path, false},
+		{"missing", filepath.Join(dir, "missing.jpg"), true},
+	}
+	for _, tt := range tests {
+		fd, modtime, err := s.Original(tt.path)
+		if tt.notExist {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: err = %v, want a not exist error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(fd)
+		fd.Close()
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: content differs from the file", tt.name)
+		}
+		if !modtime.Equal(fi.ModTime()) {
+			t.Errorf("%s: modtime = %v, want %v", tt.name, modtime, fi.ModTime())
+		}
+	}
+}
+
+func TestImageServiceResized(t *testing.T) {
+	useTestCache(t)
+	dir := t.TempDir()
+	path, _ := writeTestImage(t, dir, "photo.jpg")
+	errBackend := errors.New("backend failed")
+	tests := []struct {
+		name  string
+		width uint
+		// cached and inMemory are the contents of the cache backend
+		// and of the memory cache before the request
+		cached, inMemory string
+		limits           imageLimitsConf
+		maxFileSize      int64
+		backendErr       error
+		want             string
+		wantErr          error
+		// generated is true if the backend resizes the photo, and
+		// stored if the result is put in the cache backend
+		generated, stored, memorized bool
+	}{
+		{name: "generated", width: 600, want: "resized:600", generated: true, stored: true},
+		{name: "generated small", width: 200, want: "resized:200", generated: true, stored: true, memorized: true},
+		{name: "cache hit", width: 600, cached: "cached", want: "cached"},
+		{name: "cache hit small", width: 200, cached: "cached", want: "cached", memorized: true},
+		{name: "memory hit", width: 200, cached: "cached", inMemory: "memory", want: "memory", memorized: true},
+		{name: "max megapixels", width: 600, limits: imageLimitsConf{MaxMegapixels: 0.001}, wantErr: errImageTooLarge},
+		{name: "max dimension", width: 600, limits: imageLimitsConf{MaxDimension: 50}, wantErr: errImageTooLarge},
+		{name: "max file size", width: 600, maxFileSize: 10, wantErr: errImageTooLarge},
+		{name: "limits of cached versions", width: 600, cached: "cached", limits: imageLimitsConf{MaxDimension: 50}, want: "cached"},
+		{name: "backend error", width: 600, backendErr: errBackend, wantErr: errBackend, generated: true},
+	}
+	oldLimits, oldMaxFileSize := conf.ImageLimits, maxSourceFileSize
+	defer func() {
+		conf.ImageLimits, maxSourceFileSize = oldLimits, oldMaxFileSize
+	}()
+	for _, tt := range tests {
+		conf.ImageLimits, maxSourceFileSize = tt.limits, tt.maxFileSize
+		cache, backend, memory := newMapCache(), &fakeBackend{err: tt.backendErr}, newTestMemory()
+		s := newImageService(cache, backend, memory)
+		key, _, err := s.key(path, tt.width, "", aspect{}, "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.cached != "" {
+			cache.entries[key] = []byte(tt.cached)
+		}
+		if tt.inMemory != "" {
+			memory.put(key, []byte(tt.inMemory), time.Now())
+		}
+		fd, _, err := s.Resized(context.Background(), path, tt.width, "", aspect{}, "")
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else {
+			data, _ := ioutil.ReadAll(fd)
+			fd.Close()
+			if string(data) != tt.want {
+				t.Errorf("%s: got %q, want %q", tt.name, data, tt.want)
+			}
+		}
+		if generated := backend.calls > 0; generated != tt.generated {
+			t.Errorf("%s: generated = %v, want %v", tt.name, generated, tt.generated)
+		}
+		if stored := cache.puts > 0; stored != tt.stored {
+			t.Errorf("%s: stored = %v, want %v", tt.name, stored, tt.stored)
+		}
+		if _, _, memorized := memory.get(key); memorized != tt.memorized {
+			t.Errorf("%s: in memory = %v, want %v", tt.name, memorized, tt.memorized)
+		}
+		if tt.stored && !strings.HasPrefix(string(cache.entries[key]), "resized:") {
+			t.Errorf("%s: cache holds %q", tt.name, cache.entries[key])
+		}
+	}
+}
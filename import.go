@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importModes are the ways originals are imported into the gallery. Hard
+// links and reflinks share the data of the originals, so importing from a
+// mount of the same filesystem, such as a NAS share, does not duplicate
+// them on disk. Both fall back to copying when the source is on another
+// filesystem, or when the filesystem does not support them.
+var importModes = map[string]bool{"copy": true, "hardlink": true, "reflink": true}
+
+// importer imports the photos of a directory into an album of the gallery
+type importer struct {
+	mode string
+	// counts of the files imported by each method, and of those skipped
+	// because the album already has them
+	linked, cloned, copied, skipped int
+	// warned is set once the failure of the mode is logged, the
+	// following ones are only counted as copies
+	warned bool
+}
+
+// importable returns true if the file at path is an image, or the raw
+// version or video of a photo
+func importable(path string) bool {
+	return imgre.MatchString(path) || companionre.MatchString(path)
+}
+
+// importDir imports the files of src and of its sub directories into dst,
+// keeping their tree
+func (im *importer) importDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !fi.Mode().IsRegular() || !importable(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if existing, err := os.Stat(target); err == nil {
+			if !os.SameFile(existing, fi) && existing.Size() != fi.Size() {
+				logWarnf("import: skipping %q, %q already exists", path, target)
+			}
+			im.skipped++
+			return nil
+		}
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return im.importFile(path, target, fi)
+	})
+}
+
+// importFile imports the file at src to dst with the mode of the importer,
+// or by copying it if the mode fails
+func (im *importer) importFile(src, dst string, fi os.FileInfo) error {
+	var err error
+	switch im.mode {
+	case "hardlink":
+		if err = os.Link(src, dst); err == nil {
+			im.linked++
+			return nil
+		}
+	case "reflink":
+		if err = reflinkFile(src, dst); err == nil {
+			im.cloned++
+			return nil
+		}
+	}
+	if err != nil && !im.warned {
+		logWarnf("import: cannot %s %q, copying the files that cannot be linked: %v", im.mode, src, err)
+		im.warned = true
+	}
+	if err := copyFile(src, dst, fi); err != nil {
+		return err
+	}
+	im.copied++
+	return nil
+}
+
+// copyFile copies the file at src to dst, through a temporary file so the
+// gallery never indexes a partial copy, and keeps its modification time
+func copyFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".galilego-import"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// importCmd implements the `galilego import` subcommand, which imports the
+// photos of a directory into an album. The album is indexed by the next
+// scan of the gallery.
+func importCmd(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		root = fs.String("root", "gallery", "Root of the gallery tree")
+		mode = fs.String("mode", "copy", "How originals are imported: copy, hardlink or reflink")
+	)
+	fs.Parse(args)
+	if fs.NArg() != 2 || !importModes[*mode] {
+		fmt.Fprintf(os.Stderr, "usage: %s import [-root gallery] [-mode copy|hardlink|reflink] <dir> <album>\n", os.Args[0])
+		os.Exit(2)
+	}
+	src := fs.Arg(0)
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		log.Fatalf("import: %q is not a directory", src)
+	}
+	album := strings.Trim(filepath.Clean("/"+fs.Arg(1)), "/")
+	if album == "" {
+		log.Fatalf("import: missing album")
+	}
+	im := importer{mode: *mode}
+	if err := im.importDir(src, filepath.Join(*root, album)); err != nil {
+		log.Fatal(err)
+	}
+	logInfof("import: %q imported into %q: %d hard linked, %d reflinked, %d copied, %d already present",
+		src, album, im.linked, im.cloned, im.copied, im.skipped)
+}
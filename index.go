@@ -0,0 +1,584 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRescanInterval is the time between two scans of the gallery when
+// rescaninterval is not configured
+const defaultRescanInterval = 10 * time.Minute
+
+// mediaEntry describes an image of the gallery in the media index
+type mediaEntry struct {
+	// Path is relative to the working directory, such as
+	// "gallery/album/photo.jpg"
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	// Hash is the sha256 of the content of the file, which lets the
+	// verify command detect files corrupted since they were indexed
+	Hash string `json:"hash,omitempty"`
+	// Captured is the EXIF capture date of the image, or its modification
+	// time when it has none
+	Captured time.Time `json:"captured"`
+	// Placeholder is a tiny preview of the image, as a data URI
+	Placeholder string `json:"placeholder,omitempty"`
+	// Tags are assigned by users of the gallery, while Keywords are read
+	// from the XMP and IPTC metadata of the file
+	Tags     []string `json:"tags,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+	// Title, Caption and Rating, from 0 to 5 stars, are set by users of
+	// the gallery
+	Title   string `json:"title,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	Rating  int    `json:"rating,omitempty"`
+	// Ratings are the ratings of each user, whose average is Rating
+	Ratings map[string]int `json:"ratings,omitempty"`
+	// Place is the name of the town the photo was taken in, resolved from
+	// its GPS coordinates when geocoding is configured
+	Place string `json:"place,omitempty"`
+}
+
+// allTags returns the tags and keywords of the image
+func (e mediaEntry) allTags() []string {
+	return normalizeTags(append(append([]string{}, e.Tags...), e.Keywords...))
+}
+
+// hasTag returns true if the image has the tag, or the keyword, tag
+func (e mediaEntry) hasTag(tag string) bool {
+	for _, t := range e.allTags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// inPlace returns true if the image was taken at place, whatever its case
+func (e mediaEntry) inPlace(place string) bool {
+	return e.Place != "" && strings.EqualFold(e.Place, place)
+}
+
+// root returns the name of the top level album containing the image, or an
+// empty string if the image is at the root of the gallery
+func (e mediaEntry) root() string {
+	rel := strings.TrimPrefix(e.Path, "gallery/")
+	if i := strings.Index(rel, "/"); i > 0 {
+		return rel[:i]
+	}
+	return ""
+}
+
+// mediaIndex keeps track of the images of the gallery and their metadata,
+// so listings that span the whole gallery do not need to read every file
+type mediaIndex struct {
+	sync.RWMutex
+	entries map[string]*mediaEntry
+	scanned time.Time
+	store   indexStore
+	// saveMu serializes the saves of the rescans and of tag edits
+	saveMu sync.Mutex
+}
+
+var index = &mediaIndex{entries: make(map[string]*mediaEntry)}
+
+// indexPath returns the path of the file the index is saved to
+func indexPath() string {
+	if conf.IndexFile != "" {
+		return conf.IndexFile
+	}
+	return "index.json"
+}
+
+// indexStore persists the media index, and coordinates the instances that
+// share it in stateless mode
+type indexStore interface {
+	load() ([]*mediaEntry, error)
+	save(entries []*mediaEntry) error
+	// modified returns the time the index was last saved, by any instance
+	modified() (time.Time, error)
+	// lock designates the instance that scans the gallery, and returns
+	// false if another instance holds the lock
+	lock() bool
+	unlock()
+}
+
+// newIndexStore returns the database store if a database is configured,
+// and the index file otherwise
+func newIndexStore() indexStore {
+	if db != nil {
+		return &dbIndexStore{}
+	}
+	return fileIndexStore{path: indexPath()}
+}
+
+// fileIndexStore saves the index as a json file
+type fileIndexStore struct {
+	path string
+}
+
+func (s fileIndexStore) load() ([]*mediaEntry, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []*mediaEntry
+	err = json.Unmarshal(data, &entries)
+	return entries, err
+}
+
+// save writes the index to disk, replacing the previous version atomically
+func (s fileIndexStore) save(entries []*mediaEntry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(s.path+".tmp", data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+func (s fileIndexStore) modified() (time.Time, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (s fileIndexStore) lock() bool { return lockScan(s.path + ".lock") }
+
+func (s fileIndexStore) unlock() { unlockScan(s.path + ".lock") }
+
+// load reads the index saved by a previous run, or by another instance,
+// replacing the current entries
+func (idx *mediaIndex) load() error {
+	entries, err := idx.store.load()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*mediaEntry, len(entries))
+	for _, e := range entries {
+		loaded[e.Path] = e
+	}
+	idx.Lock()
+	idx.entries = loaded
+	idx.Unlock()
+	return nil
+}
+
+// save persists a copy of the current entries
+func (idx *mediaIndex) save() error {
+	idx.saveMu.Lock()
+	defer idx.saveMu.Unlock()
+	idx.RLock()
+	entries := make([]*mediaEntry, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		entries = append(entries, e)
+	}
+	idx.RUnlock()
+	return idx.store.save(entries)
+}
+
+// scan walks the gallery under the root of the job and updates the index,
+// recording its progress in the job. The metadata of files that did not
+// change since the last scan is not read again. Entries whose file is gone
+// are only removed once the whole root was walked, not when the job is
+// canceled.
+func (idx *mediaIndex) scan(job *scanJob) error {
+	root := job.Path
+	seen := make(map[string]bool)
+	// the thumbnails of new images are generated in the background, and
+	// their watchers notified, but not for every image of the gallery on
+	// the first scan
+	idx.RLock()
+	warm := !idx.scanned.IsZero() || len(idx.entries) > 0
+	// photos indexed before geocoding was configured are located once,
+	// by the first scan of the process
+	locate := idx.scanned.IsZero() && len(geocoders) > 0
+	// sidecars modified since the previous scan are read again, or since
+	// the index was saved by the first scan of the process
+	lastScan := idx.scanned
+	idx.RUnlock()
+	if lastScan.IsZero() && conf.XMP.sidecars() {
+		lastScan, _ = idx.store.modified()
+	}
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if cerr := job.ctx.Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			logErrorf("index: %v", err)
+			job.failed(err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !isImage(path) {
+			return nil
+		}
+		seen[path] = true
+		job.progress(func(j *scanJob) { j.Scanned++ })
+		if job.Thumbnails {
+			// once the image is indexed, whether it changed or not
+			defer generateThumbnails(job, path)
+		}
+		idx.RLock()
+		old, ok := idx.entries[path]
+		idx.RUnlock()
+		if ok && old.Size == fi.Size() && old.ModTime.Equal(fi.ModTime()) {
+			e := *old
+			if e.Hash == "" {
+				// entries indexed before files were hashed
+				if e.Hash, err = hashFile(path); err != nil {
+					logErrorf("index: failed to hash %q: %v", path, err)
+					job.failed(err)
+				}
+			}
+			if e.Place == "" && locate {
+				if exif, err := readExif(path); err == nil {
+					e.Place = photoPlace(path, exif)
+				}
+			}
+			sidecar := false
+			if conf.XMP.sidecars() && sidecarChanged(path, lastScan) {
+				embedded, _, _ := readKeywords(path)
+				sidecar = applySidecar(&e, embedded)
+			}
+			if e.Hash != old.Hash || e.Place != old.Place || sidecar {
+				idx.putScanned(old, &e)
+			}
+			if sidecar {
+				invalidateListing(filepath.Dir(path))
+			}
+			return nil
+		}
+		e := &mediaEntry{
+			Path:     path,
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+			Captured: fi.ModTime(),
+		}
+		if e.Hash, err = hashFile(path); err != nil {
+			logErrorf("index: failed to hash %q: %v", path, err)
+			job.failed(err)
+		}
+		if exif, err := readExif(path); err == nil {
+			if !exif.DateTimeOriginal.IsZero() {
+				e.Captured = exif.DateTimeOriginal
+			}
+			e.Place = photoPlace(path, exif)
+		}
+		if e.Placeholder, err = genPlaceholder(path); err != nil {
+			logErrorf("index: failed to generate placeholder of %q: %v", path, err)
+			job.failed(err)
+		}
+		var xmpRating int
+		e.Keywords, xmpRating, _ = readKeywords(path)
+		if ok {
+			// tags, descriptions and ratings belong to the image, not
+			// to a version of the file
+			e.Tags, e.Title, e.Caption = old.Tags, old.Title, old.Caption
+			e.Rating, e.Ratings = old.Rating, old.Ratings
+		}
+		if conf.XMP.sidecars() {
+			applySidecar(e, e.Keywords)
+		}
+		if conf.Ratings.XMP && e.Rating == 0 && len(e.Ratings) == 0 {
+			if rating, ok := readSidecarRating(path); ok {
+				xmpRating = rating
+			}
+			e.Rating = xmpRating
+		}
+		idx.putScanned(old, e)
+		job.progress(func(j *scanJob) { j.Indexed++ })
+		invalidateListing(filepath.Dir(path))
+		if warm {
+			if !job.Thumbnails {
+				queueWarm(path)
+			}
+			if !ok {
+				notifyAdded(path)
+				recordActivity("photo", path, "", 0)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	idx.Lock()
+	for path := range idx.entries {
+		if !seen[path] && (root == "gallery" || strings.HasPrefix(path, root+"/")) {
+			delete(idx.entries, path)
+			invalidateListing(filepath.Dir(path))
+			job.progress(func(j *scanJob) { j.Removed++ })
+		}
+	}
+	if root == "gallery" {
+		idx.scanned = time.Now()
+	}
+	idx.Unlock()
+	return nil
+}
+
+// putScanned puts the entry e, built by a scan from old, the entry read
+// before the file was examined, in the index. The file is examined without
+// holding the lock, so the tags, descriptions and ratings that users set
+// meanwhile, with the tags api for instance, replace those of old.
+func (idx *mediaIndex) putScanned(old, e *mediaEntry) {
+	idx.Lock()
+	defer idx.Unlock()
+	if live, ok := idx.entries[e.Path]; ok && live != old {
+		e.Tags, e.Title, e.Caption = live.Tags, live.Title, live.Caption
+		e.Rating, e.Ratings = live.Rating, live.Ratings
+	}
+	idx.entries[e.Path] = e
+}
+
+// run loads the saved index, then rescans the gallery periodically. In
+// stateless mode, a single instance scans the shared gallery at a time, and
+// the others load the index it saved. Standbys do not scan until they are
+// promoted.
+func (idx *mediaIndex) run() {
+	if err := idx.load(); err != nil {
+		logErrorf("index: failed to load saved index: %v", err)
+	}
+	interval := conf.RescanInterval
+	if interval <= 0 {
+		interval = defaultRescanInterval
+	}
+	// in stateless mode, check often for an index saved by another
+	// instance, which does not cause more scans
+	poll := interval
+	if conf.Stateless && poll > time.Minute {
+		poll = time.Minute
+	}
+	var loaded time.Time
+	for {
+		if isStandby() {
+			// the index is replicated from the primary
+		} else if !conf.Stateless {
+			idx.rescan(startScan("gallery", false))
+		} else if saved, err := idx.store.modified(); err == nil && time.Since(saved) < interval {
+			// another instance scanned the gallery recently
+			if saved.After(loaded) {
+				if err = idx.load(); err != nil {
+					logErrorf("index: failed to load shared index: %v", err)
+				}
+				loaded = saved
+			}
+		} else if err == nil && idx.store.lock() {
+			idx.rescan(startScan("gallery", false))
+			idx.store.unlock()
+			loaded = time.Now()
+		} else if err != nil {
+			logErrorf("index: %v", err)
+		}
+		time.Sleep(poll)
+	}
+}
+
+// rescan runs a scan job and saves the updated index. Nothing is done if
+// job is nil, as another scan is running.
+func (idx *mediaIndex) rescan(job *scanJob) {
+	if job == nil {
+		return
+	}
+	start := time.Now()
+	err := idx.scan(job)
+	if err != nil {
+		logErrorf("index: scan of %q failed: %v", job.Path, err)
+	}
+	// the entries indexed before a cancellation are kept
+	if serr := idx.save(); serr != nil {
+		logErrorf("index: failed to save index: %v", serr)
+		if err == nil {
+			err = serr
+		}
+	}
+	job.finish(err)
+	logInfof("index: scanned %d images in %s", idx.count(), time.Since(start))
+}
+
+// get returns the index entry of the image at path
+func (idx *mediaIndex) get(path string) (mediaEntry, bool) {
+	idx.RLock()
+	defer idx.RUnlock()
+	e, ok := idx.entries[filepath.Clean(path)]
+	if !ok {
+		return mediaEntry{}, false
+	}
+	return *e, true
+}
+
+// setTags adds and removes tags of the image at path, and saves the index
+func (idx *mediaIndex) setTags(path string, add, remove []string) (mediaEntry, error) {
+	entries, err := idx.update([]string{path}, func(e *mediaEntry) {
+		e.changeTags(add, remove)
+	})
+	if err != nil {
+		return mediaEntry{}, err
+	}
+	return entries[0], nil
+}
+
+// changeTags adds and removes tags of the image
+func (e *mediaEntry) changeTags(add, remove []string) {
+	removed := make(map[string]bool)
+	for _, tag := range normalizeTags(remove) {
+		removed[tag] = true
+	}
+	var tags []string
+	for _, tag := range append(e.Tags, add...) {
+		if !removed[normalizeTag(tag)] {
+			tags = append(tags, tag)
+		}
+	}
+	e.Tags = normalizeTags(tags)
+}
+
+// update applies change to the images at paths and saves the index. Either
+// every image is changed, or none is: nothing is changed if one of the
+// images is not in the index, and the changes are reverted if the index
+// cannot be saved.
+func (idx *mediaIndex) update(paths []string, change func(e *mediaEntry)) ([]mediaEntry, error) {
+	idx.Lock()
+	olds := make([]*mediaEntry, len(paths))
+	for i, path := range paths {
+		old, ok := idx.entries[filepath.Clean(path)]
+		if !ok {
+			idx.Unlock()
+			return nil, os.ErrNotExist
+		}
+		olds[i] = old
+	}
+	// entries are replaced rather than modified, as copies of the
+	// pointers are saved without holding the lock
+	news := make([]*mediaEntry, len(paths))
+	updated := make([]mediaEntry, len(paths))
+	for i, old := range olds {
+		e := *old
+		change(&e)
+		news[i] = &e
+		idx.entries[e.Path] = &e
+		updated[i] = e
+	}
+	idx.Unlock()
+	if err := idx.save(); err != nil {
+		idx.Lock()
+		for i, old := range olds {
+			// unless a rescan replaced the entry in the meantime
+			if idx.entries[old.Path] == news[i] {
+				idx.entries[old.Path] = old
+			}
+		}
+		idx.Unlock()
+		return nil, err
+	}
+	return updated, nil
+}
+
+// refresh generates the placeholder of the image at path again, after it
+// was edited, and saves the index
+func (idx *mediaIndex) refresh(path string) error {
+	idx.RLock()
+	old, ok := idx.entries[filepath.Clean(path)]
+	idx.RUnlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	e := *old
+	placeholder, err := genPlaceholder(path)
+	if err != nil {
+		return err
+	}
+	e.Placeholder = placeholder
+	idx.Lock()
+	idx.entries[e.Path] = &e
+	idx.Unlock()
+	return idx.save()
+}
+
+// tagCounts returns the number of images of each tag and keyword, among the
+// images whose path is selected by visible
+func (idx *mediaIndex) tagCounts(visible func(path string) bool) map[string]int {
+	counts := make(map[string]int)
+	idx.RLock()
+	defer idx.RUnlock()
+	for _, e := range idx.entries {
+		if !visible(e.Path) {
+			continue
+		}
+		for _, tag := range e.allTags() {
+			counts[tag]++
+		}
+	}
+	return counts
+}
+
+// placeCounts returns the number of images taken at each place, among the
+// images selected by visible
+func (idx *mediaIndex) placeCounts(visible func(path string) bool) map[string]int {
+	counts := make(map[string]int)
+	idx.RLock()
+	defer idx.RUnlock()
+	for _, e := range idx.entries {
+		if e.Place != "" && visible(e.Path) {
+			counts[e.Place]++
+		}
+	}
+	return counts
+}
+
+func (idx *mediaIndex) count() int {
+	idx.RLock()
+	defer idx.RUnlock()
+	return len(idx.entries)
+}
+
+// newestByRoot returns the time the most recent image of each top level
+// album was added or modified
+func (idx *mediaIndex) newestByRoot() map[string]time.Time {
+	newest := make(map[string]time.Time)
+	idx.RLock()
+	defer idx.RUnlock()
+	for _, e := range idx.entries {
+		if root := rootOf(e.Path); root != "" && e.ModTime.After(newest[root]) {
+			newest[root] = e.ModTime
+		}
+	}
+	return newest
+}
+
+// byCaptureDate returns the images of the index whose path starts with
+// prefix, most recent first
+func (idx *mediaIndex) byCaptureDate(prefix string) (entries []mediaEntry) {
+	idx.RLock()
+	for path, e := range idx.entries {
+		if strings.HasPrefix(path, prefix) {
+			entries = append(entries, *e)
+		}
+	}
+	idx.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Captured.Equal(entries[j].Captured) {
+			return entries[i].Path < entries[j].Path
+		}
+		return entries[i].Captured.After(entries[j].Captured)
+	})
+	return
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxGalleryImages is the number of images of the ImageGallery embedded in
+// the pages of public albums, which are the first ones of the album
+const maxGalleryImages = 100
+
+// imageGallery is an album described as a schema.org ImageGallery, in
+// JSON-LD, which search engines read to show the photos in their results
+type imageGallery struct {
+	Context         string        `json:"@context"`
+	Type            string        `json:"@type"`
+	Name            string        `json:"name"`
+	Description     string        `json:"description,omitempty"`
+	URL             string        `json:"url"`
+	Image           string        `json:"image,omitempty"`
+	AssociatedMedia []imageObject `json:"associatedMedia,omitempty"`
+}
+
+// imageObject is a photo of an imageGallery
+type imageObject struct {
+	Type            string       `json:"@type"`
+	Name            string       `json:"name"`
+	ContentURL      string       `json:"contentUrl"`
+	ThumbnailURL    string       `json:"thumbnailUrl"`
+	Caption         string       `json:"caption,omitempty"`
+	DateCreated     string       `json:"dateCreated,omitempty"`
+	Keywords        string       `json:"keywords,omitempty"`
+	ContentLocation *schemaPlace `json:"contentLocation,omitempty"`
+}
+
+// schemaPlace is the town a photo was taken in
+type schemaPlace struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+// publicAlbum returns true if anyone can see the album at path without
+// signing in, because the gallery does not authenticate its visitors, or the
+// album is the one of the demo
+func publicAlbum(path string) bool {
+	if conf.Demo {
+		return rootOf(path) != "" && rootOf(path) == conf.DemoRoot
+	}
+	return !conf.Authenticate
+}
+
+// newImageGallery describes the album dir, with the images of its listing
+// if it is set. Shared albums and views get the title, description, url and
+// preview of their card.
+func newImageGallery(albumDir, locale string, listing *albumListing) imageGallery {
+	base := "https://" + conf.Host
+	g := imageGallery{
+		Context: "https://schema.org",
+		Type:    "ImageGallery",
+		Name:    filepath.Base(albumDir),
+		URL:     base + link("/"+albumDir+"/"),
+	}
+	if albumDir == "gallery" {
+		g.Name = tr(locale, "title")
+	}
+	if s, ok := findShare(albumDir); ok {
+		g.Name, g.Description, g.URL = s.title(), s.Description, base+s.url()
+		g.Image = base + link("/preview/"+s.key())
+	}
+	if listing == nil {
+		return g
+	}
+	for _, img := range listing.Images {
+		o := imageObject{
+			Type:         "ImageObject",
+			Name:         img.Name,
+			ContentURL:   base + img.URL,
+			ThumbnailURL: base + img.Thumb,
+			Caption:      img.Caption,
+			Keywords:     strings.Join(img.Tags, ", "),
+		}
+		if img.Title != "" {
+			o.Name = img.Title
+		}
+		if !img.Captured.IsZero() {
+			o.DateCreated = img.Captured.Format(time.RFC3339)
+		}
+		if img.Place != "" {
+			o.ContentLocation = &schemaPlace{Type: "Place", Name: img.Place}
+		}
+		g.AssociatedMedia = append(g.AssociatedMedia, o)
+	}
+	return g
+}
+
+// writeImageGallery returns the album dir and the images of its listing as
+// JSON-LD
+func writeImageGallery(w http.ResponseWriter, r *http.Request, albumDir string, listing albumListing) {
+	w.Header().Set("Content-Type", "application/ld+json")
+	json.NewEncoder(w).Encode(newImageGallery(albumDir, requestLocale(r), &listing))
+}
+
+// galleryScript returns the script element of the JSON-LD of a gallery.
+// json.Marshal escapes <, > and &, so the content cannot close the script.
+func galleryScript(g imageGallery) string {
+	data, err := json.Marshal(g)
+	if err != nil {
+		logErrorf("jsonld: %v", err)
+		return ""
+	}
+	return `<script type="application/ld+json">` + string(data) + `</script>`
+}
+
+// galleryTags embeds the JSON-LD of public albums in their pages, with their
+// first images
+func galleryTags(r *http.Request, name string, page []byte) []byte {
+	if name != "album" && name != "index" {
+		return page
+	}
+	galpath, ok := mux.Vars(r)["galpath"]
+	if !ok {
+		return page
+	}
+	albumDir := filepath.Join("gallery", filepath.Clean("/"+galpath))
+	listing := publicListing(albumDir)
+	if listing == nil {
+		return page
+	}
+	script := galleryScript(newImageGallery(albumDir, requestLocale(r), listing))
+	return bytes.Replace(page, []byte("</head>"), []byte(script+"</head>"), 1)
+}
+
+// publicListing returns the listing of the first images of the album dir,
+// or nil if the album is not public
+func publicListing(albumDir string) *albumListing {
+	if !publicAlbum(albumDir) {
+		return nil
+	}
+	listing, err := listAlbum(albumDir, "", "", 0)
+	if err != nil {
+		return nil
+	}
+	if len(listing.Images) > maxGalleryImages {
+		listing.Images = listing.Images[:maxGalleryImages]
+	}
+	return &listing
+}
+
+// initJSONLD embeds the JSON-LD of public albums in their pages
+func initJSONLD() {
+	registerRenderHooks(nil, galleryTags)
+}
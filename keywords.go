@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	xmpHeader     = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	photoshopHead = []byte("Photoshop 3.0\x00")
+	xmpSubject    = regexp.MustCompile(`(?s)<dc:subject>(.*?)</dc:subject>`)
+	xmpListItem   = regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`)
+	// xmpRatingRe matches the rating as an attribute or as an element
+	xmpRatingRe = regexp.MustCompile(`xmp:Rating(?:="|>)(-?[0-9]+)`)
+)
+
+// readKeywords returns the keywords embedded in a JPEG file by photo
+// managers, from its XMP dc:subject and its IPTC keywords, along with its
+// XMP rating
+func readKeywords(path string) (keywords []string, rating int, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	r := bufio.NewReader(fd)
+	var soi [2]byte
+	if _, err = io.ReadFull(r, soi[:]); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, 0, nil
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xff {
+			break
+		}
+		// metadata segments precede the start of scan
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			break
+		}
+		if marker[1] != 0xe1 && marker[1] != 0xed {
+			if _, err := r.Discard(length); err != nil {
+				break
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			break
+		}
+		switch {
+		case bytes.HasPrefix(segment, xmpHeader):
+			keywords = append(keywords, xmpKeywords(segment[len(xmpHeader):])...)
+			if r, ok := xmpRating(segment[len(xmpHeader):]); ok {
+				rating = r
+			}
+		case bytes.HasPrefix(segment, photoshopHead):
+			keywords = append(keywords, iptcKeywords(segment[len(photoshopHead):])...)
+		}
+	}
+	return normalizeTags(keywords), rating, nil
+}
+
+// xmpRating returns the xmp:Rating of an XMP packet, from 0 to 5 stars.
+// Photos rejected by photo managers, rated -1, have no rating.
+func xmpRating(packet []byte) (int, bool) {
+	m := xmpRatingRe.FindSubmatch(packet)
+	if m == nil {
+		return 0, false
+	}
+	rating, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return 0, false
+	}
+	if rating < 0 {
+		rating = 0
+	} else if rating > 5 {
+		rating = 5
+	}
+	return rating, true
+}
+
+// readSidecarRating returns the rating of the XMP sidecar of an image, named
+// either image.jpg.xmp or image.xmp, if it has one
+func readSidecarRating(path string) (int, bool) {
+	for _, xmp := range []string{path + ".xmp", xmpSidecarPath(path)} {
+		if packet, err := ioutil.ReadFile(xmp); err == nil {
+			return xmpRating(packet)
+		}
+	}
+	return 0, false
+}
+
+// xmpKeywords returns the items of the dc:subject bag of an XMP packet
+func xmpKeywords(packet []byte) (keywords []string) {
+	subject := xmpSubject.FindSubmatch(packet)
+	if subject == nil {
+		return
+	}
+	for _, item := range xmpListItem.FindAllSubmatch(subject[1], -1) {
+		keywords = append(keywords, html.UnescapeString(string(item[1])))
+	}
+	return
+}
+
+// iptcKeywords returns the keywords (dataset 2:25) of the IPTC record
+// stored in the image resources of a Photoshop APP13 segment
+func iptcKeywords(resources []byte) (keywords []string) {
+	for len(resources) >= 12 && bytes.HasPrefix(resources, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(resources[4:])
+		// the resource name is a pascal string padded to an even length
+		nameLen := int(resources[6]) + 1
+		nameLen += nameLen % 2
+		if 6+nameLen+4 > len(resources) {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(resources[6+nameLen:]))
+		data := resources[6+nameLen+4:]
+		if size > len(data) {
+			return
+		}
+		if id == 0x0404 {
+			keywords = append(keywords, iptcDatasets(data[:size], 2, 25)...)
+		}
+		size += size % 2
+		if size > len(data) {
+			return
+		}
+		resources = data[size:]
+	}
+	return
+}
+
+// iptcDatasets returns the values of a dataset of an IPTC record
+func iptcDatasets(iptc []byte, record, dataset byte) (values []string) {
+	for len(iptc) >= 5 && iptc[0] == 0x1c {
+		size := int(binary.BigEndian.Uint16(iptc[3:]))
+		if 5+size > len(iptc) {
+			return
+		}
+		if iptc[1] == record && iptc[2] == dataset {
+			values = append(values, string(iptc[5:5+size]))
+		}
+		iptc = iptc[5+size:]
+	}
+	return
+}
+
+// normalizeTag lowercases a tag and removes the characters that would get
+// in the way of tag urls
+func normalizeTag(tag string) string {
+	tag = strings.NewReplacer("/", "-", ",", " ", "?", "", "#", "").Replace(tag)
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// normalizeTags normalizes a list of tags, sorted and without duplicates
+func normalizeTags(tags []string) (normalized []string) {
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// defaultMaxMegapixels limits the size of decoded images when the
+// configuration sets no limit. Decoding an image takes about 4 bytes per
+// pixel, so a small file claiming huge dimensions could exhaust memory.
+const defaultMaxMegapixels = 100
+
+// imageLimitsConf sets the largest source images that are decoded to be
+// resized. Larger images can still be downloaded in their original version.
+type imageLimitsConf struct {
+	// MaxMegapixels is the maximum width times height, in millions of
+	// pixels
+	MaxMegapixels float64
+	// MaxDimension is the maximum width or height, in pixels
+	MaxDimension int
+	// MaxFileSize is the maximum size of a source file, such as 50MB
+	MaxFileSize string
+}
+
+var errImageTooLarge = errors.New("image exceeds the configured size limits")
+
+// maxSourceFileSize is the parsed MaxFileSize of the configuration
+var maxSourceFileSize int64
+
+func initImageLimits() (err error) {
+	maxSourceFileSize, err = parseSize(conf.ImageLimits.MaxFileSize)
+	return
+}
+
+// checkImageLimits reads the header of the image in fd to verify it can be
+// decoded safely, then rewinds fd so the image can be decoded
+func checkImageLimits(fd *os.File) error {
+	if maxSourceFileSize > 0 {
+		fi, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() > maxSourceFileSize {
+			return fmt.Errorf("%w: %q is %d bytes", errImageTooLarge, fd.Name(), fi.Size())
+		}
+	}
+	cfg, _, err := image.DecodeConfig(fd)
+	if err != nil {
+		return err
+	}
+	if float64(cfg.Width)*float64(cfg.Height) > maxPixels() {
+		return fmt.Errorf("%w: %q is %dx%d pixels", errImageTooLarge, fd.Name(), cfg.Width, cfg.Height)
+	}
+	if max := conf.ImageLimits.MaxDimension; max > 0 && (cfg.Width > max || cfg.Height > max) {
+		return fmt.Errorf("%w: %q is %dx%d pixels", errImageTooLarge, fd.Name(), cfg.Width, cfg.Height)
+	}
+	_, err = fd.Seek(0, io.SeekStart)
+	return err
+}
+
+// maxPixels returns the largest number of pixels of decoded images
+func maxPixels() float64 {
+	max := conf.ImageLimits.MaxMegapixels
+	if max <= 0 {
+		max = defaultMaxMegapixels
+	}
+	return max * 1e6
+}
+
+// fullWidth returns the largest dimension of the image at path, which
+// resizes it to its full size
+func fullWidth(path string) (uint64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	cfg, _, err := image.DecodeConfig(fd)
+	if err != nil {
+		return 0, err
+	}
+	if cfg.Height > cfg.Width {
+		return uint64(cfg.Height), nil
+	}
+	return uint64(cfg.Width), nil
+}
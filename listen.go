@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// unixPrefix marks listen addresses that refer to a unix domain socket
+const unixPrefix = "unix:"
+
+// listenerConf is the configuration of one of the addresses the gallery
+// listens on
+type listenerConf struct {
+	Address string
+	// TLS defaults to true for TCP addresses, and to false for unix
+	// sockets which are meant to sit behind a local proxy that terminates
+	// TLS
+	TLS *bool
+	// CertFile and KeyFile default to the global certificate
+	CertFile, KeyFile string
+	// MinTLS is the minimum version of TLS accepted, "1.2" or "1.3"
+	MinTLS string
+}
+
+// shutdownTimeout is the time given to requests in flight to complete
+// when the gallery is asked to stop
+const shutdownTimeout = 30 * time.Second
+
+// drainDelay is the time during which a stateless instance keeps accepting
+// requests after being asked to stop, while reporting itself as draining
+const drainDelay = 5 * time.Second
+
+// serveListeners serves handler on every listener, and returns when the
+// first of them fails. On SIGTERM or SIGINT, listeners stop accepting
+// connections and nil is returned once the requests in flight are complete,
+// so instances can be restarted without failing requests.
+func serveListeners(listeners []listenerConf, handler http.Handler) error {
+	errs := make(chan error, len(listeners))
+	var servers []*http.Server
+	for _, lc := range listeners {
+		srv, err := lc.server(handler)
+		if err != nil {
+			return fmt.Errorf("listener %q: %v", lc.Address, err)
+		}
+		servers = append(servers, srv)
+		l, err := listen(lc.Address)
+		if err != nil {
+			return err
+		}
+		go func(lc listenerConf) {
+			if srv.TLSConfig == nil {
+				logInfof("serving http on %s", lc.Address)
+				errs <- srv.Serve(l)
+				return
+			}
+			logInfof("serving https on %s", lc.Address)
+			// the certificate comes from the GetCertificate function of
+			// the TLS configuration, which reloads it when it changes
+			errs <- srv.ServeTLS(l, "", "")
+		}(lc)
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-stop:
+		logInfof("received %s, shutting down", sig)
+	}
+	atomic.StoreInt32(&draining, 1)
+	if conf.Stateless {
+		// give load balancers the time to notice the instance is
+		// draining before it stops accepting connections
+		time.Sleep(drainDelay)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if index.store != nil {
+		index.store.unlock()
+	}
+	// the hashes found since the last flush are kept for the next start
+	manifest.flush()
+	return nil
+}
+
+// server returns the http server of handler on a listener, with TLS
+// configured unless it is disabled. The certificate is reloaded when its
+// files change.
+func (lc *listenerConf) server(handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{Addr: lc.Address, Handler: handler}
+	useTLS := !strings.HasPrefix(lc.Address, unixPrefix)
+	if lc.TLS != nil {
+		useTLS = *lc.TLS
+	}
+	if !useTLS {
+		return srv, nil
+	}
+	if lc.CertFile == "" && lc.KeyFile == "" {
+		lc.CertFile, lc.KeyFile = conf.CertFile, conf.KeyFile
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+	switch lc.MinTLS {
+	case "", "1.2":
+	case "1.3":
+		srv.TLSConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", lc.MinTLS)
+	}
+	cr, err := reloadingCertificate(lc.CertFile, lc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	srv.TLSConfig.GetCertificate = cr.getCertificate
+	return srv, nil
+}
+
+// listen opens a listener on a TCP address, or on a unix domain socket if
+// addr starts with "unix:". Sockets get the mode and ownership set in the
+// configuration.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	// remove the socket left behind by a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SocketMode != 0 {
+		if err = os.Chmod(path, os.FileMode(conf.SocketMode)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if conf.SocketOwner != "" || conf.SocketGroup != "" {
+		uid, gid, err := socketOwnership(conf.SocketOwner, conf.SocketGroup)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err = os.Chown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// socketOwnership resolves user and group names into numerical ids. An
+// empty name resolves to -1, which leaves the ownership unchanged.
+func socketOwnership(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			return uid, gid, fmt.Errorf("invalid socket owner: %v", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return uid, gid, fmt.Errorf("invalid socket group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return
+}
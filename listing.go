@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultListingTTL     = time.Minute
+	defaultListingWorkers = 16
+)
+
+// listingConf sets the cache of the album listings. Listings are kept for
+// ttl, until the modification time of their directory changes, or until
+// the index or an upload invalidates them. A negative ttl disables the
+// cache.
+//
+//	listing:
+//	  ttl: 5m
+//	  workers: 32
+type listingConf struct {
+	TTL time.Duration
+	// Workers is the number of files stat'ed at once when a directory is
+	// listed
+	Workers int
+}
+
+// dirListing is the content of a directory, sorted by name
+type dirListing struct {
+	entries []os.FileInfo
+	modtime time.Time
+	listed  time.Time
+}
+
+var listings = struct {
+	sync.Mutex
+	dirs map[string]*dirListing
+}{dirs: make(map[string]*dirListing)}
+
+// readAlbum returns the entries of an album directory sorted by name, like
+// ioutil.ReadDir, from the cache if the directory did not change. The
+// entries are shared by the callers, which must not modify them.
+func readAlbum(dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	ttl := conf.Listing.TTL
+	if ttl == 0 {
+		ttl = defaultListingTTL
+	}
+	listings.Lock()
+	l, ok := listings.dirs[dir]
+	listings.Unlock()
+	if ok && l.modtime.Equal(fi.ModTime()) && time.Since(l.listed) < ttl {
+		return l.entries, nil
+	}
+	entries, err := readDirConcurrent(dir)
+	if err != nil || ttl < 0 {
+		return entries, err
+	}
+	listings.Lock()
+	// forget about the listings that expired
+	for d, old := range listings.dirs {
+		if time.Since(old.listed) >= ttl {
+			delete(listings.dirs, d)
+		}
+	}
+	listings.dirs[dir] = &dirListing{entries: entries, modtime: fi.ModTime(), listed: time.Now()}
+	listings.Unlock()
+	return entries, nil
+}
+
+// invalidateListing drops the cached listing of a directory, after files
+// were added to it or removed from it
+func invalidateListing(dir string) {
+	listings.Lock()
+	delete(listings.dirs, filepath.Clean(dir))
+	listings.Unlock()
+}
+
+// readDirConcurrent lists a directory like ioutil.ReadDir, but stats its
+// entries with several workers, as folders of thousands of photos on
+// network storage take seconds to stat one file at a time
+func readDirConcurrent(dir string) ([]os.FileInfo, error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	workers := conf.Listing.Workers
+	if workers <= 0 {
+		workers = defaultListingWorkers
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				infos[i], errs[i] = os.Lstat(filepath.Join(dir, names[i]))
+			}
+		}()
+	}
+	for i := range names {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	entries := make([]os.FileInfo, 0, len(names))
+	for i, fi := range infos {
+		if errs[i] != nil {
+			// files removed while the directory was listed are skipped
+			if os.IsNotExist(errs[i]) {
+				continue
+			}
+			return nil, errs[i]
+		}
+		entries = append(entries, fi)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// logLevel is the severity of a message of the log. Messages below the
+// level set by log_level are dropped:
+//
+//	log_level: warn
+//
+// The levels are debug, info (the default), warn and error. The -debug flag
+// sets the level to debug, which also logs the headers of the requests and
+// every step of the image pipeline.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels are the names of the levels, in the configuration and in the
+// messages
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// minLogLevel is the level of the least severe messages that are logged
+var minLogLevel = levelInfo
+
+// initLogging sets the level of the log from the configuration, unless debug
+// is set
+func initLogging(debug bool) error {
+	if debug {
+		minLogLevel = levelDebug
+		return nil
+	}
+	if conf.LogLevel == "" {
+		return nil
+	}
+	level := indexOf(logLevels, strings.ToLower(conf.LogLevel))
+	if level < 0 {
+		return fmt.Errorf("unknown log level %q", conf.LogLevel)
+	}
+	minLogLevel = logLevel(level)
+	return nil
+}
+
+// debugLogging returns true if debug messages are logged, for callers that
+// would otherwise gather their content for nothing
+func debugLogging() bool {
+	return minLogLevel == levelDebug
+}
+
+func logDebugf(format string, v ...interface{}) { logf(levelDebug, format, v...) }
+func logInfof(format string, v ...interface{})  { logf(levelInfo, format, v...) }
+func logWarnf(format string, v ...interface{})  { logf(levelWarn, format, v...) }
+func logErrorf(format string, v ...interface{}) { logf(levelError, format, v...) }
+
+// logf logs a message of the given level, prefixed by the name of the level,
+// with its secrets redacted
+func logf(level logLevel, format string, v ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	log.Output(3, strings.ToUpper(logLevels[level])+" "+redact(fmt.Sprintf(format, v...)))
+}
+
+// secretRe matches the secrets that messages may carry: the credentials of
+// Authorization headers, the values of parameters such as password=, and
+// the tokens of drop box urls
+var secretRe = regexp.MustCompile(`(?i)(\b(?:bearer|basic)\s+)[^\s"',;]{8,}|(\b(?:password|passwd|token|secret|csrf)=|/dropbox/)[^\s&"'/,;]+`)
+
+// redact replaces the secrets of a message
+func redact(msg string) string {
+	return secretRe.ReplaceAllString(msg, "${1}${2}[redacted]")
+}
+
+// sensitiveHeaders are the request headers whose values are never logged
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", csrfHeader}
+
+// redactHeaders returns a copy of the headers, with the values of the
+// sensitive ones redacted
+func redactHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[redacted]"}
+		}
+	}
+	return redacted
+}
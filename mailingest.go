@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMailMaxSize is the largest email accepted by the mail listener,
+// when the configuration sets none
+const defaultMailMaxSize = 50 << 20
+
+// mailTimeout is the time a client of the mail listener has to send each
+// command, and the whole content of an email
+const mailTimeout = 5 * time.Minute
+
+// mailMaxSessions is the number of SMTP clients served at once. Each holds
+// an email of up to the max size in memory, so the others wait to connect.
+const mailMaxSessions = 4
+
+// mailIngestConf is a mail server that files the photos attached to the
+// emails of a few senders into an album, so relatives can email their
+// photos to the gallery. The mail exchanger of the domain, or a forwarding
+// rule of a mailbox, delivers the emails to its listen address. Only the
+// emails whose From address is one of senders, or of a domain of senders
+// written as @domain, are accepted. Senders are easily forged, so the
+// recipients are required, and are the only addresses the server accepts
+// emails for: they are the secret of the album, and should be kept as
+// private as a password. The emails are encrypted with STARTTLS when the
+// gallery has a certificate.
+//
+//	mailingest:
+//	  listen: 0.0.0.0:2525
+//	  album: family/inbox
+//	  senders: [grandma@example.org, "@family.example.net"]
+//	  recipients: [photos-7d2f@example.net]
+//	  maxsize: 52428800
+type mailIngestConf struct {
+	Listen     string
+	Album      string
+	Senders    []string
+	Recipients []string
+	// MaxSize is the largest email accepted, attachments included, in
+	// bytes
+	MaxSize int64
+}
+
+// mailAttachment is an image attached to an email
+type mailAttachment struct {
+	name string
+	data []byte
+}
+
+// mailAlbumDir returns the directory of the album emailed photos are filed
+// into
+func mailAlbumDir() string {
+	return filepath.Join("gallery", filepath.Clean("/"+conf.MailIngest.Album))
+}
+
+// checkMailIngest verifies the configuration of the mail listener
+func checkMailIngest() error {
+	mc := conf.MailIngest
+	if mc.Listen == "" {
+		return nil
+	}
+	if strings.Trim(mc.Album, "/") == "" {
+		return fmt.Errorf("mailingest: missing album")
+	}
+	if fi, err := os.Stat(mailAlbumDir()); err != nil || !fi.IsDir() {
+		return fmt.Errorf("mailingest: album %q does not exist", mc.Album)
+	}
+	if len(mc.Senders) == 0 {
+		return fmt.Errorf("mailingest: no senders allowed")
+	}
+	// anyone can forge a sender, but not guess a secret recipient
+	if len(mc.Recipients) == 0 {
+		return fmt.Errorf("mailingest: no recipients set, add a secret address the photos are sent to")
+	}
+	for _, r := range mc.Recipients {
+		if !strings.Contains(strings.Trim(r, "@"), "@") {
+			return fmt.Errorf("mailingest: invalid recipient %q, expected an address such as photos-7d2f@example.net", r)
+		}
+	}
+	return nil
+}
+
+// serveMailIngest starts the mail listener, if the configuration sets one
+func serveMailIngest() error {
+	if conf.MailIngest.Listen == "" {
+		return nil
+	}
+	if err := checkMailIngest(); err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if conf.CertFile != "" && conf.KeyFile != "" {
+		cr, err := reloadingCertificate(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("mailingest: %v", err)
+		}
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cr.getCertificate}
+	}
+	l, err := net.Listen("tcp", conf.MailIngest.Listen)
+	if err != nil {
+		return fmt.Errorf("mailingest: %v", err)
+	}
+	logInfof("mailingest: filing the photos emailed to %s into %q", conf.MailIngest.Listen, conf.MailIngest.Album)
+	sessions := make(chan struct{}, mailMaxSessions)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				logErrorf("mailingest: %v", err)
+				return
+			}
+			select {
+			case sessions <- struct{}{}:
+			default:
+				// mail exchangers retry later on a 421
+				logWarnf("mailingest: %d sessions in progress, refusing %s", mailMaxSessions, c.RemoteAddr())
+				c.SetDeadline(time.Now().Add(10 * time.Second))
+				fmt.Fprintf(c, "421 %s too many connections, try again later\r\n", conf.Host)
+				c.Close()
+				continue
+			}
+			go func() {
+				defer func() { <-sessions }()
+				serveMailSession(c, tlsConfig)
+			}()
+		}
+	}()
+	return nil
+}
+
+// mailSession is the state of an SMTP connection
+type mailSession struct {
+	conn       net.Conn
+	text       *textproto.Conn
+	tlsConfig  *tls.Config
+	from       string
+	recipients int
+}
+
+// serveMailSession receives the emails of an SMTP client, with the subset of
+// RFC 5321 mail exchangers use to deliver them
+func serveMailSession(c net.Conn, tlsConfig *tls.Config) {
+	s := &mailSession{conn: c, text: textproto.NewConn(c), tlsConfig: tlsConfig}
+	defer func() { s.text.Close() }()
+	maxSize := conf.MailIngest.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMailMaxSize
+	}
+	s.reply(220, conf.Host+" galilego ESMTP")
+	for {
+		s.conn.SetDeadline(time.Now().Add(mailTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.reset()
+			s.reply(250, conf.Host)
+		case "EHLO":
+			s.reset()
+			extensions := []string{conf.Host, "8BITMIME", "PIPELINING", "SIZE " + strconv.FormatInt(maxSize, 10)}
+			if s.tlsConfig != nil {
+				extensions = append(extensions, "STARTTLS")
+			}
+			s.reply(250, extensions...)
+		case "STARTTLS":
+			if s.tlsConfig == nil {
+				s.reply(502, "STARTTLS not available")
+				continue
+			}
+			s.reply(220, "ready to start TLS")
+			tc := tls.Server(s.conn, s.tlsConfig)
+			if err = tc.Handshake(); err != nil {
+				logWarnf("mailingest: TLS handshake with %s failed: %v", s.conn.RemoteAddr(), err)
+				return
+			}
+			// the client starts over, and STARTTLS cannot be sent again
+			s.conn, s.text, s.tlsConfig = tc, textproto.NewConn(tc), nil
+			s.reset()
+		case "MAIL":
+			from, ok := mailPath(arg, "FROM:")
+			if !ok {
+				s.reply(501, "syntax: MAIL FROM:<address>")
+				continue
+			}
+			if size := mailSizeParam(arg); size > maxSize {
+				s.reply(552, "message too large")
+				continue
+			}
+			s.reset()
+			s.from = from
+			s.reply(250, "OK")
+		case "RCPT":
+			to, ok := mailPath(arg, "TO:")
+			switch {
+			case !ok:
+				s.reply(501, "syntax: RCPT TO:<address>")
+			case s.from == "":
+				s.reply(503, "MAIL first")
+			case !mailAddressIn(to, conf.MailIngest.Recipients, false):
+				s.reply(550, "no such user")
+			default:
+				s.recipients++
+				s.reply(250, "OK")
+			}
+		case "DATA":
+			if s.recipients == 0 {
+				s.reply(503, "RCPT first")
+				continue
+			}
+			s.reply(354, "end data with <CR><LF>.<CR><LF>")
+			s.conn.SetDeadline(time.Now().Add(mailTimeout))
+			dr := s.text.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dr, maxSize+1))
+			if err != nil {
+				return
+			}
+			if int64(len(data)) > maxSize {
+				// the rest of the email is discarded
+				io.Copy(ioutil.Discard, dr)
+				s.reply(552, "message too large")
+			} else if err = ingestMail(data); err != nil {
+				logWarnf("mailingest: rejected email from %s sent by %s: %v", s.from, s.conn.RemoteAddr(), err)
+				s.reply(550, err.Error())
+			} else {
+				s.reply(250, "OK")
+			}
+			s.reset()
+		case "RSET":
+			s.reset()
+			s.reply(250, "OK")
+		case "NOOP":
+			s.reply(250, "OK")
+		case "VRFY":
+			s.reply(252, "cannot verify users")
+		case "QUIT":
+			s.reply(221, "bye")
+			return
+		default:
+			s.reply(502, "command not implemented")
+		}
+	}
+}
+
+// reset forgets the sender and the recipients of the email in progress
+func (s *mailSession) reset() {
+	s.from, s.recipients = "", 0
+}
+
+// reply sends a reply of code to the client, on several lines if there are
+// several
+func (s *mailSession) reply(code int, lines ...string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		s.text.PrintfLine("%d%s%s", code, sep, line)
+	}
+}
+
+// mailPath returns the address of a MAIL FROM or RCPT TO argument, such as
+// "FROM:<bob@example.net> SIZE=1024". The null sender of bounces is not
+// accepted, as they carry no photos.
+func mailPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(arg, '>')
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return "", false
+	}
+	addr := arg[1:end]
+	return addr, strings.Contains(addr, "@")
+}
+
+// mailSizeParam returns the SIZE parameter of a MAIL FROM command, or 0
+func mailSizeParam(arg string) int64 {
+	for _, param := range strings.Fields(arg) {
+		if len(param) > 5 && strings.EqualFold(param[:5], "SIZE=") {
+			size, _ := strconv.ParseInt(param[5:], 10, 64)
+			return size
+		}
+	}
+	return 0
+}
+
+// mailAddressIn returns true if addr is one of addresses, or if domains is
+// set, of the domains among them written as @domain
+func mailAddressIn(addr string, addresses []string, domains bool) bool {
+	addr = strings.ToLower(addr)
+	for _, a := range addresses {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == addr || (domains && strings.HasPrefix(a, "@") && strings.HasSuffix(addr, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestMail files the images attached to an email into the album, if the
+// sender is allowed to send them
+func ingestMail(data []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid message")
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil || !mailAddressIn(from.Address, conf.MailIngest.Senders, true) {
+		return fmt.Errorf("sender not allowed")
+	}
+	albumDir := mailAlbumDir()
+	if isArchived(albumDir) {
+		return fmt.Errorf("album archived")
+	}
+	attachments, err := mailAttachments(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+	if len(attachments) == 0 {
+		return fmt.Errorf("no photos attached")
+	}
+	var saved int
+	for _, a := range attachments {
+		dest := filepath.Join(albumDir, a.name)
+		// the subject of the email is the event of the albums that
+		// sort their uploads by date
+		dest, err := routeUpload(dest, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(a.data)), nil
+		}, msg.Header.Get("Subject"))
+		if err != nil {
+			logErrorf("mailingest: failed to route %q: %v", a.name, err)
+			continue
+		}
+		dest = availableName(dest)
+		if err = saveUploadContent(bytes.NewReader(a.data), dest, int64(len(a.data))); err != nil {
+			logErrorf("mailingest: failed to save %q: %v", dest, err)
+			continue
+		}
+		invalidateListing(filepath.Dir(dest))
+		queueWarm(dest)
+		notifyAdded(dest)
+		saved++
+	}
+	if saved == 0 {
+		return fmt.Errorf("no photos could be saved")
+	}
+	logInfof("mailingest: filed %d photos emailed by %s into %q", saved, from.Address, albumDir)
+	return nil
+}
+
+// mailAttachments returns the images of the part of an email with header
+// and body, and of its sub parts
+func mailAttachments(header textproto.MIMEHeader, body io.Reader) ([]mailAttachment, error) {
+	ctype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		ctype = "text/plain"
+	}
+	if strings.HasPrefix(ctype, "multipart/") {
+		var attachments []mailAttachment
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return attachments, nil
+			}
+			if err != nil {
+				return attachments, err
+			}
+			sub, err := mailAttachments(p.Header, p)
+			if err != nil {
+				return attachments, err
+			}
+			attachments = append(attachments, sub...)
+		}
+	}
+	if !strings.HasPrefix(ctype, "image/") {
+		return nil, nil
+	}
+	name := params["name"]
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dparams["filename"] != "" {
+		name = dparams["filename"]
+	}
+	name = unsafeNameChars.ReplaceAllString(filepath.Base(name), "_")
+	if !imgre.MatchString(name) {
+		// pasted images have no name, or one without an extension
+		exts, _ := mime.ExtensionsByType(ctype)
+		name = ""
+		for _, ext := range exts {
+			if imgre.MatchString(ext) {
+				name = "email-" + time.Now().Format("20060102-150405") + ext
+			}
+		}
+		if name == "" {
+			return nil, nil
+		}
+	}
+	// multipart parts are decoded from quoted-printable already
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		// the line breaks of the encoding are ignored
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return []mailAttachment{{name: name, data: data}}, nil
+}
+
+// availableName returns dest, or if a file already exists there, the first
+// of dest-1, dest-2, and so on that does not exist. Relatives often send
+// photos with the same names, such as IMG_0001.JPG.
+func availableName(dest string) string {
+	ext := filepath.Ext(dest)
+	base := strings.TrimSuffix(dest, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			return dest
+		}
+		dest = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStreamOriginal(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "video.mp4")
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modtime, modtime); err != nil {
+		t.Fatal(err)
+	}
+	size := strconv.Itoa(len(content))
+	lastModified := modtime.Format(http.TimeFormat)
+	stale := modtime.Add(-time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+		// contentRange is the expected Content-Range header, and body
+		// the expected body, unless it is nil
+		contentRange string
+		body         []byte
+	}{
+		{name: "whole file", status: http.StatusOK, body: content},
+		{name: "range", headers: map[string]string{"Range": "bytes=10-19"},
+			status: http.StatusPartialContent, contentRange: "bytes 10-19/" + size, body: content[10:20]},
+		{name: "open range", headers: map[string]string{"Range": "bytes=990-"},
+			status: http.StatusPartialContent, contentRange: "bytes 990-999/" + size, body: content[990:]},
+		{name: "suffix range", headers: map[string]string{"Range": "bytes=-5"},
+			status: http.StatusPartialContent, contentRange: "bytes 995-999/" + size, body: content[995:]},
+		{name: "unsatisfiable range", headers: map[string]string{"Range": "bytes=2000-2010"},
+			status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */" + size},
+		{name: "matching if-range", headers: map[string]string{"Range": "bytes=0-4", "If-Range": lastModified},
+			status: http.StatusPartialContent, contentRange: "bytes 0-4/" + size, body: content[:5]},
+		{name: "stale if-range", headers: map[string]string{"Range": "bytes=0-4", "If-Range": stale},
+			status: http.StatusOK, body: content},
+		{name: "head", method: http.MethodHead, status: http.StatusOK, body: []byte{}},
+		{name: "missing", path: filepath.Join(dir, "missing.mp4"), status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		method, p := tt.method, tt.path
+		if method == "" {
+			method = http.MethodGet
+		}
+		if p == "" {
+			p = path
+		}
+		r := httptest.NewRequest(method, "/gallery/album/video.mp4", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		streamOriginal(w, r, p)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusNotFound {
+			continue
+		}
+		if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s: Content-Range = %q, want %q", tt.name, got, tt.contentRange)
+		}
+		if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%s: Accept-Ranges = %q, want bytes", tt.name, got)
+		}
+		if got := w.Header().Get("Last-Modified"); got != lastModified {
+			t.Errorf("%s: Last-Modified = %q, want %q", tt.name, got, lastModified)
+		}
+		if tt.body != nil && !bytes.Equal(w.Body.Bytes(), tt.body) {
+			t.Errorf("%s: body of %d bytes, want %d bytes", tt.name, w.Body.Len(), len(tt.body))
+		}
+		if method == http.MethodHead {
+			if got := w.Header().Get("Content-Length"); got != size {
+				t.Errorf("%s: Content-Length = %q, want %q", tt.name, got, size)
+			}
+		}
+	}
+}
+
+func TestStreamable(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"video.mp4", ".album.yaml", ".archive.json", "photo.jpg", "photo.jpg.edit.json",
+		"photo.jpg.xmp", "photo.xmp", "photo.jpg.txt", "IMG_0001.jpg", "IMG_0001.CR2", "orphan.nef", "track.gpx",
+		"notes.md", "upload.gpx.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldFiles := conf.Files
+	conf.Files = filesConf{"/": {"gpx"}}
+	defer func() {
+		conf.Files = oldFiles
+	}()
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"video.mp4", true},
+		{"track.gpx", true},
+		{"IMG_0001.CR2", true},
+		{".album.yaml", false},
+		{".archive.json", false},
+		{"photo.jpg.edit.json", false},
+		{"photo.jpg.xmp", false},
+		{"photo.xmp", false},
+		{"photo.jpg.txt", false},
+		{"orphan.nef", false},
+		{"notes.md", false},
+		{"upload.gpx.tmp", false},
+	}
+	for _, tt := range tests {
+		if got := streamable(filepath.Join(dir, tt.name)); got != tt.want {
+			t.Errorf("%s: streamable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMemoryMaxWidth = 300
+	defaultMemorySize     = 64 << 20
+)
+
+// memoryCacheConf keeps the small thumbnails in memory, in front of the cache
+// backend, so the thumbnails of the slideshows and index pages are served
+// without opening a file or querying the backend. The least recently used
+// thumbnails are evicted once size is reached.
+//
+//	memorycache:
+//	  maxwidth: 400
+//	  size: 128MB
+type memoryCacheConf struct {
+	// MaxWidth is the width of the largest thumbnails kept in memory,
+	// 300 pixels by default
+	MaxWidth uint
+	// Size is the memory used by the thumbnails, 64MB by default
+	Size     string
+	Disabled bool
+}
+
+// memoryCache is a least recently used cache of thumbnails, by the key of
+// their entry in the cache backend
+type memoryCache struct {
+	sync.Mutex
+	max, used int64
+	lru       *list.List
+	entries   map[string]*list.Element
+}
+
+// memoryEntry is a thumbnail of the memory cache
+type memoryEntry struct {
+	key     string
+	data    []byte
+	modtime time.Time
+}
+
+var thumbMemory = &memoryCache{
+	max:     defaultMemorySize,
+	lru:     list.New(),
+	entries: make(map[string]*list.Element),
+}
+
+// initMemoryCache sets the size of the memory cache of the configuration
+func initMemoryCache() error {
+	size, err := parseSize(conf.MemoryCache.Size)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		thumbMemory.max = size
+	}
+	return nil
+}
+
+// inMemory returns true if the thumbnails of the given width are kept in
+// memory
+func inMemory(width uint) bool {
+	max := conf.MemoryCache.MaxWidth
+	if max == 0 {
+		max = defaultMemoryMaxWidth
+	}
+	return !conf.MemoryCache.Disabled && width > 0 && width <= max
+}
+
+// get returns the content of a thumbnail and the time it was generated
+func (c *memoryCache) get(key string) ([]byte, time.Time, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	c.lru.MoveToFront(el)
+	e := el.Value.(*memoryEntry)
+	return e.data, e.modtime, true
+}
+
+// memoryStats are the metrics of the memory cache
+type memoryStats struct {
+	Entries int   `json:"entries"`
+	Used    int64 `json:"used"`
+	Max     int64 `json:"max"`
+}
+
+// stats returns the number of thumbnails in memory, and the memory they use
+func (c *memoryCache) stats() memoryStats {
+	c.Lock()
+	defer c.Unlock()
+	return memoryStats{Entries: len(c.entries), Used: c.used, Max: c.max}
+}
+
+// put adds a thumbnail, and evicts the least recently used ones to make room
+// for it. The data must not be modified afterwards.
+func (c *memoryCache) put(key string, data []byte, modtime time.Time) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, data: data, modtime: modtime})
+	c.used += int64(len(data))
+	for c.used > c.max {
+		oldest := c.lru.Back()
+		e := oldest.Value.(*memoryEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, e.key)
+		c.used -= int64(len(e.data))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxBatchSize is the maximum number of images changed by a single request
+const maxBatchSize = 1000
+
+// metadataChange is the json body of a batch metadata edit. Fields that are
+// absent are left unchanged.
+type metadataChange struct {
+	// Paths are relative to the root of the gallery, such as
+	// "album/photo.jpg"
+	Paths   []string  `json:"paths"`
+	Title   *string   `json:"title"`
+	Caption *string   `json:"caption"`
+	Rating  *int      `json:"rating"`
+	Tags    tagChange `json:"tags"`
+	// XMP writes the metadata of the images back to XMP sidecar files, as
+	// every change does when xmp write is configured
+	XMP bool `json:"xmp"`
+}
+
+// imageMetadata is the metadata of an image returned by the batch api
+type imageMetadata struct {
+	Path     string   `json:"path"`
+	Title    string   `json:"title,omitempty"`
+	Caption  string   `json:"caption,omitempty"`
+	Rating   int      `json:"rating,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// patchImages applies a metadata change to a list of images at once, for
+// bulk curation from scripts. The change is applied to all the images, or
+// to none of them if one is missing.
+func patchImages(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	var change metadataChange
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&change); err != nil ||
+		len(change.Paths) == 0 || len(change.Paths) > maxBatchSize ||
+		(change.Rating != nil && (*change.Rating < 0 || *change.Rating > 5)) {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	paths := make([]string, len(change.Paths))
+	for i, p := range change.Paths {
+		paths[i] = filepath.Join("gallery", filepath.Clean("/"+p))
+		if !canEdit(username, paths[i]) {
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+	entries, err := index.update(paths, func(e *mediaEntry) {
+		if change.Title != nil {
+			e.Title = strings.TrimSpace(*change.Title)
+		}
+		if change.Caption != nil {
+			e.Caption = strings.TrimSpace(*change.Caption)
+		}
+		if change.Rating != nil {
+			e.Rating = *change.Rating
+		}
+		e.changeTags(change.Tags.Add, change.Tags.Remove)
+	})
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if err != nil {
+		logErrorf("metadata: failed to update %d images: %v", len(paths), err)
+		writeError(w, r, http.StatusInternalServerError, "metadata_failed")
+		return
+	}
+	logInfof("metadata: user %q updated %d images", username, len(entries))
+	response := struct {
+		Images []imageMetadata `json:"images"`
+		// XMPFailed lists the images whose sidecar could not be written,
+		// while their metadata was saved in the index
+		XMPFailed []string `json:"xmp_failed,omitempty"`
+	}{Images: []imageMetadata{}}
+	for _, e := range entries {
+		path := strings.TrimPrefix(e.Path, "gallery/")
+		response.Images = append(response.Images, imageMetadata{
+			Path:     path,
+			Title:    e.Title,
+			Caption:  e.Caption,
+			Rating:   e.Rating,
+			Tags:     e.Tags,
+			Keywords: e.Keywords,
+		})
+		if change.XMP || conf.XMP.Write {
+			if err := writeXMPSidecar(e); err != nil {
+				logErrorf("metadata: failed to write xmp sidecar of %q: %v", e.Path, err)
+				response.XMPFailed = append(response.XMPFailed, path)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// xmpCreatorTool marks the sidecars written by the gallery, which are the
+// only ones it overwrites
+const xmpCreatorTool = `xmp:CreatorTool="galilego"`
+
+// xmpSidecarPath returns the path of the XMP sidecar of an image, named
+// after the image without its extension, as photo managers expect
+func xmpSidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".xmp"
+}
+
+// writeXMPSidecar writes the title, caption, rating and tags of an image to
+// its XMP sidecar file. Sidecars created by other applications, such as
+// photo managers, are only updated when xmp write is configured, and are
+// never overwritten.
+func writeXMPSidecar(e mediaEntry) error {
+	path, _, _ := findXMPSidecar(e.Path)
+	if existing, err := ioutil.ReadFile(path); err == nil && !bytes.Contains(existing, []byte(xmpCreatorTool)) {
+		if !conf.XMP.Write {
+			return fmt.Errorf("%q was not written by galilego", path)
+		}
+		if err = ioutil.WriteFile(path+".tmp", updateXMPPacket(existing, e), 0644); err != nil {
+			return err
+		}
+		return os.Rename(path+".tmp", path)
+	}
+	esc := func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	}
+	var subjects string
+	for _, tag := range e.Tags {
+		subjects += "\n\t\t\t\t\t<rdf:li>" + esc(tag) + "</rdf:li>"
+	}
+	xmp := `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+	<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+		<rdf:Description rdf:about=""
+			xmlns:dc="http://purl.org/dc/elements/1.1/"
+			xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+			` + xmpCreatorTool + `
+			xmp:Rating="` + strconv.Itoa(e.Rating) + `">
+			<dc:title><rdf:Alt><rdf:li xml:lang="x-default">` + esc(e.Title) + `</rdf:li></rdf:Alt></dc:title>
+			<dc:description><rdf:Alt><rdf:li xml:lang="x-default">` + esc(e.Caption) + `</rdf:li></rdf:Alt></dc:description>
+			<dc:subject>
+				<rdf:Bag>` + subjects + `
+				</rdf:Bag>
+			</dc:subject>
+		</rdf:Description>
+	</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+	if err := ioutil.WriteFile(path+".tmp", []byte(xmp), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mimeConf selects how the types of the files of the gallery are detected.
+// By default they are known by their extension. With sniff, the first 512
+// bytes of the files set the Content-Type of the originals, and files whose
+// content is of another kind than their extension, such as an html page
+// named photo.jpg, are left out of the albums and refused. A png named
+// photo.jpg is still served, as image/png. With extensionless, files without
+// an extension whose content is an image, as exported by some phones, are
+// shown like photos.
+//
+//	mime:
+//	  sniff: true
+//	  extensionless: true
+type mimeConf struct {
+	Sniff         bool
+	Extensionless bool
+}
+
+// sniffCacheSize is the number of files whose sniffed type is remembered,
+// the least recently used being forgotten first
+const sniffCacheSize = 10000
+
+// sniffedType is the type of the content of a file, valid as long as the
+// file keeps its size and modification time
+type sniffedType struct {
+	path    string
+	size    int64
+	modtime time.Time
+	ctype   string
+}
+
+// sniffCache is a least recently used cache of the sniffed types, by the
+// path of their file
+var sniffCache = struct {
+	sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}{lru: list.New(), entries: make(map[string]*list.Element)}
+
+// sniffType returns the type of the content of the file at path, detected
+// from its first 512 bytes, such as "image/jpeg", or
+// "application/octet-stream" if it is not known
+func sniffType(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	sniffCache.Lock()
+	el, ok := sniffCache.entries[path]
+	if ok {
+		sniffCache.lru.MoveToFront(el)
+		s := el.Value.(*sniffedType)
+		if s.size == fi.Size() && s.modtime.Equal(fi.ModTime()) {
+			sniffCache.Unlock()
+			return s.ctype, nil
+		}
+	}
+	sniffCache.Unlock()
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	ctype := http.DetectContentType(head[:n])
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	sniffCache.Lock()
+	defer sniffCache.Unlock()
+	s := &sniffedType{path: path, size: fi.Size(), modtime: fi.ModTime(), ctype: ctype}
+	if el, ok := sniffCache.entries[path]; ok {
+		el.Value = s
+		sniffCache.lru.MoveToFront(el)
+		return ctype, nil
+	}
+	sniffCache.entries[path] = sniffCache.lru.PushFront(s)
+	for sniffCache.lru.Len() > sniffCacheSize {
+		oldest := sniffCache.lru.Back()
+		sniffCache.lru.Remove(oldest)
+		delete(sniffCache.entries, oldest.Value.(*sniffedType).path)
+	}
+	return ctype, nil
+}
+
+// extensionType returns the type of a file known by its extension, or an
+// empty string
+func extensionType(path string) string {
+	ctype := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = ctype[:i]
+	}
+	return ctype
+}
+
+// contentMatches returns true if the content of the file at path is of the
+// kind of its extension, such as an image for photo.jpg. Contents that are
+// not recognized, such as tiff images and most videos, are not refused.
+func contentMatches(path string) bool {
+	ctype, err := sniffType(path)
+	if err != nil || ctype == "application/octet-stream" {
+		return true
+	}
+	ext := extensionType(path)
+	if ext == "" || textFormat(ctype, ext) {
+		return true
+	}
+	kind := func(t string) string { return t[:strings.Index(t+"/", "/")] }
+	return kind(ext) == kind(ctype)
+}
+
+// textFormat returns true if the sniffed type ctype is the plain text or xml
+// of a file whose extension is a more precise format, such as a gpx track
+// sniffed as text/xml
+func textFormat(ctype, ext string) bool {
+	return (ctype == "text/plain" || ctype == "text/xml") &&
+		(strings.HasSuffix(ext, "+xml") || strings.HasSuffix(ext, "+json") || strings.HasPrefix(ext, "text/"))
+}
+
+// isImage returns true if the file at path is shown as a photo: an image
+// by its extension, whose content is an image if sniffing is enabled, or a
+// file without extension whose content is an image if those are enabled
+func isImage(path string) bool {
+	if imgre.MatchString(path) {
+		return !conf.MIME.Sniff || contentMatches(path)
+	}
+	if !conf.MIME.Extensionless || filepath.Ext(path) != "" {
+		return false
+	}
+	ctype, err := sniffType(path)
+	return err == nil && strings.HasPrefix(ctype, "image/")
+}
+
+// originalType sets the Content-Type of the original of the file at path
+// from its content when sniffing is enabled, unless its extension names a
+// more precise text format, and returns false after
+// refusing the files whose content does not match their extension. Without
+// sniffing, http.ServeContent sets the type from the extension.
+func originalType(w http.ResponseWriter, r *http.Request, path string) bool {
+	if !conf.MIME.Sniff && (!conf.MIME.Extensionless || filepath.Ext(path) != "") {
+		return true
+	}
+	if !contentMatches(path) {
+		logWarnf("mime: refusing %q, whose content does not match its extension", path)
+		writeError(w, r, http.StatusUnsupportedMediaType, "content_mismatch")
+		return false
+	}
+	if ctype, err := sniffType(path); err == nil && ctype != "application/octet-stream" && !textFormat(ctype, extensionType(path)) {
+		if strings.HasPrefix(ctype, "text/") {
+			ctype += "; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+	return true
+}
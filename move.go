@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errAlbumExists   = errors.New("the destination album already exists")
+	errAlbumArchived = errors.New("the album is archived")
+	errMoveInvalid   = errors.New("an album cannot be moved into itself")
+	errScanBusy      = errors.New("a scan is running")
+)
+
+// albumMove is the body of a request to the album move api. From is moved
+// to To, which must not exist, or merged into it with Merge, in which case
+// none of the files of From may already exist in To.
+type albumMove struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Merge bool   `json:"merge"`
+}
+
+// albumMoveResult reports what was moved and updated along with the album
+type albumMoveResult struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Merged bool   `json:"merged"`
+	// Files are the files moved, and Photos the entries of the index
+	// moved with their tags, titles and ratings
+	Files  int `json:"files"`
+	Photos int `json:"photos"`
+	// Selections and Shares are the shared selections and views, and the
+	// shareable albums, whose photos were in the album
+	Selections int `json:"selections"`
+	Shares     int `json:"shares"`
+	// Collisions are the files of the album that already exist in the
+	// destination, which prevent a merge
+	Collisions []string `json:"collisions,omitempty"`
+}
+
+// movedPath returns the path of a file or album of src once src is moved to
+// dst, and false if path is not part of src
+func movedPath(path, src, dst string) (string, bool) {
+	if path == src {
+		return dst, true
+	}
+	if strings.HasPrefix(path, src+"/") {
+		return dst + strings.TrimPrefix(path, src), true
+	}
+	return path, false
+}
+
+// moveCollisions returns the files of src, relative to it, that already
+// exist in dst
+func moveCollisions(src, dst string) (collisions []string, err error) {
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Lstat(filepath.Join(dst, rel)); err == nil {
+			collisions = append(collisions, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return
+}
+
+// mergeDirs moves the files of src into dst, along with its sub albums, and
+// removes the directories of src. The files already moved are moved back if
+// one of them cannot be moved.
+func mergeDirs(src, dst string) (moved int, err error) {
+	var files, dirs []string
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, path := range files {
+		dest, _ := movedPath(path, src, dst)
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err == nil {
+			err = os.Rename(path, dest)
+		}
+		if err != nil {
+			for _, path := range files[:i] {
+				dest, _ := movedPath(path, src, dst)
+				if rerr := os.Rename(dest, path); rerr != nil {
+					logErrorf("move: failed to move %q back to %q: %v", dest, path, rerr)
+				}
+			}
+			return 0, err
+		}
+	}
+	// the deepest directories are removed first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if rerr := os.Remove(dirs[i]); rerr != nil {
+			logWarnf("move: failed to remove %q: %v", dirs[i], rerr)
+		}
+	}
+	return len(files), nil
+}
+
+// moveFiles moves the album src to dst, or merges it into dst, and returns
+// the number of files moved
+func moveFiles(src, dst string, merge bool) (int, error) {
+	if merge {
+		return mergeDirs(src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return 0, err
+	}
+	moved := 0
+	filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			moved++
+		}
+		return nil
+	})
+	return moved, nil
+}
+
+// moveAlbum moves the album src to dst, or merges it into dst, and moves
+// along the entries of the index, the photos of the shared selections and
+// the shareable albums, and the sprite sheets of the cache, which are keyed
+// by path. Thumbnails are keyed by the content of the photos and need not
+// move. The move holds the place of a scan, so the index is not scanned in
+// the meantime, and the destination is scanned once the files are moved.
+func moveAlbum(req albumMove, username string) (albumMoveResult, error) {
+	src := filepath.Join("gallery", filepath.Clean("/"+req.From))
+	dst := filepath.Join("gallery", filepath.Clean("/"+req.To))
+	result := albumMoveResult{From: strings.TrimPrefix(src, "gallery/"), To: strings.TrimPrefix(dst, "gallery/"), Merged: req.Merge}
+	if fi, err := os.Stat(src); src == "gallery" || err != nil || !fi.IsDir() {
+		return result, errNotAlbum
+	}
+	if _, inside := movedPath(dst, src, dst); dst == "gallery" || inside {
+		return result, errMoveInvalid
+	}
+	fi, err := os.Stat(dst)
+	switch {
+	case err == nil && !req.Merge:
+		return result, errAlbumExists
+	case err == nil && !fi.IsDir():
+		return result, errAlbumExists
+	case err != nil && req.Merge:
+		return result, errNotAlbum
+	}
+	// nor the archived albums, nor the albums they contain, can be moved
+	// or receive photos
+	if isArchived(src) || isArchived(dst) {
+		return result, errAlbumArchived
+	}
+	for _, dir := range archivedAlbums() {
+		if _, inside := movedPath(dir, src, dst); inside {
+			return result, errAlbumArchived
+		}
+	}
+	if req.Merge {
+		if result.Collisions, err = moveCollisions(src, dst); err != nil {
+			return result, err
+		}
+		if len(result.Collisions) > 0 {
+			return result, errAlbumExists
+		}
+	}
+	if conf.Stateless && !index.store.lock() {
+		return result, errScanBusy
+	}
+	job := startScan(dst, false)
+	if job == nil {
+		if conf.Stateless {
+			index.store.unlock()
+		}
+		return result, errScanBusy
+	}
+	if result.Files, err = moveFiles(src, dst, req.Merge); err != nil {
+		job.finish(err)
+		if conf.Stateless {
+			index.store.unlock()
+		}
+		return result, err
+	}
+	logInfof("move: user %q moved %d files of %q to %q", username, result.Files, src, dst)
+	// entries are replaced rather than modified, as copies of the pointers
+	// are saved without holding the lock
+	index.Lock()
+	for path, old := range index.entries {
+		if moved, ok := movedPath(path, src, dst); ok {
+			e := *old
+			e.Path = moved
+			delete(index.entries, path)
+			index.entries[moved] = &e
+			invalidateListing(filepath.Dir(path))
+			invalidateListing(filepath.Dir(moved))
+			result.Photos++
+		}
+	}
+	index.Unlock()
+	result.Selections = moveSelections(src, dst)
+	result.Shares = moveShares(src, dst)
+	moveHomeAlbum(src, dst)
+	if c, ok := imgCache.(cacheMover); ok {
+		moveCachedAlbum(c, src, dst, req.Merge)
+	}
+	// the scan saves the index, and reads the metadata of the merged
+	// photos that changed
+	index.rescan(job)
+	if conf.Stateless {
+		index.store.unlock()
+	}
+	return result, nil
+}
+
+// moveSelections replaces the paths of the photos of src in the shared
+// selections, and of the albums and hidden photos of src in the views, and
+// returns the number of selections and views that changed
+func moveSelections(src, dst string) (count int) {
+	stored, err := virtualAlbums.albums()
+	if err != nil {
+		logErrorf("move: failed to list virtual albums: %v", err)
+		return
+	}
+	for _, a := range stored {
+		changed := false
+		photos := make([]string, len(a.Photos))
+		for i, path := range a.Photos {
+			photos[i], _ = movedPath(path, src, dst)
+			changed = changed || photos[i] != path
+		}
+		a.Photos = photos
+		if a.view() {
+			album, moved := movedPath(a.albumPath(), src, dst)
+			a.Album = strings.TrimPrefix(album, "gallery/")
+			changed = changed || moved
+			hidden := make([]string, len(a.Hidden))
+			for i, path := range a.Hidden {
+				hidden[i], _ = movedPath(path, src, dst)
+				changed = changed || hidden[i] != path
+			}
+			a.Hidden = hidden
+		}
+		if !changed {
+			continue
+		}
+		// the stores have no update, the virtual album is replaced
+		if err = virtualAlbums.remove(a.Name); err == nil {
+			err = virtualAlbums.add(a)
+		}
+		if err != nil {
+			logErrorf("move: failed to update virtual album %q: %v", a.Name, err)
+			continue
+		}
+		count++
+	}
+	return
+}
+
+// moveShares points the shareable albums of src to dst, so their links
+// keep working until the process restarts. The configuration cannot be
+// rewritten, and must be updated by the admins.
+func moveShares(src, dst string) (count int) {
+	from, to := strings.TrimPrefix(src, "gallery/"), strings.TrimPrefix(dst, "gallery/")
+	shares := append([]shareConf(nil), conf.Sharing...)
+	for i, s := range shares {
+		if album, ok := movedPath(s.Album, from, to); ok {
+			logWarnf("move: the shareable album %q is now %q, update the sharing configuration", s.Album, album)
+			shares[i].Album = album
+			count++
+		}
+	}
+	conf.Sharing = shares
+	return
+}
+
+// moveHomeAlbum replaces a top level album pinned or hidden by the admins
+// with its new name, or drops it once it is no longer a top level album
+func moveHomeAlbum(src, dst string) {
+	from, to := strings.TrimPrefix(src, "gallery/"), strings.TrimPrefix(dst, "gallery/")
+	if strings.Contains(from, "/") {
+		return
+	}
+	layout, err := homeLayouts.layout()
+	if err != nil {
+		logErrorf("move: failed to load the layout of the home page: %v", err)
+		return
+	}
+	pinned, hidden := indexOf(layout.Pinned, from) >= 0, indexOf(layout.Hidden, from) >= 0
+	if !pinned && !hidden {
+		return
+	}
+	layout.Pinned, layout.Hidden = removeValue(layout.Pinned, from), removeValue(layout.Hidden, from)
+	if !strings.Contains(to, "/") {
+		if pinned {
+			layout.Pinned = appendMissing(layout.Pinned, to)
+		}
+		if hidden {
+			layout.Hidden = appendMissing(layout.Hidden, to)
+		}
+	}
+	if err = homeLayouts.save(layout); err != nil {
+		logErrorf("move: failed to save the layout of the home page: %v", err)
+	}
+}
+
+// moveCachedAlbum moves the sprite sheets of src, and of its sub albums,
+// to dst. Those of a merged album do not match the photos of the
+// destination, and are removed like the previews of shareable albums, which
+// are generated again when they are requested.
+func moveCachedAlbum(c cacheMover, src, dst string, merge bool) {
+	var err error
+	if merge {
+		err = c.remove("sprites/" + src + "/")
+	} else {
+		err = c.relocate("sprites/"+src+"/", "sprites/"+dst+"/")
+	}
+	if err != nil {
+		logErrorf("cache: failed to move the sprite sheets of %q: %v", src, err)
+	}
+	for _, prefix := range []string{"previews/" + src + "_", "previews/" + src + "/", "previews/" + dst + "_"} {
+		if err = c.remove(prefix); err != nil {
+			logErrorf("cache: failed to remove the previews of %q: %v", prefix, err)
+		}
+	}
+}
+
+// moveError replies to a move that failed with the error of err
+func moveError(w http.ResponseWriter, r *http.Request, req albumMove, err error) {
+	switch err {
+	case errNotAlbum:
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+	case errMoveInvalid:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+	case errAlbumExists:
+		writeError(w, r, http.StatusConflict, "album_exists")
+	case errAlbumArchived:
+		writeError(w, r, http.StatusForbidden, "album_archived")
+	case errScanBusy:
+		writeError(w, r, http.StatusConflict, "scan_busy")
+	default:
+		logErrorf("move: failed to move %q to %q: %v", req.From, req.To, err)
+		writeError(w, r, http.StatusInternalServerError, "move_failed")
+	}
+}
+
+// albumsView lets admins move and merge albums
+func albumsView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "move_albums")+`</h1>
+		<form method="POST" action="`+link("/admin/albums")+`"><input type="text" name="from" placeholder="album/subalbum"/> <input type="text" name="to" placeholder="album/subalbum"/> <label><input type="checkbox" name="merge" value="1"/> `+
+		tr(locale, "merge_albums")+`</label> <button type="submit">`+tr(locale, "move_album")+`</button></form>
+	</body>
+</html>`))
+}
+
+// albumsAction moves or merges the album of the form, and shows the album
+// once moved
+func albumsAction(w http.ResponseWriter, r *http.Request) {
+	req := albumMove{From: r.FormValue("from"), To: r.FormValue("to"), Merge: r.FormValue("merge") != ""}
+	result, err := moveAlbum(req, requestUser(r))
+	if err != nil {
+		if len(result.Collisions) > 0 {
+			writeErrorMessage(w, r, http.StatusConflict, fmt.Sprintf(tr(requestLocale(r), "merge_collisions"), len(result.Collisions)))
+			return
+		}
+		moveError(w, r, req, err)
+		return
+	}
+	http.Redirect(w, r, link("/gallery/"+result.To+"/"), http.StatusSeeOther)
+}
+
+// apiMoveAlbum moves or merges the album of the json body, and returns what
+// was moved. A merge prevented by files that exist in both albums returns
+// their list.
+func apiMoveAlbum(w http.ResponseWriter, r *http.Request) {
+	var req albumMove
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<12)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	result, err := moveAlbum(req, requestUser(r))
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Collisions) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	if err != nil {
+		w.Header().Del("Content-Type")
+		moveError(w, r, req, err)
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
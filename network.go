@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// networkConf restricts the addresses from which the gallery, or some of its
+// top level albums, can be reached. Rules are evaluated before
+// authentication, so clients outside of them cannot even try credentials.
+// Countries are ISO codes looked up in a MaxMind database, such as
+// GeoLite2-Country.mmdb.
+//
+//	network:
+//	  geoipdb: /var/lib/GeoIP/GeoLite2-Country.mmdb
+//	  allow: [192.168.0.0/16, 2001:db8::/32]
+//	  countries: [FR, BE]
+//	  roots:
+//	    family:
+//	      allow: [192.168.1.0/24]
+//	    travels:
+//	      denycountries: [RU]
+type networkConf struct {
+	GeoIPDB string
+	// the rules of the whole gallery are inlined
+	networkRules `yaml:",inline"`
+	// Roots are the rules of top level albums, which also have to pass
+	// those of the gallery
+	Roots map[string]networkRules
+}
+
+// networkRules refuses the addresses of deny and of the denycountries.
+// When allow or countries are set, the other addresses are only accepted if
+// they are in allow or in one of the countries.
+type networkRules struct {
+	Allow         []string
+	Deny          []string
+	Countries     []string
+	DenyCountries []string
+}
+
+// accessList is the parsed version of networkRules
+type accessList struct {
+	allow, deny              []*net.IPNet
+	countries, denyCountries map[string]bool
+}
+
+var (
+	galleryAccess *accessList
+	rootAccess    map[string]*accessList
+	geoip         *geoipDB
+	// forwarders are the proxies whose X-Forwarded-For header is trusted
+	forwarders *proxyAuth
+)
+
+// initNetwork parses the network rules of the configuration, and opens the
+// geoip database
+func initNetwork() (err error) {
+	nc := conf.Network
+	if nc.GeoIPDB != "" {
+		geoip, err = openGeoIP(nc.GeoIPDB)
+		if err != nil {
+			return fmt.Errorf("network: %v", err)
+		}
+	}
+	if galleryAccess, err = parseNetworkRules(nc.networkRules); err != nil {
+		return err
+	}
+	rootAccess = make(map[string]*accessList)
+	for root, rules := range nc.Roots {
+		if rootAccess[root], err = parseNetworkRules(rules); err != nil {
+			return err
+		}
+	}
+	if len(conf.TrustedProxies) > 0 {
+		p, err := newProxyAuth(conf.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		forwarders = &p
+	}
+	if galleryAccess == nil && len(rootAccess) == 0 {
+		return nil
+	}
+	// requests received on unix domain sockets have no address, so the
+	// rules can only be enforced with the one forwarded by a local proxy
+	listeners := conf.Listeners
+	if conf.Listen != "" {
+		listeners = append([]listenerConf{{Address: conf.Listen}}, listeners...)
+	}
+	for _, lc := range listeners {
+		if strings.HasPrefix(lc.Address, unixPrefix) && (forwarders == nil || !forwarders.unix) {
+			return fmt.Errorf("network: rules cannot be enforced on %s unless trustedproxies includes unix", lc.Address)
+		}
+	}
+	return nil
+}
+
+// parseNetworkRules returns the access list of rules, or nil if they are
+// empty
+func parseNetworkRules(rules networkRules) (*accessList, error) {
+	if len(rules.Allow)+len(rules.Deny)+len(rules.Countries)+len(rules.DenyCountries) == 0 {
+		return nil, nil
+	}
+	if len(rules.Countries)+len(rules.DenyCountries) > 0 && geoip == nil {
+		return nil, fmt.Errorf("network: country rules require a geoipdb")
+	}
+	a := &accessList{
+		countries:     make(map[string]bool),
+		denyCountries: make(map[string]bool),
+	}
+	for _, list := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{{rules.Allow, &a.allow}, {rules.Deny, &a.deny}} {
+		for _, cidr := range list.cidrs {
+			if !strings.Contains(cidr, "/") {
+				if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("network: invalid address %q: %v", cidr, err)
+			}
+			*list.nets = append(*list.nets, ipnet)
+		}
+	}
+	for _, c := range rules.Countries {
+		a.countries[strings.ToUpper(c)] = true
+	}
+	for _, c := range rules.DenyCountries {
+		a.denyCountries[strings.ToUpper(c)] = true
+	}
+	return a, nil
+}
+
+// permits returns true if the rules accept ip. The country of ip is only
+// looked up if the rules need it.
+func (a *accessList) permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	country := ""
+	if len(a.countries)+len(a.denyCountries) > 0 {
+		var err error
+		if country, err = geoip.country(ip); err != nil {
+			logErrorf("network: failed to look up the country of %s: %v", ip, err)
+		}
+	}
+	if a.denyCountries[country] {
+		return false
+	}
+	if len(a.allow)+len(a.countries) == 0 {
+		return true
+	}
+	return a.countries[country]
+}
+
+// clientAddress returns the address of the client of a request, or nil for
+// requests received on unix domain sockets. Behind a trusted proxy, it is
+// the last address that the proxy added to X-Forwarded-For.
+func clientAddress(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if forwarders != nil && forwarders.trusted(r) {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if fip := net.ParseIP(strings.TrimSpace(forwarded[len(forwarded)-1])); fip != nil {
+			ip = fip
+		}
+	}
+	return ip
+}
+
+// reachable returns true if the top level album root, or the whole gallery
+// if root is empty, can be reached from ip. The requests received on unix
+// domain sockets without X-Forwarded-For have no address, and are only
+// accepted where no rules apply.
+func reachable(ip net.IP, root string) bool {
+	if ip == nil {
+		return galleryAccess == nil && (root == "" || rootAccess[root] == nil)
+	}
+	if !galleryAccess.permits(ip) {
+		return false
+	}
+	return root == "" || rootAccess[root].permits(ip)
+}
+
+// reachableFilter returns the filter of the photos the user of the request
+// can see from its address, without those of the top level albums
+// restricted to other networks
+func reachableFilter(r *http.Request) func(path string) bool {
+	visible, ip := viewFilter(requestUser(r)), clientAddress(r)
+	return func(path string) bool {
+		return visible(path) && reachable(ip, rootOf(path))
+	}
+}
+
+// requireNetwork refuses the requests whose address is not accepted by the
+// network rules of the gallery, or of the top level album they request
+func requireNetwork(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if galleryAccess == nil && len(rootAccess) == 0 {
+			pass(w, r)
+			return
+		}
+		root := ""
+		if galpath, ok := mux.Vars(r)["galpath"]; ok {
+			root = rootOf(filepath.Join("gallery", filepath.Clean("/"+galpath)))
+		}
+		ip := clientAddress(r)
+		if !reachable(ip, root) {
+			logWarnf("network: refused %s from %s", r.URL.Path, ip)
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		pass(w, r)
+	}
+}
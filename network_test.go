@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReachableListings(t *testing.T) {
+	oldIndex, oldGallery, oldRoots := index, galleryAccess, rootAccess
+	defer func() {
+		index, galleryAccess, rootAccess = oldIndex, oldGallery, oldRoots
+	}()
+	captured := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	index = &mediaIndex{entries: map[string]*mediaEntry{
+		"gallery/family/a.jpg": {Path: "gallery/family/a.jpg", Captured: captured,
+			Tags: []string{"beach"}, Place: "Paris"},
+		"gallery/travels/b.jpg": {Path: "gallery/travels/b.jpg", Captured: captured,
+			Tags: []string{"beach", "desert"}, Place: "Rome"},
+	}}
+	var err error
+	galleryAccess = nil
+	rootAccess = make(map[string]*accessList)
+	if rootAccess["travels"], err = parseNetworkRules(networkRules{Allow: []string{"10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/timeline", timeline)
+	router.HandleFunc("/timeline/{root}", timeline)
+	router.HandleFunc("/tags", tagList)
+	router.HandleFunc("/tags/{tag}", tagPage)
+	router.HandleFunc("/api/tags", apiTags)
+	router.HandleFunc("/places", placeList)
+	router.HandleFunc("/places/{place}", placePage)
+	router.HandleFunc("/api/places", apiPlaces)
+	tests := []struct {
+		path   string
+		status int
+		// want is in the body of the response when it is not empty
+		want string
+	}{
+		{"/timeline", http.StatusOK, "gallery/family/a.jpg"},
+		{"/timeline/travels", http.StatusNotFound, ""},
+		{"/timeline?place=Rome", http.StatusNotFound, ""},
+		{"/tags", http.StatusOK, "beach"},
+		{"/tags/beach", http.StatusOK, "gallery/family/a.jpg"},
+		{"/tags/desert", http.StatusNotFound, ""},
+		{"/api/tags", http.StatusOK, `"beach":1`},
+		{"/places", http.StatusOK, "Paris"},
+		{"/places/Rome", http.StatusNotFound, ""},
+		{"/api/places", http.StatusOK, `"Paris":1`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, w.Code, tt.status)
+			continue
+		}
+		body := w.Body.String()
+		if tt.want != "" && !strings.Contains(body, tt.want) {
+			t.Errorf("%s: body does not contain %q", tt.path, tt.want)
+		}
+		for _, denied := range []string{"travels", "desert", "Rome"} {
+			if strings.Contains(body, denied) && !strings.Contains(tt.path, denied) {
+				t.Errorf("%s: body contains %q of the denied root", tt.path, denied)
+			}
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyDelay is how long the photos added to an album are collected before
+// a single notification is sent for all of them
+const notifyDelay = time.Minute
+
+// notifyConf sends a notification when photos are added to the watched
+// albums, to a webhook or by email.
+//
+//	notifications:
+//	  - albums: [family]
+//	    email: [alice@example.net, carol@example.net]
+//	  - albums: ["/"]
+//	    webhook: https://chat.example.net/hooks/photos
+type notifyConf struct {
+	// Albums are watched along with their sub albums, "/" watches the
+	// whole gallery
+	Albums  []string
+	Webhook string
+	Email   []string
+}
+
+// smtpConf is the mail server notifications are sent through.
+//
+//	smtp:
+//	  address: mail.example.net:587
+//	  username: galilego
+//	  password: s3cr3t
+//	  from: photos@example.net
+type smtpConf struct {
+	Address            string
+	Username, Password string
+	From               string
+}
+
+// notification describes the photos recently added to an album
+type notification struct {
+	Event string `json:"event"`
+	// Album is relative to the gallery, such as "family/2020"
+	Album  string   `json:"album"`
+	URL    string   `json:"url"`
+	Photos []string `json:"photos"`
+}
+
+// notifier delivers notifications. Webhooks and emails are built in, and
+// other notifiers can be added with registerNotifier.
+type notifier interface {
+	notify(n notification) error
+}
+
+// webhookNotifier posts notifications as json to a url
+type webhookNotifier struct {
+	url string
+}
+
+func (wh webhookNotifier) notify(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	resp, err := remoteClient.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %q returned %s", wh.url, resp.Status)
+	}
+	return nil
+}
+
+// emailNotifier mails notifications through the smtp server of the
+// configuration
+type emailNotifier struct {
+	to []string
+}
+
+// smtpAuth returns the authentication of the smtp server, or nil if it
+// accepts mails without it
+func smtpAuth() smtp.Auth {
+	if conf.SMTP.Username == "" {
+		return nil
+	}
+	host := conf.SMTP.Address
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	return smtp.PlainAuth("", conf.SMTP.Username, conf.SMTP.Password, host)
+}
+
+func (em emailNotifier) notify(n notification) error {
+	msg := "From: " + conf.SMTP.From + "\r\n" +
+		"To: " + strings.Join(em.to, ", ") + "\r\n" +
+		"Subject: " + fmt.Sprintf(tr(conf.Locale, "notify_subject"), n.Album) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		fmt.Sprintf(tr(conf.Locale, "notify_body"), len(n.Photos), n.Album) + "\r\n" +
+		n.URL + "\r\n"
+	return smtp.SendMail(conf.SMTP.Address, smtpAuth(), conf.SMTP.From, em.to, []byte(msg))
+}
+
+// watcher is a notifier of the photos added to some albums
+type watcher struct {
+	albums []string
+	notifier
+}
+
+var (
+	watchers []watcher
+	// pending collects the photos added to each album, per watcher,
+	// until they are notified
+	pending    = make(map[int]map[string][]string)
+	lastAdded  time.Time
+	notified   = make(map[string]time.Time)
+	notifyLock sync.Mutex
+)
+
+// registerNotifier adds a notifier of the photos added to albums, which are
+// watched along with their sub albums
+func registerNotifier(albums []string, n notifier) {
+	watchers = append(watchers, watcher{albums: albums, notifier: n})
+}
+
+// initNotifications registers the notifiers of the configuration
+func initNotifications() error {
+	for _, nc := range conf.Notifications {
+		if len(nc.Albums) == 0 {
+			return fmt.Errorf("notifications: no albums to watch")
+		}
+		if nc.Webhook != "" {
+			registerNotifier(nc.Albums, webhookNotifier{url: nc.Webhook})
+		}
+		if len(nc.Email) > 0 {
+			if conf.SMTP.Address == "" || conf.SMTP.From == "" {
+				return fmt.Errorf("notifications: email requires the address and from of the smtp server")
+			}
+			registerNotifier(nc.Albums, emailNotifier{to: nc.Email})
+		}
+	}
+	if err := initDigests(); err != nil {
+		return err
+	}
+	if len(watchers) > 0 {
+		go sendNotifications()
+	}
+	return nil
+}
+
+// notifyAdded records a photo added to the gallery, by an upload or found by
+// a scan. A photo is only notified once, even if it is both uploaded and
+// then found by the next scan.
+func notifyAdded(path string) {
+	if len(watchers) == 0 || !isImage(path) {
+		return
+	}
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	if _, ok := notified[path]; ok {
+		return
+	}
+	notified[path] = time.Now()
+	album := strings.TrimPrefix(filepath.ToSlash(filepath.Dir(path)), "gallery")
+	album = strings.TrimPrefix(album, "/")
+	for i, w := range watchers {
+		if !inAlbums(path, w.albums) {
+			continue
+		}
+		if pending[i] == nil {
+			pending[i] = make(map[string][]string)
+		}
+		pending[i][album] = append(pending[i][album], strings.TrimPrefix(filepath.ToSlash(path), "gallery/"))
+	}
+	lastAdded = time.Now()
+}
+
+// sendNotifications sends the pending notifications once no photo was added
+// for notifyDelay, so an upload of many photos is notified once
+func sendNotifications() {
+	for range time.Tick(notifyDelay / 4) {
+		notifyLock.Lock()
+		if len(pending) == 0 || time.Since(lastAdded) < notifyDelay {
+			notifyLock.Unlock()
+			continue
+		}
+		batches := pending
+		pending = make(map[int]map[string][]string)
+		for path, t := range notified {
+			// long enough for the photo to be indexed
+			if time.Since(t) > 24*time.Hour {
+				delete(notified, path)
+			}
+		}
+		notifyLock.Unlock()
+		for i, albums := range batches {
+			for album, photos := range albums {
+				sort.Strings(photos)
+				n := notification{
+					Event:  "photos_added",
+					Album:  album,
+					URL:    "https://" + conf.Host + link("/gallery/"),
+					Photos: photos,
+				}
+				if album != "" {
+					n.URL += album + "/"
+				}
+				if err := watchers[i].notify(n); err != nil {
+					logErrorf("notify: failed to notify %d photos added to %q: %v", len(photos), album, err)
+				}
+			}
+		}
+	}
+}
+
+// inAlbums returns true if path, such as "gallery/family/2020/a.jpg", is in
+// one of albums or of their sub albums. "/" designates the whole gallery.
+func inAlbums(path string, albums []string) bool {
+	rel := strings.TrimPrefix(filepath.ToSlash(path), "gallery")
+	for _, album := range albums {
+		album = strings.Trim(album, "/")
+		if album == "" || strings.TrimPrefix(rel, "/"+album) == "" ||
+			strings.HasPrefix(rel, "/"+album+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// photoInfo describes a photo of the random and on this day views in json
+type photoInfo struct {
+	Path        string    `json:"path"`
+	URL         string    `json:"url"`
+	Thumb       string    `json:"thumb"`
+	Placeholder string    `json:"placeholder,omitempty"`
+	Captured    time.Time `json:"captured"`
+	Tags        []string  `json:"tags,omitempty"`
+	Place       string    `json:"place,omitempty"`
+}
+
+// onThisDay is returned as json by the on this day endpoint
+type onThisDay struct {
+	// Date is the month and day of the photos, such as "10-15"
+	Date   string      `json:"date"`
+	Photos []photoInfo `json:"photos"`
+}
+
+func newPhotoInfo(e mediaEntry) photoInfo {
+	return photoInfo{
+		Path:        strings.TrimPrefix(e.Path, "gallery/"),
+		URL:         link("/" + e.Path),
+		Thumb:       link("/" + e.Path + "?width=300" + editQuery(e.Path)),
+		Placeholder: e.Placeholder,
+		Captured:    e.Captured,
+		Tags:        e.allTags(),
+		Place:       e.Place,
+	}
+}
+
+// randomPhoto picks a photo of the gallery among those selected by visible,
+// and returns false if there are none
+func randomPhoto(visible func(path string) bool) (mediaEntry, bool) {
+	var entries []mediaEntry
+	for _, e := range index.byCaptureDate("gallery/") {
+		if visible(e.Path) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return mediaEntry{}, false
+	}
+	return entries[rand.Intn(len(entries))], true
+}
+
+// sameDay returns true if captured is on the month and day of day. Photos
+// taken on February 29 show up on February 28 of the other years.
+func sameDay(captured, day time.Time) bool {
+	_, m, d := captured.Date()
+	if m == time.February && d == 29 && day.Month() == time.February && day.Day() == 28 {
+		// March 1 follows February 28 in the years without a February 29
+		return time.Date(day.Year(), time.February, 29, 0, 0, 0, 0, time.UTC).Month() == time.March
+	}
+	return m == day.Month() && d == day.Day()
+}
+
+// photosOnThisDay returns the photos selected by visible that were taken on
+// the month and day of day in the previous years, the most recent first
+func photosOnThisDay(day time.Time, visible func(path string) bool) (entries []mediaEntry) {
+	for _, e := range index.byCaptureDate("gallery/") {
+		if e.Captured.IsZero() || e.Captured.Year() >= day.Year() || !sameDay(e.Captured, day) {
+			continue
+		}
+		if visible(e.Path) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// onThisDayDate returns the day of an on this day request: today, or the
+// month and day of the date parameter, such as 12-25
+func onThisDayDate(r *http.Request) (time.Time, error) {
+	now := time.Now()
+	v := r.URL.Query().Get("date")
+	if v == "" {
+		return now, nil
+	}
+	t, err := time.Parse("01-02", v)
+	if err != nil {
+		return now, err
+	}
+	day := time.Date(now.Year(), t.Month(), t.Day(), 0, 0, 0, 0, now.Location())
+	if day.Month() != t.Month() {
+		// February 29 of a year without one, whose photos show up on
+		// February 28
+		day = day.AddDate(0, 0, -1)
+	}
+	return day, nil
+}
+
+// randomPage shows a random photo of the gallery, with a link to another
+// one
+func randomPage(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	e, ok := randomPhoto(reachableFilter(r))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	album := path.Dir(e.Path)
+	// every visit shows another photo
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "random_photo")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "random_photo")+`</h1>
+		<p><a href="`+link("/random")+`">`+tr(locale, "another_photo")+`</a> <a href="`+html.EscapeString(link("/"+album+"/"))+`">`+html.EscapeString(strings.TrimPrefix(album, "gallery/"))+`</a> `+formatDate(locale, e.Captured, false)+`</p>
+		<a href="`+html.EscapeString(link("/"+e.Path))+`"><img src="`+html.EscapeString(link("/"+e.Path+"?width=1200"+editQuery(e.Path)))+`" title="`+html.EscapeString(e.Path)+`"`+placeholderStyle(e.Path)+`/></a>
+	</body>
+</html>`)
+}
+
+// apiRandom returns a random photo of the gallery as json
+func apiRandom(w http.ResponseWriter, r *http.Request) {
+	e, ok := randomPhoto(reachableFilter(r))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(newPhotoInfo(e))
+}
+
+// onThisDayPage shows the photos taken on the same day in the previous
+// years, by year
+func onThisDayPage(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	day, err := onThisDayDate(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	entries := photosOnThisDay(day, reachableFilter(r))
+	if len(entries) == 0 {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	var photosHtml string
+	var lastYear int
+	for _, e := range entries {
+		if y := e.Captured.Year(); y != lastYear {
+			lastYear = y
+			ago := fmt.Sprintf(tr(locale, "years_ago"), day.Year()-y)
+			if day.Year()-y == 1 {
+				ago = tr(locale, "year_ago")
+			}
+			photosHtml += fmt.Sprintf(`<h2 style="font-size: 1.2em;">%d, %s</h2>`+"\n", y, ago)
+		}
+		photosHtml += fmt.Sprintf(`<a href="%s"><img src="%s?width=200&amp;crop=center%s" width="200" height="200" loading="lazy" title="%s"%s/></a>`+"\n",
+			html.EscapeString(link("/"+e.Path)), html.EscapeString(link("/"+e.Path)), html.EscapeString(editQuery(e.Path)), html.EscapeString(e.Path), placeholderStyle(e.Path))
+	}
+	// the photos change with the day
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(untilTomorrow(time.Now()).Seconds())))
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "on_this_day")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "on_this_day")+`</h1>
+		<p><a href="`+link("/timeline")+`">`+tr(locale, "timeline")+`</a> <a href="`+link("/random")+`">`+tr(locale, "random_photo")+`</a></p>
+`+photosHtml+`
+	</body>
+</html>`)
+}
+
+// apiOnThisDay returns the photos taken on the same day in the previous
+// years as json, the most recent first
+func apiOnThisDay(w http.ResponseWriter, r *http.Request) {
+	day, err := onThisDayDate(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	result := onThisDay{Date: day.Format("01-02"), Photos: []photoInfo{}}
+	for _, e := range photosOnThisDay(day, reachableFilter(r)) {
+		result.Photos = append(result.Photos, newPhotoInfo(e))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(untilTomorrow(time.Now()).Seconds())))
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// placeholderWidth is the width in pixels of the low quality placeholders
+// displayed, blurred by the browser, while images load
+const placeholderWidth = 16
+
+// genPlaceholder returns a tiny, low quality version of the image at path
+// as a data URI that can be embedded in HTML and json
+func genPlaceholder(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	if err = checkImageLimits(fd); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(fd)
+	if err != nil {
+		return "", err
+	}
+	edit := readEdit(path)
+	small := resize.Thumbnail(placeholderWidth, placeholderWidth, edit.cropImage(img), resize.Bilinear)
+	small = edit.rotateImage(small)
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, small, &jpeg.Options{Quality: 40}); err != nil {
+		return "", err
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// placeholderStyle returns the inline style that shows the placeholder of
+// an indexed image as the background of its img element
+func placeholderStyle(path string) string {
+	e, ok := index.get(path)
+	if !ok || e.Placeholder == "" {
+		return ""
+	}
+	return ` style="background: url(` + e.Placeholder + `) center / cover no-repeat;"`
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// placeList shows the places photos were taken at, with the number of
+// photos of each. The q query parameter searches the places whose name
+// contains it.
+func placeList(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	counts := index.placeCounts(reachableFilter(r))
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	places := make([]string, 0, len(counts))
+	for place := range counts {
+		if strings.Contains(strings.ToLower(place), query) {
+			places = append(places, place)
+		}
+	}
+	sort.Strings(places)
+	var placesHtml string
+	for _, place := range places {
+		placesHtml += fmt.Sprintf(`<li><a href="%s">%s</a> (%d)</li>`+"\n",
+			html.EscapeString(link("/places/"+url.PathEscape(place))), html.EscapeString(place), counts[place])
+	}
+	if placesHtml == "" {
+		placesHtml = "<p>" + tr(locale, "no_places") + "</p>"
+	} else {
+		placesHtml = "<ul>\n" + placesHtml + "</ul>"
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "places")+`</h1>
+		<form method="GET" action="`+link("/places")+`"><input type="search" name="q" value="`+html.EscapeString(query)+`"/> <button type="submit">`+tr(locale, "search")+`</button></form>
+`+placesHtml+`
+	</body>
+</html>`)
+}
+
+// placePage shows the photos taken at a place, most recent first
+func placePage(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	place := mux.Vars(r)["place"]
+	var photosHtml string
+	visible := reachableFilter(r)
+	for _, e := range index.byCaptureDate("gallery/") {
+		if !e.inPlace(place) || !visible(e.Path) {
+			continue
+		}
+		photosHtml += fmt.Sprintf(`<a href="%s"><img src="%s?width=200&amp;crop=center%s" width="200" height="200" loading="lazy" title="%s"%s/></a>`+"\n",
+			html.EscapeString(link("/"+e.Path)), html.EscapeString(link("/"+e.Path)), html.EscapeString(editQuery(e.Path)), html.EscapeString(e.Path), placeholderStyle(e.Path))
+	}
+	if photosHtml == "" {
+		writeError(w, r, http.StatusNotFound, "no_places")
+		return
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "photos_in")+` `+html.EscapeString(place)+`</h1>
+		<p><a href="`+link("/places")+`">`+tr(locale, "places")+`</a> <a href="`+html.EscapeString(link("/timeline?place="+url.QueryEscape(place)))+`">`+tr(locale, "timeline")+`</a></p>
+`+photosHtml+`
+	</body>
+</html>`)
+}
+
+// apiPlaces returns the number of photos taken at every place as json
+func apiPlaces(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index.placeCounts(reachableFilter(r)))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// potdImage describes the picture of the day in json
+type potdImage struct {
+	Date        string    `json:"date"`
+	Path        string    `json:"path"`
+	URL         string    `json:"url"`
+	Thumb       string    `json:"thumb"`
+	Placeholder string    `json:"placeholder,omitempty"`
+	Captured    time.Time `json:"captured"`
+	Tags        []string  `json:"tags,omitempty"`
+}
+
+// pictureOfTheDay picks an image of the album at galpath for the day of now,
+// among the images selected by visible. The same image is picked all day
+// long, and every instance of the gallery picks the same one, as the choice
+// only depends on the date and on the images of the index.
+func pictureOfTheDay(galpath string, now time.Time, visible func(path string) bool) (mediaEntry, bool) {
+	prefix := "gallery/"
+	if galpath != "" {
+		prefix += galpath + "/"
+	}
+	var entries []mediaEntry
+	for _, e := range index.byCaptureDate(prefix) {
+		if visible(e.Path) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return mediaEntry{}, false
+	}
+	// hashing the date spreads consecutive days across the whole album
+	sum := sha256.Sum256([]byte(now.Format("2006-01-02") + " " + prefix))
+	return entries[binary.BigEndian.Uint64(sum[:8])%uint64(len(entries))], true
+}
+
+// untilTomorrow returns the duration until the next picture of the day
+func untilTomorrow(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Sub(now)
+}
+
+// potdGalpath returns the album of a picture of the day request
+func potdGalpath(r *http.Request) string {
+	return strings.Trim(filepath.Clean("/"+mux.Vars(r)["galpath"]), "/")
+}
+
+// potdRedirect redirects to a resized version of the picture of the day, so
+// it can be embedded with an img tag. The width parameter sets its size,
+// 1200 pixels by default.
+func potdRedirect(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	e, ok := pictureOfTheDay(potdGalpath(r), now, reachableFilter(r))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	width, err := strconv.Atoi(r.URL.Query().Get("width"))
+	if err != nil || width <= 0 {
+		width = 1200
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(untilTomorrow(now).Seconds())))
+	http.Redirect(w, r, link(fmt.Sprintf("/%s?width=%d%s", e.Path, width, editQuery(e.Path))), http.StatusFound)
+}
+
+// potdInfo returns the picture of the day as json
+func potdInfo(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	e, ok := pictureOfTheDay(potdGalpath(r), now, reachableFilter(r))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "no_images")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(untilTomorrow(now).Seconds())))
+	json.NewEncoder(w).Encode(potdImage{
+		Date:        now.Format("2006-01-02"),
+		Path:        strings.TrimPrefix(e.Path, "gallery/"),
+		URL:         link("/" + e.Path),
+		Thumb:       link("/" + e.Path + "?width=300" + editQuery(e.Path)),
+		Placeholder: e.Placeholder,
+		Captured:    e.Captured,
+		Tags:        e.allTags(),
+	})
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+const (
+	defaultSlideSeconds = 3
+	maxSlideSeconds     = 60
+	minPasswordLength   = 8
+)
+
+// userProfile holds the display name and the preferences a user sets on
+// their profile page
+type userProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	// Password is the hash of the password chosen by a user of the
+	// configuration, which replaces their configured password. Users of the
+	// database have their password changed in the users table instead.
+	Password string `json:"password,omitempty"`
+	// Theme is light or dark
+	Theme string `json:"theme,omitempty"`
+	// Sort is the order of the photos of albums: name, date or shuffle
+	Sort string `json:"sort,omitempty"`
+	// SlideSeconds is the time each photo of the slideshow is shown
+	SlideSeconds int `json:"slideseconds,omitempty"`
+	// Favorites are the paths of the photos the user added to their
+	// favorites, from the index view of albums
+	Favorites []string `json:"favorites,omitempty"`
+}
+
+var (
+	profileThemes = []string{"light", "dark"}
+	profileSorts  = []string{"name", "date", "shuffle"}
+)
+
+// profileStore persists the profiles, in the database if one is configured
+// and in profilefile otherwise
+type profileStore interface {
+	// profile returns the profile of a user, which is empty if they never
+	// saved it
+	profile(username string) (userProfile, error)
+	save(username string, p userProfile) error
+}
+
+var profiles profileStore
+
+// initProfiles selects the store of the profiles, and applies the
+// preferences of users to the pages they are shown
+func initProfiles() {
+	if db != nil {
+		profiles = dbProfileStore{}
+	} else {
+		path := conf.ProfileFile
+		if path == "" {
+			path = "profiles.json"
+		}
+		profiles = &fileProfileStore{path: path}
+	}
+	registerRenderHooks(applyPreferences, darkTheme)
+}
+
+// requestProfile returns the profile of the user of the request, or an empty
+// profile for anonymous requests
+func requestProfile(r *http.Request) userProfile {
+	username := requestUser(r)
+	if username == "" || profiles == nil {
+		return userProfile{}
+	}
+	p, err := profiles.profile(username)
+	if err != nil {
+		logErrorf("profile: failed to load profile of %q: %v", username, err)
+	}
+	return p
+}
+
+// applyPreferences sets the display name of the user, the order of the
+// photos and the speed of the slideshow of the album pages. The order of an
+// album only follows the preference when the request does not select one.
+func applyPreferences(r *http.Request, name string, data interface{}) {
+	view, ok := data.(*albumView)
+	if !ok {
+		return
+	}
+	p := requestProfile(r)
+	view.UserName = p.DisplayName
+	if view.UserName == "" {
+		view.UserName = requestUser(r)
+	}
+	view.SlideInterval = defaultSlideSeconds * 1000
+	if p.SlideSeconds > 0 {
+		view.SlideInterval = p.SlideSeconds * 1000
+	}
+	if name != "album" {
+		return
+	}
+	if _, ok := r.URL.Query()["shuffle"]; ok {
+		return
+	}
+	switch p.Sort {
+	case "date":
+		sort.SliceStable(view.Photos, func(i, j int) bool {
+			return view.Photos[i].Captured.Before(view.Photos[j].Captured)
+		})
+	case "shuffle":
+		view.Seed, view.Shuffled = time.Now().UnixNano(), true
+		shuffle(view.Seed, len(view.Photos), func(i, j int) {
+			view.Photos[i], view.Photos[j] = view.Photos[j], view.Photos[i]
+		})
+	}
+}
+
+// darkStyle is added to the pages of the users who prefer the dark theme
+const darkStyle = `<style>
+			body { background: #1e1e1e; color: #ddd; }
+			a { color: #8cf; }
+		</style>
+	</head>`
+
+// darkTheme styles the pages of the users who prefer the dark theme
+func darkTheme(r *http.Request, name string, page []byte) []byte {
+	if requestProfile(r).Theme != "dark" {
+		return page
+	}
+	return bytes.Replace(page, []byte("</head>"), []byte(darkStyle), 1)
+}
+
+// profilePassword returns the hash of the password a user of the
+// configuration chose on their profile page, or an empty string if they
+// still use the password of the configuration
+func profilePassword(username string) string {
+	if profiles == nil {
+		return ""
+	}
+	p, err := profiles.profile(username)
+	if err != nil {
+		logErrorf("profile: failed to load profile of %q: %v", username, err)
+	}
+	return p.Password
+}
+
+// verifyPassword returns true if password is the current password of a user
+// of the configuration or of the database
+func verifyPassword(username, password string) bool {
+	if configured, ok := conf.Users[username]; ok {
+		if hash := profilePassword(username); hash != "" {
+			return checkPassword(hash, password)
+		}
+		// the setup wizard writes the hash of the password of the admin
+		if isPasswordHash(configured) {
+			return checkPassword(configured, password)
+		}
+		return equalSecrets(password, configured)
+	}
+	if db == nil {
+		return false
+	}
+	var hash string
+	if err := db.QueryRow(rebind(`SELECT password FROM users WHERE name = ?`), username).Scan(&hash); err != nil {
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// changePassword sets the password of a user. The passwords of the users of
+// the configuration are kept in their profile, as a hash, and those of the
+// database in its users table.
+func changePassword(username, password string) error {
+	if _, ok := conf.Users[username]; !ok {
+		if db == nil {
+			return fmt.Errorf("user %q not found", username)
+		}
+		return setUser(username, password)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	p, err := profiles.profile(username)
+	if err != nil {
+		return err
+	}
+	p.Password = hash
+	return profiles.save(username, p)
+}
+
+// profilePage shows the profile of the user, with the forms that change
+// their preferences and their password
+func profilePage(w http.ResponseWriter, r *http.Request) {
+	writeProfilePage(w, r, "")
+}
+
+func writeProfilePage(w http.ResponseWriter, r *http.Request, message string) {
+	locale := requestLocale(r)
+	username := requestUser(r)
+	if username == "" {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	p := requestProfile(r)
+	options := func(values []string, selected, prefix string) (opts string) {
+		for _, v := range values {
+			sel := ""
+			if v == selected {
+				sel = ` selected`
+			}
+			opts += `<option value="` + v + `"` + sel + `>` + tr(locale, prefix+v) + `</option>`
+		}
+		return
+	}
+	seconds := p.SlideSeconds
+	if seconds == 0 {
+		seconds = defaultSlideSeconds
+	}
+	if message != "" {
+		message = "<p><b>" + html.EscapeString(message) + "</b></p>"
+	}
+	var passwordHtml string
+	if conf.AuthMode != "proxy" {
+		passwordHtml = `<h2 style="font-size: 1.2em;">` + tr(locale, "change_password") + `</h2>
+		<form method="POST" action="` + link("/profile") + `">
+			<p><label>` + tr(locale, "current_password") + ` <input type="password" name="current" autocomplete="current-password"/></label></p>
+			<p><label>` + tr(locale, "new_password") + ` <input type="password" name="new" autocomplete="new-password"/></label></p>
+			<p><label>` + tr(locale, "confirm_password") + ` <input type="password" name="confirm" autocomplete="new-password"/></label></p>
+			<p><button type="submit" name="action" value="password">` + tr(locale, "change_password") + `</button></p>
+		</form>`
+	}
+	// the page is not cached, it changes as soon as the profile is saved
+	w.Header().Set("Cache-Control", "no-store")
+	page := []byte(`<!DOCTYPE html>
+<html lang="` + locale + `">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>` + tr(locale, "title") + `</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">` + tr(locale, "profile") + ` ` + html.EscapeString(username) + `</h1>
+		<p><a href="` + link("/") + `">` + tr(locale, "back_home") + `</a></p>
+		` + message + `
+		<form method="POST" action="` + link("/profile") + `">
+			<p><label>` + tr(locale, "display_name") + ` <input type="text" name="displayname" value="` + html.EscapeString(p.DisplayName) + `"/></label></p>
+			<p><label>` + tr(locale, "theme") + ` <select name="theme">` + options(profileThemes, p.Theme, "theme_") + `</select></label></p>
+			<p><label>` + tr(locale, "sort_order") + ` <select name="sort">` + options(profileSorts, p.Sort, "sort_") + `</select></label></p>
+			<p><label>` + tr(locale, "slide_seconds") + ` <input type="number" name="slideseconds" min="1" max="` + strconv.Itoa(maxSlideSeconds) + `" value="` + strconv.Itoa(seconds) + `"/></label></p>
+			<p><button type="submit" name="action" value="preferences">` + tr(locale, "save") + `</button></p>
+		</form>
+		` + passwordHtml + `
+	</body>
+</html>`)
+	io.WriteString(w, csrfPage(r, string(darkTheme(r, "profile", page))))
+}
+
+// profileUpdate saves the preferences of the user, or changes their password
+func profileUpdate(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	username := requestUser(r)
+	if username == "" {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	switch r.FormValue("action") {
+	case "preferences":
+		p, err := profiles.profile(username)
+		if err != nil {
+			logErrorf("profile: failed to load profile of %q: %v", username, err)
+			writeError(w, r, http.StatusInternalServerError, "profile_failed")
+			return
+		}
+		p.DisplayName = strings.TrimSpace(r.FormValue("displayname"))
+		p.Theme = oneOf(r.FormValue("theme"), profileThemes)
+		p.Sort = oneOf(r.FormValue("sort"), profileSorts)
+		p.SlideSeconds, _ = strconv.Atoi(r.FormValue("slideseconds"))
+		if p.SlideSeconds < 1 || p.SlideSeconds > maxSlideSeconds {
+			p.SlideSeconds = defaultSlideSeconds
+		}
+		if err = profiles.save(username, p); err != nil {
+			logErrorf("profile: failed to save profile of %q: %v", username, err)
+			writeError(w, r, http.StatusInternalServerError, "profile_failed")
+			return
+		}
+		writeProfilePage(w, r, tr(locale, "profile_saved"))
+	case "password":
+		// api tokens must not be turned into the password of the account
+		if _, ok := context.Get(r, scopeKey).(role); ok || conf.AuthMode == "proxy" {
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		if !verifyPassword(username, r.FormValue("current")) {
+			authFailed(r, username, "invalid current password on password change")
+			writeProfilePage(w, r, tr(locale, "wrong_password"))
+			return
+		}
+		password := r.FormValue("new")
+		if len(password) < minPasswordLength {
+			writeProfilePage(w, r, fmt.Sprintf(tr(locale, "password_too_short"), minPasswordLength))
+			return
+		}
+		if password != r.FormValue("confirm") {
+			writeProfilePage(w, r, tr(locale, "password_mismatch"))
+			return
+		}
+		if err := changePassword(username, password); err != nil {
+			logErrorf("profile: failed to change password of %q: %v", username, err)
+			writeError(w, r, http.StatusInternalServerError, "profile_failed")
+			return
+		}
+		logInfof("profile: user %q changed their password", username)
+		writeProfilePage(w, r, tr(locale, "password_changed"))
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+	}
+}
+
+// oneOf returns value if it is one of values, or the first of values
+func oneOf(value string, values []string) string {
+	for _, v := range values {
+		if value == v {
+			return v
+		}
+	}
+	return values[0]
+}
+
+// fileProfileStore keeps the profiles in a json file, by username, which is
+// read again when it changes
+type fileProfileStore struct {
+	path     string
+	mu       sync.Mutex
+	modtime  time.Time
+	profiles map[string]userProfile
+}
+
+// load reads the profile file if it changed since it was last read. The
+// caller must hold the lock.
+func (s *fileProfileStore) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.profiles, s.modtime = make(map[string]userProfile), time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modtime) && s.profiles != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]userProfile)
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("invalid profile file %q: %v", s.path, err)
+	}
+	s.profiles, s.modtime = loaded, fi.ModTime()
+	return nil
+}
+
+func (s *fileProfileStore) profile(username string) (userProfile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load()
+	return s.profiles[username], err
+}
+
+func (s *fileProfileStore) save(username string, p userProfile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	updated := make(map[string]userProfile, len(s.profiles)+1)
+	for name, old := range s.profiles {
+		updated[name] = old
+	}
+	updated[username] = p
+	data, err := json.MarshalIndent(updated, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file holds password hashes
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.profiles, s.modtime = updated, time.Time{}
+	return nil
+}
+
+// dbProfileStore keeps the profiles in the profiles table of the database,
+// as json documents
+type dbProfileStore struct{}
+
+func (dbProfileStore) profile(username string) (p userProfile, err error) {
+	var data string
+	err = db.QueryRow(rebind(`SELECT data FROM profiles WHERE username = ?`), username).Scan(&data)
+	if err == sql.ErrNoRows {
+		return p, nil
+	} else if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal([]byte(data), &p)
+	return p, err
+}
+
+func (dbProfileStore) save(username string, p userProfile) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(rebind(`DELETE FROM profiles WHERE username = ?`), username); err == nil {
+		_, err = tx.Exec(rebind(`INSERT INTO profiles (username, data) VALUES (?, ?)`), username, string(data))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// profilingConf enables a listener that serves the profiles of
+// net/http/pprof at /debug/pprof/ and the runtime metrics of expvar at
+// /debug/vars, along with those of the resize queue and of the memory cache.
+// The listener has no authentication, so it only accepts loopback
+// addresses, to be reached from the host or through an ssh tunnel.
+//
+//	profiling:
+//	  listen: 127.0.0.1:6060
+type profilingConf struct {
+	Listen string
+}
+
+// initProfiling checks the address of the profiling listener, and publishes
+// the metrics of the gallery
+func initProfiling() error {
+	if conf.Profiling.Listen == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conf.Profiling.Listen)
+	if err != nil {
+		return fmt.Errorf("profiling: invalid listen address %q: %v", conf.Profiling.Listen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("profiling: %q is not a loopback address", conf.Profiling.Listen)
+	}
+	expvar.Publish("resize_queue", expvar.Func(func() interface{} { return currentQueueStats() }))
+	expvar.Publish("memory_cache", expvar.Func(func() interface{} { return thumbMemory.stats() }))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	return nil
+}
+
+// serveProfiling starts the profiling listener in the background. Its
+// handlers are registered on a mux of their own: the listeners of the
+// gallery never serve the default mux, where net/http/pprof and expvar
+// register themselves.
+func serveProfiling() error {
+	if conf.Profiling.Listen == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	l, err := net.Listen("tcp", conf.Profiling.Listen)
+	if err != nil {
+		return fmt.Errorf("profiling: %v", err)
+	}
+	logInfof("profiling: serving pprof and expvar on http://%s/debug/", conf.Profiling.Listen)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logErrorf("profiling: %v", err)
+		}
+	}()
+	return nil
+}
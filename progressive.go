@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamWidth is the width from which resized jpeg images are sent to the
+// clients while they are encoded, rather than once complete, and encoded
+// progressively by the vips backend, so browsers render a coarse version of
+// large previews while the rest arrives
+const streamWidth = 1000
+
+// streamed returns true if the resized images of width in format are
+// streamed
+func streamed(width uint, format string) bool {
+	return width >= streamWidth && (format == "" || format == "jpeg")
+}
+
+// imageStream is a resized image being encoded, which grows as the image
+// backend writes it
+type imageStream struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	data []byte
+	done bool
+	err  error
+}
+
+func newImageStream() *imageStream {
+	s := &imageStream{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *imageStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	s.data = append(s.data, p...)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish ends the encoding, which failed if err is not nil
+func (s *imageStream) finish(err error) {
+	s.mu.Lock()
+	s.done, s.err = true, err
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// wait waits for the end of the encoding, and returns the encoded image
+func (s *imageStream) wait() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.done {
+		s.cond.Wait()
+	}
+	return s.data, s.err
+}
+
+// streamReader reads an image stream from its start, waiting for the data
+// that is not encoded yet. Seeking waits for the end of the encoding, so
+// the callers that need the whole image, such as http.ServeContent, read it
+// like a cached file.
+type streamReader struct {
+	stream *imageStream
+	offset int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	s := r.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int64(len(s.data)) <= r.offset && !s.done {
+		s.cond.Wait()
+	}
+	if int64(len(s.data)) <= r.offset {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[r.offset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *streamReader) Seek(offset int64, whence int) (int64, error) {
+	data, err := r.stream.wait()
+	if err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(len(data))
+	}
+	if offset < 0 {
+		return 0, errors.New("streamReader.Seek: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *streamReader) Close() error { return nil }
+
+// serveStream sends a resized image to the client as it is encoded. Range
+// and conditional requests get the whole image, which is new. The
+// connection is aborted if the encoding fails, so the client does not keep
+// a truncated image.
+func serveStream(w http.ResponseWriter, r *http.Request, fd *streamReader, modtime time.Time) {
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := fd.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF || errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			logErrorf("image: failed to stream %s: %v", r.URL.Path, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
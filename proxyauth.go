@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultProxyUserHeader is the header in which authenticating reverse
+// proxies, such as Authelia, pass the name of the user, unless another one is
+// set with proxyuserheader, such as X-Forwarded-User for oauth2-proxy
+const defaultProxyUserHeader = "Remote-User"
+
+// proxyAuth trusts the name of the user set in a header by a reverse proxy
+// that authenticated the request. Only requests coming from the addresses
+// of the proxies are trusted, as anyone else could set the header.
+type proxyAuth struct {
+	nets []*net.IPNet
+	// unix trusts the requests received on unix domain sockets, which
+	// come from a local proxy
+	unix bool
+	// header is the only header the name of the user is read from. The
+	// proxy must remove it from the requests of the clients, or they
+	// could log in as anyone, so no other header is ever looked at.
+	header string
+}
+
+// newProxyAuth parses the trusted proxies of the configuration, given as
+// CIDR ranges, single addresses, or "unix" for unix domain sockets
+func newProxyAuth(trusted []string) (p proxyAuth, err error) {
+	if len(trusted) == 0 {
+		return p, fmt.Errorf("auth_mode proxy requires at least one trusted proxy")
+	}
+	for _, t := range trusted {
+		if t == "unix" {
+			p.unix = true
+			continue
+		}
+		if !strings.Contains(t, "/") {
+			if ip := net.ParseIP(t); ip != nil && ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(t)
+		if err != nil {
+			return p, fmt.Errorf("invalid trusted proxy %q: %v", t, err)
+		}
+		p.nets = append(p.nets, ipnet)
+	}
+	return p, nil
+}
+
+// trusted returns true if the request was sent by a trusted proxy
+func (p proxyAuth) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// unix domain sockets have no remote address
+		return p.unix
+	}
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p proxyAuth) Authenticate(r *http.Request) (username string, ok bool) {
+	header := p.header
+	if header == "" {
+		header = defaultProxyUserHeader
+	}
+	username = strings.TrimSpace(r.Header.Get(header))
+	if username == "" {
+		authFailed(r, "", "no user header set by the proxy")
+		return "", false
+	}
+	if !p.trusted(r) {
+		authFailed(r, username, "user header sent by an untrusted address")
+		return "", false
+	}
+	return username, true
+}
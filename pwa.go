@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPWAThumbnails = 500
+	defaultPWAPages      = 100
+	defaultPWAColor      = "#333333"
+)
+
+// pwaConf makes the gallery an installable web app. Pages link a manifest
+// and register a service worker, which keeps the pages and scripts of the
+// gallery, the most recently viewed thumbnails, up to thumbnails of them
+// (500 by default), and the last albums opened, so they can be browsed
+// offline. icon is a square PNG or JPEG shown on the home screen of phones,
+// a plain square of themecolor is used otherwise.
+//
+//	pwa:
+//	  name: Family photos
+//	  shortname: Photos
+//	  themecolor: "#336699"
+//	  icon: /etc/galilego/icon.png
+//	  thumbnails: 1000
+type pwaConf struct {
+	Name, ShortName string
+	ThemeColor      string
+	Icon            string
+	Thumbnails      int
+	Disabled        bool
+}
+
+// pwaIcon is an icon of the manifest
+type pwaIcon struct {
+	sizes, ctype string
+	data         []byte
+}
+
+var (
+	// pwaIcons are the icons of the manifest by file name
+	pwaIcons map[string]pwaIcon
+	// pwaVersion names the cache of the pages and scripts of the service
+	// worker, so it is replaced when galilego is upgraded
+	pwaVersion string
+	pwaColorRe = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+// initPWA loads the icons of the manifest, and links the manifest and the
+// service worker from every page. It has to be called after initStatics,
+// as the service worker keeps the assets by their hashed name.
+func initPWA() error {
+	pc := &conf.PWA
+	// the service worker would keep the assets being worked on
+	if pc.Disabled || conf.DevMode {
+		return nil
+	}
+	if pc.ThemeColor == "" {
+		pc.ThemeColor = defaultPWAColor
+	}
+	if !pwaColorRe.MatchString(pc.ThemeColor) {
+		return fmt.Errorf("pwa: invalid themecolor %q", pc.ThemeColor)
+	}
+	if pc.Thumbnails <= 0 {
+		pc.Thumbnails = defaultPWAThumbnails
+	}
+	pwaIcons = make(map[string]pwaIcon)
+	if pc.Icon != "" {
+		data, err := ioutil.ReadFile(pc.Icon)
+		if err != nil {
+			return fmt.Errorf("pwa: %v", err)
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || (format != "png" && format != "jpeg") {
+			return fmt.Errorf("pwa: icon %q is not a PNG or JPEG image", pc.Icon)
+		}
+		pwaIcons["icon."+strings.Replace(format, "jpeg", "jpg", 1)] = pwaIcon{
+			sizes: fmt.Sprintf("%dx%d", cfg.Width, cfg.Height),
+			ctype: "image/" + format,
+			data:  data,
+		}
+	} else {
+		for _, size := range []int{192, 512} {
+			data, err := plainIcon(size, pc.ThemeColor)
+			if err != nil {
+				return fmt.Errorf("pwa: %v", err)
+			}
+			pwaIcons["icon-"+strconv.Itoa(size)+".png"] = pwaIcon{
+				sizes: fmt.Sprintf("%dx%d", size, size),
+				ctype: "image/png",
+				data:  data,
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(pwaShell(), "\n")))
+	pwaVersion = hex.EncodeToString(sum[:5])
+	registerRenderHooks(nil, pwaHead)
+	return nil
+}
+
+// plainIcon returns a PNG square of the given color, such as #336699
+func plainIcon(size int, hexColor string) ([]byte, error) {
+	c, err := parseHexColor(hexColor)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// pwaShell returns the urls kept by the service worker when it is installed:
+// the home page and the assets of the statics directory
+func pwaShell() []string {
+	shell := []string{link("/")}
+	for name, a := range staticAssets {
+		if name != a.name {
+			shell = append(shell, link("/"+staticsDir+"/"+name))
+		}
+	}
+	sort.Strings(shell[1:])
+	return shell
+}
+
+// pwaHead links the manifest from the head of the pages, and registers the
+// service worker
+func pwaHead(r *http.Request, name string, page []byte) []byte {
+	head := `<link rel="manifest" href="` + link("/manifest.webmanifest") + `">` +
+		`<meta name="theme-color" content="` + html.EscapeString(conf.PWA.ThemeColor) + `">`
+	if files := pwaIconFiles(); len(files) > 0 {
+		// the last of the generated icons is the largest
+		head += `<link rel="apple-touch-icon" href="` + link("/icons/"+files[len(files)-1]) + `">`
+	}
+	head += `<script>if ("serviceWorker" in navigator) { navigator.serviceWorker.register("` +
+		link("/sw.js") + `", {scope: "` + link("/") + `"}); }</script>`
+	return bytes.Replace(page, []byte("</head>"), []byte(head+"</head>"), 1)
+}
+
+// serveManifest serves the web app manifest, which lets phones add the
+// gallery to their home screen
+func serveManifest(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	manifest := struct {
+		Name            string              `json:"name"`
+		ShortName       string              `json:"short_name"`
+		StartURL        string              `json:"start_url"`
+		Scope           string              `json:"scope"`
+		Display         string              `json:"display"`
+		ThemeColor      string              `json:"theme_color"`
+		BackgroundColor string              `json:"background_color"`
+		Icons           []map[string]string `json:"icons"`
+	}{
+		Name:            conf.PWA.Name,
+		ShortName:       conf.PWA.ShortName,
+		StartURL:        link("/"),
+		Scope:           link("/"),
+		Display:         "standalone",
+		ThemeColor:      conf.PWA.ThemeColor,
+		BackgroundColor: "#ffffff",
+	}
+	if manifest.Name == "" {
+		manifest.Name = tr(locale, "title")
+	}
+	if manifest.ShortName == "" {
+		manifest.ShortName = "Galilego"
+	}
+	for _, file := range pwaIconFiles() {
+		manifest.Icons = append(manifest.Icons, map[string]string{
+			"src":   link("/icons/" + file),
+			"sizes": pwaIcons[file].sizes,
+			"type":  pwaIcons[file].ctype,
+		})
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// pwaIconFiles returns the file names of the icons, sorted
+func pwaIconFiles() []string {
+	var files []string
+	for file := range pwaIcons {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// serveIcon serves an icon of the manifest
+func serveIcon(w http.ResponseWriter, r *http.Request) {
+	icon, ok := pwaIcons[mux.Vars(r)["icon"]]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	w.Header().Set("Content-Type", icon.ctype)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(icon.data)
+}
+
+// pwaWorker is the service worker of the gallery. The pages and the album
+// api are fetched from the network first, and kept for when it is not
+// reachable, while the assets and the thumbnails are served from the cache
+// first. Originals, videos and every other request go to the network.
+const pwaWorker = `"use strict";
+const base = %s;
+const shellCache = "galilego-shell-" + %s;
+const pageCache = "galilego-pages";
+const thumbCache = "galilego-thumbnails";
+const shell = %s;
+const offline = %s;
+
+self.addEventListener("install", event => {
+	event.waitUntil(caches.open(shellCache).then(cache => Promise.all(shell.map(url =>
+		cache.add(new Request(url, {credentials: "same-origin"})).catch(() => {})
+	))).then(() => self.skipWaiting()));
+});
+
+self.addEventListener("activate", event => {
+	event.waitUntil(caches.keys().then(keys => Promise.all(keys
+		.filter(key => key.startsWith("galilego-shell-") && key !== shellCache)
+		.map(key => caches.delete(key))
+	)).then(() => self.clients.claim()));
+});
+
+// responses to keep, which excludes errors and those the gallery does not
+// let browsers store
+function cacheable(response) {
+	return response.ok && response.type === "basic" &&
+		!/no-store/.test(response.headers.get("Cache-Control") || "");
+}
+
+// keep stores a response, and removes the oldest ones beyond max
+async function keep(name, request, response, max) {
+	const cache = await caches.open(name);
+	await cache.put(request, response);
+	const keys = await cache.keys();
+	for (let i = 0; i < keys.length - max; i++) {
+		await cache.delete(keys[i]);
+	}
+}
+
+async function cacheFirst(name, request, max) {
+	const cached = await caches.match(request);
+	if (cached) {
+		return cached;
+	}
+	const response = await fetch(request);
+	if (cacheable(response)) {
+		await keep(name, request, response.clone(), max);
+	}
+	return response;
+}
+
+async function networkFirst(name, request, max) {
+	try {
+		const response = await fetch(request);
+		if (cacheable(response)) {
+			await keep(name, request, response.clone(), max);
+		}
+		return response;
+	} catch (err) {
+		const cached = await caches.match(request);
+		if (cached) {
+			return cached;
+		}
+		if (request.mode !== "navigate") {
+			throw err;
+		}
+		return new Response(offline, {status: 503, headers: {"Content-Type": "text/html; charset=utf-8"}});
+	}
+}
+
+self.addEventListener("fetch", event => {
+	const request = event.request;
+	const url = new URL(request.url);
+	if (request.method !== "GET" || url.origin !== location.origin || !url.pathname.startsWith(base + "/")) {
+		return;
+	}
+	const path = url.pathname.slice(base.length);
+	if (path.startsWith("/statics/")) {
+		event.respondWith(cacheFirst(shellCache, request, Infinity));
+	} else if (path.startsWith("/gallery/") && url.searchParams.has("width")) {
+		event.respondWith(cacheFirst(thumbCache, request, %d));
+	} else if (request.mode === "navigate" || path.startsWith("/api/v1/album/")) {
+		event.respondWith(networkFirst(pageCache, request, %d));
+	}
+});
+`
+
+// serveServiceWorker serves the service worker, from the root of the gallery
+// so its scope covers every page
+func serveServiceWorker(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	quote := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	offline := `<!DOCTYPE html><html lang="` + locale + `"><head><meta charset="utf-8"><title>` + tr(locale, "title") +
+		`</title></head><body><h1 style="font-size: 1.5em;">` + tr(locale, "offline") + `</h1></body></html>`
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept-Language")
+	fmt.Fprintf(w, pwaWorker, quote(conf.BasePath), quote(pwaVersion), quote(pwaShell()), quote(offline),
+		conf.PWA.Thumbnails, defaultPWAPages)
+}
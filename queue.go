@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueDepth      = 64
+	defaultQueueRetryAfter = 5 * time.Second
+)
+
+// resizeQueueConf bounds the queue of the images waiting to be resized, as
+// getImage processes one image at a time. Requests that find the queue full
+// are refused with 503 Service Unavailable and a Retry-After header, rather
+// than piling up.
+//
+//	resizequeue:
+//	  depth: 128
+//	  retryafter: 10s
+type resizeQueueConf struct {
+	Depth      int
+	RetryAfter time.Duration
+}
+
+// queueStats are the metrics of the resize queue
+type queueStats struct {
+	// Depth is the number of images waiting to be resized, out of
+	// Capacity, and MaxDepth the highest depth reached
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	MaxDepth int `json:"max_depth"`
+	// Queued counts the images that went through the queue, and Rejected
+	// those refused because it was full
+	Queued   uint64 `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+	// the wait times are those of the images in the queue, before they
+	// start being processed, in milliseconds
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+	MaxWaitMs float64 `json:"max_wait_ms"`
+}
+
+var resizeQueue struct {
+	sync.Mutex
+	stats     queueStats
+	totalWait time.Duration
+}
+
+// initResizeQueue creates the queue of the images to resize
+func initResizeQueue() {
+	depth := conf.ResizeQueue.Depth
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+	reqimage = make(chan Image, depth)
+	resizeQueue.stats.Capacity = depth
+}
+
+// queueImage adds an image to the resize queue, and returns false if the
+// queue is full
+func queueImage(img Image) bool {
+	img.queued = time.Now()
+	select {
+	case reqimage <- img:
+	default:
+		resizeQueue.Lock()
+		resizeQueue.stats.Rejected++
+		resizeQueue.Unlock()
+		return false
+	}
+	logDebugf("queue: queued %s at width %d, %d images waiting", img.path, img.size, len(reqimage))
+	resizeQueue.Lock()
+	if depth := len(reqimage); depth > resizeQueue.stats.MaxDepth {
+		resizeQueue.stats.MaxDepth = depth
+	}
+	resizeQueue.Unlock()
+	return true
+}
+
+// dequeued records the time an image waited in the queue
+func dequeued(img Image) {
+	if img.queued.IsZero() {
+		return
+	}
+	wait := time.Since(img.queued)
+	logDebugf("queue: %s waited %s", img.path, wait)
+	resizeQueue.Lock()
+	resizeQueue.stats.Queued++
+	resizeQueue.totalWait += wait
+	if ms := float64(wait) / float64(time.Millisecond); ms > resizeQueue.stats.MaxWaitMs {
+		resizeQueue.stats.MaxWaitMs = ms
+	}
+	resizeQueue.Unlock()
+}
+
+// queueFull replies to a request whose image did not fit in the queue
+func queueFull(w http.ResponseWriter, r *http.Request) {
+	retry := conf.ResizeQueue.RetryAfter
+	if retry <= 0 {
+		retry = defaultQueueRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	writeError(w, r, http.StatusServiceUnavailable, "queue_full")
+}
+
+// currentQueueStats returns the metrics of the resize queue
+func currentQueueStats() queueStats {
+	resizeQueue.Lock()
+	stats := resizeQueue.stats
+	if stats.Queued > 0 {
+		stats.AvgWaitMs = float64(resizeQueue.totalWait) / float64(time.Millisecond) / float64(stats.Queued)
+	}
+	resizeQueue.Unlock()
+	stats.Depth = len(reqimage)
+	return stats
+}
+
+// queueInfo returns the metrics of the resize queue as json
+func queueInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentQueueStats())
+}
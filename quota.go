@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadRecord attributes an uploaded file to the user who sent it
+type uploadRecord struct {
+	Time time.Time `json:"time"`
+	User string    `json:"user"`
+	Path string    `json:"path"`
+}
+
+var uploadLogLock sync.Mutex
+
+// uploadLogPath returns the path of the file that records who uploaded what
+func uploadLogPath() string {
+	if conf.UploadLog != "" {
+		return conf.UploadLog
+	}
+	return "uploads.log"
+}
+
+// recordUpload appends an upload to the upload log
+func recordUpload(username, path string) {
+	line, err := json.Marshal(uploadRecord{Time: time.Now().UTC(), User: username, Path: path})
+	if err != nil {
+		logErrorf("upload: failed to encode record: %v", err)
+		return
+	}
+	uploadLogLock.Lock()
+	defer uploadLogLock.Unlock()
+	fd, err := os.OpenFile(uploadLogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logErrorf("upload: failed to open upload log: %v", err)
+		return
+	}
+	defer fd.Close()
+	if _, err = fd.Write(append(line, '\n')); err != nil {
+		logErrorf("upload: failed to record upload: %v", err)
+	}
+}
+
+// quotaUsage is the storage used by a user: the files they uploaded that
+// still exist, and the cached thumbnails generated from these files
+type quotaUsage struct {
+	User    string `json:"user"`
+	Uploads int64  `json:"uploads"`
+	Cache   int64  `json:"cache"`
+	Used    int64  `json:"used"`
+	// Limit is zero when the user has no quota
+	Limit int64 `json:"limit"`
+}
+
+// userQuota returns the storage limit of a user in bytes, zero meaning
+// unlimited
+func userQuota(username string) int64 {
+	size, ok := conf.Quotas[username]
+	if !ok {
+		size = conf.DefaultQuota
+	}
+	limit, err := parseSize(size)
+	if err != nil {
+		logErrorf("quota: invalid quota for user %q: %v", username, err)
+	}
+	return limit
+}
+
+// userUsage computes the storage currently used by a user
+func userUsage(username string) quotaUsage {
+	usage := quotaUsage{User: username, Limit: userQuota(username)}
+	uploadLogLock.Lock()
+	defer uploadLogLock.Unlock()
+	fd, err := os.Open(uploadLogPath())
+	if err != nil {
+		return usage
+	}
+	defer fd.Close()
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var rec uploadRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.User != username || seen[rec.Path] {
+			continue
+		}
+		seen[rec.Path] = true
+		fi, err := os.Stat(rec.Path)
+		if err != nil {
+			// the file was deleted since it was uploaded
+			continue
+		}
+		usage.Uploads += fi.Size()
+		if hash, err := contentHash(rec.Path); err == nil {
+			usage.Cache += imgCache.size(thumbnailPrefix(hash))
+		}
+	}
+	usage.Used = usage.Uploads + usage.Cache
+	return usage
+}
+
+// parseSize converts a size such as "500MB" or "2GB" into bytes. Units are
+// powers of 1024.
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(size, unit) {
+			mult = 1 << (10 * uint(i+1))
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit))
+			break
+		}
+	}
+	size = strings.TrimSuffix(size, "B")
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
+}
+
+// quotaInfo returns the storage usage and quota of the current user as json
+func quotaInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userUsage(requestUser(r)))
+}
+
+// quotasInfo returns the storage usage and quota of every user as json
+func quotasInfo(w http.ResponseWriter, r *http.Request) {
+	usages := []quotaUsage{}
+	for username := range conf.Users {
+		usages = append(usages, userUsage(username))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usages)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ratingsConf syncs the ratings of the gallery with the XMP Rating of the
+// photos, as set by photo managers. Photos that nobody rated in the gallery
+// take the rating of their XMP sidecar, or of the XMP embedded in the file,
+// when they are indexed. Ratings set in the gallery are written to the XMP
+// sidecars that galilego owns, see writeXMPSidecar.
+//
+//	ratings:
+//	  xmp: true
+type ratingsConf struct {
+	XMP bool
+}
+
+// initRatings shows the ratings of the photos in the album pages
+func initRatings() {
+	registerRenderHooks(applyRatings, nil)
+}
+
+// rate sets the rating of a user, from 1 to 5 stars, or removes it when stars
+// is 0, and sets the rating of the image to the average of the ratings of
+// its users
+func (e *mediaEntry) rate(username string, stars int) {
+	ratings := make(map[string]int, len(e.Ratings)+1)
+	for user, s := range e.Ratings {
+		ratings[user] = s
+	}
+	if stars == 0 {
+		delete(ratings, username)
+	} else {
+		ratings[username] = stars
+	}
+	e.Ratings = ratings
+	if len(ratings) == 0 {
+		e.Ratings, e.Rating = nil, 0
+		return
+	}
+	total := 0
+	for _, s := range ratings {
+		total += s
+	}
+	e.Rating = int(math.Round(float64(total) / float64(len(ratings))))
+}
+
+// joinRatings encodes the ratings of the users of an image for the
+// database, as a comma separated list such as "alice=4,bob=5"
+func joinRatings(ratings map[string]int) string {
+	var list []string
+	for user, stars := range ratings {
+		list = append(list, user+"="+strconv.Itoa(stars))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// splitRatings decodes the ratings encoded by joinRatings
+func splitRatings(s string) map[string]int {
+	if s == "" {
+		return nil
+	}
+	ratings := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+		if stars, err := strconv.Atoi(item[i+1:]); err == nil {
+			ratings[item[:i]] = stars
+		}
+	}
+	return ratings
+}
+
+// minRating returns the min_rating parameter of a request, from 0 to 5
+func minRating(r *http.Request) int {
+	min, err := strconv.Atoi(r.URL.Query().Get("min_rating"))
+	if err != nil || min < 0 {
+		return 0
+	}
+	if min > 5 {
+		min = 5
+	}
+	return min
+}
+
+// applyRatings sets the ratings of the photos of the album pages, including
+// the one of the user, and leaves out the photos rated below the min_rating
+// parameter
+func applyRatings(r *http.Request, name string, data interface{}) {
+	view, ok := data.(*albumView)
+	if !ok {
+		return
+	}
+	username := requestUser(r)
+	view.Rateable = username != "" && !conf.Demo
+	min := minRating(r)
+	photos := view.Photos[:0]
+	for _, p := range view.Photos {
+		if e, ok := index.get(p.Path); ok {
+			p.Rating, p.UserRating = e.Rating, e.Ratings[username]
+		}
+		if p.Rating >= min {
+			photos = append(photos, p)
+		}
+	}
+	view.Photos = photos
+}
+
+// ratingWidget returns the form rating a photo in the slideshow, which
+// shows the rating of the user and the average of all users
+func ratingWidget(photo photoView, locale string) string {
+	action := link("/edit/rating/" + strings.TrimPrefix(filepath.ToSlash(photo.Path), "gallery/"))
+	widget := `<div style="position: absolute; top: 0px; right: 0px; background: white; padding: 2px;"><form method="POST" action="` +
+		html.EscapeString(action) + `" style="display: inline;">`
+	for stars := 1; stars <= 5; stars++ {
+		star := "&#9734;"
+		if stars <= photo.UserRating {
+			star = "&#9733;"
+		}
+		widget += `<button type="submit" name="rating" value="` + strconv.Itoa(stars) + `" title="` +
+			fmt.Sprintf(tr(locale, "rate_stars"), stars) + `">` + star + `</button>`
+	}
+	if photo.UserRating > 0 {
+		widget += ` <button type="submit" name="rating" value="0">` + tr(locale, "clear_rating") + `</button>`
+	}
+	if photo.Rating > 0 {
+		widget += " " + fmt.Sprintf(tr(locale, "average_rating"), photo.Rating)
+	}
+	return widget + `</form></div>`
+}
+
+// setRating rates the image of the request with the rating of its form,
+// and returns to the page the form was sent from
+func setRating(w http.ResponseWriter, r *http.Request) {
+	e, ok := rateImage(w, r, r.FormValue("rating"))
+	if !ok {
+		return
+	}
+	back := link("/" + filepath.ToSlash(filepath.Dir(e.Path)) + "/")
+	// only the path of the referer is kept, so the redirect stays on the
+	// gallery
+	if ref, err := url.Parse(r.Referer()); err == nil && strings.HasPrefix(ref.Path, "/") && !strings.HasPrefix(ref.Path, "//") {
+		back = ref.Path
+		if ref.RawQuery != "" {
+			back += "?" + ref.RawQuery
+		}
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// ratingChange is the body of a request to the rating api
+type ratingChange struct {
+	Rating int `json:"rating"`
+}
+
+// apiSetRating rates the image of the request with the rating of its json
+// body, and returns the ratings of the image
+func apiSetRating(w http.ResponseWriter, r *http.Request) {
+	var change ratingChange
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&change); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	e, ok := rateImage(w, r, strconv.Itoa(change.Rating))
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rating     int `json:"rating"`
+		UserRating int `json:"user_rating"`
+		Votes      int `json:"votes"`
+	}{e.Rating, e.Ratings[requestUser(r)], len(e.Ratings)})
+}
+
+// rateImage sets the rating of the user of the request on the image of the
+// galpath route variable, and replies to the request if it fails
+func rateImage(w http.ResponseWriter, r *http.Request, rating string) (mediaEntry, bool) {
+	username := requestUser(r)
+	if username == "" {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return mediaEntry{}, false
+	}
+	stars, err := strconv.Atoi(rating)
+	if err != nil || stars < 0 || stars > 5 {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return mediaEntry{}, false
+	}
+	path := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	entries, err := index.update([]string{path}, func(e *mediaEntry) {
+		e.rate(username, stars)
+	})
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return mediaEntry{}, false
+	}
+	if err != nil {
+		logErrorf("ratings: failed to rate %q: %v", path, err)
+		writeError(w, r, http.StatusInternalServerError, "metadata_failed")
+		return mediaEntry{}, false
+	}
+	e := entries[0]
+	logInfof("ratings: user %q rated %q with %d stars", username, path, stars)
+	if stars > 0 {
+		recordActivity("rating", path, username, stars)
+	}
+	if conf.Ratings.XMP || conf.XMP.Write {
+		if err := writeXMPSidecar(e); err != nil {
+			logErrorf("ratings: failed to write xmp sidecar of %q: %v", path, err)
+		}
+	}
+	return e, true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisConf is the address of the redis server of the cache. Entries
+// expire after TTL, if set.
+//
+//	redis:
+//	  address: 10.0.0.5:6379
+//	  password: s3cr3t
+//	  db: 2
+//	  ttl: 720h
+type redisConf struct {
+	Address  string
+	Password string
+	DB       int
+	TTL      time.Duration
+}
+
+// redisCache stores entries in redis, prefixed with the time they were
+// stored. It talks to the server over a single connection, which is opened
+// again after errors.
+type redisCache struct {
+	conf redisConf
+	mu   *sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func newRedisCache(rc redisConf) *redisCache {
+	if rc.Address == "" {
+		rc.Address = "127.0.0.1:6379"
+	}
+	return &redisCache{conf: rc, mu: new(sync.Mutex)}
+}
+
+var errRedisNil = errors.New("redis: nil reply")
+
+// do sends a command and returns its reply, which is an int64, a []byte,
+// a []interface{} or nil
+func (c *redisCache) do(args ...string) (reply interface{}, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err = c.dial(); err != nil {
+			return
+		}
+	}
+	reply, err = c.roundTrip(args)
+	if err != nil && err != errRedisNil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return
+}
+
+func (c *redisCache) dial() (err error) {
+	c.conn, err = net.DialTimeout("tcp", c.conf.Address, 5*time.Second)
+	if err != nil {
+		return
+	}
+	c.rd = bufio.NewReader(c.conn)
+	if c.conf.Password != "" {
+		if _, err = c.roundTrip([]string{"AUTH", c.conf.Password}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return
+		}
+	}
+	if c.conf.DB != 0 {
+		if _, err = c.roundTrip([]string{"SELECT", strconv.Itoa(c.conf.DB)}); err != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+	return
+}
+
+func (c *redisCache) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.rd)
+}
+
+// redisError is an error returned by the server, after which the
+// connection can still be used
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = readRedisReply(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply %q", line)
+}
+
+func (c *redisCache) get(key string) (cachedFile, time.Time, error) {
+	reply, err := c.do("GET", key)
+	if err == errRedisNil {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, ok := reply.([]byte)
+	if !ok || len(data) < 8 {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	stored := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	return memFile{bytes.NewReader(data[8:])}, stored, nil
+}
+
+func (c *redisCache) put(key string, data []byte) error {
+	value := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(time.Now().Unix()))
+	copy(value[8:], data)
+	args := []string{"SET", key, string(value)}
+	if c.conf.TTL > 0 {
+		args = append(args, "EX", strconv.Itoa(int(c.conf.TTL.Seconds())))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *redisCache) size(prefix string) (total int64) {
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", redisGlobEscape(prefix)+"*", "COUNT", "1000")
+		if err != nil {
+			logErrorf("cache: %v", err)
+			return
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return
+		}
+		keys, _ := items[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			if n, err := c.do("STRLEN", string(key)); err == nil {
+				// do not count the time prefix of the entry
+				if l, ok := n.(int64); ok && l > 8 {
+					total += l - 8
+				}
+			}
+		}
+		next, _ := items[0].([]byte)
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return
+		}
+	}
+}
+
+// redisGlobEscape escapes the special characters of redis patterns
+func redisGlobEscape(s string) string {
+	var buf bytes.Buffer
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the ioctl that clones the data of a file into another, on the
+// filesystems that support reflinks such as btrfs and xfs
+const ficlone = 0x40049409
+
+// reflinkFile creates dst as a copy on write clone of the file at src,
+// which shares its data until either of them is modified
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno != 0 {
+		err = errno
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// reflinkFile is only implemented on linux, other systems copy the files
+func reflinkFile(src, dst string) error {
+	return errors.New("reflinks are not supported on this system")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultRemoteTTL is the time originals downloaded from remote galleries
+// are kept before being downloaded again, when cachettl is not configured
+const defaultRemoteTTL = 24 * time.Hour
+
+// remoteConf is a remote photo source, shown as an album of the gallery
+// under /remote/{name}/. Its images are downloaded, cached and resized
+// locally.
+//
+//	remotes:
+//	  - name: family
+//	    type: galilego
+//	    url: https://photos.example.org
+//	    username: bob
+//	    password: s3cr3t
+//	  - name: archive
+//	    url: https://example.net/photos/
+type remoteConf struct {
+	Name string
+	// Type is galilego for another galilego server, whose albums are
+	// listed with its api, or listing for a web server that generates
+	// html listings of its directories, the default
+	Type               string
+	URL                string
+	Username, Password string
+}
+
+// remoteClient downloads listings and images from remote galleries
+var remoteClient = &http.Client{Timeout: time.Minute}
+
+// remoteDownloads serializes the downloads of remote originals
+var remoteDownloads sync.Mutex
+
+// findRemote returns the remote of the configuration named name
+func findRemote(name string) (remoteConf, bool) {
+	for _, rc := range conf.Remotes {
+		if rc.Name == name {
+			return rc, true
+		}
+	}
+	return remoteConf{}, false
+}
+
+// remoteURL returns the url of rel on the remote. rel is a clean slash
+// separated path, relative to the root of the remote.
+func (rc remoteConf) remoteURL(prefix, rel string) string {
+	var escaped []string
+	for _, comp := range strings.Split(rel, "/") {
+		escaped = append(escaped, url.PathEscape(comp))
+	}
+	return strings.TrimSuffix(rc.URL, "/") + prefix + "/" + strings.Join(escaped, "/")
+}
+
+// get sends a request to the remote, with its credentials
+func (rc remoteConf) get(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rc.Username != "" {
+		req.SetBasicAuth(rc.Username, rc.Password)
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("remote %q returned %s for %s", rc.Name, resp.Status, u)
+	}
+	return resp, nil
+}
+
+// hrefre extracts the links of an html directory listing
+var hrefre = regexp.MustCompile(`(?i)<a\s[^>]*href="([^"]+)"`)
+
+// list returns the sub albums and the images of the album at rel
+func (rc remoteConf) list(rel string) (albums, images []string, err error) {
+	if rc.Type == "galilego" {
+		resp, err := rc.get(rc.remoteURL("/api/v1/album", rel))
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		var listing albumListing
+		if err = json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&listing); err != nil {
+			return nil, nil, err
+		}
+		for _, img := range listing.Images {
+			images = append(images, img.Name)
+		}
+		return listing.Albums, images, nil
+	}
+	u := rc.remoteURL("", rel)
+	if rel != "" {
+		u += "/"
+	}
+	resp, err := rc.get(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	page, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	for _, m := range hrefre.FindAllSubmatch(page, -1) {
+		href, err := url.PathUnescape(string(m[1]))
+		// only the direct children of the directory are listed, not
+		// parents, sorting links or absolute urls
+		if err != nil || strings.ContainsAny(href, "?#:") || strings.HasPrefix(href, ".") || seen[href] {
+			continue
+		}
+		seen[href] = true
+		name := strings.TrimSuffix(href, "/")
+		if name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		if strings.HasSuffix(href, "/") {
+			albums = append(albums, name)
+		} else if imgre.MatchString(name) {
+			images = append(images, name)
+		}
+	}
+	return albums, images, nil
+}
+
+// fetch returns the path of a local copy of the original image at rel,
+// downloading it if it is missing or older than the cache ttl
+func (rc remoteConf) fetch(rel string) (string, error) {
+	local := filepath.Join(remoteCacheDir(), rc.Name, filepath.FromSlash(rel))
+	ttl := conf.RemoteCacheTTL
+	if ttl <= 0 {
+		ttl = defaultRemoteTTL
+	}
+	remoteDownloads.Lock()
+	defer remoteDownloads.Unlock()
+	if fi, err := os.Stat(local); err == nil && time.Since(fi.ModTime()) < ttl {
+		return local, nil
+	}
+	prefix := ""
+	if rc.Type == "galilego" {
+		prefix = "/gallery"
+	}
+	resp, err := rc.get(rc.remoteURL(prefix, rel))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err = os.MkdirAll(filepath.Dir(local), 0750); err != nil {
+		return "", err
+	}
+	fd, err := os.Create(local + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	body := io.Reader(resp.Body)
+	if maxSourceFileSize > 0 {
+		// one more byte than the limit, so larger images are refused
+		// by checkImageLimits instead of being truncated
+		body = io.LimitReader(body, maxSourceFileSize+1)
+	}
+	if _, err = io.Copy(fd, body); err != nil {
+		fd.Close()
+		os.Remove(local + ".tmp")
+		return "", err
+	}
+	if err = fd.Close(); err != nil {
+		return "", err
+	}
+	return local, os.Rename(local+".tmp", local)
+}
+
+// remoteCacheDir returns the directory the originals of remote galleries
+// are downloaded to
+func remoteCacheDir() string {
+	if conf.RemoteCacheDir != "" {
+		return conf.RemoteCacheDir
+	}
+	return "remotecache"
+}
+
+// serveRemote shows an album of a remote gallery, or returns one of its
+// images, resized locally like the images of the gallery
+func serveRemote(w http.ResponseWriter, r *http.Request) {
+	rc, ok := findRemote(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	if !canView(requestUser(r), "remote/"+rc.Name) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+mux.Vars(r)["path"]), "/")
+	if imgre.MatchString(rel) {
+		local, err := rc.fetch(rel)
+		if err != nil {
+			logErrorf("remote: failed to fetch %q from %q: %v", rel, rc.Name, err)
+			if os.IsNotExist(err) {
+				writeError(w, r, http.StatusNotFound, "not_found")
+			} else {
+				writeError(w, r, http.StatusBadGateway, "remote_failed")
+			}
+			return
+		}
+		serveImage(w, r, local)
+		return
+	}
+	albums, images, err := rc.list(rel)
+	if err != nil {
+		logErrorf("remote: failed to list %q of %q: %v", rel, rc.Name, err)
+		if os.IsNotExist(err) {
+			writeError(w, r, http.StatusNotFound, "album_not_found")
+		} else {
+			writeError(w, r, http.StatusBadGateway, "remote_failed")
+		}
+		return
+	}
+	albumPath := strings.TrimSuffix("remote/"+rc.Name+"/"+rel, "/")
+	view := albumView{
+		Locale: requestLocale(r),
+		Path:   albumPath,
+		// skip the /remote/ component, which is not an album
+		Nav: galleryNav(albumPath)[1:],
+	}
+	for _, name := range albums {
+		view.Albums = append(view.Albums, albumLink{Name: name, Path: albumPath + "/" + name})
+	}
+	for _, name := range images {
+		view.Photos = append(view.Photos, photoView{Name: name, Path: albumPath + "/" + name})
+	}
+	renderPage(w, r, "album", &view)
+}
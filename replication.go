@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultReplicationInterval is the time between two pulls of the standby,
+// when the configuration sets none
+const defaultReplicationInterval = 30 * time.Second
+
+// replicationConf keeps a warm standby of a gallery that does not share its
+// storage, such as a second server whose copy of the photos is synchronized
+// with rsync or syncthing. The primary serves its index and its cached
+// thumbnails to the instances presenting its token. The standby, which sets
+// the url of its primary, pulls the changes every interval instead of
+// scanning the gallery, so it can take over without indexing the gallery
+// and generating its thumbnails again. A standby with a promote delay scans
+// the gallery itself once its primary has been unreachable for that long,
+// and stops replicating until it is restarted.
+//
+//	replication:
+//	  token: 5d1c2b7e9a0f4e3c
+//
+//	replication:
+//	  primary: https://photos.example.org
+//	  token: 5d1c2b7e9a0f4e3c
+//	  interval: 1m
+//	  promote: 10m
+type replicationConf struct {
+	Primary  string
+	Token    string
+	Interval time.Duration
+	Promote  time.Duration
+}
+
+// standby is set while the instance replicates its primary, and does not
+// scan the gallery
+var standby int32
+
+// isStandby returns true if the instance replicates its primary
+func isStandby() bool {
+	return atomic.LoadInt32(&standby) == 1
+}
+
+// replicaClient pulls the index and the thumbnails of the primary
+var replicaClient = &http.Client{Timeout: 5 * time.Minute}
+
+// replicatedEntry is a cache entry listed by the primary
+type replicatedEntry struct {
+	Key     string    `json:"key"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// initReplication starts replicating the primary of the configuration, if
+// it sets one
+func initReplication() error {
+	c := conf.Replication
+	if c.Primary == "" {
+		return nil
+	}
+	if c.Token == "" {
+		return fmt.Errorf("replication: a standby requires the token of its primary")
+	}
+	if _, err := url.Parse(c.Primary); err != nil {
+		return fmt.Errorf("replication: invalid primary url: %v", err)
+	}
+	atomic.StoreInt32(&standby, 1)
+	go replicate()
+	return nil
+}
+
+// replicate pulls the index and the new cache entries of the primary every
+// interval, until the standby is promoted
+func replicate() {
+	interval := conf.Replication.Interval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+	var etag string
+	var since time.Time
+	reached := time.Now()
+	for {
+		tag, err := pullIndex(etag)
+		if err == nil {
+			etag = tag
+			since, err = pullCache(since)
+		}
+		if err == nil {
+			reached = time.Now()
+		} else {
+			logErrorf("replication: %v", err)
+			if promote := conf.Replication.Promote; promote > 0 && time.Since(reached) > promote {
+				logWarnf("replication: primary unreachable since %s, taking over", reached.Format(time.RFC3339))
+				atomic.StoreInt32(&standby, 0)
+				return
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// getPrimary sends a request to the primary, with its token
+func getPrimary(path string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(conf.Replication.Primary, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Replication.Token)
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return nil, fmt.Errorf("primary returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+// pullIndex replaces the index with the one of the primary, unless it did
+// not change since the version of etag, and returns the etag of the index
+func pullIndex(etag string) (string, error) {
+	header := make(http.Header)
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	resp, err := getPrimary("/api/v1/replication/index", header)
+	if err != nil {
+		return etag, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return etag, nil
+	}
+	var entries []*mediaEntry
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return etag, fmt.Errorf("invalid index: %v", err)
+	}
+	if err = index.store.save(entries); err != nil {
+		return etag, err
+	}
+	if err = index.load(); err != nil {
+		return etag, err
+	}
+	logInfof("replication: loaded index of %d images", len(entries))
+	return resp.Header.Get("ETag"), nil
+}
+
+// pullCache copies the cache entries the primary stored since the given
+// time, and returns the time of the newest one. Entries stored again since
+// they were copied, such as the sprite sheets of albums, are copied again.
+func pullCache(since time.Time) (time.Time, error) {
+	resp, err := getPrimary("/api/v1/replication/cache?since="+url.QueryEscape(since.Format(time.RFC3339Nano)), nil)
+	if err != nil {
+		return since, err
+	}
+	var entries []replicatedEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	resp.Body.Close()
+	if err != nil {
+		return since, fmt.Errorf("invalid cache listing: %v", err)
+	}
+	// copied in the order they were stored, so the pull resumes after the
+	// last entry copied
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime.Before(entries[j].ModTime) })
+	var copied int
+	newest := since
+	for _, e := range entries {
+		if fd, stored, err := imgCache.get(e.Key); err == nil {
+			fd.Close()
+			if !stored.Before(e.ModTime) {
+				continue
+			}
+		}
+		if err = pullCacheEntry(e.Key); err != nil {
+			// the entries are copied again on the next pull
+			return newest, err
+		}
+		copied++
+		if e.ModTime.After(newest) {
+			newest = e.ModTime
+		}
+	}
+	if copied > 0 {
+		logInfof("replication: copied %d cache entries", copied)
+	}
+	return newest, nil
+}
+
+// pullCacheEntry copies the cache entry of the primary stored under key
+func pullCacheEntry(key string) error {
+	resp, err := getPrimary("/api/v1/replication/cache/"+key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return imgCache.put(key, data)
+}
+
+// replicationAuth serves the requests of the standbys presenting the token
+// of the replication
+func replicationAuth(h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !equalSecrets(token, conf.Replication.Token) {
+			logWarnf("replication: rejected request from %s with an invalid token", r.RemoteAddr)
+			writeError(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// replicationIndex serves the saved index to the standbys, with the time it
+// was saved as its etag, so unchanged indexes are not sent again
+func replicationIndex(w http.ResponseWriter, r *http.Request) {
+	saved, err := index.store.modified()
+	if err != nil {
+		logErrorf("replication: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "replication_failed")
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, saved.UnixNano()))
+	if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	entries, err := index.store.load()
+	if err != nil {
+		logErrorf("replication: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "replication_failed")
+		return
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		logErrorf("replication: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "replication_failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, bytes.NewReader(data))
+}
+
+// replicationCache lists the entries of the local cache stored after the
+// since parameter. The standbys of a primary whose cache is shared, in
+// redis or s3, have nothing to copy.
+func replicationCache(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+	}
+	entries := []replicatedEntry{}
+	if c, ok := imgCache.(localCache); ok {
+		filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() || strings.HasSuffix(path, ".tmp") || !fi.ModTime().After(since) {
+				return nil
+			}
+			key := filepath.ToSlash(strings.TrimPrefix(path, filepath.Clean(c.dir)+string(filepath.Separator)))
+			// each instance keeps the hashes of its own files
+			if key != manifestKey {
+				entries = append(entries, replicatedEntry{Key: key, ModTime: fi.ModTime()})
+			}
+			return nil
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// replicationCacheEntry serves a cache entry to the standbys
+func replicationCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	fd, stored, err := imgCache.get(key)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	defer fd.Close()
+	http.ServeContent(w, r, filepath.Base(key), stored, fd)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScanErrors is the number of errors kept in the progress of a scan,
+// those beyond it are only counted
+const maxScanErrors = 100
+
+// scanJob is a scan of the gallery, or of one of its albums, and its
+// progress. Scans are started periodically by the index, or by the admins
+// from /admin/rescan and the rescan api.
+type scanJob struct {
+	// Path is the root of the scan, such as "gallery/album"
+	Path string `json:"path"`
+	// Thumbnails is true if the scan generates the missing thumbnails of
+	// every image, rather than only queueing those of the new images
+	Thumbnails bool       `json:"thumbnails"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	// Scanned counts the images walked, Indexed those that were new or
+	// had changed, and Removed those that no longer exist
+	Scanned    int      `json:"scanned"`
+	Indexed    int      `json:"indexed"`
+	Removed    int      `json:"removed"`
+	Generated  int      `json:"thumbnails_generated"`
+	ErrorCount int      `json:"error_count"`
+	Errors     []string `json:"errors,omitempty"`
+	Canceled   bool     `json:"canceled,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// scans holds the running scan and the last finished one
+var scans struct {
+	sync.Mutex
+	current, last *scanJob
+}
+
+// startScan registers a scan of root, or returns nil if a scan is running
+func startScan(root string, thumbnails bool) *scanJob {
+	scans.Lock()
+	defer scans.Unlock()
+	if scans.current != nil {
+		return nil
+	}
+	job := &scanJob{Path: root, Thumbnails: thumbnails, Started: time.Now()}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	scans.current = job
+	return job
+}
+
+// progress updates the counters of the job
+func (j *scanJob) progress(update func(j *scanJob)) {
+	scans.Lock()
+	update(j)
+	scans.Unlock()
+}
+
+// failed records an error of the job, which does not stop it
+func (j *scanJob) failed(err error) {
+	scans.Lock()
+	j.ErrorCount++
+	if len(j.Errors) < maxScanErrors {
+		j.Errors = append(j.Errors, err.Error())
+	}
+	scans.Unlock()
+}
+
+// finish ends the job, whose scan returned err
+func (j *scanJob) finish(err error) {
+	j.cancel()
+	now := time.Now()
+	scans.Lock()
+	j.Finished = &now
+	if err == context.Canceled {
+		j.Canceled = true
+	} else if err != nil {
+		j.ErrorCount++
+		j.Errors = append(j.Errors, err.Error())
+	}
+	scans.current, scans.last = nil, j
+	scans.Unlock()
+}
+
+// snapshot returns a copy of the job, which can be read without holding the
+// lock
+func (j *scanJob) snapshot() *scanJob {
+	if j == nil {
+		return nil
+	}
+	scans.Lock()
+	defer scans.Unlock()
+	c := *j
+	c.Errors = append([]string(nil), j.Errors...)
+	return &c
+}
+
+// scanSnapshot returns a copy of the running and of the last scan
+func scanSnapshot() (current, last *scanJob) {
+	scans.Lock()
+	current, last = scans.current, scans.last
+	scans.Unlock()
+	return current.snapshot(), last.snapshot()
+}
+
+// generateThumbnails generates the thumbnails of the image at path that are
+// not cached yet, through the resize queue like those of the clients
+func generateThumbnails(job *scanJob, path string) {
+	for _, width := range warmWidths() {
+		if job.ctx.Err() != nil {
+			return
+		}
+		if images.Cached(path, width, "", aspect{}, "") {
+			continue
+		}
+		img := Image{
+			ctx:        job.ctx,
+			path:       path,
+			size:       width,
+			returnchan: make(chan Image),
+		}
+		reqimage <- img
+		img = <-img.returnchan
+		close(img.returnchan)
+		if img.fd != nil {
+			img.fd.Close()
+		}
+		if img.err != nil {
+			if img.err != context.Canceled {
+				job.failed(fmt.Errorf("failed to generate %q at width %d: %v", path, width, img.err))
+			}
+			return
+		}
+		job.progress(func(j *scanJob) { j.Generated++ })
+	}
+}
+
+// rescanRequest is the body of a request to the rescan api. An empty path
+// scans the whole gallery.
+type rescanRequest struct {
+	Path       string `json:"path"`
+	Thumbnails bool   `json:"thumbnails"`
+}
+
+// beginRescan starts a scan of the album of the request in the background,
+// and returns it. It replies to the request and returns nil if the scan
+// cannot start.
+func beginRescan(w http.ResponseWriter, r *http.Request, req rescanRequest) *scanJob {
+	root := filepath.Join("gallery", filepath.Clean("/"+req.Path))
+	if _, err := os.Stat(root); err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return nil
+	}
+	// in stateless mode, the other instances must not scan at the same
+	// time
+	if conf.Stateless && !index.store.lock() {
+		writeError(w, r, http.StatusConflict, "scan_busy")
+		return nil
+	}
+	job := startScan(root, req.Thumbnails)
+	if job == nil {
+		if conf.Stateless {
+			index.store.unlock()
+		}
+		writeError(w, r, http.StatusConflict, "scan_busy")
+		return nil
+	}
+	logInfof("index: user %q started a scan of %q", requestUser(r), root)
+	go func() {
+		index.rescan(job)
+		if conf.Stateless {
+			index.store.unlock()
+		}
+	}()
+	return job
+}
+
+// cancelRescan cancels the running scan, and returns false if there is none
+func cancelRescan(r *http.Request) bool {
+	scans.Lock()
+	job := scans.current
+	scans.Unlock()
+	if job == nil {
+		return false
+	}
+	logInfof("index: user %q canceled the scan of %q", requestUser(r), job.Path)
+	job.cancel()
+	return true
+}
+
+// apiRescan returns the progress of the running and of the last scan
+func apiRescan(w http.ResponseWriter, r *http.Request) {
+	current, last := scanSnapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Current *scanJob `json:"current"`
+		Last    *scanJob `json:"last"`
+	}{current, last})
+}
+
+// apiStartRescan starts a scan of the gallery, or of the album of the path
+// of its json body
+func apiStartRescan(w http.ResponseWriter, r *http.Request) {
+	var req rescanRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	job := beginRescan(w, r, req)
+	if job == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// apiCancelRescan cancels the running scan
+func apiCancelRescan(w http.ResponseWriter, r *http.Request) {
+	if !cancelRescan(r) {
+		writeError(w, r, http.StatusNotFound, "no_scan")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rescanView shows the progress of the running or of the last scan, and lets
+// admins start and cancel scans
+func rescanView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	current, last := scanSnapshot()
+	job, refresh := current, ""
+	if job != nil {
+		// the page follows the progress of the scan
+		refresh = `<meta http-equiv="refresh" content="2">`
+	} else {
+		job = last
+	}
+	var progressHtml string
+	if job == nil {
+		progressHtml = "<p>" + tr(locale, "no_scan") + "</p>\n"
+	} else {
+		status := tr(locale, "scan_running")
+		if job.Canceled {
+			status = tr(locale, "scan_canceled")
+		} else if job.Finished != nil {
+			status = fmt.Sprintf(tr(locale, "scan_finished"), job.Finished.Sub(job.Started).Round(time.Second))
+		}
+		progressHtml = fmt.Sprintf(`<p>%s: %s, %s</p>
+		<ul>
+			<li>%s: %d</li>
+			<li>%s: %d</li>
+			<li>%s: %d</li>
+			<li>%s: %d</li>
+			<li>%s: %d</li>
+		</ul>
+`, html.EscapeString(strings.TrimPrefix(job.Path, "gallery")+"/"), job.Started.Format(time.RFC3339), status,
+			tr(locale, "files_scanned"), job.Scanned, tr(locale, "files_indexed"), job.Indexed,
+			tr(locale, "files_removed"), job.Removed, tr(locale, "thumbs_generated"), job.Generated,
+			tr(locale, "scan_errors"), job.ErrorCount)
+		if len(job.Errors) > 0 {
+			progressHtml += "\t\t<ul>\n"
+			for _, e := range job.Errors {
+				progressHtml += "\t\t\t<li>" + html.EscapeString(e) + "</li>\n"
+			}
+			progressHtml += "\t\t</ul>\n"
+		}
+	}
+	action := `<form method="POST" action="` + link("/admin/rescan") + `"><input type="text" name="path" placeholder="album/subalbum"/> <label><input type="checkbox" name="thumbnails" value="1"/> ` +
+		tr(locale, "rescan_thumbnails") + `</label> <button type="submit" name="action" value="start">` + tr(locale, "start_rescan") + `</button></form>`
+	if current != nil {
+		action = `<form method="POST" action="` + link("/admin/rescan") + `"><button type="submit" name="action" value="cancel">` + tr(locale, "cancel_rescan") + `</button></form>`
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8">`+refresh+`<title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "rescan")+`</h1>
+		`+action+`
+		`+progressHtml+`	</body>
+</html>`))
+}
+
+// rescanAction starts or cancels a scan from the admin page
+func rescanAction(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("action") {
+	case "start":
+		req := rescanRequest{Path: r.FormValue("path"), Thumbnails: r.FormValue("thumbnails") != ""}
+		if beginRescan(w, r, req) == nil {
+			return
+		}
+	case "cancel":
+		if !cancelRescan(r) {
+			writeError(w, r, http.StatusNotFound, "no_scan")
+			return
+		}
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	http.Redirect(w, r, link("/admin/rescan"), http.StatusSeeOther)
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// tusVersion is the version of the tus resumable upload protocol
+	// implemented by the upload endpoint, see https://tus.io/protocols/resumable-upload
+	tusVersion = "1.0.0"
+	// defaultResumableMaxSize is the maximum size of a resumable upload,
+	// when the configuration sets none
+	defaultResumableMaxSize = 4 << 30
+	// defaultResumableExpiration is how long an unfinished resumable
+	// upload is kept, when the configuration sets no expiration
+	defaultResumableExpiration = 24 * time.Hour
+	// statusChecksumMismatch is returned by the tus checksum extension
+	// when a chunk does not match its checksum
+	statusChecksumMismatch = 460
+)
+
+// resumableConf configures the resumable uploads of large files, such as
+// videos and raw photos, over unreliable connections.
+//
+//	resumable:
+//	  dir: /var/lib/galilego/uploads-partial
+//	  maxsize: 8GB
+//	  expiration: 48h
+type resumableConf struct {
+	// Dir stores the uploads until they are complete, uploads-partial by
+	// default
+	Dir string
+	// MaxSize is the size of the largest file that can be uploaded, such
+	// as 8GB
+	MaxSize string
+	// Expiration is how long unfinished uploads are kept
+	Expiration time.Duration
+}
+
+// resumableUpload is the state of a resumable upload, stored next to the
+// data received so far
+type resumableUpload struct {
+	ID     string `json:"id"`
+	User   string `json:"user"`
+	Album  string `json:"album"`
+	Name   string `json:"name"`
+	Length int64  `json:"length"`
+	// Checksum of the whole file, such as "sha256 <base64 digest>",
+	// verified once the upload is complete
+	Checksum string `json:"checksum,omitempty"`
+	// Event names the sub album of albums that route their uploads
+	Event   string    `json:"event,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+var (
+	// resumableMaxSize is the parsed MaxSize of the configuration
+	resumableMaxSize int64 = defaultResumableMaxSize
+	// resumableIDre matches the identifiers of resumable uploads
+	resumableIDre = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	// resumableBusy holds the uploads being written, which cannot be
+	// written to by another request at the same time
+	resumableBusy = make(map[string]bool)
+	resumableLock sync.Mutex
+)
+
+// checksumAlgorithms are the hash functions of the tus checksum extension
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+func initResumable() error {
+	if conf.Resumable.MaxSize == "" {
+		return nil
+	}
+	size, err := parseSize(conf.Resumable.MaxSize)
+	if err != nil {
+		return err
+	}
+	if size > 0 {
+		resumableMaxSize = size
+	}
+	return nil
+}
+
+// resumableDir returns the directory of unfinished uploads
+func resumableDir() string {
+	if conf.Resumable.Dir != "" {
+		return conf.Resumable.Dir
+	}
+	return "uploads-partial"
+}
+
+func (u resumableUpload) dataPath() string {
+	return filepath.Join(resumableDir(), u.ID+".part")
+}
+
+func (u resumableUpload) infoPath() string {
+	return filepath.Join(resumableDir(), u.ID+".json")
+}
+
+// offset returns the number of bytes received so far
+func (u resumableUpload) offset() (int64, error) {
+	fi, err := os.Stat(u.dataPath())
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// remove deletes the upload and the data received so far
+func (u resumableUpload) remove() {
+	os.Remove(u.dataPath())
+	os.Remove(u.infoPath())
+}
+
+// loadResumable returns the upload of the given id, if it belongs to username
+// and has not expired
+func loadResumable(id, username string) (u resumableUpload, err error) {
+	if !resumableIDre.MatchString(id) {
+		return u, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(resumableDir(), id+".json"))
+	if err != nil {
+		return u, err
+	}
+	if err = json.Unmarshal(data, &u); err != nil {
+		return u, err
+	}
+	if u.User != username || time.Now().After(u.Expires) {
+		return u, os.ErrNotExist
+	}
+	return u, nil
+}
+
+// removeExpiredUploads deletes the unfinished uploads that have expired
+func removeExpiredUploads() {
+	infos, _ := filepath.Glob(filepath.Join(resumableDir(), "*.json"))
+	for _, path := range infos {
+		var u resumableUpload
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &u)
+		}
+		if err == nil && time.Now().After(u.Expires) {
+			logInfof("upload: removing expired upload %q of user %q", u.Name, u.User)
+			u.remove()
+		}
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header of the tus
+// protocol, a list of keys and base64 encoded values separated by commas
+func parseUploadMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		var value []byte
+		if len(fields) > 1 {
+			var err error
+			if value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		meta[fields[0]] = string(value)
+	}
+	return meta, nil
+}
+
+// parseChecksum splits a checksum such as "sha256 <base64 digest>", as sent
+// in the Upload-Checksum header, into a hash and the expected digest
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	fields := strings.Fields(checksum)
+	if len(fields) != 2 {
+		return nil, nil, fmt.Errorf("invalid checksum %q", checksum)
+	}
+	newHash, ok := checksumAlgorithms[fields[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported checksum algorithm %q", fields[0])
+	}
+	digest, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return newHash(), digest, nil
+}
+
+// tusHeaders sets the headers common to every tus response, and verifies
+// the client speaks the same version of the protocol
+func tusHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != "OPTIONS" && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, r, http.StatusPreconditionFailed, "tus_version")
+		return false
+	}
+	return true
+}
+
+// resumableOptions describes the tus protocol supported by the server
+func resumableOptions(w http.ResponseWriter, r *http.Request) {
+	tusHeaders(w, r)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,checksum,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(resumableMaxSize, 10))
+	w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	if conf.UploadResize.MaxDimension > 0 {
+		// clients may resize the photos before uploading them
+		w.Header().Set("Upload-Max-Dimension", strconv.Itoa(conf.UploadResize.MaxDimension))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createResumable starts a resumable upload into albumDir, with the tus
+// creation extension. The name of the file, and optionally the checksum of
+// its content, are sent in the filename and checksum metadata.
+func createResumable(w http.ResponseWriter, r *http.Request, username, albumDir string) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	meta, merr := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil || merr != nil || length <= 0 || meta["filename"] == "" {
+		writeError(w, r, http.StatusBadRequest, "upload_invalid")
+		return
+	}
+	if meta["checksum"] != "" {
+		if _, _, err = parseChecksum(meta["checksum"]); err != nil {
+			writeError(w, r, http.StatusBadRequest, "upload_invalid")
+			return
+		}
+	}
+	name := unsafeNameChars.ReplaceAllString(filepath.Base(meta["filename"]), "_")
+	dest := filepath.Join(albumDir, name)
+	if !uploadable(dest) {
+		writeError(w, r, http.StatusBadRequest, "upload_invalid")
+		return
+	}
+	if length > resumableMaxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "upload_invalid")
+		return
+	}
+	if _, err = os.Lstat(dest); err == nil {
+		writeError(w, r, http.StatusConflict, "upload_exists")
+		return
+	}
+	if usage := userUsage(username); usage.Limit > 0 && usage.Used+length > usage.Limit {
+		logWarnf("upload: user %q is over quota, %d bytes used of %d", username, usage.Used, usage.Limit)
+		locale := requestLocale(r)
+		writeErrorMessage(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf(tr(locale, "over_quota"),
+			formatSize(locale, usage.Used), formatSize(locale, usage.Limit)))
+		return
+	}
+	removeExpiredUploads()
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		logErrorf("upload: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "upload_failed")
+		return
+	}
+	expiration := conf.Resumable.Expiration
+	if expiration <= 0 {
+		expiration = defaultResumableExpiration
+	}
+	u := resumableUpload{
+		ID:       hex.EncodeToString(id),
+		User:     username,
+		Album:    albumDir,
+		Name:     name,
+		Length:   length,
+		Checksum: meta["checksum"],
+		Event:    meta["event"],
+		Expires:  time.Now().Add(expiration),
+	}
+	info, err := json.Marshal(u)
+	if err == nil {
+		err = os.MkdirAll(resumableDir(), 0750)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(u.dataPath(), nil, 0640)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(u.infoPath(), info, 0640)
+	}
+	if err != nil {
+		logErrorf("upload: failed to create resumable upload of %q: %v", dest, err)
+		u.remove()
+		writeError(w, r, http.StatusInternalServerError, "upload_failed")
+		return
+	}
+	logInfof("upload: user %q started a resumable upload of %d bytes to %q", username, length, dest)
+	w.Header().Set("Location", link("/api/v1/uploads/"+u.ID))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// resumableStatus returns the offset a resumable upload should be continued
+// from
+func resumableStatus(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	u, err := loadResumable(mux.Vars(r)["id"], requestUser(r))
+	var offset int64
+	if err == nil {
+		offset, err = u.offset()
+	}
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// resumableCancel terminates a resumable upload, with the tus termination
+// extension
+func resumableCancel(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	u, err := loadResumable(mux.Vars(r)["id"], requestUser(r))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if !lockResumable(u.ID) {
+		writeError(w, r, http.StatusConflict, "upload_busy")
+		return
+	}
+	defer unlockResumable(u.ID)
+	u.remove()
+	logInfof("upload: user %q canceled the upload of %q", u.User, u.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockResumable reserves an upload for a request, and returns false if it
+// is already being written by another request
+func lockResumable(id string) bool {
+	resumableLock.Lock()
+	defer resumableLock.Unlock()
+	if resumableBusy[id] {
+		return false
+	}
+	resumableBusy[id] = true
+	return true
+}
+
+func unlockResumable(id string) {
+	resumableLock.Lock()
+	delete(resumableBusy, id)
+	resumableLock.Unlock()
+}
+
+// resumableChunk appends a chunk of data to a resumable upload, at the offset
+// the client believes the upload is at. Chunks sent with an Upload-Checksum
+// header are discarded if they do not match it. Once all the data is
+// received, the file is verified and moved into its album.
+func resumableChunk(w http.ResponseWriter, r *http.Request) {
+	if !tusHeaders(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, r, http.StatusUnsupportedMediaType, "upload_invalid")
+		return
+	}
+	u, err := loadResumable(mux.Vars(r)["id"], requestUser(r))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if !lockResumable(u.ID) {
+		writeError(w, r, http.StatusConflict, "upload_busy")
+		return
+	}
+	defer unlockResumable(u.ID)
+	offset, err := u.offset()
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || claimed != offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		writeError(w, r, http.StatusConflict, "upload_bad_offset")
+		return
+	}
+	var (
+		sum    hash.Hash
+		digest []byte
+	)
+	if checksum := r.Header.Get("Upload-Checksum"); checksum != "" {
+		if sum, digest, err = parseChecksum(checksum); err != nil {
+			writeError(w, r, http.StatusBadRequest, "upload_invalid")
+			return
+		}
+	}
+	fd, err := os.OpenFile(u.dataPath(), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		logErrorf("upload: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "upload_failed")
+		return
+	}
+	body := io.Reader(io.LimitReader(r.Body, u.Length-offset))
+	if sum != nil {
+		body = io.TeeReader(body, sum)
+	}
+	// the data received before the connection is lost is kept, so the
+	// upload can be resumed from there
+	n, err := io.Copy(fd, body)
+	if sum != nil && (err != nil || !bytes.Equal(sum.Sum(nil), digest)) {
+		// a chunk with a checksum is all or nothing
+		fd.Truncate(offset)
+		fd.Close()
+		if err == nil {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			writeError(w, r, statusChecksumMismatch, "upload_bad_checksum")
+		}
+		return
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logErrorf("upload: failed to receive %q after %d bytes: %v", u.Name, offset+n, err)
+		return
+	}
+	offset += n
+	if offset == u.Length {
+		if status, key := completeResumable(u); status != 0 {
+			writeError(w, r, status, key)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", u.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeResumable verifies a complete upload and moves it into its album.
+// It returns the status and message of the error of an upload that was
+// rejected and removed, or zero if the file was stored.
+func completeResumable(u resumableUpload) (int, string) {
+	defer u.remove()
+	dest := filepath.Join(u.Album, u.Name)
+	fd, err := os.Open(u.dataPath())
+	if err != nil {
+		logErrorf("upload: %v", err)
+		return http.StatusInternalServerError, "upload_failed"
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(fd, head)
+	if err = checkUploadContent(dest, head[:n]); err != nil {
+		fd.Close()
+		logWarnf("upload: rejected upload of %q by %q: %v", dest, u.User, err)
+		return http.StatusUnsupportedMediaType, "upload_invalid"
+	}
+	if err = checkUploadDimensions(fd, dest); err != nil {
+		fd.Close()
+		logWarnf("upload: rejected upload of %q by %q: %v", dest, u.User, err)
+		return http.StatusRequestEntityTooLarge, "upload_oversized"
+	}
+	if u.Checksum != "" {
+		sum, digest, _ := parseChecksum(u.Checksum)
+		fd.Seek(0, io.SeekStart)
+		if _, err = io.Copy(sum, fd); err != nil || !bytes.Equal(sum.Sum(nil), digest) {
+			fd.Close()
+			logWarnf("upload: checksum of %q uploaded by %q does not match", dest, u.User)
+			return statusChecksumMismatch, "upload_bad_checksum"
+		}
+	}
+	if err = scanUpload(fd, dest); err != nil {
+		fd.Close()
+		if _, ok := err.(infectedError); ok {
+			logWarnf("upload: rejected upload of %q by %q: %v", dest, u.User, err)
+			return http.StatusUnprocessableEntity, "upload_infected"
+		}
+		logErrorf("upload: %v", err)
+		return http.StatusServiceUnavailable, "upload_failed"
+	}
+	dest, err = routeUpload(dest, func() (io.ReadCloser, error) { return os.Open(u.dataPath()) }, u.Event)
+	if err != nil {
+		fd.Close()
+		logErrorf("upload: failed to route %q: %v", u.Name, err)
+		return http.StatusInternalServerError, "upload_failed"
+	}
+	// the album may have been archived since the upload was created
+	if isArchived(dest) {
+		fd.Close()
+		logWarnf("upload: %q is archived, rejecting upload by %q", dest, u.User)
+		return http.StatusForbidden, "album_archived"
+	}
+	// the name is reserved first, so an existing file is never overwritten
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		fd.Close()
+		logErrorf("upload: failed to store %q: %v", dest, err)
+		if os.IsExist(err) {
+			return http.StatusConflict, "upload_exists"
+		}
+		return http.StatusInternalServerError, "upload_failed"
+	}
+	if err = os.Rename(u.dataPath(), dest); err != nil {
+		// the directory of uploads can be on another filesystem
+		fd.Seek(0, io.SeekStart)
+		_, err = io.Copy(out, fd)
+	}
+	fd.Close()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		logErrorf("upload: failed to store %q: %v", dest, err)
+		return http.StatusInternalServerError, "upload_failed"
+	}
+	recordUpload(u.User, dest)
+	invalidateListing(filepath.Dir(dest))
+	queueWarm(dest)
+	notifyAdded(dest)
+	logInfof("upload: user %q uploaded %q", u.User, dest)
+	return 0, ""
+}
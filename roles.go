@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// role is the level of access of a user to a top level album. Each role has
+// the permissions of the roles below it.
+type role int
+
+const (
+	// roleNone cannot see the album
+	roleNone role = iota
+	// roleViewer can browse and download the photos
+	roleViewer
+	// roleUploader can also upload photos, and tag and edit them
+	roleUploader
+	// roleAdmin has every permission, and on the whole gallery, can use
+	// the admin pages
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"viewer":   roleViewer,
+	"uploader": roleUploader,
+	"admin":    roleAdmin,
+}
+
+// initRoles verifies the role bindings of the configuration
+func initRoles() error {
+	for username, bindings := range conf.Roles {
+		for root, name := range bindings {
+			if _, ok := roleNames[name]; !ok {
+				return fmt.Errorf("roles: unknown role %q of user %q on %q", name, username, root)
+			}
+		}
+	}
+	return nil
+}
+
+// rootOf returns the top level album of a path, such as "family" for
+// gallery/family/2020/photo.jpg, or an empty string for paths outside of
+// the gallery
+func rootOf(path string) string {
+	rel := filepath.ToSlash(path)
+	if !strings.HasPrefix(rel, "gallery/") {
+		return ""
+	}
+	rel = strings.TrimPrefix(rel, "gallery/")
+	if i := strings.Index(rel, "/"); i >= 0 {
+		return rel[:i]
+	}
+	return rel
+}
+
+// userRole returns the role of a user on the top level album root. Roles
+// are bound to a top level album, or to the whole gallery with "*". Users
+// without any binding are viewers of the whole gallery, and admins and
+// uploaders keep their role on the whole gallery. In demo mode, everyone is
+// a viewer of the demo album only.
+func userRole(username, root string) role {
+	if conf.Demo {
+		if root != "" && root == conf.DemoRoot {
+			return roleViewer
+		}
+		return roleNone
+	}
+	if !conf.Authenticate {
+		return roleViewer
+	}
+	r := roleViewer
+	if bindings, ok := conf.Roles[username]; ok {
+		r = roleNames[bindings["*"]]
+		if bound := roleNames[bindings[root]]; root != "" && bound > r {
+			r = bound
+		}
+	}
+	for _, uploader := range conf.Uploaders {
+		if username == uploader && r < roleUploader {
+			r = roleUploader
+		}
+	}
+	for _, admin := range conf.Admins {
+		if username == admin {
+			r = roleAdmin
+		}
+	}
+	return r
+}
+
+// canView returns true if the user can see the photo or album at path
+func canView(username, path string) bool {
+	return userRole(username, rootOf(path)) >= roleViewer
+}
+
+// viewFilter returns a function that selects the paths a user can see, for
+// listings that span the whole gallery
+func viewFilter(username string) func(path string) bool {
+	return func(path string) bool {
+		return canView(username, path)
+	}
+}
+
+// requireView restricts the routes of an album or photo, designated by the
+// galpath route variable, to the users who can see it
+func requireView(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		galpath, ok := mux.Vars(r)["galpath"]
+		username := requestUser(r)
+		if !ok || canView(username, filepath.Join("gallery", filepath.Clean("/"+galpath))) {
+			pass(w, r)
+			return
+		}
+		logWarnf("access denied: user %q cannot view %q", username, galpath)
+		writeError(w, r, http.StatusForbidden, "forbidden")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// searchQuery selects the photos of the index matching a saved search, such
+// as `tag:beach AND year:2023`. Terms are combined with AND, OR and NOT, and
+// grouped with parentheses, and terms that follow each other without an
+// operator must all match:
+//
+//	tag:beach         photos with the tag or keyword beach
+//	place:"New York"  photos taken in a town
+//	year:2023         photos captured in 2023
+//	album:family      photos of an album and of its sub albums
+//	rating:4          photos rated 4 or more
+//	sunset            photos whose tags, title or caption contain sunset
+type searchQuery func(e mediaEntry) bool
+
+// parseSearch parses a saved search into the query it designates
+func parseSearch(s string) (searchQuery, error) {
+	tokens, err := searchTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty search")
+	}
+	p := &searchParser{tokens: tokens}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in search", p.tokens[p.pos])
+	}
+	return q, nil
+}
+
+// searchTokens splits a search into parentheses and terms, which keep the
+// quotes of their values
+func searchTokens(s string) (tokens []string, err error) {
+	var cur strings.Builder
+	quoted := false
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			cur.WriteRune(c)
+		case quoted:
+			cur.WriteRune(c)
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case unicode.IsSpace(c):
+			flush()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in search")
+	}
+	flush()
+	return tokens, nil
+}
+
+// searchParser parses the tokens of a search by recursive descent. NOT binds
+// tighter than AND, which binds tighter than OR.
+type searchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *searchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *searchParser) or() (searchQuery, error) {
+	q, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left := q
+		q = func(e mediaEntry) bool { return left(e) || right(e) }
+	}
+	return q, nil
+}
+
+func (p *searchParser) and() (searchQuery, error) {
+	q, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok != "" && tok != "OR" && tok != ")"; tok = p.peek() {
+		if tok == "AND" {
+			p.pos++
+		}
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left := q
+		q = func(e mediaEntry) bool { return left(e) && right(e) }
+	}
+	return q, nil
+}
+
+func (p *searchParser) not() (searchQuery, error) {
+	if p.peek() == "NOT" {
+		p.pos++
+		q, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(e mediaEntry) bool { return !q(e) }, nil
+	}
+	return p.primary()
+}
+
+func (p *searchParser) primary() (searchQuery, error) {
+	tok := p.peek()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("incomplete search")
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected %q in search", tok)
+	}
+	p.pos++
+	if tok == "(" {
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in search")
+		}
+		p.pos++
+		return q, nil
+	}
+	return searchTerm(tok)
+}
+
+// searchTerm returns the query of a single term, such as tag:beach
+func searchTerm(tok string) (searchQuery, error) {
+	field, value := "", tok
+	if i := strings.Index(tok, ":"); i > 0 && !strings.HasPrefix(tok, `"`) {
+		field, value = tok[:i], tok[i+1:]
+	}
+	value = strings.Trim(value, `"`)
+	if value == "" {
+		return nil, fmt.Errorf("empty value in search term %q", tok)
+	}
+	switch field {
+	case "":
+		word := strings.ToLower(value)
+		return func(e mediaEntry) bool {
+			for _, t := range e.allTags() {
+				if strings.Contains(t, word) {
+					return true
+				}
+			}
+			return strings.Contains(strings.ToLower(e.Title), word) ||
+				strings.Contains(strings.ToLower(e.Caption), word)
+		}, nil
+	case "tag":
+		tag := normalizeTag(value)
+		return func(e mediaEntry) bool { return e.hasTag(tag) }, nil
+	case "place":
+		return func(e mediaEntry) bool { return e.inPlace(value) }, nil
+	case "year":
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid year in search term %q", tok)
+		}
+		return func(e mediaEntry) bool { return e.Captured.Year() == year }, nil
+	case "album":
+		prefix := "gallery/" + strings.Trim(value, "/") + "/"
+		return func(e mediaEntry) bool { return strings.HasPrefix(e.Path, prefix) }, nil
+	case "rating":
+		rating, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rating in search term %q", tok)
+		}
+		return func(e mediaEntry) bool { return e.Rating >= rating }, nil
+	}
+	return nil, fmt.Errorf("unknown field %q in search term %q", field, tok)
+}
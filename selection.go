@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// selectionLifetime is how long the link of a shared selection works
+const selectionLifetime = 30 * 24 * time.Hour
+
+// selectionAction applies the action of the form of the index view to the
+// photos selected in it: download them as a zip archive, add them to or
+// remove them from the favorites of the user, or share them as a transient
+// virtual album
+func selectionAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	galpath := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	var paths []string
+	for _, name := range r.PostForm["photo"] {
+		path := filepath.Join(galpath, filepath.Base(name))
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && isImage(path) {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		writeError(w, r, http.StatusBadRequest, "empty_selection")
+		return
+	}
+	switch r.PostForm.Get("action") {
+	case "download":
+		// every photo is checked, so none is sent from an album whose
+		// policy does not allow its originals
+		for _, path := range paths {
+			if !downloadPolicy(path).originals() {
+				downloadBlocked(w, r, path)
+				return
+			}
+		}
+		downloadSelection(w, r, galpath, paths)
+	case "favorite", "unfavorite":
+		if err := updateFavorites(username, paths, r.PostForm.Get("action") == "favorite"); err != nil {
+			logErrorf("selection: failed to update the favorites of %q: %v", username, err)
+			writeError(w, r, http.StatusInternalServerError, "profile_failed")
+			return
+		}
+		http.Redirect(w, r, link("/"+galpath+"/?view=index&page="+r.URL.Query().Get("page")), http.StatusSeeOther)
+	case "share":
+		a, err := shareSelection(paths)
+		if err != nil {
+			logErrorf("selection: failed to share the photos of %q: %v", galpath, err)
+			writeError(w, r, http.StatusInternalServerError, "virtual_failed")
+			return
+		}
+		logInfof("selection: user %q shared %d photos of %q as %q", username, len(paths), galpath, a.Name)
+		http.Redirect(w, r, a.url(), http.StatusSeeOther)
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+	}
+}
+
+// downloadSelection streams a zip archive of the originals of the photos.
+// Photos are already compressed, so they are stored as they are. Like other
+// originals, the archive counts against the streams and the bandwidth
+// limits, and each photo is recorded in the audit log.
+func downloadSelection(w http.ResponseWriter, r *http.Request, galpath string, paths []string) {
+	release, ok := acquireStream(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	logInfof("selection: user %q downloads %d photos of %q", requestUser(r), len(paths), galpath)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(galpath)+".zip"))
+	zw := zip.NewWriter(throttle(w, r))
+	for _, path := range paths {
+		if err := zipFile(zw, path); err != nil {
+			// the archive is already partly sent, it is left truncated
+			logErrorf("selection: failed to add %q to the archive: %v", path, err)
+			return
+		}
+		recordDownload(r, path)
+	}
+	if err := zw.Close(); err != nil {
+		logErrorf("selection: failed to write the archive of %q: %v", galpath, err)
+	}
+}
+
+// zipFile adds the file at path to the archive, under its name
+func zipFile(zw *zip.Writer, path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Store
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, fd)
+	return err
+}
+
+// updateFavorites adds the photos at paths to the favorites of the user, or
+// removes them
+func updateFavorites(username string, paths []string, add bool) error {
+	if username == "" {
+		return fmt.Errorf("anonymous users have no favorites")
+	}
+	p, err := profiles.profile(username)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, path := range paths {
+		selected[path] = true
+	}
+	favorites := p.Favorites[:0:0]
+	for _, path := range p.Favorites {
+		if !selected[path] {
+			favorites = append(favorites, path)
+		}
+	}
+	if add {
+		favorites = append(favorites, paths...)
+	}
+	p.Favorites = favorites
+	return profiles.save(username, p)
+}
+
+// shareSelection creates a virtual album of the photos at paths, with a
+// random name, which expires after selectionLifetime
+func shareSelection(paths []string) (virtualAlbum, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return virtualAlbum{}, err
+	}
+	expires := time.Now().Add(selectionLifetime).Truncate(time.Second)
+	a := virtualAlbum{
+		Name:    "selection-" + hex.EncodeToString(id),
+		Photos:  paths,
+		Expires: &expires,
+	}
+	return a, virtualAlbums.add(a)
+}
+
+// favoritesPage shows the favorites of the user in the slideshow of the
+// albums, in the order they were added
+func favoritesPage(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	username := requestUser(r)
+	if username == "" {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	view := albumView{
+		Locale: locale,
+		Path:   "favorites",
+		Nav:    []navLink{{Name: tr(locale, "favorites"), URL: link("/favorites/")}},
+	}
+	visible := reachableFilter(r)
+	for _, path := range requestProfile(r).Favorites {
+		e, ok := index.get(path)
+		if !ok || !visible(path) {
+			continue
+		}
+		view.Photos = append(view.Photos, photoView{
+			Name:     filepath.Base(e.Path),
+			Path:     e.Path,
+			Captured: e.Captured,
+			Tags:     e.allTags(),
+			Title:    e.Title,
+			Caption:  e.Caption,
+			Place:    e.Place,
+		})
+	}
+	renderPage(w, r, "album", &view)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// setupAddress is the address of the setup wizard, which only listens on the
+// loopback interface
+const setupAddress = "127.0.0.1:8064"
+
+// usernameRe matches the usernames the setup wizard accepts, which cannot
+// contain the colon of basic authentication
+var usernameRe = regexp.MustCompile(`^[\pL\pN_.@-]+$`)
+
+// setupWizard creates the configuration file when galilego is started
+// without one. It is served once, on setupAddress, at a url holding a random
+// token that is only printed to the log, and stops as soon as the file is
+// written.
+type setupWizard struct {
+	// path is the configuration file the wizard writes
+	path  string
+	token string
+	// done receives the result of the wizard once the file is written:
+	// false if galilego cannot start until a certificate is obtained
+	done chan bool
+}
+
+// setupConfig is the configuration written by the setup wizard, in the
+// order of its fields
+type setupConfig struct {
+	Root         string            `yaml:"root"`
+	Host         string            `yaml:"host"`
+	Listen       string            `yaml:"listen"`
+	CertFile     string            `yaml:"certfile"`
+	KeyFile      string            `yaml:"keyfile"`
+	Authenticate bool              `yaml:"authenticate"`
+	Users        map[string]string `yaml:"users"`
+	Admins       []string          `yaml:"admins"`
+}
+
+// runSetup serves the setup wizard until it writes the configuration file at
+// path, and returns whether galilego can start with it
+func runSetup(path string) (start bool, err error) {
+	wizard := &setupWizard{path: path, token: newCSRFToken()[:32], done: make(chan bool, 1)}
+	l, err := net.Listen("tcp", setupAddress)
+	if err != nil {
+		return false, fmt.Errorf("setup: %v", err)
+	}
+	srv := &http.Server{Handler: wizard}
+	go srv.Serve(l)
+	logInfof("setup: no configuration found at %q, open http://%s/setup/%s to create it", path, setupAddress, wizard.token)
+	start = <-wizard.done
+	// let the last page of the wizard reach the browser
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	return start, nil
+}
+
+func (s *setupWizard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !equalSecrets(r.URL.Path, "/setup/"+s.token) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.Method {
+	case "GET":
+		s.writePage(w, r, "")
+	case "POST":
+		s.create(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writePage shows the form of the wizard, with the values already submitted
+func (s *setupWizard) writePage(w http.ResponseWriter, r *http.Request, message string) {
+	locale := requestLocale(r)
+	value := func(name, def string) string {
+		if v := r.FormValue(name); v != "" {
+			return html.EscapeString(v)
+		}
+		return html.EscapeString(def)
+	}
+	checked := func(mode string) string {
+		if r.FormValue("tls") == mode || (r.FormValue("tls") == "" && mode == "selfsigned") {
+			return " checked"
+		}
+		return ""
+	}
+	cwd, _ := os.Getwd()
+	if message != "" {
+		message = "<p><b>" + html.EscapeString(message) + "</b></p>"
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "setup_title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "setup_title")+`</h1>
+		<p>`+fmt.Sprintf(tr(locale, "setup_intro"), html.EscapeString(s.path))+`</p>
+		`+message+`
+		<form method="POST" action="/setup/`+s.token+`">
+			<p><label>`+tr(locale, "setup_root")+` <input type="text" name="root" size="40" value="`+value("root", cwd)+`"/></label></p>
+			<p><label>`+tr(locale, "setup_host")+` <input type="text" name="host" value="`+value("host", "localhost")+`"/></label></p>
+			<p><label>`+tr(locale, "setup_listen")+` <input type="text" name="listen" value="`+value("listen", "0.0.0.0:8064")+`"/></label></p>
+			<p><label>`+tr(locale, "setup_admin")+` <input type="text" name="username" value="`+value("username", "")+`"/></label></p>
+			<p><label>`+tr(locale, "setup_password")+` <input type="password" name="password" autocomplete="new-password"/></label></p>
+			<p><label>`+tr(locale, "confirm_password")+` <input type="password" name="confirm" autocomplete="new-password"/></label></p>
+			<p>`+tr(locale, "setup_tls")+`</p>
+			<p><label><input type="radio" name="tls" value="selfsigned"`+checked("selfsigned")+`/> `+tr(locale, "tls_selfsigned")+`</label></p>
+			<p><label><input type="radio" name="tls" value="acme"`+checked("acme")+`/> `+tr(locale, "tls_acme")+`</label></p>
+			<p><label><input type="radio" name="tls" value="files"`+checked("files")+`/> `+tr(locale, "tls_files")+`</label>
+				<input type="text" name="certfile" placeholder="/etc/galilego/server.crt" value="`+value("certfile", "")+`"/>
+				<input type="text" name="keyfile" placeholder="/etc/galilego/server.key" value="`+value("keyfile", "")+`"/></p>
+			<p><button type="submit">`+tr(locale, "setup_create")+`</button></p>
+		</form>
+	</body>
+</html>`)
+}
+
+// create checks the form, writes the configuration file and the files it
+// refers to, and ends the wizard
+func (s *setupWizard) create(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	root, err := filepath.Abs(r.FormValue("root"))
+	if err != nil || r.FormValue("root") == "" || r.FormValue("host") == "" {
+		s.writePage(w, r, tr(locale, "setup_missing"))
+		return
+	}
+	c := setupConfig{
+		Root:         root,
+		Host:         r.FormValue("host"),
+		Listen:       r.FormValue("listen"),
+		Authenticate: true,
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		s.writePage(w, r, tr(locale, "setup_bad_listen"))
+		return
+	}
+	username, password := r.FormValue("username"), r.FormValue("password")
+	if !usernameRe.MatchString(username) {
+		s.writePage(w, r, tr(locale, "setup_bad_username"))
+		return
+	}
+	if len(password) < minPasswordLength {
+		s.writePage(w, r, fmt.Sprintf(tr(locale, "password_too_short"), minPasswordLength))
+		return
+	}
+	if password != r.FormValue("confirm") {
+		s.writePage(w, r, tr(locale, "password_mismatch"))
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		s.writePage(w, r, fmt.Sprintf(tr(locale, "setup_failed"), err))
+		return
+	}
+	c.Users = map[string]string{username: hash}
+	c.Admins = []string{username}
+	if err = os.MkdirAll(filepath.Join(root, "gallery"), 0755); err != nil {
+		s.writePage(w, r, fmt.Sprintf(tr(locale, "setup_failed"), err))
+		return
+	}
+	start := true
+	switch r.FormValue("tls") {
+	case "selfsigned":
+		// the certificate of a previous run of the wizard is kept
+		c.CertFile, c.KeyFile = filepath.Join(root, "server.crt"), filepath.Join(root, "server.key")
+		if _, lerr := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); lerr != nil {
+			err = selfSignedCertificate(c.Host, c.CertFile, c.KeyFile)
+		}
+	case "acme":
+		// the certificate is obtained and renewed by certbot, and
+		// reloaded by the listeners when it changes
+		live := filepath.Join("/etc/letsencrypt/live", filepath.Base(c.Host))
+		c.CertFile, c.KeyFile = filepath.Join(live, "fullchain.pem"), filepath.Join(live, "privkey.pem")
+		_, lerr := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		start = lerr == nil
+	case "files":
+		c.CertFile, c.KeyFile = r.FormValue("certfile"), r.FormValue("keyfile")
+		if _, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			s.writePage(w, r, fmt.Sprintf(tr(locale, "setup_bad_cert"), err))
+			return
+		}
+	default:
+		s.writePage(w, r, tr(locale, "setup_missing"))
+		return
+	}
+	if err == nil {
+		err = writeSetupConfig(s.path, c)
+	}
+	if err != nil {
+		logErrorf("setup: failed to create the configuration: %v", err)
+		s.writePage(w, r, fmt.Sprintf(tr(locale, "setup_failed"), err))
+		return
+	}
+	logInfof("setup: configuration written to %q, with admin %q", s.path, username)
+	next := fmt.Sprintf(tr(locale, "setup_starting"), html.EscapeString(c.Listen))
+	if !start {
+		next = fmt.Sprintf(tr(locale, "setup_acme"), html.EscapeString(c.Host),
+			"<code>certbot certonly --standalone -d "+html.EscapeString(c.Host)+"</code>")
+		logInfof("setup: obtain the certificate of %s with certbot, then start galilego again", c.Host)
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "setup_title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "setup_title")+`</h1>
+		<p>`+fmt.Sprintf(tr(locale, "setup_done"), html.EscapeString(s.path))+`</p>
+		<p>`+next+`</p>
+	</body>
+</html>`)
+	s.done <- start
+}
+
+// writeSetupConfig writes the configuration of the wizard to path, which must
+// not exist. The file holds the hash of the password of the admin.
+func writeSetupConfig(path string, c setupConfig) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fd, "# created by the setup wizard of galilego, see main.go for the other settings\n")
+	if err == nil {
+		_, err = fd.Write(data)
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// previewWidth and previewHeight are the size of the preview images,
+	// as chat apps and social networks expect for large cards
+	previewWidth  = 1200
+	previewHeight = 630
+	// previewPhotos is the number of photos in the collage of a preview
+	previewPhotos = 4
+)
+
+// shareConf marks an album as shareable: links to /share/{album} show a card
+// with its title, description and a collage of four of its photos in chat
+// apps and social networks, which fetch them without credentials. The page
+// itself redirects people to the album, which still requires them to sign
+// in. Album pages of shareable albums also carry the tags of the card. A
+// view, which shows an album without some of its photos, is shared in place
+// of the album at /share/virtual/{view}.
+//
+//	sharing:
+//	  - album: travels/iceland
+//	    title: Iceland 2019
+//	    description: Two weeks around the ring road
+//	  - view: wedding-family
+type shareConf struct {
+	Album string
+	// View is the name of a virtual album showing a view of an album
+	View        string
+	Title       string
+	Description string
+}
+
+// previewRequest is the preview of a shareable album, generated by the
+// resize queue
+type previewRequest struct {
+	paths []string
+	// key is the key of the preview in the cache backend
+	key string
+}
+
+// initSharing checks the shareable albums, and adds the tags of their cards
+// to their album pages
+func initSharing() error {
+	for i, s := range conf.Sharing {
+		if s.View != "" {
+			if s.Album != "" {
+				return fmt.Errorf("sharing: album and view %q are mutually exclusive", s.View)
+			}
+			continue
+		}
+		album := strings.Trim(filepath.ToSlash(filepath.Clean("/"+s.Album)), "/")
+		if album == "" {
+			return fmt.Errorf("sharing: missing album")
+		}
+		conf.Sharing[i].Album = album
+	}
+	if len(conf.Sharing) > 0 {
+		registerRenderHooks(nil, shareTags)
+	}
+	return nil
+}
+
+// title returns the title of a shared album, which defaults to its name
+func (s shareConf) title() string {
+	if s.Title != "" {
+		return s.Title
+	}
+	if s.View != "" {
+		return s.View
+	}
+	return filepath.Base(s.Album)
+}
+
+// key returns the path of a shared album in the urls of its card, such as
+// "travels/iceland", or "virtual/wedding-family" for a view
+func (s shareConf) key() string {
+	if s.View != "" {
+		return "virtual/" + s.View
+	}
+	return s.Album
+}
+
+// url returns the url of the page of a shared album or view
+func (s shareConf) url() string {
+	if s.View != "" {
+		return link("/virtual/" + url.PathEscape(s.View) + "/")
+	}
+	return link("/gallery/" + s.Album + "/")
+}
+
+// photos returns the paths of the photos of a shared album, or of those a
+// shared view does not hide
+func (s shareConf) photos() ([]string, error) {
+	if s.View == "" {
+		galpath := filepath.Join("gallery", s.Album)
+		names, err := albumImages(galpath)
+		paths := make([]string, len(names))
+		for i, name := range names {
+			paths[i] = filepath.Join(galpath, name)
+		}
+		return paths, err
+	}
+	a, ok := findVirtualAlbum(s.View)
+	if !ok || !a.view() {
+		return nil, os.ErrNotExist
+	}
+	return a.viewPaths()
+}
+
+// findShare returns the sharing configuration of the album at galpath, such
+// as "gallery/travels/iceland", or of the view at "gallery/virtual/{view}"
+func findShare(galpath string) (shareConf, bool) {
+	album := strings.Trim(filepath.ToSlash(strings.TrimPrefix(filepath.Clean(galpath), "gallery")), "/")
+	for _, s := range conf.Sharing {
+		if s.key() == album {
+			return s, true
+		}
+	}
+	return shareConf{}, false
+}
+
+// shareCard returns the OpenGraph and Twitter tags of the card of a shared
+// album
+func shareCard(s shareConf, locale string) string {
+	title := s.title()
+	description := s.Description
+	if description == "" {
+		paths, _ := s.photos()
+		description = fmt.Sprintf(tr(locale, "share_photos"), formatCount(locale, int64(len(paths))))
+	}
+	base := "https://" + conf.Host
+	tags := [][2]string{
+		{"og:type", "website"},
+		{"og:title", title},
+		{"og:description", description},
+		{"og:url", base + link("/share/"+s.key())},
+		{"og:image", base + link("/preview/"+s.key())},
+		{"og:image:width", strconv.Itoa(previewWidth)},
+		{"og:image:height", strconv.Itoa(previewHeight)},
+		{"twitter:card", "summary_large_image"},
+		{"twitter:title", title},
+		{"twitter:description", description},
+		{"twitter:image", base + link("/preview/"+s.key())},
+	}
+	var card string
+	for _, t := range tags {
+		attr := "property"
+		if strings.HasPrefix(t[0], "twitter:") {
+			attr = "name"
+		}
+		card += fmt.Sprintf(`<meta %s="%s" content="%s">`, attr, t[0], html.EscapeString(t[1]))
+	}
+	return card
+}
+
+// shareTags adds the card of a shareable album or view to the head of its
+// pages
+func shareTags(r *http.Request, name string, page []byte) []byte {
+	if name != "album" && name != "index" {
+		return page
+	}
+	galpath := "gallery/" + mux.Vars(r)["galpath"]
+	if view, ok := mux.Vars(r)["name"]; ok {
+		// the page of a virtual album
+		galpath = "gallery/virtual/" + view
+	}
+	s, ok := findShare(galpath)
+	if !ok {
+		return page
+	}
+	card := shareCard(s, requestLocale(r))
+	return bytes.Replace(page, []byte("</head>"), []byte(card+"</head>"), 1)
+}
+
+// sharePage returns the card of a shareable album, and sends browsers on to
+// the album. Albums that are not shareable are not found, so their names
+// do not leak.
+func sharePage(w http.ResponseWriter, r *http.Request) {
+	galpath := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	s, ok := findShare(galpath)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	locale := requestLocale(r)
+	title := s.title()
+	album := html.EscapeString(s.url())
+	// the photos of albums that require signing in are not listed
+	var listing *albumListing
+	if s.View == "" {
+		listing = publicListing(galpath)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<title>`+html.EscapeString(title)+`</title>
+		`+shareCard(s, locale)+`
+		`+galleryScript(newImageGallery(galpath, locale, listing))+`
+		<meta http-equiv="refresh" content="0; url=`+album+`">
+	</head>
+	<body>
+		<p><a href="`+album+`">`+html.EscapeString(title)+`</a></p>
+	</body>
+</html>`)
+}
+
+// previewPaths returns the paths of the photos of the collage of a shared
+// album, its best rated ones, and a version string that changes when any of
+// them is modified
+func previewPaths(s shareConf) (paths []string, version string, err error) {
+	all, err := s.photos()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(all) == 0 {
+		return nil, "", os.ErrNotExist
+	}
+	rating := func(path string) int {
+		e, _ := index.get(path)
+		return e.Rating
+	}
+	sort.SliceStable(all, func(i, j int) bool { return rating(all[i]) > rating(all[j]) })
+	if len(all) > previewPhotos {
+		all = all[:previewPhotos]
+	}
+	h := sha256.New()
+	for _, path := range all {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(h, "%s %d %d %s\n", filepath.Base(path), fi.Size(), fi.ModTime().UnixNano(), readEdit(path).version())
+	}
+	return all, hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// genPreview draws the collage of a preview: the photos are cut to squares,
+// whose middle band fills a cell of a 2x2 grid. Albums with fewer photos
+// repeat them. It stops when ctx is canceled.
+func genPreview(ctx context.Context, galpath string, paths []string) ([]byte, error) {
+	const cellWidth, cellHeight = previewWidth / 2, previewHeight / 2
+	collage := image.NewRGBA(image.Rect(0, 0, previewWidth, previewHeight))
+	draw.Draw(collage, collage.Bounds(), image.White, image.Point{}, draw.Src)
+	var thumbs []image.Image
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fd, _, err := images.Resized(ctx, path, cellWidth, "center", aspect{}, "")
+		if err != nil {
+			logWarnf("share: skipping %q: %v", path, err)
+			continue
+		}
+		img, _, err := image.Decode(fd)
+		fd.Close()
+		if err != nil {
+			logWarnf("share: skipping %q: %v", path, err)
+			continue
+		}
+		thumbs = append(thumbs, img)
+	}
+	if len(thumbs) == 0 {
+		return nil, fmt.Errorf("no photo of %q could be read", galpath)
+	}
+	for i := 0; i < previewPhotos; i++ {
+		thumb := thumbs[i%len(thumbs)]
+		tb := thumb.Bounds()
+		x, y := (i%2)*cellWidth, (i/2)*cellHeight
+		src := tb.Min
+		if tb.Dy() > cellHeight {
+			src.Y += (tb.Dy() - cellHeight) / 2
+		}
+		draw.Draw(collage, image.Rect(x, y, x+cellWidth, y+cellHeight), thumb, src, draw.Src)
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, collage, &jpeg.Options{Quality: 85})
+	return buf.Bytes(), err
+}
+
+// servePreview returns the preview image of a shareable album, generating it
+// if the cached version is missing or outdated
+func servePreview(w http.ResponseWriter, r *http.Request) {
+	galpath := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	s, ok := findShare(galpath)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	paths, version, err := previewPaths(s)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	// previews are generated by the resize queue, like the other images
+	img := Image{
+		ctx:        r.Context(),
+		path:       galpath,
+		preview:    &previewRequest{paths: paths, key: fmt.Sprintf("previews/%s_%s.jpg", galpath, version)},
+		returnchan: make(chan Image),
+	}
+	defer close(img.returnchan)
+	if !queueImage(img) {
+		logWarnf("resize queue is full, refusing the preview of %s", galpath)
+		queueFull(w, r)
+		return
+	}
+	img = <-img.returnchan
+	if errors.Is(img.err, context.Canceled) {
+		logDebugf("preview of %s canceled", galpath)
+		return
+	}
+	if img.err != nil {
+		logErrorf("share: failed to generate %q: %v", img.preview.key, img.err)
+		writeError(w, r, http.StatusInternalServerError, "preview_failed")
+		return
+	}
+	defer img.fd.Close()
+	// crawlers fetch the preview without credentials, and proxies can keep
+	// it as it is public
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, img.preview.key, img.modtime, img.fd)
+}
+
+// Preview returns the preview of the shareable album at galpath, from the
+// cache, or generated and stored in the cache
+func (s *ImageService) Preview(ctx context.Context, galpath string, q previewRequest) (cachedFile, time.Time, error) {
+	fd, modtime, err := s.cache.get(q.key)
+	if err == nil {
+		return fd, modtime, nil
+	}
+	if !os.IsNotExist(err) {
+		logErrorf("cache: failed to read %q: %v", q.key, err)
+	}
+	data, err := genPreview(ctx, galpath, q.paths)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := s.cache.put(q.key, data); err != nil {
+		logErrorf("cache: failed to store %q: %v", q.key, err)
+	}
+	return memFile{bytes.NewReader(data)}, time.Now(), nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+// shuffleSeed returns the seed of the random order requested with the
+// shuffle parameter, and false if the natural order is requested. The seed
+// parameter selects a given order, so paginated clients get the same order
+// across requests, and a random seed is picked when it is absent.
+func shuffleSeed(r *http.Request) (int64, bool) {
+	if shuffle, _ := strconv.ParseBool(r.URL.Query().Get("shuffle")); !shuffle {
+		return 0, false
+	}
+	if seed, err := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64); err == nil {
+		return seed, true
+	}
+	return rand.Int63(), true
+}
+
+// shuffle reorders n elements with swap, in an order that only depends on
+// the seed
+func shuffle(seed int64, n int, swap func(i, j int)) {
+	rand.New(rand.NewSource(seed)).Shuffle(n, swap)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// xmpConf reads the metadata of the photos from the XMP sidecars of photo
+// managers such as Lightroom, IMG_1234.xmp, or darktable, IMG_1234.jpg.xmp:
+// their titles, descriptions, keywords and ratings are indexed with the
+// photos, and read again when the sidecars change. With write, which implies
+// reading them, the titles, captions, tags and ratings set in the gallery
+// are written to the sidecars, including those of other applications,
+// rather than only kept in the index, so the metadata follows the photos.
+//
+//	xmp:
+//	  sidecars: true
+//	  write: true
+type xmpConf struct {
+	Sidecars bool
+	Write    bool
+}
+
+// sidecars returns true if the metadata of the sidecars is indexed
+func (c xmpConf) sidecars() bool {
+	return c.Sidecars || c.Write
+}
+
+var (
+	xmpRatingAttr    = regexp.MustCompile(`xmp:Rating="-?[0-9]*"`)
+	xmpRatingElement = regexp.MustCompile(`(?s)<xmp:Rating>.*?</xmp:Rating>`)
+	xmpDescriptionRe = regexp.MustCompile(`(?s)<rdf:Description\b[^>]*?(/?)>`)
+)
+
+// sidecarMetadata is the metadata of a photo read from its XMP sidecar
+type sidecarMetadata struct {
+	Title, Caption string
+	Keywords       []string
+	Rating         int
+	HasRating      bool
+}
+
+// findXMPSidecar returns the path of the XMP sidecar of an image, the one of
+// darktable, image.jpg.xmp, or of Lightroom, image.xmp, and false if it has
+// none yet
+func findXMPSidecar(path string) (string, os.FileInfo, bool) {
+	for _, xmp := range []string{path + ".xmp", xmpSidecarPath(path)} {
+		if fi, err := os.Stat(xmp); err == nil && fi.Mode().IsRegular() {
+			return xmp, fi, true
+		}
+	}
+	return xmpSidecarPath(path), nil, false
+}
+
+// readSidecar returns the metadata of the XMP sidecar of an image, if it
+// has one
+func readSidecar(path string) (sidecarMetadata, bool) {
+	xmp, _, ok := findXMPSidecar(path)
+	if !ok {
+		return sidecarMetadata{}, false
+	}
+	packet, err := ioutil.ReadFile(xmp)
+	if err != nil {
+		logErrorf("xmp: failed to read %q: %v", xmp, err)
+		return sidecarMetadata{}, false
+	}
+	m := sidecarMetadata{
+		Title:    xmpAltText(xmpTitle, packet),
+		Caption:  xmpAltText(xmpDescription, packet),
+		Keywords: xmpKeywords(packet),
+	}
+	m.Rating, m.HasRating = xmpRating(packet)
+	return m, true
+}
+
+// sidecarChanged returns true if the XMP sidecar of an image was modified
+// after a time, or if the time is zero and the image has a sidecar
+func sidecarChanged(path string, since time.Time) bool {
+	_, fi, ok := findXMPSidecar(path)
+	return ok && (since.IsZero() || fi.ModTime().After(since))
+}
+
+// applySidecar sets the metadata of the XMP sidecar of an image on its
+// entry, and returns false if it has none. The keywords of the sidecar join
+// those embedded in the image, the tags of the gallery written to the
+// sidecar remain tags, and its rating only applies to the photos that
+// nobody rated in the gallery.
+func applySidecar(e *mediaEntry, embedded []string) bool {
+	m, ok := readSidecar(e.Path)
+	if !ok {
+		return false
+	}
+	tags := make(map[string]bool)
+	for _, tag := range e.Tags {
+		tags[tag] = true
+	}
+	e.Keywords = nil
+	for _, keyword := range normalizeTags(append(append([]string{}, embedded...), m.Keywords...)) {
+		if !tags[keyword] {
+			e.Keywords = append(e.Keywords, keyword)
+		}
+	}
+	if m.Title != "" {
+		e.Title = m.Title
+	}
+	if m.Caption != "" {
+		e.Caption = m.Caption
+	}
+	if m.HasRating && len(e.Ratings) == 0 {
+		e.Rating = m.Rating
+	}
+	return true
+}
+
+// updateXMPPacket replaces the title, description, subject and rating of
+// the XMP packet of another application with those of an image, and keeps
+// the rest of the packet. Properties the packet lacks are added to its
+// first rdf:Description.
+func updateXMPPacket(packet []byte, e mediaEntry) []byte {
+	esc := func(s string) string {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	}
+	// the keywords already in the sidecar keep their spelling
+	wanted := make(map[string]bool)
+	for _, tag := range e.allTags() {
+		wanted[tag] = true
+	}
+	var subjects string
+	for _, keyword := range xmpKeywords(packet) {
+		if tag := normalizeTag(keyword); wanted[tag] {
+			subjects += "<rdf:li>" + esc(keyword) + "</rdf:li>"
+			delete(wanted, tag)
+		}
+	}
+	for _, tag := range e.allTags() {
+		if wanted[tag] {
+			subjects += "<rdf:li>" + esc(tag) + "</rdf:li>"
+		}
+	}
+	// properties are replaced even when they are cleared, but only added
+	// when they have a value
+	var missing string
+	for _, p := range []struct {
+		re      *regexp.Regexp
+		value   string
+		element string
+	}{
+		{xmpTitle, e.Title, `<dc:title><rdf:Alt><rdf:li xml:lang="x-default">` + esc(e.Title) + `</rdf:li></rdf:Alt></dc:title>`},
+		{xmpDescription, e.Caption, `<dc:description><rdf:Alt><rdf:li xml:lang="x-default">` + esc(e.Caption) + `</rdf:li></rdf:Alt></dc:description>`},
+		{xmpSubject, subjects, `<dc:subject><rdf:Bag>` + subjects + `</rdf:Bag></dc:subject>`},
+	} {
+		if p.re.Match(packet) {
+			element := p.element
+			packet = p.re.ReplaceAllFunc(packet, func([]byte) []byte { return []byte(element) })
+		} else if p.value != "" {
+			missing += p.element
+		}
+	}
+	// photos rejected by photo managers, rated -1, keep their rating
+	// unless they are rated in the gallery
+	rating := strconv.Itoa(e.Rating)
+	old, _ := xmpRating(packet)
+	switch {
+	case e.Rating == 0 && old == 0:
+	case xmpRatingAttr.Match(packet):
+		packet = xmpRatingAttr.ReplaceAll(packet, []byte(`xmp:Rating="`+rating+`"`))
+	case xmpRatingElement.Match(packet):
+		packet = xmpRatingElement.ReplaceAll(packet, []byte(`<xmp:Rating>`+rating+`</xmp:Rating>`))
+	default:
+		missing += `<xmp:Rating>` + rating + `</xmp:Rating>`
+	}
+	if missing == "" {
+		return packet
+	}
+	loc := xmpDescriptionRe.FindSubmatchIndex(packet)
+	if loc == nil {
+		return packet
+	}
+	start := string(packet[loc[0]:loc[1]])
+	if loc[2] != loc[3] {
+		// a description without content, such as <rdf:Description ... />
+		start = start[:len(start)-2] + ">"
+		missing += "</rdf:Description>"
+	}
+	for prefix, ns := range map[string]string{"dc": "http://purl.org/dc/elements/1.1/", "xmp": "http://ns.adobe.com/xap/1.0/"} {
+		if !bytes.Contains(packet, []byte("xmlns:"+prefix+"=")) {
+			start = start[:len(start)-1] + ` xmlns:` + prefix + `="` + ns + `">`
+		}
+	}
+	var buf bytes.Buffer
+	buf.Write(packet[:loc[0]])
+	buf.WriteString(start + missing)
+	buf.Write(packet[loc[1]:])
+	return buf.Bytes()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+// slowLog receives the operations of the image pipeline that take longer
+// than the configured threshold. It writes to stderr unless a slowlog file
+// is configured.
+var slowLog = log.New(os.Stderr, "slow: ", log.LstdFlags)
+
+// openSlowLog sends the slow operations log to the file at path
+func openSlowLog(path string) error {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	slowLog = log.New(fd, "", log.LstdFlags)
+	return nil
+}
+
+// pipelineOp measures the duration and memory allocations of a decode,
+// resize or encode operation
+type pipelineOp struct {
+	name  string
+	path  string
+	start time.Time
+	alloc uint64
+}
+
+// startOp starts measuring an operation of the image pipeline. Nothing is
+// measured when the slow log is disabled.
+func startOp(name, path string) *pipelineOp {
+	if conf.SlowThreshold <= 0 {
+		return nil
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return &pipelineOp{name: name, path: path, start: time.Now(), alloc: ms.TotalAlloc}
+}
+
+// done logs the operation if it exceeded the slow threshold, along with the
+// dimensions of the image it processed
+func (op *pipelineOp) done(bounds image.Rectangle) {
+	if op == nil {
+		return
+	}
+	elapsed := time.Since(op.start)
+	if elapsed < conf.SlowThreshold {
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	slowLog.Printf("op=%s path=%q dims=%dx%d duration=%s alloc=%s",
+		op.name, op.path, bounds.Dx(), bounds.Dy(), elapsed, humanBytes(ms.TotalAlloc-op.alloc))
+}
+
+// humanBytes formats a number of bytes with a binary unit
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/nfnt/resize"
+)
+
+// cropModes lists the values accepted by the `crop` query parameter. Both
+// produce square thumbnails: `center` keeps the middle of the image while
+// `smart` keeps its most salient region.
+var cropModes = map[string]bool{
+	"center": true,
+	"smart":  true,
+}
+
+// saliencyWidth is the width of the downscaled copy of an image used to
+// compute its saliency map
+const saliencyWidth = 64
+
+// cropSquare returns the largest square region of img, chosen according to
+// mode
+func cropSquare(img image.Image, mode string) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	offset := (b.Dx() + b.Dy() - 2*side) / 2
+	if mode == "smart" {
+		offset = salientOffset(img, side)
+	}
+	rect := image.Rect(b.Min.X, b.Min.Y, b.Min.X+side, b.Min.Y+side)
+	if b.Dx() > b.Dy() {
+		rect = rect.Add(image.Pt(offset, 0))
+	} else {
+		rect = rect.Add(image.Pt(0, offset))
+	}
+	return subImage(img, rect)
+}
+
+// subImage returns the region rect of img, sharing its pixels when possible
+func subImage(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+// salientOffset returns the offset along the longest axis of img of the
+// square of the given side that contains the most salient pixels. Saliency
+// favors edges, saturated colors and skin tones, which keeps faces and
+// subjects in frame rather than blindly cutting the center of the image.
+func salientOffset(img image.Image, side int) int {
+	b := img.Bounds()
+	scale := float64(saliencyWidth) / float64(b.Dx())
+	small := resize.Resize(saliencyWidth, 0, img, resize.Bilinear)
+	sb := small.Bounds()
+	horizontal := b.Dx() > b.Dy()
+	length, window := sb.Dy(), int(float64(side)*scale)
+	if horizontal {
+		length = sb.Dx()
+	}
+	if window >= length {
+		return 0
+	}
+	// sum the saliency of each column (or row) of the small image
+	sums := make([]float64, length)
+	for y := sb.Min.Y; y < sb.Max.Y; y++ {
+		for x := sb.Min.X; x < sb.Max.X; x++ {
+			s := saliency(small, x, y)
+			if horizontal {
+				sums[x-sb.Min.X] += s
+			} else {
+				sums[y-sb.Min.Y] += s
+			}
+		}
+	}
+	// slide the window along the axis and keep the best position
+	var cur float64
+	for i := 0; i < window; i++ {
+		cur += sums[i]
+	}
+	best, bestPos := cur, 0
+	for i := window; i < length; i++ {
+		cur += sums[i] - sums[i-window]
+		if cur > best {
+			best, bestPos = cur, i-window+1
+		}
+	}
+	offset := int(float64(bestPos) / scale)
+	if max := b.Dx() + b.Dy() - 2*side; offset > max {
+		offset = max
+	}
+	return offset
+}
+
+// saliency scores how likely the pixel at x, y is part of the subject of
+// the image
+func saliency(img image.Image, x, y int) float64 {
+	r, g, b := rgb(img, x, y)
+	score := 0.0
+	// edges: difference with the neighboring pixels
+	b2 := img.Bounds()
+	if x+1 < b2.Max.X && y+1 < b2.Max.Y {
+		rx, gx, bx := rgb(img, x+1, y)
+		ry, gy, by := rgb(img, x, y+1)
+		score += (abs(r-rx) + abs(g-gx) + abs(b-bx) + abs(r-ry) + abs(g-gy) + abs(b-by)) / 3
+	}
+	// saturation
+	max, min := r, r
+	for _, c := range []float64{g, b} {
+		if c > max {
+			max = c
+		}
+		if c < min {
+			min = c
+		}
+	}
+	score += (max - min) / 2
+	// skin tones, as a cheap stand in for face detection
+	if r > 95 && g > 40 && b > 20 && r > g && r > b && r-min > 15 && abs(r-g) > 15 {
+		score += 64
+	}
+	return score
+}
+
+// rgb returns the 8 bits color components of a pixel
+func rgb(img image.Image, x, y int) (r, g, b float64) {
+	r32, g32, b32, _ := img.At(x, y).RGBA()
+	return float64(r32 >> 8), float64(g32 >> 8), float64(b32 >> 8)
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
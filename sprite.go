@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+)
+
+const (
+	// spritePageSize is the number of thumbnails on each page of the index
+	// view, and thus in each sprite sheet
+	spritePageSize = 100
+	// spriteCell is the width and height in pixels of a thumbnail in a
+	// sprite sheet
+	spriteCell = 150
+	// spriteColumns is the number of thumbnails on each row of a sprite sheet
+	spriteColumns = 10
+)
+
+// spriteRequest is a sprite sheet to generate through the resize queue,
+// like the thumbnails, as it decodes up to a page of originals
+type spriteRequest struct {
+	names []string
+	// key is the key of the sheet in the cache backend
+	key string
+}
+
+// albumImages returns the sorted names of the images in the directory at path
+func albumImages(path string) (names []string, err error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dirContent, err := dir.Readdir(-1)
+	if err != nil {
+		return
+	}
+	for _, dirEntry := range dirContent {
+		if dirEntry.Mode().IsRegular() && isImage(filepath.Join(path, dirEntry.Name())) {
+			names = append(names, dirEntry.Name())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// spritePage returns the names of the images on a given page of an album,
+// and a version string that changes when any of these images is modified
+func spritePage(path string, page int) (names []string, version string, err error) {
+	all, err := albumImages(path)
+	if err != nil {
+		return
+	}
+	start := page * spritePageSize
+	if page < 0 || start >= len(all) {
+		return nil, "", os.ErrNotExist
+	}
+	end := start + spritePageSize
+	if end > len(all) {
+		end = len(all)
+	}
+	names = all[start:end]
+	h := sha256.New()
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(path, name))
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(h, "%s %d %d %s\n", name, fi.Size(), fi.ModTime().UnixNano(), readEdit(filepath.Join(path, name)).version())
+	}
+	version = hex.EncodeToString(h.Sum(nil))[:12]
+	return
+}
+
+// spriteOffset returns the position of the i-th thumbnail in a sprite sheet
+func spriteOffset(i int) (x, y int) {
+	return (i % spriteColumns) * spriteCell, (i / spriteColumns) * spriteCell
+}
+
+// genSprite draws the thumbnails of names into a single jpeg sprite sheet.
+// Each thumbnail is centered in its cell. It stops between photos once ctx
+// is canceled.
+func genSprite(ctx context.Context, path string, names []string) ([]byte, error) {
+	rows := (len(names) + spriteColumns - 1) / spriteColumns
+	cols := spriteColumns
+	if len(names) < cols {
+		cols = len(names)
+	}
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*spriteCell, rows*spriteCell))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.ZP, draw.Src)
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		fd, err := os.Open(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		err = checkImageLimits(fd)
+		var img image.Image
+		if err == nil {
+			img, _, err = image.Decode(fd)
+		}
+		fd.Close()
+		if err != nil {
+			logWarnf("sprite: skipping %q: %v", name, err)
+			continue
+		}
+		edit := readEdit(filepath.Join(path, name))
+		thumb := resize.Thumbnail(spriteCell, spriteCell, edit.cropImage(img), resize.NearestNeighbor)
+		thumb = edit.rotateImage(thumb)
+		x, y := spriteOffset(i)
+		tb := thumb.Bounds()
+		x += (spriteCell - tb.Dx()) / 2
+		y += (spriteCell - tb.Dy()) / 2
+		draw.Draw(sheet, image.Rect(x, y, x+tb.Dx(), y+tb.Dy()), thumb, tb.Min, draw.Src)
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, sheet, nil)
+	return buf.Bytes(), err
+}
+
+// serveSprite returns the sprite sheet of a page of an album, generating it
+// if the cached version is missing or outdated
+func serveSprite(w http.ResponseWriter, r *http.Request) {
+	galpath := filepath.Clean("gallery/" + mux.Vars(r)["galpath"])
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil {
+		page = 0
+	}
+	names, version, err := spritePage(galpath, page)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	img := Image{
+		ctx:        r.Context(),
+		path:       galpath,
+		sprite:     &spriteRequest{names: names, key: fmt.Sprintf("sprites/%s/%d_%s.jpg", galpath, page, version)},
+		returnchan: make(chan Image),
+	}
+	defer close(img.returnchan)
+	if !queueImage(img) {
+		logWarnf("resize queue is full, refusing the sprite sheet of %s", galpath)
+		queueFull(w, r)
+		return
+	}
+	img = <-img.returnchan
+	if errors.Is(img.err, context.Canceled) {
+		logDebugf("sprite sheet of %s canceled", galpath)
+		return
+	}
+	if img.err != nil {
+		logErrorf("sprite: failed to generate %q: %v", img.sprite.key, img.err)
+		writeError(w, r, http.StatusInternalServerError, "sprite_failed")
+		return
+	}
+	defer img.fd.Close()
+	conf.Caching.Thumbnails.setHeaders(w)
+	http.ServeContent(w, r, img.sprite.key, img.modtime, img.fd)
+}
+
+// Sprite returns the sprite sheet of the photos of a page of the album at
+// galpath, from the cache, or generated and stored in the cache
+func (s *ImageService) Sprite(ctx context.Context, galpath string, q spriteRequest) (cachedFile, time.Time, error) {
+	fd, modtime, err := s.cache.get(q.key)
+	if err == nil {
+		return fd, modtime, nil
+	}
+	if !os.IsNotExist(err) {
+		logErrorf("cache: failed to read %q: %v", q.key, err)
+	}
+	data, err := genSprite(ctx, galpath, q.names)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if err := s.cache.put(q.key, data); err != nil {
+		logErrorf("cache: failed to store %q: %v", q.key, err)
+	}
+	return memFile{bytes.NewReader(data)}, time.Now(), nil
+}
+
+// genIndexHtml returns the HTML of a page of the index view of an album, in
+// which every thumbnail is a region of the page's sprite sheet. Photos can
+// be selected to be downloaded, unless the originals of the album cannot be,
+// added to the favorites or shared, and to be tagged when the album is
+// editable. The demo has no selection.
+func genIndexHtml(galpath string, page int, locale string, editable bool) string {
+	names, version, err := spritePage(galpath, page)
+	if err != nil {
+		return "<p>" + tr(locale, "no_images") + "</p>"
+	}
+	galpath = strings.TrimSuffix(galpath, "/")
+	album := strings.TrimPrefix(strings.TrimPrefix(galpath, "gallery"), "/")
+	spriteURL := html.EscapeString(link(fmt.Sprintf("/sprite/%s?page=%d&v=%s", album, page, version)))
+	selectable := !conf.Demo
+	var indexHtml string
+	if selectable {
+		indexHtml += fmt.Sprintf(`<form method="POST" action="%s">`+"\n",
+			html.EscapeString(link(fmt.Sprintf("/selection/%s?page=%d", album, page))))
+	}
+	for i, name := range names {
+		x, y := spriteOffset(i)
+		title := name
+		if e, ok := index.get(filepath.Join(galpath, name)); ok && len(e.allTags()) > 0 {
+			title += " (" + strings.Join(e.allTags(), ", ") + ")"
+		}
+		indexHtml += fmt.Sprintf(`<a href="%s" title="%s"><div style="display: inline-block; width: %dpx; height: %dpx; background: url(%s) -%dpx -%dpx no-repeat;"></div></a>`,
+			html.EscapeString(link("/"+galpath+"/"+name)), html.EscapeString(title),
+			spriteCell, spriteCell, spriteURL, x, y)
+		if selectable {
+			indexHtml += fmt.Sprintf(`<input type="checkbox" name="photo" value="%s"/>`, html.EscapeString(name))
+		}
+		indexHtml += "\n"
+	}
+	// the tags come first, so that the enter key in their field submits
+	// the form to them
+	if selectable && editable {
+		tagsURL := html.EscapeString(link(fmt.Sprintf("/edit/tags/%s?page=%d", album, page)))
+		indexHtml += `<p><label>` + tr(locale, "tags") + ` <input type="text" name="tags"/></label>
+	<button type="submit" formaction="` + tagsURL + `" name="action" value="add">` + tr(locale, "add_tags") + `</button>
+	<button type="submit" formaction="` + tagsURL + `" name="action" value="remove">` + tr(locale, "remove_tags") + `</button></p>
+`
+	}
+	if selectable {
+		indexHtml += `<p>`
+		if albumPolicy(galpath).originals() {
+			indexHtml += `<button type="submit" name="action" value="download">` + tr(locale, "download_zip") + `</button>
+	`
+		}
+		indexHtml += `<button type="submit" name="action" value="favorite">` + tr(locale, "add_favorites") + `</button>
+	<button type="submit" name="action" value="unfavorite">` + tr(locale, "remove_favorites") + `</button>
+	<button type="submit" name="action" value="share">` + tr(locale, "share_selection") + `</button></p>
+</form>
+`
+	}
+	indexHtml += "<p>"
+	if page > 0 {
+		indexHtml += fmt.Sprintf(`<a href="?view=index&amp;page=%d">&larr;</a> `, page-1)
+	}
+	if _, _, err := spritePage(galpath, page+1); err == nil {
+		indexHtml += fmt.Sprintf(`<a href="?view=index&amp;page=%d">&rarr;</a>`, page+1)
+	}
+	indexHtml += "</p>"
+	return indexHtml
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// staticsDir holds the scripts, styles and images bundled with galilego
+const staticsDir = "statics"
+
+// staticAsset is a file of the statics directory, kept in memory along with
+// its compressed variants
+type staticAsset struct {
+	name    string
+	modtime time.Time
+	// hash is a digest of the content, which is part of the name the
+	// asset is linked with, so browsers can keep it forever
+	hash string
+	// variants are the content of the asset by content encoding, the
+	// empty encoding being the original
+	variants map[string][]byte
+}
+
+// hashedName returns the name of the asset with its hash, such as
+// jquery-2.2.3.min.0123456789.js
+func (a *staticAsset) hashedName() string {
+	ext := filepath.Ext(a.name)
+	return strings.TrimSuffix(a.name, ext) + "." + a.hash + ext
+}
+
+// staticEncodings are the content encodings of the variants, by order of
+// preference, with the extension of their pre-compressed files
+var staticEncodings = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+var (
+	// staticAssets are the assets by original and by hashed name
+	staticAssets = make(map[string]*staticAsset)
+	// staticURLs rewrites the links to the assets of the rendered pages to
+	// their hashed names
+	staticURLs *strings.Replacer
+)
+
+// initStatics loads the statics directory. Files ending in .br and .gz are
+// the pre-compressed variants of the file of the same name, created with
+// `make statics`, and a gzip variant of the text assets that have none is
+// compressed on startup. In development mode, the assets are read from the
+// directory on every request instead.
+func initStatics() error {
+	if conf.DevMode {
+		logInfof("statics: development mode, serving %s from disk", staticsDir)
+		return nil
+	}
+	files, err := ioutil.ReadDir(staticsDir)
+	if os.IsNotExist(err) {
+		logWarnf("statics: no %s directory, the slideshow will not work", staticsDir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var rewrites []string
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || isStaticVariant(fi.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(staticsDir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a := &staticAsset{
+			name:     fi.Name(),
+			modtime:  fi.ModTime(),
+			hash:     hex.EncodeToString(sum[:5]),
+			variants: map[string][]byte{"": data},
+		}
+		for _, enc := range staticEncodings {
+			if compressed, err := ioutil.ReadFile(filepath.Join(staticsDir, fi.Name()+enc.ext)); err == nil {
+				a.variants[enc.encoding] = compressed
+			}
+		}
+		if _, ok := a.variants["gzip"]; !ok && compressible(fi.Name()) {
+			var buf bytes.Buffer
+			gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+			gz.Write(data)
+			gz.Close()
+			if buf.Len() < len(data) {
+				a.variants["gzip"] = buf.Bytes()
+			}
+		}
+		staticAssets[a.name] = a
+		staticAssets[a.hashedName()] = a
+		hashed := link("/" + staticsDir + "/" + a.hashedName())
+		if conf.BasePath != "" {
+			// links that already include the base path are only hashed
+			rewrites = append(rewrites, link("/"+staticsDir+"/"+a.name), hashed)
+		}
+		rewrites = append(rewrites, "/"+staticsDir+"/"+a.name, hashed)
+	}
+	staticURLs = strings.NewReplacer(rewrites...)
+	registerRenderHooks(nil, rewriteStaticURLs)
+	logInfof("statics: loaded %d assets", len(staticAssets)/2)
+	return nil
+}
+
+// isStaticVariant returns true if name is a pre-compressed variant
+func isStaticVariant(name string) bool {
+	for _, enc := range staticEncodings {
+		if strings.HasSuffix(name, enc.ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible returns true for the text assets, images are already
+// compressed
+func compressible(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".js", ".css", ".svg", ".html", ".txt", ".json":
+		return true
+	}
+	return false
+}
+
+// rewriteStaticURLs links the pages to the hashed names of the assets, so a
+// new version of an asset is fetched as soon as galilego is upgraded
+func rewriteStaticURLs(r *http.Request, name string, page []byte) []byte {
+	return []byte(staticURLs.Replace(string(page)))
+}
+
+// serveStatic serves an asset, in the encoding preferred by the client.
+// Hashed names never change content, and are cached for a year, while the
+// original names are revalidated.
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["staticfile"]
+	if conf.DevMode {
+		serveStaticFile(w, r, name)
+		return
+	}
+	a, ok := staticAssets[name]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if name == a.name {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	w.Header().Set("Vary", "Accept-Encoding")
+	ctype := mime.TypeByExtension(filepath.Ext(a.name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	encoding := ""
+	for _, enc := range staticEncodings {
+		if _, ok := a.variants[enc.encoding]; ok && acceptsEncoding(r.Header.Get("Accept-Encoding"), enc.encoding) {
+			encoding = enc.encoding
+			break
+		}
+	}
+	etag := a.hash
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+	}
+	w.Header().Set("ETag", strconv.Quote(etag))
+	http.ServeContent(w, r, a.name, a.modtime, bytes.NewReader(a.variants[encoding]))
+}
+
+// serveStaticFile serves the current content of an asset of the statics
+// directory, uncompressed and not cached, in development mode
+func serveStaticFile(w http.ResponseWriter, r *http.Request, name string) {
+	fd, err := os.Open(filepath.Join(staticsDir, filepath.Base(name)))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), fd)
+}
+
+// acceptsEncoding returns true if an Accept-Encoding header such as
+// "gzip, deflate, br;q=0.9" accepts the encoding
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if name := strings.ToLower(strings.TrimSpace(fields[0])); name != encoding && name != "*" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
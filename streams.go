@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStreamsPerUser = 4
+	defaultStreamsWait    = 10 * time.Second
+)
+
+// streamsConf limits the number of originals and videos sent at once, as
+// each of them holds a file open for the length of its download. A user, or
+// an anonymous client address, cannot hold more than peruser of the max
+// streams, 4 by default, so a single client cannot starve the others.
+// Requests wait for a free stream for up to wait, 10 seconds by default, and
+// are then refused with 503 Service Unavailable. A zero max is unlimited.
+//
+//	streams:
+//	  max: 32
+//	  peruser: 4
+//	  wait: 10s
+type streamsConf struct {
+	Max     int
+	PerUser int
+	Wait    time.Duration
+}
+
+var streams struct {
+	sync.Mutex
+	// slots holds a value for each stream being sent
+	slots chan struct{}
+	// users counts the streams of each user or client address
+	users map[string]int
+}
+
+// initStreams creates the slots of the streams of the configuration
+func initStreams() {
+	if conf.Streams.Max <= 0 {
+		return
+	}
+	streams.slots = make(chan struct{}, conf.Streams.Max)
+	streams.users = make(map[string]int)
+}
+
+// acquireStream reserves a stream for the request, and returns the function
+// that releases it once the stream is sent. If no stream is available, the
+// request is replied to and ok is false.
+func acquireStream(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if streams.slots == nil {
+		return func() {}, true
+	}
+	owner := requestUser(r)
+	if owner == "" {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		owner = ip
+	}
+	perUser := conf.Streams.PerUser
+	if perUser <= 0 {
+		perUser = defaultStreamsPerUser
+	}
+	streams.Lock()
+	if streams.users[owner] >= perUser {
+		streams.Unlock()
+		logWarnf("streams: %s already has %d streams, refusing %s", owner, perUser, r.URL.Path)
+		streamsBusy(w, r, http.StatusTooManyRequests)
+		return nil, false
+	}
+	streams.users[owner]++
+	streams.Unlock()
+	leave := func() {
+		streams.Lock()
+		if streams.users[owner]--; streams.users[owner] <= 0 {
+			delete(streams.users, owner)
+		}
+		streams.Unlock()
+	}
+	wait := conf.Streams.Wait
+	if wait <= 0 {
+		wait = defaultStreamsWait
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case streams.slots <- struct{}{}:
+		return func() {
+			<-streams.slots
+			leave()
+		}, true
+	case <-r.Context().Done():
+		leave()
+		return nil, false
+	case <-t.C:
+		leave()
+		logWarnf("streams: all %d streams are in use, refusing %s", cap(streams.slots), r.URL.Path)
+		streamsBusy(w, r, http.StatusServiceUnavailable)
+		return nil, false
+	}
+}
+
+// streamsBusy replies to a request for a stream that is not available
+func streamsBusy(w http.ResponseWriter, r *http.Request, status int) {
+	wait := conf.Streams.Wait
+	if wait <= 0 {
+		wait = defaultStreamsWait
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeError(w, r, status, "streams_busy")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// canEdit returns true if the user is allowed to modify the metadata of
+// the photos at path, such as their tags
+func canEdit(username, path string) bool {
+	return canUpload(username, path)
+}
+
+// tagList shows every tag and keyword of the gallery, with the number of
+// photos that have it
+func tagList(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	counts := index.tagCounts(reachableFilter(r))
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	var tagsHtml string
+	for _, tag := range tags {
+		tagsHtml += fmt.Sprintf(`<li><a href="%s">%s</a> (%d)</li>`+"\n",
+			html.EscapeString(link("/tags/"+url.PathEscape(tag))), html.EscapeString(tag), counts[tag])
+	}
+	if tagsHtml == "" {
+		tagsHtml = "<p>" + tr(locale, "no_tags") + "</p>"
+	} else {
+		tagsHtml = "<ul>\n" + tagsHtml + "</ul>"
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "tags")+`</h1>
+`+tagsHtml+`
+	</body>
+</html>`)
+}
+
+// tagPage shows the photos that have a tag, most recent first
+func tagPage(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	tag := normalizeTag(mux.Vars(r)["tag"])
+	var photosHtml string
+	visible := reachableFilter(r)
+	for _, e := range index.byCaptureDate("gallery/") {
+		if !e.hasTag(tag) || !visible(e.Path) {
+			continue
+		}
+		photosHtml += fmt.Sprintf(`<a href="%s"><img src="%s?width=200&amp;crop=center%s" width="200" height="200" loading="lazy" title="%s"%s/></a>`+"\n",
+			html.EscapeString(link("/"+e.Path)), html.EscapeString(link("/"+e.Path)), html.EscapeString(editQuery(e.Path)), html.EscapeString(e.Path), placeholderStyle(e.Path))
+	}
+	if photosHtml == "" {
+		writeError(w, r, http.StatusNotFound, "no_tags")
+		return
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "tagged")+` `+html.EscapeString(tag)+`</h1>
+		<p><a href="`+link("/tags")+`">`+tr(locale, "tags")+`</a></p>
+`+photosHtml+`
+	</body>
+</html>`)
+}
+
+// editTags adds or removes the comma separated tags of the form to the
+// photos selected in the index view of an album
+func editTags(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	galpath := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if !canEdit(username, galpath) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	tags := strings.Split(r.PostForm.Get("tags"), ",")
+	for _, name := range r.PostForm["photo"] {
+		path := filepath.Join(galpath, filepath.Base(name))
+		var (
+			e   mediaEntry
+			err error
+		)
+		switch r.PostForm.Get("action") {
+		case "add":
+			e, err = index.setTags(path, tags, nil)
+		case "remove":
+			e, err = index.setTags(path, nil, tags)
+		default:
+			continue
+		}
+		if err != nil {
+			logErrorf("tags: failed to tag %q: %v", path, err)
+			continue
+		}
+		writeTagsSidecar(e)
+	}
+	logInfof("tags: user %q tagged %d photos of %q", username, len(r.PostForm["photo"]), galpath)
+	http.Redirect(w, r, link("/"+galpath+"/?view=index&page="+r.URL.Query().Get("page")), http.StatusSeeOther)
+}
+
+// writeTagsSidecar writes the tags of an image to its XMP sidecar, when the
+// gallery writes the sidecars
+func writeTagsSidecar(e mediaEntry) {
+	if !conf.XMP.Write {
+		return
+	}
+	if err := writeXMPSidecar(e); err != nil {
+		logErrorf("tags: failed to write xmp sidecar of %q: %v", e.Path, err)
+	}
+}
+
+// apiTags returns the number of photos of every tag as json
+func apiTags(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(index.tagCounts(reachableFilter(r)))
+}
+
+// tagChange is the body of a request to the tags api
+type tagChange struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// apiSetTags adds and removes tags of the photo designated by the galpath
+// route variable, and returns its tags
+func apiSetTags(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	path := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if !canEdit(username, path) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	var change tagChange
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&change); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	e, err := index.setTags(path, change.Add, change.Remove)
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if err != nil {
+		logErrorf("tags: failed to tag %q: %v", path, err)
+		writeError(w, r, http.StatusInternalServerError, "tag_failed")
+		return
+	}
+	logInfof("tags: user %q set tags %v on %q", username, e.Tags, path)
+	writeTagsSidecar(e)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"tags": e.Tags, "keywords": e.Keywords})
+}
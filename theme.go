@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// albumView is the data of the album pages, as consumed by the templates
+type albumView struct {
+	Locale string
+	// Path is relative to the working directory, such as "gallery/album"
+	Path   string
+	Nav    []navLink
+	Albums []albumLink
+	Photos []photoView
+	// Documents are the PDF documents of the album, when documents are
+	// enabled for it
+	Documents []photoView
+	// Files are the other files of the album whose extension is allowed,
+	// such as gpx tracks
+	Files []photoView
+	// Audio are the audio files of the album, played inline
+	Audio []photoView
+	// Editable is true if the user can tag and edit the photos
+	Editable bool
+	// IndexHtml is the sprite based index of the album, in the index view
+	IndexHtml template.HTML
+	// Shuffled is true if the photos are in the random order of Seed
+	Shuffled bool
+	Seed     int64
+	// UserName is the display name of the user, empty for anonymous users
+	UserName string
+	// SlideInterval is the time each photo of the slideshow is shown, in
+	// milliseconds, as set in the profile of the user
+	SlideInterval int
+	// Rateable is true if the user can rate the photos
+	Rateable bool
+}
+
+// navLink is a link to one of the albums containing the current album
+type navLink struct {
+	Name, URL string
+}
+
+// albumLink is a sub album of the current album
+type albumLink struct {
+	Name, Path string
+	// Pinned is true for the albums pinned to the top of the home page
+	Pinned bool
+}
+
+// photoView is a photo of the current album
+type photoView struct {
+	Name, Path string
+	Captured   time.Time
+	Tags       []string
+	// Companions are the names of the raw files and live photo videos of
+	// the photo
+	Companions []string
+	// Title and Caption are set in the gallery, or by the sidecar files
+	// of the photo
+	Title, Caption string
+	// Rating is the average rating of the photo, from 0 to 5 stars, and
+	// UserRating the one of the user
+	Rating, UserRating int
+	// Place is the town the photo was taken in
+	Place string
+	// Size is the size of the files of the album, in bytes
+	Size int64
+	// Cover is true for the audio files that embed a picture, shown as
+	// their thumbnail
+	Cover bool
+}
+
+// templateFuncs are the functions available to the templates of themes:
+//
+//	tr locale key            translated message of the user interface
+//	link path                url of a path of galilego, such as
+//	                         {{link "/timeline"}}, under the base path
+//	albumURL path            url of an album
+//	thumbURL path width      url of a resized version of a photo
+//	downloadURL path         url of the original version of a photo, or
+//	                         of its largest resized version if the
+//	                         originals of its album cannot be downloaded
+//	formatDate time layout   time formatted with a Go layout, or nothing
+//	                         if the time is zero
+//	localDate locale time    date in the words of the locale, such as
+//	                         {{localDate .Locale (exif .Path).DateTimeOriginal}}
+//	localSize locale bytes   size with the units of the locale
+//	localCount locale n      number with the separators of the locale
+//	exif path                exif tags of a photo, such as
+//	                         {{(exif .Path).DateTimeOriginal}}
+//	placeholder path         style attribute showing the blurred
+//	                         placeholder of a photo while it loads
+//	editToolbar path locale  forms editing a photo
+//	ratingWidget photo locale  the form rating a photo
+//	companionLinks photo locale
+//	                         download links of the companion files
+//	documentThumbnails       true if documents have thumbnails
+//	fileIcon path            icon of the type of a file
+//	jssorScript interval     the script of the slideshow, which shows
+//	                         each photo for interval milliseconds, such
+//	                         as {{jssorScript .SlideInterval}}
+//	jssorStyle               the styles of the slideshow
+//	browseScript             the script of the folder tree of the browse
+//	                         layout, see the "browse" template
+var templateFuncs = template.FuncMap{
+	"tr":   tr,
+	"link": link,
+	"albumURL": func(path string) string {
+		return link("/" + filepath.ToSlash(path) + "/")
+	},
+	"thumbURL": func(path string, width int) string {
+		return link("/" + filepath.ToSlash(path) + "?width=" + strconv.Itoa(width) + editQuery(path))
+	},
+	"downloadURL": downloadLink,
+	"formatDate": func(t time.Time, layout string) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(layout)
+	},
+	"localDate": func(locale string, t time.Time) string {
+		return formatDate(locale, t, false)
+	},
+	"localSize": func(locale string, n int64) string {
+		return formatSize(locale, n)
+	},
+	"localCount": func(locale string, n int) string {
+		return formatCount(locale, int64(n))
+	},
+	"exif": func(path string) exifData {
+		data, _ := readExif(path)
+		return data
+	},
+	"placeholder": func(path string) template.HTMLAttr {
+		return template.HTMLAttr(placeholderStyle(path))
+	},
+	"editToolbar": func(path, locale string) template.HTML {
+		return template.HTML(editToolbar(path, locale))
+	},
+	"ratingWidget": func(photo photoView, locale string) template.HTML {
+		return template.HTML(ratingWidget(photo, locale))
+	},
+	"companionLinks": func(photo photoView, locale string) template.HTML {
+		return template.HTML(companionLinks(photo.Path, photo.Companions, locale))
+	},
+	"documentThumbnails": func() bool {
+		return conf.Documents.Thumbnailer != ""
+	},
+	"fileIcon": func(path string) template.HTML {
+		return template.HTML(fileIcon(path))
+	},
+	"jssorScript": func(interval ...int) template.HTML {
+		if len(interval) == 0 || interval[0] <= 0 {
+			return template.HTML(jssorParameters)
+		}
+		return template.HTML(strings.Replace(jssorParameters, "$AutoPlayInterval: 3000,",
+			"$AutoPlayInterval: "+strconv.Itoa(interval[0])+",", 1))
+	},
+	"jssorStyle":   func() template.HTML { return template.HTML(jssorStyle) },
+	"browseScript": browseScript,
+}
+
+// defaultTemplates render the pages of the gallery. Themes can redefine any
+// of them, including the empty "head" and "footer" blocks of every page.
+var defaultTemplates = template.Must(template.New("").Funcs(templateFuncs).Parse(`
+{{define "albums"}}{{range .Albums}}<div><a href="{{albumURL .Path}}"><img src="/statics/f.jpg" alt="{{.Name}}"/>{{if .Pinned}}&#9733; {{end}}{{.Name}}</a></div>{{end}}{{end}}
+
+{{define "documents"}}{{if .Documents}}<h2 style="font-size: 1.3em;">{{tr .Locale "documents"}}</h2>
+{{range .Documents}}<div><a href="{{downloadURL .Path}}" target="_blank">{{if documentThumbnails}}<img src="{{thumbURL .Path 300}}" alt="{{.Name}}" loading="lazy"/>{{end}}{{.Name}}</a></div>{{end}}{{end}}{{end}}
+
+{{define "audio"}}{{if .Audio}}<h2 style="font-size: 1.3em;">{{tr .Locale "audio"}}</h2>
+{{range .Audio}}<div>{{if .Cover}}<img src="{{thumbURL .Path 300}}" alt="{{.Name}}" loading="lazy" style="width: 150px; vertical-align: middle;"/> {{end}}{{.Name}} <audio controls preload="none" src="{{downloadURL .Path}}"></audio></div>{{end}}{{end}}{{end}}
+
+{{define "files"}}{{if .Files}}<h2 style="font-size: 1.3em;">{{tr .Locale "files"}}</h2>
+{{$locale := .Locale}}{{range .Files}}<div><a href="{{downloadURL .Path}}" target="_blank">{{fileIcon .Path}} {{.Name}}</a> ({{localSize $locale .Size}})</div>{{end}}{{end}}{{end}}
+
+{{define "caption"}}{{if or .Title .Caption .Place}}<div style="position: absolute; bottom: 0px; right: 0px; max-width: 800px; background: white; padding: 2px;">{{if .Title}}<b>{{.Title}}</b> {{end}}{{.Caption}}{{if .Place}} <a href="{{link "/places/"}}{{.Place}}"><i>{{.Place}}</i></a>{{end}}</div>{{end}}{{end}}
+
+{{define "nav"}}<h1 style="font-size: 1.5em;">{{tr .Locale "navigation"}} {{range .Nav}}/&nbsp;<a href="{{.URL}}">{{.Name}}</a>&nbsp;{{end}}</h1>{{end}}
+
+{{define "home"}}<!DOCTYPE html>
+<html lang="{{.Locale}}">
+	<head>
+		<meta charset="utf-8">
+		<title>{{tr .Locale "title"}}</title>
+		{{block "head" .}}{{end}}
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">{{tr .Locale "content_of"}} <a href="{{link "/"}}">/</a></h1>
+		<p><a href="{{link "/gallery/?view=browse"}}">{{tr .Locale "browse"}}</a> <a href="{{link "/timeline"}}">{{tr .Locale "timeline"}}</a> <a href="{{link "/tags"}}">{{tr .Locale "tags"}}</a> <a href="{{link "/places"}}">{{tr .Locale "places"}}</a>{{if .UserName}} <a href="{{link "/favorites/"}}">{{tr .Locale "favorites"}}</a> <a href="{{link "/profile"}}">{{.UserName}}</a>{{end}}</p>
+		{{template "albums" .}}
+		{{block "footer" .}}{{end}}
+	</body>
+</html>{{end}}
+
+{{define "index"}}<!DOCTYPE html>
+<html lang="{{.Locale}}">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>{{tr .Locale "title"}}</title>
+		{{template "head" .}}
+	</head>
+	<body>
+		{{template "nav" .}}
+		<p><a href="?">{{tr .Locale "slideshow"}}</a> <a href="?view=browse">{{tr .Locale "browse"}}</a></p>
+		{{template "albums" .}}
+		{{template "audio" .}}
+		{{template "documents" .}}
+		{{template "files" .}}
+		{{.IndexHtml}}
+		{{template "footer" .}}
+	</body>
+</html>{{end}}
+
+{{define "browse"}}<!DOCTYPE html>
+<html lang="{{.Locale}}">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>{{tr .Locale "title"}}</title>
+		<style>#photos img { width: 200px; height: 200px; object-fit: cover; margin: 2px; }</style>
+		{{template "head" .}}
+	</head>
+	<body style="display: flex; margin: 0;">
+		<div id="tree" style="flex: 0 0 280px; height: 100vh; overflow: auto; padding: 8px; border-right: 1px solid #ccc;" data-current="{{.Path}}" data-label="{{tr .Locale "navigation"}}" data-tree="{{link "/api/v1/tree"}}" data-album="{{link "/api/v1/album/"}}" data-gallery="{{link "/gallery/"}}"></div>
+		<div style="flex: 1; height: 100vh; overflow: auto; padding: 8px;">
+			<div id="nav">{{template "nav" .}}</div>
+			<p><a id="slideshow" href="{{albumURL .Path}}">{{tr .Locale "slideshow"}}</a> <a id="index" href="{{albumURL .Path}}?view=index">{{tr .Locale "index"}}</a></p>
+			<div id="photos">{{range .Photos}}<a href="{{downloadURL .Path}}"><img src="{{thumbURL .Path 300}}" alt="{{.Name}}" loading="lazy"{{placeholder .Path}}/></a>{{end}}</div>
+			{{template "footer" .}}
+		</div>
+		{{browseScript}}
+	</body>
+</html>{{end}}
+
+{{define "album"}}<!DOCTYPE html>
+<html lang="{{.Locale}}">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<script src="/statics/jquery-2.2.3.min.js"></script>
+		<script src="/statics/jssor.slider.mini.js"></script>
+		{{jssorScript .SlideInterval}}
+		<title>{{tr .Locale "title"}}</title>
+		{{template "head" .}}
+	</head>
+	<body>
+		{{template "nav" .}}
+		<p>{{tr .Locale "slider_help"}}</p>
+		<p><a href="?view=index">{{tr .Locale "index"}}</a> <a href="?view=browse">{{tr .Locale "browse"}}</a> {{if .Shuffled}}<a href="?shuffle=0">{{tr .Locale "unshuffle"}}</a> <a href="?shuffle=1&amp;seed={{.Seed}}">{{tr .Locale "shuffle_link"}}</a>{{else}}<a href="?shuffle=1">{{tr .Locale "shuffle"}}</a>{{end}}</p>
+		{{template "albums" .}}
+		<!-- Jssor Slider Begin -->
+		<div id="slider1_container" style="position: relative; top: 0px; left: 0px; width: 1300px; height: 700px; background: #191919; background-color: white; overflow: hidden;">
+			<!-- Loading Screen -->
+			<div u="loading" style="position: absolute; top: 0px; left: 0px;">
+				<div style="filter: alpha(opacity=70); opacity:0.7; position: absolute; display: block;
+					background-color: #000000; top: 0px; left: 0px;width: 100%;height:100%;">
+				</div>
+				<div style="position: absolute; display: block; background: url(/statics/loading.gif) no-repeat center center;
+					top: 0px; left: 0px;width: 100%;height:100%;">
+				</div>
+			</div>
+
+			<!-- Slides Container -->
+			<div u="slides" style="cursor: move; position: absolute; left: 130px; top: 0px; width: 1300px; height: 700px; overflow: hidden;">
+				{{$locale := .Locale}}{{$editable := .Editable}}{{$rateable := .Rateable}}
+				{{range .Photos}}<div>
+					<a href="{{downloadURL .Path}}"><img u="image" src="{{thumbURL .Path 1200}}"{{placeholder .Path}} /></a>
+					<img u="thumb" src="{{thumbURL .Path 300}}"{{placeholder .Path}} />
+					{{template "caption" .}}
+					{{if not .Captured.IsZero}}<div style="position: absolute; bottom: 0px; left: 0px; background: white; padding: 2px;">{{localDate $locale .Captured}}</div>{{end}}
+					{{if $editable}}{{editToolbar .Path $locale}}{{end}}
+					{{if $rateable}}{{ratingWidget . $locale}}{{end}}
+					{{companionLinks . $locale}}
+				</div>
+				{{end}}
+			</div>
+			{{jssorStyle}}
+		</div>
+		{{template "audio" .}}
+		{{template "documents" .}}
+		{{template "files" .}}
+		{{template "footer" .}}
+	</body>
+</html>{{end}}
+`))
+
+// pageTemplates are the default templates, redefined by those of the theme
+var pageTemplates = defaultTemplates
+
+// theme is the version of the templates of the theme directory that were
+// loaded, which are reloaded in development mode when it changes
+var theme struct {
+	sync.Mutex
+	version string
+}
+
+// initTemplates loads the templates of the theme directory, which redefine
+// the default templates of the same name
+func initTemplates() error {
+	if conf.ThemeDir == "" {
+		return nil
+	}
+	if err := loadTheme(); err != nil {
+		return err
+	}
+	logInfof("theme: loaded templates from %q", conf.ThemeDir)
+	return nil
+}
+
+// themeVersion returns the names, sizes and modification times of the
+// templates of the theme directory, which change when a template is edited,
+// added or removed
+func themeVersion() string {
+	files, _ := filepath.Glob(filepath.Join(conf.ThemeDir, "*.html"))
+	var version strings.Builder
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&version, "%s %d %d\n", file, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return version.String()
+}
+
+// loadTheme parses the templates of the theme directory over the default
+// templates
+func loadTheme() error {
+	version := themeVersion()
+	t, err := defaultTemplates.Clone()
+	if err != nil {
+		return err
+	}
+	if t, err = t.ParseGlob(filepath.Join(conf.ThemeDir, "*.html")); err != nil {
+		return err
+	}
+	pageTemplates, theme.version = t, version
+	return nil
+}
+
+// templates returns the templates pages are rendered with. In development
+// mode, the templates of the theme are parsed again as soon as one of them
+// changed, and their errors are returned until they are fixed.
+func templates() (*template.Template, error) {
+	if !conf.DevMode || conf.ThemeDir == "" {
+		return pageTemplates, nil
+	}
+	theme.Lock()
+	defer theme.Unlock()
+	if themeVersion() == theme.version {
+		return pageTemplates, nil
+	}
+	if err := loadTheme(); err != nil {
+		return nil, err
+	}
+	logInfof("theme: reloaded templates from %q", conf.ThemeDir)
+	return pageTemplates, nil
+}
+
+// preRenderHook can modify the data of a page before it is rendered by the
+// template of the given name
+type preRenderHook func(r *http.Request, name string, data interface{})
+
+// postRenderHook can modify the HTML of a rendered page before it is sent
+type postRenderHook func(r *http.Request, name string, page []byte) []byte
+
+var (
+	preRenderHooks  []preRenderHook
+	postRenderHooks []postRenderHook
+)
+
+// registerRenderHooks adds hooks called around the rendering of every page,
+// in the order they were registered. Either hook can be nil.
+func registerRenderHooks(pre preRenderHook, post postRenderHook) {
+	if pre != nil {
+		preRenderHooks = append(preRenderHooks, pre)
+	}
+	if post != nil {
+		postRenderHooks = append(postRenderHooks, post)
+	}
+}
+
+// renderPage renders the template of the given name with data, through the
+// render hooks, and writes the page to w
+func renderPage(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	for _, hook := range preRenderHooks {
+		hook(r, name, data)
+	}
+	var buf bytes.Buffer
+	t, err := templates()
+	if err == nil {
+		err = t.ExecuteTemplate(&buf, name, data)
+	}
+	if err != nil {
+		logErrorf("theme: failed to render %q: %v", name, err)
+		if conf.DevMode {
+			// the error of the template being worked on
+			writeErrorMessage(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, "render_failed")
+		return
+	}
+	page := buf.Bytes()
+	for _, hook := range postRenderHooks {
+		page = hook(r, name, page)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bandwidthConf limits the rate, in bytes per second, at which originals
+// and videos are sent, such as "2MB". A zero or empty limit is disabled.
+//
+//	bandwidth:
+//	  global: 8MB
+//	  perip: 2MB
+//	  peruser: 4MB
+type bandwidthConf struct {
+	// Global is shared by every download
+	Global string
+	// PerIP is shared by the downloads of a client address
+	PerIP string
+	// PerUser is shared by the downloads of an authenticated user
+	PerUser string
+}
+
+// throttleChunk is the largest write sent at once by a throttled response
+const throttleChunk = 32 << 10
+
+// byteBucket is a token bucket counting bytes, refilled at rate bytes per
+// second with bursts of up to one second of traffic
+type byteBucket struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate int64) *byteBucket {
+	return &byteBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait reserves n bytes and blocks until the bucket has refilled enough to
+// send them, or until ctx is canceled
+func (b *byteBucket) wait(ctx context.Context, n int) error {
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idle returns true if the bucket has refilled entirely
+func (b *byteBucket) idle() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.tokens+time.Since(b.last).Seconds()*b.rate >= b.rate
+}
+
+// bucketSet holds one bucket per client address or per user
+type bucketSet struct {
+	sync.Mutex
+	rate    int64
+	buckets map[string]*byteBucket
+}
+
+func (s *bucketSet) get(key string) *byteBucket {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		// forget about the buckets of clients that are done downloading
+		for k, old := range s.buckets {
+			if old.idle() {
+				delete(s.buckets, k)
+			}
+		}
+		b = newByteBucket(s.rate)
+		s.buckets[key] = b
+	}
+	return b
+}
+
+var (
+	globalBandwidth *byteBucket
+	ipBandwidth     *bucketSet
+	userBandwidth   *bucketSet
+)
+
+// initBandwidth parses the bandwidth limits of the configuration
+func initBandwidth() error {
+	global, err := parseSize(conf.Bandwidth.Global)
+	if err != nil {
+		return err
+	}
+	perIP, err := parseSize(conf.Bandwidth.PerIP)
+	if err != nil {
+		return err
+	}
+	perUser, err := parseSize(conf.Bandwidth.PerUser)
+	if err != nil {
+		return err
+	}
+	if global > 0 {
+		globalBandwidth = newByteBucket(global)
+	}
+	if perIP > 0 {
+		ipBandwidth = &bucketSet{rate: perIP, buckets: make(map[string]*byteBucket)}
+	}
+	if perUser > 0 {
+		userBandwidth = &bucketSet{rate: perUser, buckets: make(map[string]*byteBucket)}
+	}
+	return nil
+}
+
+// throttledWriter sends the body of a response no faster than its buckets
+// allow
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*byteBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		for _, b := range t.buckets {
+			if err = b.wait(t.ctx, len(chunk)); err != nil {
+				return
+			}
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return
+}
+
+// throttle wraps w so the response to r is subject to the bandwidth limits
+// of the configuration
+func throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var buckets []*byteBucket
+	if globalBandwidth != nil {
+		buckets = append(buckets, globalBandwidth)
+	}
+	if ipBandwidth != nil {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		buckets = append(buckets, ipBandwidth.get(ip))
+	}
+	if username := requestUser(r); userBandwidth != nil && username != "" {
+		buckets = append(buckets, userBandwidth.get(username))
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), buckets: buckets}
+}
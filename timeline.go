@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// timeline shows the images of the gallery, or of one of its top level
+// albums, grouped by capture year, month and day, along with the places of
+// each day. A single year is shown at a time, the most recent by default.
+func timeline(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	root := mux.Vars(r)["root"]
+	prefix := "gallery/"
+	base := link("/timeline")
+	if root != "" {
+		prefix += root + "/"
+		base += "/" + root
+	}
+	var entries []mediaEntry
+	visible := reachableFilter(r)
+	for _, e := range index.byCaptureDate(prefix) {
+		if visible(e.Path) {
+			entries = append(entries, e)
+		}
+	}
+	filter := url.Values{}
+	if tag := normalizeTag(r.URL.Query().Get("tag")); tag != "" {
+		// only show the photos of a tag
+		var tagged []mediaEntry
+		for _, e := range entries {
+			if e.hasTag(tag) {
+				tagged = append(tagged, e)
+			}
+		}
+		entries = tagged
+		filter.Set("tag", tag)
+	}
+	if place := strings.TrimSpace(r.URL.Query().Get("place")); place != "" {
+		// only show the photos taken at a place
+		var located []mediaEntry
+		for _, e := range entries {
+			if e.inPlace(place) {
+				located = append(located, e)
+			}
+		}
+		entries = located
+		filter.Set("place", place)
+	}
+	if len(filter) > 0 {
+		base += "?" + html.EscapeString(filter.Encode()) + "&amp;"
+	} else {
+		base += "?"
+	}
+	if len(entries) == 0 {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	year := entries[0].Captured.Year()
+	if y, err := strconv.Atoi(r.URL.Query().Get("year")); err == nil {
+		year = y
+	}
+	// the places of each day are listed next to its date
+	dayPlaces := make(map[string][]string)
+	seenPlaces := make(map[string]bool)
+	for _, e := range entries {
+		day := e.Captured.Format("2006-01-02")
+		if e.Place != "" && !seenPlaces[day+"/"+e.Place] {
+			seenPlaces[day+"/"+e.Place] = true
+			dayPlaces[day] = append(dayPlaces[day], e.Place)
+		}
+	}
+
+	// jump to date navigation: every year, then every month of the year
+	var yearsHtml, monthsHtml, photosHtml string
+	var lastYear, lastDay int
+	var lastMonth time.Month
+	for _, e := range entries {
+		y, m, d := e.Captured.Date()
+		if y != lastYear {
+			yearsHtml += fmt.Sprintf(`<a href="%syear=%d">%d</a> `, base, y, y)
+			lastYear = y
+		}
+		if y != year {
+			continue
+		}
+		if m != lastMonth {
+			monthsHtml += fmt.Sprintf(`<a href="#%d-%02d">%s</a> `, y, m, tr(locale, "month_"+strconv.Itoa(int(m))))
+			photosHtml += fmt.Sprintf(`<h2 id="%d-%02d" style="font-size: 1.3em;">%s %d</h2>`+"\n",
+				y, m, tr(locale, "month_"+strconv.Itoa(int(m))), y)
+			lastMonth = m
+			lastDay = 0
+		}
+		if d != lastDay {
+			var placesHtml string
+			for _, place := range dayPlaces[e.Captured.Format("2006-01-02")] {
+				placesHtml += fmt.Sprintf(` <a href="%s">%s</a>`,
+					html.EscapeString(link("/places/"+url.PathEscape(place))), html.EscapeString(place))
+			}
+			photosHtml += fmt.Sprintf(`<h3 style="font-size: 1.1em;">%d%s</h3>`+"\n", d, placesHtml)
+			lastDay = d
+		}
+		photosHtml += fmt.Sprintf(`<a href="%s"><img src="%s?width=200&amp;crop=center%s" width="200" height="200" loading="lazy" title="%s"%s/></a>`+"\n",
+			html.EscapeString(link("/"+e.Path)), html.EscapeString(link("/"+e.Path)), html.EscapeString(editQuery(e.Path)), html.EscapeString(e.Path), placeholderStyle(e.Path))
+	}
+	if photosHtml == "" {
+		photosHtml = "<p>" + tr(locale, "no_images") + "</p>"
+	}
+	io.WriteString(w, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head>
+		<meta charset="utf-8">
+		<meta name="viewport" content="width=device-width, initial-scale=1.0">
+		<title>`+tr(locale, "title")+`</title>
+	</head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+html.EscapeString(strings.TrimSpace(tr(locale, "timeline")+" "+root))+` `+strconv.Itoa(year)+`</h1>
+		<p>`+yearsHtml+`</p>
+		<p>`+monthsHtml+`</p>
+`+photosHtml+`
+	</body>
+</html>`)
+}
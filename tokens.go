@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/context"
+)
+
+// apiToken lets scripts and mobile clients authenticate as a user without
+// the password of the account. The secret of a token is only shown when it
+// is created, and only its sha256 is stored.
+type apiToken struct {
+	// ID identifies the token, and is the first part of the bearer token
+	ID   string `json:"id"`
+	Hash string `json:"hash"`
+	User string `json:"user"`
+	// Name describes the client the token was created for
+	Name    string    `json:"name"`
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+// tokenScopes are the scopes of the tokens, each capping the role of the
+// user in the requests authenticated by a token. read only allows the GET
+// requests, upload also allows writes to the albums, and admin also allows
+// the admin pages.
+var tokenScopes = map[string]role{
+	"read":   roleViewer,
+	"upload": roleUploader,
+	"admin":  roleAdmin,
+}
+
+// tokenStore persists the api tokens, in the database if one is configured
+// and in tokenfile otherwise
+type tokenStore interface {
+	tokens() ([]apiToken, error)
+	// find returns the token with the given id, or false if there is none
+	find(id string) (apiToken, bool, error)
+	add(t apiToken) error
+	revoke(id string) error
+}
+
+var apiTokens tokenStore
+
+// initTokens selects the store of the api tokens
+func initTokens() {
+	if db != nil {
+		apiTokens = dbTokenStore{}
+		return
+	}
+	path := conf.TokenFile
+	if path == "" {
+		path = "tokens.json"
+	}
+	apiTokens = &fileTokenStore{path: path}
+}
+
+// newToken creates a token for a user and returns it, along with the bearer
+// token to give to the client, made of the id and of the secret
+func newToken(username, name, scope string) (apiToken, string, error) {
+	if _, ok := tokenScopes[scope]; !ok {
+		return apiToken{}, "", fmt.Errorf("unknown scope %q", scope)
+	}
+	buf := make([]byte, 36)
+	if _, err := rand.Read(buf); err != nil {
+		return apiToken{}, "", err
+	}
+	id, secret := hex.EncodeToString(buf[:4]), hex.EncodeToString(buf[4:])
+	t := apiToken{
+		ID:      id,
+		Hash:    hashSecret(secret),
+		User:    username,
+		Name:    name,
+		Scope:   scope,
+		Created: time.Now().UTC(),
+	}
+	if err := apiTokens.add(t); err != nil {
+		return apiToken{}, "", err
+	}
+	return t, id + "." + secret, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenAuth authenticates the requests that carry an api token in their
+// Authorization header, as "Bearer id.secret"
+type tokenAuth struct {
+	// known returns false for the users who were removed since their
+	// tokens were created, or is nil if users are managed elsewhere
+	known func(username string) bool
+}
+
+func (a tokenAuth) Authenticate(r *http.Request) (username string, ok bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), ".", 2)
+	if len(fields) != 2 {
+		authFailed(r, "", "malformed api token")
+		return "", false
+	}
+	t, found, err := apiTokens.find(fields[0])
+	if err != nil {
+		logWarnf("auth failed: %v", err)
+		return "", false
+	}
+	// the secret is hashed even if the token does not exist, so the time
+	// taken to reject a request does not reveal which tokens exist
+	if !equalSecrets(hashSecret(fields[1]), t.Hash) || !found {
+		authFailed(r, t.User, "invalid api token "+fields[0])
+		return "", false
+	}
+	if a.known != nil && !a.known(t.User) {
+		authFailed(r, t.User, "api token of a user who is not listed as authorized")
+		return "", false
+	}
+	context.Set(r, scopeKey, tokenScopes[t.Scope])
+	context.Set(r, tokenKey, t.ID)
+	return t.User, true
+}
+
+// knownUser returns true if a user is listed in the configuration or in the
+// database
+func knownUser(username string) bool {
+	if _, ok := conf.Users[username]; ok {
+		return true
+	}
+	if db == nil {
+		return false
+	}
+	var name string
+	err := db.QueryRow(rebind(`SELECT name FROM users WHERE name = ?`), username).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		logWarnf("auth failed: %v", err)
+	}
+	return err == nil
+}
+
+// requireScope rejects the requests authenticated by a token whose scope
+// does not cover them. The role of the user is still checked by the
+// handlers, the scope of a token can only restrict it.
+func requireScope(pass handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope, ok := context.Get(r, scopeKey).(role)
+		if !ok {
+			pass(w, r)
+			return
+		}
+		needed := roleViewer
+		if strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+			needed = roleAdmin
+		} else if r.Method != "GET" && r.Method != "HEAD" {
+			needed = roleUploader
+		}
+		if scope < needed {
+			logWarnf("access denied: api token of user %q does not allow %s %s", requestUser(r), r.Method, r.URL.Path)
+			writeError(w, r, http.StatusForbidden, "token_scope")
+			return
+		}
+		pass(w, r)
+	}
+}
+
+// fileTokenStore keeps the tokens in a json file, which is read again when
+// it changes, so tokens created and revoked from the command line, or by
+// other instances sharing the file, are picked up without a restart
+type fileTokenStore struct {
+	path    string
+	mu      sync.Mutex
+	modtime time.Time
+	list    []apiToken
+}
+
+// load reads the token file if it changed since it was last read. The
+// caller must hold the lock.
+func (s *fileTokenStore) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.list, s.modtime = nil, time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modtime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []apiToken
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("tokens: invalid token file %q: %v", s.path, err)
+	}
+	s.list, s.modtime = list, fi.ModTime()
+	return nil
+}
+
+// write replaces the token file. The caller must hold the lock.
+func (s *fileTokenStore) write(list []apiToken) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	// read the file again on the next call, to get its modification time
+	s.modtime = time.Time{}
+	return nil
+}
+
+func (s *fileTokenStore) tokens() ([]apiToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load()
+	return append([]apiToken(nil), s.list...), err
+}
+
+func (s *fileTokenStore) find(id string) (apiToken, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return apiToken{}, false, err
+	}
+	for _, t := range s.list {
+		if t.ID == id {
+			return t, true, nil
+		}
+	}
+	return apiToken{}, false, nil
+}
+
+func (s *fileTokenStore) add(t apiToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.write(append(append([]apiToken(nil), s.list...), t))
+}
+
+func (s *fileTokenStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	var list []apiToken
+	for _, t := range s.list {
+		if t.ID != id {
+			list = append(list, t)
+		}
+	}
+	if len(list) == len(s.list) {
+		return fmt.Errorf("token %q not found", id)
+	}
+	return s.write(list)
+}
+
+// dbTokenStore keeps the tokens in the api_tokens table of the database
+type dbTokenStore struct{}
+
+func (dbTokenStore) tokens() (list []apiToken, err error) {
+	rows, err := db.Query(`SELECT id, hash, username, name, scope, created FROM api_tokens`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t apiToken
+		if err = rows.Scan(&t.ID, &t.Hash, &t.User, &t.Name, &t.Scope, &t.Created); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (dbTokenStore) find(id string) (t apiToken, found bool, err error) {
+	err = db.QueryRow(rebind(`SELECT id, hash, username, name, scope, created FROM api_tokens WHERE id = ?`), id).
+		Scan(&t.ID, &t.Hash, &t.User, &t.Name, &t.Scope, &t.Created)
+	if err == sql.ErrNoRows {
+		return t, false, nil
+	}
+	return t, err == nil, err
+}
+
+func (dbTokenStore) add(t apiToken) error {
+	_, err := db.Exec(rebind(`INSERT INTO api_tokens (id, hash, username, name, scope, created) VALUES (?, ?, ?, ?, ?, ?)`),
+		t.ID, t.Hash, t.User, t.Name, t.Scope, t.Created)
+	return err
+}
+
+func (dbTokenStore) revoke(id string) error {
+	res, err := db.Exec(rebind(`DELETE FROM api_tokens WHERE id = ?`), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("token %q not found", id)
+	}
+	return nil
+}
+
+// tokensView lists the api tokens of every user, and lets admins create and
+// revoke them. The secret of a new token is shown once, by tokenAction.
+func tokensView(w http.ResponseWriter, r *http.Request) {
+	writeTokensPage(w, r, "")
+}
+
+func writeTokensPage(w http.ResponseWriter, r *http.Request, created string) {
+	locale := requestLocale(r)
+	list, err := apiTokens.tokens()
+	if err != nil {
+		logErrorf("tokens: failed to list tokens: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "token_failed")
+		return
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	var tokensHtml string
+	for _, t := range list {
+		tokensHtml += fmt.Sprintf(`<li>%s: %s (%s, %s, %s)
+	<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="id" value="%s"/><button type="submit" name="action" value="revoke">%s</button></form>
+</li>
+`, html.EscapeString(t.User), html.EscapeString(t.Name), html.EscapeString(t.ID), html.EscapeString(t.Scope),
+			t.Created.Format(time.RFC3339), link("/admin/tokens"), html.EscapeString(t.ID), tr(locale, "revoke"))
+	}
+	if tokensHtml == "" {
+		tokensHtml = "<p>" + tr(locale, "none_found") + "</p>"
+	} else {
+		tokensHtml = "<ul>\n" + tokensHtml + "</ul>"
+	}
+	if created != "" {
+		created = `<p>` + tr(locale, "token_created") + ` <code>` + html.EscapeString(created) + `</code></p>
+`
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "api_tokens")+`</h1>
+`+created+`		<form method="POST" action="`+link("/admin/tokens")+`"><input type="text" name="user" placeholder="user"/> <input type="text" name="name" placeholder="name"/> <select name="scope"><option value="read">read</option><option value="upload">upload</option><option value="admin">admin</option></select> <button type="submit" name="action" value="create">`+tr(locale, "create")+`</button></form>
+`+tokensHtml+`
+	</body>
+</html>`))
+}
+
+// tokenAction creates or revokes the api token of the form
+func tokenAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	switch r.FormValue("action") {
+	case "create":
+		user := strings.TrimSpace(r.FormValue("user"))
+		if user == "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		t, secret, err := newToken(user, strings.TrimSpace(r.FormValue("name")), r.FormValue("scope"))
+		if err != nil {
+			logErrorf("tokens: failed to create token: %v", err)
+			writeError(w, r, http.StatusBadRequest, "token_failed")
+			return
+		}
+		logInfof("tokens: user %q created token %q of user %q with scope %s", username, t.ID, t.User, t.Scope)
+		// the page is not cached, it holds the only copy of the secret
+		w.Header().Set("Cache-Control", "no-store")
+		writeTokensPage(w, r, secret)
+	case "revoke":
+		id := r.FormValue("id")
+		if err := apiTokens.revoke(id); err != nil {
+			logErrorf("tokens: failed to revoke token %q: %v", id, err)
+			writeError(w, r, http.StatusNotFound, "token_failed")
+			return
+		}
+		logInfof("tokens: user %q revoked token %q", username, id)
+		http.Redirect(w, r, link("/admin/tokens"), http.StatusSeeOther)
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+	}
+}
+
+// tokenCmd creates, lists and revokes api tokens:
+// galilego token [-c config.yaml] [-scope read] [-name client] username
+// galilego token [-c config.yaml] -list
+// galilego token [-c config.yaml] -revoke id
+func tokenCmd(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	var (
+		config = fs.String("c", "config.yaml", "Load configuration from file")
+		scope  = fs.String("scope", "read", "Scope of the new token: read, upload or admin")
+		name   = fs.String("name", "", "Name of the client of the new token")
+		list   = fs.Bool("list", false, "List the tokens")
+		revoke = fs.String("revoke", "", "Revoke the token with this id")
+	)
+	fs.Parse(args)
+	if err := loadConfig(*config); err != nil {
+		log.Fatal(err)
+	}
+	if conf.Database.Driver != "" {
+		if err := openDatabase(conf.Database); err != nil {
+			log.Fatal(err)
+		}
+	}
+	initTokens()
+	switch {
+	case *list:
+		tokens, err := apiTokens.tokens()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, t := range tokens {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Scope, t.Created.Format(time.RFC3339), t.Name)
+		}
+	case *revoke != "":
+		if err := apiTokens.revoke(*revoke); err != nil {
+			log.Fatal(err)
+		}
+		logInfof("token: revoked token %q", *revoke)
+	case fs.NArg() == 1:
+		t, secret, err := newToken(fs.Arg(0), *name, *scope)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfof("token: created token %q of user %q with scope %s", t.ID, t.User, t.Scope)
+		// the secret goes alone to the standard output, for scripts
+		fmt.Println(secret)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultTrashRetention is how long deleted photos can be restored,
+	// when the configuration sets no retention
+	defaultTrashRetention = 30 * 24 * time.Hour
+	// defaultTrashPurge is the interval of the purges of the trash
+	defaultTrashPurge = 24 * time.Hour
+)
+
+// trashConf configures the trash of the photos deleted by their uploaders,
+// or by the admins. Deleted photos are moved to the trash directory, which
+// should be on the filesystem of the gallery, with their sidecars, and can
+// be restored on /trash until retention has passed. The trash is purged of
+// the expired photos every purge interval.
+//
+//	trash:
+//	  dir: /var/lib/galilego/trash
+//	  retention: 720h
+//	  purge: 6h
+type trashConf struct {
+	// Dir holds the deleted photos, trash by default
+	Dir       string
+	Retention time.Duration
+	Purge     time.Duration
+}
+
+// trashItem is a deleted photo, stored in the directory of its id along
+// with its sidecars, and described by the json file of its id
+type trashItem struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+	Size    int64     `json:"size"`
+	// Files are the names of the photo and of its sidecars
+	Files []string `json:"files"`
+	// Entry keeps the tags, titles and ratings of the photo, which it
+	// recovers when it is restored
+	Entry *mediaEntry `json:"entry,omitempty"`
+}
+
+// trashIDre matches the identifiers of trash items
+var trashIDre = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// trashDir returns the directory of the trash
+func trashDir() string {
+	if conf.Trash.Dir != "" {
+		return conf.Trash.Dir
+	}
+	return "trash"
+}
+
+func (t trashItem) dataDir() string {
+	return filepath.Join(trashDir(), t.ID)
+}
+
+func (t trashItem) infoPath() string {
+	return filepath.Join(trashDir(), t.ID+".json")
+}
+
+// remove deletes the item and its files
+func (t trashItem) remove() error {
+	if err := os.RemoveAll(t.dataDir()); err != nil {
+		return err
+	}
+	return os.Remove(t.infoPath())
+}
+
+// initTrash purges the trash periodically
+func initTrash() {
+	interval := conf.Trash.Purge
+	if interval <= 0 {
+		interval = defaultTrashPurge
+	}
+	go func() {
+		for {
+			// the index is loaded by the time of the first purge
+			time.Sleep(interval)
+			purgeTrash()
+		}
+	}()
+}
+
+// photoFiles returns the names of the sidecars of the photo at path that
+// exist, after the name of the photo
+func photoFiles(path string) []string {
+	names := []string{filepath.Base(path)}
+	for _, sidecar := range []string{editPath(path), path + ".txt", path + ".xmp", xmpSidecarPath(path)} {
+		if fi, err := os.Stat(sidecar); err == nil && fi.Mode().IsRegular() {
+			names = append(names, filepath.Base(sidecar))
+		}
+	}
+	return names
+}
+
+// uploader returns the user who uploaded the file at path, or an empty
+// string if it was not uploaded from the gallery
+func uploader(path string) (username string) {
+	uploadLogLock.Lock()
+	defer uploadLogLock.Unlock()
+	fd, err := os.Open(uploadLogPath())
+	if err != nil {
+		return ""
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var rec uploadRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) == nil && rec.Path == path {
+			// the last upload of a path replaced the previous ones
+			username = rec.User
+		}
+	}
+	return
+}
+
+// canDelete returns true if the user can move the photo at path to the
+// trash: admins can delete any photo, and uploaders the photos they
+// uploaded, unless the album is archived
+func canDelete(username, path string) bool {
+	if isArchived(path) {
+		return false
+	}
+	return isAdmin(username) || (canUpload(username, path) && uploader(path) == username)
+}
+
+// trashPhoto moves the photo at path and its sidecars to the trash, and
+// removes it from the index
+func trashPhoto(path, username string) (trashItem, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return trashItem{}, err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return trashItem{}, err
+	}
+	retention := conf.Trash.Retention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	t := trashItem{
+		ID:      hex.EncodeToString(id),
+		User:    username,
+		Path:    path,
+		Deleted: now,
+		Expires: now.Add(retention),
+		Size:    fi.Size(),
+		Files:   photoFiles(path),
+	}
+	if e, ok := index.get(path); ok {
+		t.Entry = &e
+	}
+	if err = os.MkdirAll(t.dataDir(), 0750); err != nil {
+		return t, err
+	}
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(t.infoPath(), data, 0640)
+	}
+	if err != nil {
+		os.RemoveAll(t.dataDir())
+		return t, err
+	}
+	dir := filepath.Dir(path)
+	for i, name := range t.Files {
+		if err = os.Rename(filepath.Join(dir, name), filepath.Join(t.dataDir(), name)); err != nil {
+			// the files already moved go back to the album
+			for _, name := range t.Files[:i] {
+				os.Rename(filepath.Join(t.dataDir(), name), filepath.Join(dir, name))
+			}
+			t.remove()
+			return t, err
+		}
+	}
+	index.Lock()
+	delete(index.entries, filepath.Clean(path))
+	index.Unlock()
+	invalidateListing(dir)
+	if err = index.save(); err != nil {
+		logErrorf("trash: failed to save index: %v", err)
+	}
+	return t, nil
+}
+
+// restore moves the photo and its sidecars back to their album, and puts
+// the photo back in the index with its metadata. Nothing is restored if a
+// file of the same name was added to the album since.
+func (t trashItem) restore() error {
+	dir := filepath.Dir(t.Path)
+	for _, name := range t.Files {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return os.ErrExist
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range t.Files {
+		if err := os.Rename(filepath.Join(t.dataDir(), name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if t.Entry != nil {
+		index.Lock()
+		index.entries[t.Entry.Path] = t.Entry
+		index.Unlock()
+		if err := index.save(); err != nil {
+			logErrorf("trash: failed to save index: %v", err)
+		}
+	}
+	invalidateListing(dir)
+	return t.remove()
+}
+
+// trashItems returns the items of the trash deleted by username, or by
+// anyone if username is empty, most recently deleted first. Expired items
+// are left out, until they are purged.
+func trashItems(username string) ([]trashItem, error) {
+	infos, err := filepath.Glob(filepath.Join(trashDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := []trashItem{}
+	now := time.Now()
+	for _, path := range infos {
+		var t trashItem
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &t)
+		}
+		if err != nil {
+			logErrorf("trash: invalid item %q: %v", path, err)
+			continue
+		}
+		if now.After(t.Expires) || (username != "" && t.User != username) {
+			continue
+		}
+		items = append(items, t)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Deleted.After(items[j].Deleted) })
+	return items, nil
+}
+
+// findTrashItem returns the item of the given id, if username can restore
+// it: admins can restore every item, and the other users their own
+func findTrashItem(id, username string) (t trashItem, err error) {
+	if !trashIDre.MatchString(id) {
+		return t, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(filepath.Join(trashDir(), id+".json"))
+	if err != nil {
+		return t, err
+	}
+	if err = json.Unmarshal(data, &t); err != nil {
+		return t, err
+	}
+	if time.Now().After(t.Expires) || (t.User != username && !isAdmin(username)) {
+		return t, os.ErrNotExist
+	}
+	return t, nil
+}
+
+// purgeTrash deletes the items whose retention has passed, along with the
+// thumbnails of the local cache that no photo of the index shares
+func purgeTrash() {
+	infos, _ := filepath.Glob(filepath.Join(trashDir(), "*.json"))
+	for _, path := range infos {
+		var t trashItem
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &t)
+		}
+		if err != nil || !time.Now().After(t.Expires) {
+			continue
+		}
+		if err = t.remove(); err != nil {
+			logErrorf("trash: failed to purge %q: %v", t.Path, err)
+			continue
+		}
+		logInfof("trash: purged %q, deleted by %q on %s", t.Path, t.User, t.Deleted.Format(time.RFC3339))
+		c, ok := imgCache.(cacheMover)
+		if !ok || t.Entry == nil || t.Entry.Hash == "" || indexedHash(t.Entry.Hash) {
+			continue
+		}
+		if err = c.remove(thumbnailPrefix(t.Entry.Hash)); err != nil {
+			logErrorf("trash: failed to remove the thumbnails of %q: %v", t.Path, err)
+		}
+	}
+}
+
+// indexedHash returns true if a photo of the index has the given hash
+func indexedHash(hash string) bool {
+	index.RLock()
+	defer index.RUnlock()
+	for _, e := range index.entries {
+		if e.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// trashError replies to a trash request that failed with the error of err
+func trashError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case os.IsNotExist(err):
+		writeError(w, r, http.StatusNotFound, "not_found")
+	case os.IsExist(err):
+		writeError(w, r, http.StatusConflict, "upload_exists")
+	default:
+		logErrorf("trash: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "trash_failed")
+	}
+}
+
+// apiDeleteImage moves the photo of the galpath route variable to the trash,
+// and returns its trash item
+func apiDeleteImage(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	path := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if !isImage(path) {
+		writeError(w, r, http.StatusNotFound, "not_found")
+		return
+	}
+	if !canDelete(username, path) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	t, err := trashPhoto(path, username)
+	if err != nil {
+		trashError(w, r, err)
+		return
+	}
+	logInfof("trash: user %q deleted %q", username, path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// apiTrash lists the items of the trash of the user, or of every user for
+// the admins, as json
+func apiTrash(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	if isAdmin(username) {
+		username = ""
+	}
+	items, err := trashItems(username)
+	if err != nil {
+		trashError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// apiRestoreTrash restores the trash item of the id route variable
+func apiRestoreTrash(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	t, err := findTrashItem(mux.Vars(r)["id"], username)
+	if err == nil {
+		err = t.restore()
+	}
+	if err != nil {
+		trashError(w, r, err)
+		return
+	}
+	logInfof("trash: user %q restored %q", username, t.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashView lists the photos deleted by the user, or by every user for the
+// admins, which can be restored until they expire
+func trashView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	username := requestUser(r)
+	all := isAdmin(username)
+	if all {
+		username = ""
+	}
+	items, err := trashItems(username)
+	if err != nil {
+		trashError(w, r, err)
+		return
+	}
+	var itemsHtml string
+	for _, t := range items {
+		deleted := fmt.Sprintf(tr(locale, "trash_item"), formatSize(locale, t.Size), formatDate(locale, t.Deleted, true), formatDate(locale, t.Expires, true))
+		if all {
+			deleted = html.EscapeString(t.User) + ", " + deleted
+		}
+		itemsHtml += fmt.Sprintf(`<li>%s, %s
+	<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="id" value="%s"/><button type="submit" name="action" value="restore">%s</button></form>
+</li>
+`, html.EscapeString(strings.TrimPrefix(t.Path, "gallery/")), deleted, link("/trash"), t.ID, tr(locale, "trash_restore"))
+	}
+	if itemsHtml == "" {
+		itemsHtml = "<p>" + tr(locale, "none_found") + "</p>"
+	} else {
+		itemsHtml = "<ul>\n" + itemsHtml + "</ul>"
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "trash")+`</h1>
+`+itemsHtml+`
+	</body>
+</html>`))
+}
+
+// trashAction restores the trash item of the form
+func trashAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	if r.FormValue("action") != "restore" {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	t, err := findTrashItem(r.FormValue("id"), username)
+	if err == nil {
+		err = t.restore()
+	}
+	if err != nil {
+		trashError(w, r, err)
+		return
+	}
+	logInfof("trash: user %q restored %q", username, t.Path)
+	http.Redirect(w, r, link("/trash"), http.StatusSeeOther)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// treeNode is an album of the folder tree returned by the tree endpoint,
+// with its sub albums
+type treeNode struct {
+	Name string `json:"name"`
+	// Path is relative to the gallery, such as "family/2020", and empty
+	// for the gallery itself
+	Path string `json:"path"`
+	URL  string `json:"url"`
+	// Photos is the number of photos of the album, and Total the number of
+	// photos of the album and of its sub albums
+	Photos int        `json:"photos"`
+	Total  int        `json:"total"`
+	Albums []treeNode `json:"albums,omitempty"`
+}
+
+// albumTree returns the tree of the album at dir. The listings of the
+// albums are cached, so the tree of a large gallery is only read from disk
+// when its albums change.
+func albumTree(dir string) (treeNode, error) {
+	entries, err := readAlbum(dir)
+	if err != nil {
+		return treeNode{}, err
+	}
+	node := treeNode{
+		Name: filepath.Base(dir),
+		Path: strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(dir), "gallery"), "/"),
+		URL:  link("/" + filepath.ToSlash(dir) + "/"),
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			child, err := albumTree(path)
+			if err != nil {
+				// albums removed while the tree is read are left out
+				continue
+			}
+			node.Albums = append(node.Albums, child)
+			node.Total += child.Total
+		} else if entry.Mode().IsRegular() && isImage(path) {
+			node.Photos++
+		}
+	}
+	node.Total += node.Photos
+	return node, nil
+}
+
+// apiTree returns the tree of the sub albums of the album designated by the
+// galpath route variable, or of the whole gallery, with the number of photos
+// of each, as json. The top level albums are those of the home page, in the
+// same order, without the hidden albums and those the user cannot see.
+func apiTree(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	tree, err := albumTree(dir)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	if dir == "gallery" {
+		visible := viewFilter(requestUser(r))
+		ip := clientAddress(r)
+		nodes := make(map[string]treeNode)
+		var links []albumLink
+		for _, node := range tree.Albums {
+			path := filepath.Join(dir, node.Name)
+			if visible(path) && reachable(ip, node.Name) {
+				nodes[node.Name] = node
+				links = append(links, albumLink{Name: node.Name, Path: path})
+			}
+		}
+		tree.Albums, tree.Total = nil, tree.Photos
+		for _, a := range currentHomeLayout().arrange(links) {
+			tree.Albums = append(tree.Albums, nodes[a.Name])
+			tree.Total += nodes[a.Name].Total
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// browseScript fills the folder tree of the browse layout from the tree
+// endpoint, as nested details elements that open and close, and loads the
+// photos of the albums picked in the tree from the album endpoint, so the
+// gallery is browsed without reloading the page. The address of the page
+// follows the album, so it can be bookmarked and the back button works.
+func browseScript() template.HTML {
+	return template.HTML(`<script>
+(function() {
+	var tree = document.getElementById("tree"), pane = document.getElementById("photos");
+	var nav = document.getElementById("nav"), slideshow = document.getElementById("slideshow"), index = document.getElementById("index");
+	var current = tree.dataset.current.replace(/^gallery\/?/, "").replace(/\/$/, "");
+	function escapePath(path) {
+		return path.split("/").map(encodeURIComponent).join("/");
+	}
+	function albumURL(path) {
+		return tree.dataset.gallery + (path ? escapePath(path) + "/" : "");
+	}
+	function link(text, href) {
+		var a = document.createElement("a");
+		a.textContent = text;
+		a.href = href;
+		return a;
+	}
+	function showNav(path) {
+		var h1 = document.createElement("h1");
+		h1.style.fontSize = "1.5em";
+		h1.appendChild(document.createTextNode(tree.dataset.label + " "));
+		var parts = path ? path.split("/") : [];
+		h1.appendChild(document.createTextNode("/ "));
+		h1.appendChild(link("gallery", albumURL("") + "?view=browse"));
+		for (var i = 0; i < parts.length; i++) {
+			h1.appendChild(document.createTextNode(" / "));
+			h1.appendChild(link(parts[i], albumURL(parts.slice(0, i + 1).join("/")) + "?view=browse"));
+		}
+		nav.replaceChildren(h1);
+	}
+	function showAlbum(path, push) {
+		fetch(tree.dataset.album + escapePath(path), {credentials: "same-origin", headers: {"Accept": "application/json"}}).then(function(resp) {
+			if (!resp.ok) {
+				throw new Error(resp.status);
+			}
+			return resp.json();
+		}).then(function(listing) {
+			var photos = [];
+			listing.images.forEach(function(img) {
+				var a = link("", img.url), thumb = document.createElement("img");
+				thumb.src = img.thumb;
+				thumb.alt = img.name;
+				thumb.loading = "lazy";
+				if (img.placeholder) {
+					thumb.style.background = "url(" + img.placeholder + ") center / cover no-repeat";
+				}
+				a.appendChild(thumb);
+				photos.push(a);
+			});
+			pane.replaceChildren.apply(pane, photos);
+			pane.dataset.viewOnly = listing.download === "view";
+			current = path;
+			showNav(path);
+			slideshow.href = albumURL(path);
+			index.href = albumURL(path) + "?view=index";
+			tree.querySelectorAll("summary a").forEach(function(a) {
+				a.style.fontWeight = a.dataset.path === path ? "bold" : "";
+			});
+			if (push) {
+				history.pushState({path: path}, "", albumURL(path) + "?view=browse");
+			}
+		}).catch(function() {
+			location.href = albumURL(path) + "?view=browse";
+		});
+	}
+	function addNode(parent, node) {
+		var details = document.createElement("details"), summary = document.createElement("summary");
+		var a = link(node.name, albumURL(node.path) + "?view=browse");
+		a.dataset.path = node.path;
+		a.addEventListener("click", function(e) {
+			e.preventDefault();
+			showAlbum(node.path, true);
+		});
+		if (node.path === current) {
+			a.style.fontWeight = "bold";
+		}
+		summary.appendChild(a);
+		summary.appendChild(document.createTextNode(" (" + node.total + ")"));
+		details.appendChild(summary);
+		details.style.marginLeft = parent === tree ? "0" : "1em";
+		// the albums on the way to the current album are open
+		details.open = node.path === "" || current === node.path || current.indexOf(node.path + "/") === 0;
+		if (!node.albums) {
+			// albums without sub albums have nothing to open
+			summary.style.listStyle = "none";
+		}
+		(node.albums || []).forEach(function(child) {
+			addNode(details, child);
+		});
+		parent.appendChild(details);
+	}
+	fetch(tree.dataset.tree, {credentials: "same-origin"}).then(function(resp) {
+		return resp.json();
+	}).then(function(root) {
+		addNode(tree, root);
+	});
+	// the photos of view only albums cannot be saved, see viewOnlyStyle
+	["contextmenu", "dragstart"].forEach(function(type) {
+		pane.addEventListener(type, function(e) {
+			if (pane.dataset.viewOnly === "true" && e.target.tagName == "IMG") {
+				e.preventDefault();
+			}
+		});
+	});
+	history.replaceState({path: current}, "");
+	window.addEventListener("popstate", function(e) {
+		if (e.state) {
+			showAlbum(e.state.path, false);
+		}
+	});
+})();
+</script>`)
+}
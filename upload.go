@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultUploadMaxSize is the maximum size of a file uploaded by a user
+const defaultUploadMaxSize = 200 << 20
+
+// uploadRequestMaxSize is the maximum size of the body of an upload
+// request, which may hold several files. Larger files are sent with the
+// resumable uploads.
+const uploadRequestMaxSize = 1 << 30
+
+// uploadFormOverhead is the room left in upload requests for the headers
+// and boundaries of the multipart form, on top of the files
+const uploadFormOverhead = 1 << 20
+
+// uploadable returns true if a file can be uploaded to dest, which is an
+// image, a document of an album that shows documents, or the raw version or
+// video of a photo
+func uploadable(dest string) bool {
+	return imgre.MatchString(dest) || isDocument(dest) || companionre.MatchString(dest)
+}
+
+// checkUploadContent verifies that the first bytes of a file uploaded to
+// dest match its type: an image, a PDF document, or for the companions of
+// photos, whose formats are not detected, anything but text
+func checkUploadContent(dest string, head []byte) error {
+	ctype := http.DetectContentType(head)
+	switch {
+	case imgre.MatchString(dest):
+		if strings.HasPrefix(ctype, "image/") {
+			return nil
+		}
+	case pdfre.MatchString(dest):
+		if ctype == "application/pdf" {
+			return nil
+		}
+	case !strings.HasPrefix(ctype, "text/"):
+		return nil
+	}
+	return fmt.Errorf("content of type %q does not match the name of %q", ctype, filepath.Base(dest))
+}
+
+// saveUpload copies an uploaded file to dest, see saveUploadContent
+func saveUpload(fh *multipart.FileHeader, dest string, maxSize int64) error {
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return saveUploadContent(src, dest, maxSize)
+}
+
+// saveUploadContent copies the content of an uploaded file to dest, after
+// checking that it matches its type, that it is not larger than the largest
+// accepted dimension and that it passes the virus scan. An existing file is
+// never overwritten.
+func saveUploadContent(src io.ReadSeeker, dest string, maxSize int64) error {
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	if err := checkUploadContent(dest, head[:n]); err != nil {
+		return err
+	}
+	if err := checkUploadDimensions(src, dest); err != nil {
+		return err
+	}
+	var content io.Reader = src
+	if uploadScanner != nil {
+		spooled, cleanup, err := spoolUpload(src)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if err = scanUpload(spooled, dest); err != nil {
+			return err
+		}
+		content = spooled
+	}
+	fd, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, io.LimitReader(content, maxSize))
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// uploadResult is returned as json by the upload endpoint
+type uploadResult struct {
+	Accepted []string `json:"accepted"`
+	Rejected []string `json:"rejected"`
+}
+
+// overQuota refuses an upload that would exceed the quota of the user
+func overQuota(w http.ResponseWriter, r *http.Request, usage quotaUsage) {
+	logWarnf("upload: user %q is over quota, %d bytes used of %d", usage.User, usage.Used, usage.Limit)
+	locale := requestLocale(r)
+	writeErrorMessage(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf(tr(locale, "over_quota"),
+		formatSize(locale, usage.Used), formatSize(locale, usage.Limit)))
+}
+
+// canUpload returns true if the user is allowed to upload into the album at
+// path, which must not be archived
+func canUpload(username, path string) bool {
+	return userRole(username, rootOf(path)) >= roleUploader && !isArchived(path)
+}
+
+// uploadPhotos stores the photos sent by an authenticated user into the
+// album designated by the galpath route variable, within the user's quota.
+// Albums that route their uploads store them in the sub albums of their
+// dates, see dateRoutingConf.
+func uploadPhotos(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	albumDir := filepath.Join("gallery", filepath.Clean("/"+mux.Vars(r)["galpath"]))
+	if !canUpload(username, albumDir) {
+		writeError(w, r, http.StatusForbidden, "forbidden")
+		return
+	}
+	if fi, err := os.Stat(albumDir); err != nil || !fi.IsDir() {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != "" {
+		// large files are sent in chunks with the tus protocol
+		createResumable(w, r, username, albumDir)
+		return
+	}
+	// the body is limited before it is parsed, as the files of the form
+	// are spooled to disk, so users over quota cannot fill it
+	usage := userUsage(username)
+	limit, quotaBound := int64(uploadRequestMaxSize), false
+	if usage.Limit > 0 {
+		if usage.Used >= usage.Limit {
+			overQuota(w, r, usage)
+			return
+		}
+		if left := usage.Limit - usage.Used + uploadFormOverhead; left < limit {
+			limit, quotaBound = left, true
+		}
+	}
+	tooLarge := func() {
+		if quotaBound {
+			overQuota(w, r, usage)
+		} else {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "upload_invalid")
+		}
+	}
+	if r.ContentLength > limit {
+		tooLarge()
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			tooLarge()
+		} else {
+			writeError(w, r, http.StatusBadRequest, "upload_invalid")
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	var (
+		result uploadResult
+		files  = r.MultipartForm.File["photos"]
+		total  int64
+	)
+	for _, fh := range files {
+		total += fh.Size
+	}
+	if usage.Limit > 0 && usage.Used+total > usage.Limit {
+		overQuota(w, r, usage)
+		return
+	}
+	result.Accepted, result.Rejected = []string{}, []string{}
+	for _, fh := range files {
+		name := unsafeNameChars.ReplaceAllString(filepath.Base(fh.Filename), "_")
+		dest := filepath.Join(albumDir, name)
+		if !uploadable(dest) || fh.Size > defaultUploadMaxSize {
+			result.Rejected = append(result.Rejected, name)
+			continue
+		}
+		dest, err := routeUpload(dest, func() (io.ReadCloser, error) { return fh.Open() }, r.FormValue("event"))
+		if err != nil {
+			logErrorf("upload: failed to route %q: %v", name, err)
+			result.Rejected = append(result.Rejected, name)
+			continue
+		}
+		if err = saveUpload(fh, dest, defaultUploadMaxSize); err != nil {
+			logErrorf("upload: failed to save %q: %v", dest, err)
+			result.Rejected = append(result.Rejected, name)
+			continue
+		}
+		recordUpload(username, dest)
+		invalidateListing(filepath.Dir(dest))
+		queueWarm(dest)
+		notifyAdded(dest)
+		result.Accepted = append(result.Accepted, name)
+	}
+	logInfof("upload: user %q uploaded %d files to %q", username, len(result.Accepted), albumDir)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultUploadQuality is the quality of the jpeg photos resized in the
+// browser, when the configuration sets none
+const defaultUploadQuality = 0.92
+
+// uploadResizeConf sets the largest width or height of the photos uploaded
+// by users and guests. The drop box pages resize the larger jpeg and png
+// photos in the browser before sending them, keeping their exif metadata,
+// and the upload api advertises the limit in the Upload-Max-Dimension header
+// of its OPTIONS responses, so other clients can do the same. Photos that
+// are still larger when they arrive are refused.
+//
+//	uploadresize:
+//	  maxdimension: 2560
+//	  quality: 0.9
+type uploadResizeConf struct {
+	MaxDimension int
+	// Quality is the quality of the jpeg photos resized in the browser,
+	// from 0 to 1
+	Quality float64
+}
+
+// oversizedError is returned for the uploaded photos that are larger than
+// the largest accepted dimension
+type oversizedError struct {
+	name          string
+	width, height int
+}
+
+func (e oversizedError) Error() string {
+	return fmt.Sprintf("%q is %dx%d pixels, larger than %d", e.name, e.width, e.height, conf.UploadResize.MaxDimension)
+}
+
+// checkUploadDimensions returns an oversizedError if the photo uploaded to
+// dest is larger than the largest accepted dimension. The formats whose size
+// cannot be read are not refused. The file is read from its start, and left
+// at its start.
+func checkUploadDimensions(fd io.ReadSeeker, dest string) error {
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	max := conf.UploadResize.MaxDimension
+	if max <= 0 || !imgre.MatchString(dest) {
+		return nil
+	}
+	cfg, _, err := image.DecodeConfig(fd)
+	if _, serr := fd.Seek(0, io.SeekStart); serr != nil {
+		return serr
+	}
+	if err != nil {
+		logDebugf("upload: cannot read the size of %q: %v", dest, err)
+		return nil
+	}
+	if cfg.Width > max || cfg.Height > max {
+		return oversizedError{name: filepath.Base(dest), width: cfg.Width, height: cfg.Height}
+	}
+	return nil
+}
+
+// uploadResizeScript returns the script that resizes the photos of the
+// upload forms with a data-max-dimension attribute before they are sent,
+// or nothing if uploads are not limited. The form is posted with fetch, and
+// its response replaces the page. Browsers that cannot resize, and photos
+// that fail to, send the files as they are.
+func uploadResizeScript() string {
+	c := conf.UploadResize
+	if c.MaxDimension <= 0 {
+		return ""
+	}
+	quality := c.Quality
+	if quality <= 0 || quality > 1 {
+		quality = defaultUploadQuality
+	}
+	return `<script>
+(function() {
+	var form = document.querySelector("form[data-max-dimension]");
+	var max = ` + strconv.Itoa(c.MaxDimension) + `, quality = ` + strconv.FormatFloat(quality, 'f', -1, 64) + `;
+	if (!form || !window.createImageBitmap || !window.fetch || !window.FormData) {
+		return;
+	}
+	// segments returns the offsets of the markers of the header of a jpeg
+	function segments(bytes) {
+		var found = [];
+		for (var i = 2; i + 4 <= bytes.length && bytes[i] == 0xff && bytes[i + 1] != 0xda; ) {
+			var end = i + 2 + (bytes[i + 2] << 8 | bytes[i + 3]);
+			found.push({marker: bytes[i + 1], start: i, end: end});
+			i = end;
+		}
+		return found;
+	}
+	// withExif copies the exif segment of the original jpeg into the
+	// resized one, after its jfif segment
+	function withExif(file, resized) {
+		return Promise.all([
+			new Response(file.slice(0, 131072)).arrayBuffer(),
+			new Response(resized).arrayBuffer()
+		]).then(function(buffers) {
+			var original = new Uint8Array(buffers[0]), bytes = new Uint8Array(buffers[1]);
+			var exif = segments(original).filter(function(s) {
+				return s.marker == 0xe1 && String.fromCharCode.apply(null, original.subarray(s.start + 4, s.start + 8)) == "Exif";
+			})[0];
+			if (!exif) {
+				return resized;
+			}
+			var at = 2, first = segments(bytes)[0];
+			if (first && first.marker == 0xe0) {
+				at = first.end;
+			}
+			return new Blob([bytes.subarray(0, at), original.subarray(exif.start, exif.end), bytes.subarray(at)], {type: "image/jpeg"});
+		});
+	}
+	function shrink(file) {
+		if (file.type != "image/jpeg" && file.type != "image/png") {
+			return Promise.resolve(file);
+		}
+		// the pixels are kept as stored, as the orientation of the exif
+		// metadata is copied
+		return createImageBitmap(file, {imageOrientation: file.type == "image/jpeg" ? "none" : "from-image"}).then(function(img) {
+			var scale = max / Math.max(img.width, img.height);
+			if (scale >= 1) {
+				return file;
+			}
+			var canvas = document.createElement("canvas");
+			canvas.width = Math.round(img.width * scale);
+			canvas.height = Math.round(img.height * scale);
+			canvas.getContext("2d").drawImage(img, 0, 0, canvas.width, canvas.height);
+			return new Promise(function(resolve) {
+				canvas.toBlob(resolve, file.type, quality);
+			}).then(function(resized) {
+				return file.type == "image/jpeg" ? withExif(file, resized) : resized;
+			});
+		}).catch(function() {
+			return file;
+		});
+	}
+	form.addEventListener("submit", function(e) {
+		var input = form.querySelector("input[type=file]");
+		if (!input || !input.files.length) {
+			return;
+		}
+		e.preventDefault();
+		var files = Array.prototype.slice.call(input.files);
+		var data = new FormData(form);
+		data.delete(input.name);
+		Promise.all(files.map(shrink)).then(function(blobs) {
+			blobs.forEach(function(blob, i) {
+				data.append(input.name, blob, files[i].name);
+			});
+			return fetch(form.action, {method: "POST", body: data, credentials: "same-origin"});
+		}).then(function(resp) {
+			return resp.text();
+		}).then(function(page) {
+			document.open();
+			document.write(page);
+			document.close();
+		}).catch(function() {
+			form.submit();
+		});
+	});
+})();
+</script>`
+}
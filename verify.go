@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// verifyReport is the machine readable result of the verify command
+type verifyReport struct {
+	// Checked is the number of files of the index that were verified
+	Checked int `json:"checked"`
+	// Missing files are in the index but no longer exist
+	Missing []string `json:"missing"`
+	// Modified files were changed since they were indexed, and will be
+	// indexed again by the next scan
+	Modified []string `json:"modified"`
+	// Corrupt files have the size and modification time they were indexed
+	// with, but not the same content
+	Corrupt []string `json:"corrupt"`
+	// Unhashed is the number of files indexed without a hash, whose
+	// content could not be verified
+	Unhashed int `json:"unhashed"`
+	// CacheChecked is the number of entries of the cache that were
+	// verified, the cache is only verified with the local backend
+	CacheChecked int `json:"cache_checked"`
+	// BrokenThumbnails are cache entries that cannot be decoded, and
+	// OrphanedCache entries whose original no longer exists
+	BrokenThumbnails []string `json:"broken_thumbnails"`
+	OrphanedCache    []string `json:"orphaned_cache"`
+	// Removed are the broken and orphaned cache entries deleted with
+	// -remove
+	Removed []string `json:"removed,omitempty"`
+	// Archives are the verifications of the archived albums
+	Archives []archiveCheck `json:"archives"`
+	OK       bool           `json:"ok"`
+}
+
+// verifyIndex checks that the files of the index still exist with the
+// content they were indexed with
+func verifyIndex(entries []*mediaEntry, report *verifyReport) {
+	for _, e := range entries {
+		report.Checked++
+		fi, err := os.Stat(e.Path)
+		if err != nil {
+			report.Missing = append(report.Missing, e.Path)
+			continue
+		}
+		if fi.Size() != e.Size || !fi.ModTime().Equal(e.ModTime) {
+			report.Modified = append(report.Modified, e.Path)
+			continue
+		}
+		if e.Hash == "" {
+			report.Unhashed++
+			continue
+		}
+		if sum, err := hashFile(e.Path); err != nil || sum != e.Hash {
+			report.Corrupt = append(report.Corrupt, e.Path)
+		}
+	}
+}
+
+// cacheReferenced returns true if a cache entry was generated from a file or
+// album that still exists: a thumbnail such as ab/cdef.../300_center.jpg
+// from a file whose hash is in hashes, or a sprite sheet such as
+// sprites/gallery/album/0_v.jpg from the photos of its album. Entries of
+// the layout of previous versions, keyed by the path of their original, are
+// never referenced.
+func cacheReferenced(key string, hashes map[string]bool) bool {
+	key = filepath.ToSlash(key)
+	if strings.HasPrefix(key, "sprites/") {
+		fi, err := os.Stat(filepath.Dir(strings.TrimPrefix(key, "sprites/")))
+		return err == nil && fi.IsDir()
+	}
+	parts := strings.Split(key, "/")
+	return len(parts) == 3 && hashes[parts[0]+parts[1]]
+}
+
+// verifyCache checks that the entries of the local cache decode and belong
+// to an existing original, and deletes those that do not if remove is set
+func verifyCache(c localCache, hashes map[string]bool, remove bool, report *verifyReport) error {
+	err := filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		key, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		if key == manifestKey {
+			return nil
+		}
+		report.CacheChecked++
+		bad := false
+		if !cacheReferenced(key, hashes) {
+			report.OrphanedCache = append(report.OrphanedCache, path)
+			bad = true
+		} else if fd, err := os.Open(path); err != nil {
+			return err
+		} else {
+			_, _, err = image.Decode(fd)
+			fd.Close()
+			if err != nil {
+				report.BrokenThumbnails = append(report.BrokenThumbnails, path)
+				bad = true
+			}
+		}
+		if remove && bad {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+			report.Removed = append(report.Removed, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		// nothing was cached yet
+		return nil
+	}
+	return err
+}
+
+// verifyCmd checks the integrity of the gallery against its index, and of
+// the cache of thumbnails, and prints a json report, for example to validate
+// backups. It exits with status 1 if a problem is found.
+func verifyCmd(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var (
+		config = fs.String("c", "config.yaml", "Load configuration from file")
+		remove = fs.Bool("remove", false, "Delete broken and orphaned cache entries")
+	)
+	fs.Parse(args)
+	if err := loadConfig(*config); err != nil {
+		log.Fatal(err)
+	}
+	if err := initCache(); err != nil {
+		log.Fatal(err)
+	}
+	if conf.Database.Driver != "" {
+		if err := openDatabase(conf.Database); err != nil {
+			log.Fatal(err)
+		}
+	}
+	entries, err := newIndexStore().load()
+	if err != nil {
+		log.Fatalf("verify: failed to load index: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	report := verifyReport{
+		Missing:          []string{},
+		Modified:         []string{},
+		Corrupt:          []string{},
+		BrokenThumbnails: []string{},
+		OrphanedCache:    []string{},
+		Archives:         []archiveCheck{},
+	}
+	verifyIndex(entries, &report)
+	archivesOK := true
+	for _, dir := range archivedAlbums() {
+		check, err := verifyArchive(dir)
+		if err != nil {
+			log.Fatalf("verify: failed to verify archive %q: %v", dir, err)
+		}
+		report.Archives = append(report.Archives, check)
+		archivesOK = archivesOK && check.ok()
+	}
+	// thumbnails are referenced by the hashes of the files of the index and
+	// of the manifest of the cache
+	hashes := manifest.hashes()
+	for _, e := range entries {
+		if _, err := os.Stat(e.Path); err == nil && e.Hash != "" {
+			hashes[e.Hash] = true
+		}
+	}
+	if c, ok := imgCache.(localCache); ok {
+		if err = verifyCache(c, hashes, *remove, &report); err != nil {
+			log.Fatalf("verify: failed to verify cache: %v", err)
+		}
+	} else {
+		logWarnf("verify: the %s cache backend cannot be listed, skipping the cache", conf.Cache.Type)
+	}
+	// modified files are not a problem, and removed cache entries are
+	// generated again when needed
+	report.OK = len(report.Missing) == 0 && len(report.Corrupt) == 0 && archivesOK &&
+		len(report.BrokenThumbnails)+len(report.OrphanedCache) == len(report.Removed)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+	if !report.OK {
+		damaged := 0
+		for _, check := range report.Archives {
+			if !check.ok() {
+				damaged++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "verify: %d missing, %d corrupt, %d broken thumbnails, %d orphaned cache entries, %d damaged archives\n",
+			len(report.Missing), len(report.Corrupt), len(report.BrokenThumbnails), len(report.OrphanedCache), damaged)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// virtualAlbum is a saved search of the index, shown like an album whose
+// photos are selected when it is viewed. Virtual albums are listed in
+// virtualalbums, or created by the admins on /admin/virtual. Selections
+// shared from the index view of albums are transient virtual albums of a
+// list of photos, which expire. Views show an album without some of its
+// photos, which the admins hide on /admin/virtual/{name}, and can be
+// shared instead of the album.
+//
+//	virtualalbums:
+//	  - name: beach-2023
+//	    query: tag:beach AND year:2023
+//	  - name: best
+//	    query: rating:4 NOT album:drafts
+//	  - name: wedding-family
+//	    album: weddings/2016
+//	    hidden: [gallery/weddings/2016/dsc_0042.jpg]
+type virtualAlbum struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	// Photos are the paths of the photos of a selection, which has no query
+	Photos  []string   `json:"photos,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// Album is the path of the album shown by a view, relative to the
+	// gallery, and Hidden the paths of the photos the view leaves out
+	Album  string   `json:"album,omitempty"`
+	Hidden []string `json:"hidden,omitempty"`
+	// configured is true for the virtual albums of the configuration,
+	// which cannot be removed from the admin page
+	configured bool
+}
+
+// virtualNameRe matches the valid names of virtual albums, which are part
+// of their urls
+var virtualNameRe = regexp.MustCompile(`^[\pL\pN_.-]+$`)
+
+// virtualStore persists the virtual albums created by the admins, in the
+// database if one is configured and in virtualfile otherwise
+type virtualStore interface {
+	albums() ([]virtualAlbum, error)
+	add(a virtualAlbum) error
+	remove(name string) error
+}
+
+var virtualAlbums virtualStore
+
+// initVirtualAlbums checks the virtual albums of the configuration, and
+// selects the store of those created by the admins
+func initVirtualAlbums() error {
+	seen := make(map[string]bool)
+	for _, a := range conf.VirtualAlbums {
+		if err := a.check(); err != nil {
+			return err
+		}
+		if seen[a.Name] {
+			return fmt.Errorf("virtual album %q is listed twice", a.Name)
+		}
+		seen[a.Name] = true
+	}
+	if db != nil {
+		virtualAlbums = dbVirtualStore{}
+		return nil
+	}
+	path := conf.VirtualFile
+	if path == "" {
+		path = "virtual.json"
+	}
+	virtualAlbums = &fileVirtualStore{path: path}
+	return nil
+}
+
+// check returns an error if the name, the query or the album of a virtual
+// album is invalid
+func (a virtualAlbum) check() error {
+	if !virtualNameRe.MatchString(a.Name) {
+		return fmt.Errorf("invalid virtual album name %q", a.Name)
+	}
+	if a.view() {
+		if fi, err := os.Stat(a.albumPath()); err != nil || !fi.IsDir() {
+			return fmt.Errorf("virtual album %q: album %q not found", a.Name, a.Album)
+		}
+		return nil
+	}
+	if _, err := parseSearch(a.Query); err != nil {
+		return fmt.Errorf("virtual album %q: %v", a.Name, err)
+	}
+	return nil
+}
+
+// selection returns true if the virtual album is a shared selection
+func (a virtualAlbum) selection() bool {
+	return a.Expires != nil
+}
+
+// view returns true if the virtual album is a view of an album
+func (a virtualAlbum) view() bool {
+	return a.Album != ""
+}
+
+// albumPath returns the path of the album of a view, such as
+// "gallery/weddings/2016"
+func (a virtualAlbum) albumPath() string {
+	return filepath.Join("gallery", filepath.Clean("/"+a.Album))
+}
+
+// viewPaths returns the paths of the photos of the album of a view that it
+// does not hide, in the order of the album
+func (a virtualAlbum) viewPaths() ([]string, error) {
+	names, err := albumImages(a.albumPath())
+	if err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool)
+	for _, path := range a.Hidden {
+		hidden[path] = true
+	}
+	var paths []string
+	for _, name := range names {
+		if path := filepath.Join(a.albumPath(), name); !hidden[path] {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// listVirtualAlbums returns the virtual albums of the configuration and of
+// the store, sorted by name. Expired selections are removed from the store.
+func listVirtualAlbums() ([]virtualAlbum, error) {
+	var list []virtualAlbum
+	for _, a := range conf.VirtualAlbums {
+		a.configured = true
+		list = append(list, a)
+	}
+	stored, err := virtualAlbums.albums()
+	now := time.Now()
+	for _, a := range stored {
+		if a.selection() && now.After(*a.Expires) {
+			if rerr := virtualAlbums.remove(a.Name); rerr != nil {
+				logErrorf("virtual: failed to remove expired selection %q: %v", a.Name, rerr)
+			}
+			continue
+		}
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, err
+}
+
+// findVirtualAlbum returns the virtual album of the given name
+func findVirtualAlbum(name string) (virtualAlbum, bool) {
+	list, err := listVirtualAlbums()
+	if err != nil {
+		logErrorf("virtual: failed to list virtual albums: %v", err)
+	}
+	for _, a := range list {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return virtualAlbum{}, false
+}
+
+// url returns the url of the page of the virtual album
+func (a virtualAlbum) url() string {
+	return link("/virtual/" + url.PathEscape(a.Name) + "/")
+}
+
+// photos returns the photos of the index that match the query of the album
+// and that are selected by visible, most recent first. Those of a selection keep
+// the order in which they were selected, and those of a view the order of
+// their album.
+func (a virtualAlbum) photos(visible func(path string) bool) ([]mediaEntry, error) {
+	var photos []mediaEntry
+	if a.view() {
+		paths, err := a.viewPaths()
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			if !visible(path) {
+				continue
+			}
+			// photos not indexed yet are shown without their metadata
+			e, ok := index.get(path)
+			if !ok {
+				e = mediaEntry{Path: path}
+			}
+			photos = append(photos, e)
+		}
+		return photos, nil
+	}
+	if a.selection() {
+		for _, path := range a.Photos {
+			if e, ok := index.get(path); ok && visible(e.Path) {
+				photos = append(photos, e)
+			}
+		}
+		return photos, nil
+	}
+	query, err := parseSearch(a.Query)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range index.byCaptureDate("gallery/") {
+		if visible(e.Path) && query(e) {
+			photos = append(photos, e)
+		}
+	}
+	return photos, nil
+}
+
+// virtualAlbumPage shows the photos of a virtual album in the slideshow of
+// the albums
+func virtualAlbumPage(w http.ResponseWriter, r *http.Request) {
+	a, ok := findVirtualAlbum(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	entries, err := a.photos(reachableFilter(r))
+	if os.IsNotExist(err) {
+		// the album of a view was removed
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	} else if err != nil {
+		logErrorf("virtual: invalid query of %q: %v", a.Name, err)
+		writeError(w, r, http.StatusInternalServerError, "render_failed")
+		return
+	}
+	view := albumView{
+		Locale: requestLocale(r),
+		Path:   "virtual/" + a.Name,
+		Nav:    []navLink{{Name: a.Name, URL: a.url()}},
+	}
+	for _, e := range entries {
+		view.Photos = append(view.Photos, photoView{
+			Name:     filepath.Base(e.Path),
+			Path:     e.Path,
+			Captured: e.Captured,
+			Tags:     e.allTags(),
+			Title:    e.Title,
+			Caption:  e.Caption,
+			Place:    e.Place,
+		})
+	}
+	if view.Seed, view.Shuffled = shuffleSeed(r); view.Shuffled {
+		shuffle(view.Seed, len(view.Photos), func(i, j int) {
+			view.Photos[i], view.Photos[j] = view.Photos[j], view.Photos[i]
+		})
+	}
+	renderPage(w, r, "album", &view)
+}
+
+// apiVirtualAlbums lists the names of the virtual albums as json, without
+// the selections and the views, which are only reached by their links
+func apiVirtualAlbums(w http.ResponseWriter, r *http.Request) {
+	list, err := listVirtualAlbums()
+	if err != nil {
+		logErrorf("virtual: failed to list virtual albums: %v", err)
+	}
+	names := []string{}
+	for _, a := range list {
+		if !a.selection() && !a.view() {
+			names = append(names, a.Name)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// apiVirtualAlbum lists the photos of a virtual album as json, like the
+// album endpoint lists those of an album, with the same min_rating, shuffle,
+// seed, offset and limit parameters
+func apiVirtualAlbum(w http.ResponseWriter, r *http.Request) {
+	a, ok := findVirtualAlbum(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	entries, err := a.photos(reachableFilter(r))
+	if os.IsNotExist(err) {
+		// the album of a view was removed
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	} else if err != nil {
+		logErrorf("virtual: invalid query of %q: %v", a.Name, err)
+		writeError(w, r, http.StatusInternalServerError, "render_failed")
+		return
+	}
+	listing := albumListing{Albums: []string{}, Images: []albumImage{}}
+	min := minRating(r)
+	for _, e := range entries {
+		if e.Rating < min {
+			continue
+		}
+		listing.Images = append(listing.Images, albumImage{
+			Name:        filepath.Base(e.Path),
+			URL:         link("/" + e.Path),
+			Thumb:       link("/" + e.Path + "?width=300" + editQuery(e.Path)),
+			Placeholder: e.Placeholder,
+			Captured:    e.Captured,
+			Tags:        e.allTags(),
+			Title:       e.Title,
+			Caption:     e.Caption,
+			Rating:      e.Rating,
+			Place:       e.Place,
+		})
+	}
+	writeAlbumListing(w, r, listing)
+}
+
+// virtualView lists the virtual albums, and lets admins create and remove
+// them
+func virtualView(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	list, err := listVirtualAlbums()
+	if err != nil {
+		logErrorf("virtual: failed to list virtual albums: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "virtual_failed")
+		return
+	}
+	var albumsHtml string
+	for _, a := range list {
+		if a.selection() {
+			albumsHtml += fmt.Sprintf(`<li><a href="%s">%s</a>: `, html.EscapeString(a.url()), html.EscapeString(a.Name)) +
+				fmt.Sprintf(tr(locale, "selection_of"), formatCount(locale, int64(len(a.Photos))), formatDate(locale, *a.Expires, true))
+		} else if a.view() {
+			albumsHtml += fmt.Sprintf(`<li><a href="%s">%s</a>: %s`, html.EscapeString(a.url()), html.EscapeString(a.Name),
+				fmt.Sprintf(tr(locale, "view_of"), html.EscapeString(a.Album), formatCount(locale, int64(len(a.Hidden)))))
+			if !a.configured {
+				albumsHtml += fmt.Sprintf(` <a href="%s">%s</a>`, html.EscapeString(link("/admin/virtual/"+url.PathEscape(a.Name))), tr(locale, "hide_photos"))
+			}
+		} else {
+			albumsHtml += fmt.Sprintf(`<li><a href="%s">%s</a>: <code>%s</code>`, html.EscapeString(a.url()), html.EscapeString(a.Name), html.EscapeString(a.Query))
+		}
+		if a.configured {
+			albumsHtml += " (" + tr(locale, "configured") + ")"
+		} else {
+			albumsHtml += fmt.Sprintf(`
+	<form method="POST" action="%s" style="display: inline;"><input type="hidden" name="name" value="%s"/><button type="submit" name="action" value="remove">%s</button></form>`,
+				link("/admin/virtual"), html.EscapeString(a.Name), tr(locale, "remove"))
+		}
+		albumsHtml += "</li>\n"
+	}
+	if albumsHtml == "" {
+		albumsHtml = "<p>" + tr(locale, "none_found") + "</p>"
+	} else {
+		albumsHtml = "<ul>\n" + albumsHtml + "</ul>"
+	}
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;">`+tr(locale, "virtual_albums")+`</h1>
+		<form method="POST" action="`+link("/admin/virtual")+`"><input type="text" name="name" placeholder="name"/> <input type="text" name="query" placeholder="tag:beach AND year:2023" size="40"/> <button type="submit" name="action" value="create">`+tr(locale, "create")+`</button></form>
+		<form method="POST" action="`+link("/admin/virtual")+`"><input type="text" name="name" placeholder="name"/> <input type="text" name="album" placeholder="weddings/2016" size="40"/> <button type="submit" name="action" value="view">`+tr(locale, "create_view")+`</button></form>
+`+albumsHtml+`
+	</body>
+</html>`))
+}
+
+// virtualAction creates or removes the virtual album of the form
+func virtualAction(w http.ResponseWriter, r *http.Request) {
+	username := requestUser(r)
+	a := virtualAlbum{
+		Name:  strings.TrimSpace(r.FormValue("name")),
+		Query: strings.TrimSpace(r.FormValue("query")),
+	}
+	switch r.FormValue("action") {
+	case "view":
+		a.Query = ""
+		a.Album = strings.Trim(filepath.ToSlash(filepath.Clean("/"+r.FormValue("album"))), "/")
+		if a.Album == "" {
+			writeError(w, r, http.StatusBadRequest, "album_not_found")
+			return
+		}
+		fallthrough
+	case "create":
+		if err := a.check(); err != nil {
+			logWarnf("virtual: failed to create virtual album: %v", err)
+			writeError(w, r, http.StatusBadRequest, "invalid_search")
+			return
+		}
+		if _, exists := findVirtualAlbum(a.Name); exists {
+			writeError(w, r, http.StatusConflict, "virtual_failed")
+			return
+		}
+		if err := virtualAlbums.add(a); err != nil {
+			logErrorf("virtual: failed to create virtual album %q: %v", a.Name, err)
+			writeError(w, r, http.StatusInternalServerError, "virtual_failed")
+			return
+		}
+		if a.view() {
+			logInfof("virtual: user %q created view %q of album %q", username, a.Name, a.Album)
+			http.Redirect(w, r, link("/admin/virtual/"+url.PathEscape(a.Name)), http.StatusSeeOther)
+			return
+		}
+		logInfof("virtual: user %q created virtual album %q with query %q", username, a.Name, a.Query)
+	case "remove":
+		if err := virtualAlbums.remove(a.Name); err != nil {
+			logErrorf("virtual: failed to remove virtual album %q: %v", a.Name, err)
+			writeError(w, r, http.StatusNotFound, "virtual_failed")
+			return
+		}
+		logInfof("virtual: user %q removed virtual album %q", username, a.Name)
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	http.Redirect(w, r, link("/admin/virtual"), http.StatusSeeOther)
+}
+
+// storedView returns the view of the name route variable, which must not be
+// one of the configuration
+func storedView(r *http.Request) (virtualAlbum, bool) {
+	a, ok := findVirtualAlbum(mux.Vars(r)["name"])
+	return a, ok && a.view() && !a.configured
+}
+
+// viewEditor lists the photos of the album of a view, and lets admins pick
+// those the view hides
+func viewEditor(w http.ResponseWriter, r *http.Request) {
+	locale := requestLocale(r)
+	a, ok := storedView(r)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	names, err := albumImages(a.albumPath())
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	hidden := make(map[string]bool)
+	for _, path := range a.Hidden {
+		hidden[path] = true
+	}
+	var photosHtml string
+	for _, name := range names {
+		path := filepath.Join(a.albumPath(), name)
+		checked := ""
+		if hidden[path] {
+			checked = ` checked="checked"`
+		}
+		photosHtml += fmt.Sprintf(`<label style="display: inline-block; margin: 2px;"><img src="%s?width=200&amp;crop=center%s" width="200" height="200" loading="lazy" title="%s"%s/><br/><input type="checkbox" name="hidden" value="%s"%s/> %s</label>
+`, html.EscapeString(link("/"+path)), html.EscapeString(editQuery(path)), html.EscapeString(name), placeholderStyle(path),
+			html.EscapeString(path), checked, html.EscapeString(name))
+	}
+	action := html.EscapeString(link("/admin/virtual/" + url.PathEscape(a.Name)))
+	io.WriteString(w, csrfPage(r, `<!DOCTYPE html>
+<html lang="`+locale+`">
+	<head><meta charset="utf-8"><title>`+tr(locale, "title")+`</title></head>
+	<body>
+		<h1 style="font-size: 1.5em;"><a href="`+html.EscapeString(a.url())+`">`+html.EscapeString(a.Name)+`</a>: `+tr(locale, "hide_photos")+`</h1>
+		<form method="POST" action="`+action+`">
+`+photosHtml+`
+			<p><button type="submit">`+tr(locale, "save")+`</button></p>
+		</form>
+	</body>
+</html>`))
+}
+
+// viewAction replaces the hidden photos of a view with those of the form
+func viewAction(w http.ResponseWriter, r *http.Request) {
+	a, ok := storedView(r)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "album_not_found")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	a.Hidden = nil
+	for _, path := range r.PostForm["hidden"] {
+		// only the photos of the album can be hidden
+		if path = filepath.Clean(path); filepath.Dir(path) == a.albumPath() {
+			a.Hidden = append(a.Hidden, path)
+		}
+	}
+	// the stores have no update, the view is replaced
+	err := virtualAlbums.remove(a.Name)
+	if err == nil {
+		err = virtualAlbums.add(a)
+	}
+	if err != nil {
+		logErrorf("virtual: failed to update view %q: %v", a.Name, err)
+		writeError(w, r, http.StatusInternalServerError, "virtual_failed")
+		return
+	}
+	logInfof("virtual: user %q hid %d photos of %q in view %q", requestUser(r), len(a.Hidden), a.Album, a.Name)
+	http.Redirect(w, r, link("/admin/virtual/"+url.PathEscape(a.Name)), http.StatusSeeOther)
+}
+
+// fileVirtualStore keeps the virtual albums in a json file, which is read
+// again when it changes
+type fileVirtualStore struct {
+	path    string
+	mu      sync.Mutex
+	modtime time.Time
+	list    []virtualAlbum
+}
+
+// load reads the file if it changed since it was last read. The caller must
+// hold the lock.
+func (s *fileVirtualStore) load() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.list, s.modtime = nil, time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modtime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []virtualAlbum
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("virtual: invalid virtual album file %q: %v", s.path, err)
+	}
+	s.list, s.modtime = list, fi.ModTime()
+	return nil
+}
+
+// write replaces the file. The caller must hold the lock.
+func (s *fileVirtualStore) write(list []virtualAlbum) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.modtime = time.Time{}
+	return nil
+}
+
+func (s *fileVirtualStore) albums() ([]virtualAlbum, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load()
+	return append([]virtualAlbum(nil), s.list...), err
+}
+
+func (s *fileVirtualStore) add(a virtualAlbum) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	return s.write(append(append([]virtualAlbum(nil), s.list...), a))
+}
+
+func (s *fileVirtualStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	var list []virtualAlbum
+	for _, a := range s.list {
+		if a.Name != name {
+			list = append(list, a)
+		}
+	}
+	if len(list) == len(s.list) {
+		return fmt.Errorf("virtual album %q not found", name)
+	}
+	return s.write(list)
+}
+
+// dbVirtualStore keeps the virtual albums in the virtual_albums table of the
+// database
+type dbVirtualStore struct{}
+
+func (dbVirtualStore) albums() (list []virtualAlbum, err error) {
+	rows, err := db.Query(`SELECT name, search, photos, expires, album, hidden FROM virtual_albums`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			a             virtualAlbum
+			photos        sql.NullString
+			expires       sql.NullInt64
+			album, hidden sql.NullString
+		)
+		if err = rows.Scan(&a.Name, &a.Query, &photos, &expires, &album, &hidden); err != nil {
+			return nil, err
+		}
+		if a.Album = album.String; a.Album != "" && hidden.String != "" {
+			if err = json.Unmarshal([]byte(hidden.String), &a.Hidden); err != nil {
+				return nil, fmt.Errorf("invalid hidden photos of view %q: %v", a.Name, err)
+			}
+		}
+		if expires.Valid {
+			t := time.Unix(expires.Int64, 0)
+			a.Expires = &t
+			if err = json.Unmarshal([]byte(photos.String), &a.Photos); err != nil {
+				return nil, fmt.Errorf("invalid photos of selection %q: %v", a.Name, err)
+			}
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// add inserts a virtual album, the photos of a selection and those a view
+// hides are stored as json lists
+func (dbVirtualStore) add(a virtualAlbum) error {
+	var (
+		photos        sql.NullString
+		expires       sql.NullInt64
+		album, hidden sql.NullString
+	)
+	if a.view() {
+		data, err := json.Marshal(a.Hidden)
+		if err != nil {
+			return err
+		}
+		album = sql.NullString{String: a.Album, Valid: true}
+		hidden = sql.NullString{String: string(data), Valid: true}
+	}
+	if a.selection() {
+		data, err := json.Marshal(a.Photos)
+		if err != nil {
+			return err
+		}
+		photos = sql.NullString{String: string(data), Valid: true}
+		expires = sql.NullInt64{Int64: a.Expires.Unix(), Valid: true}
+	}
+	_, err := db.Exec(rebind(`INSERT INTO virtual_albums (name, search, photos, expires, album, hidden) VALUES (?, ?, ?, ?, ?, ?)`),
+		a.Name, a.Query, photos, expires, album, hidden)
+	return err
+}
+
+func (dbVirtualStore) remove(name string) error {
+	res, err := db.Exec(rebind(`DELETE FROM virtual_albums WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("virtual album %q not found", name)
+	}
+	return nil
+}
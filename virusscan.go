@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultVirusScanTimeout bounds the scan of an upload when the
+// configuration sets no timeout
+const defaultVirusScanTimeout = time.Minute
+
+// virusScanConf scans the files uploaded by users, to drop boxes, and with
+// resumable uploads before they are stored, with a clamd daemon listening on
+// a unix socket or on a TCP address, or with a command that exits with the
+// status 1 when it finds a virus, as clamscan and clamdscan do. {file} in
+// the arguments of the command is replaced by the path of the file, which is
+// appended to them otherwise. Infected files are rejected, and copied to the
+// quarantine directory first if the action is quarantine. Uploads are also
+// rejected when the scanner fails.
+//
+//	virusscan:
+//	  clamd: unix:/run/clamav/clamd.ctl
+//	  action: quarantine
+//	  quarantine: /var/lib/galilego/quarantine
+//	  timeout: 30s
+//
+//	virusscan:
+//	  command: [clamscan, --no-summary, "{file}"]
+type virusScanConf struct {
+	// Clamd is the address of a clamd daemon, such as 127.0.0.1:3310 or
+	// unix:/run/clamav/clamd.ctl
+	Clamd   string
+	Command []string
+	// Action is reject, by default, or quarantine
+	Action     string
+	Quarantine string
+	Timeout    time.Duration
+}
+
+// virusScanner scans the content of uploaded files
+type virusScanner interface {
+	// scan returns the name of the virus found in the file, or an empty
+	// string if the file is clean
+	scan(ctx context.Context, fd *os.File) (string, error)
+}
+
+// uploadScanner is the scanner of the configuration, nil if uploads are not
+// scanned
+var uploadScanner virusScanner
+
+// infectedError is returned for the uploads that failed the virus scan
+type infectedError struct {
+	name  string
+	virus string
+}
+
+func (e infectedError) Error() string {
+	return fmt.Sprintf("%q is infected by %s", e.name, e.virus)
+}
+
+// initVirusScan sets up the scanner of the configuration
+func initVirusScan() error {
+	c := conf.VirusScan
+	switch c.Action {
+	case "", "reject":
+	case "quarantine":
+		if c.Quarantine == "" {
+			return fmt.Errorf("virusscan: quarantine action requires a quarantine directory")
+		}
+	default:
+		return fmt.Errorf("virusscan: unknown action %q", c.Action)
+	}
+	switch {
+	case c.Clamd != "" && len(c.Command) > 0:
+		return fmt.Errorf("virusscan: clamd and command are mutually exclusive")
+	case c.Clamd != "":
+		uploadScanner = clamdScanner{address: c.Clamd}
+	case len(c.Command) > 0:
+		uploadScanner = commandScanner{args: c.Command}
+	}
+	return nil
+}
+
+// scanUpload scans the uploaded file fd before it is stored at dest, and
+// returns an infectedError if it carries a virus. The file is read from its
+// start, and left at its start.
+func scanUpload(fd *os.File, dest string) error {
+	if uploadScanner == nil {
+		return nil
+	}
+	timeout := conf.VirusScan.Timeout
+	if timeout <= 0 {
+		timeout = defaultVirusScanTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	virus, err := uploadScanner.scan(ctx, fd)
+	if _, serr := fd.Seek(0, io.SeekStart); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return fmt.Errorf("virusscan: failed to scan %q: %v", dest, err)
+	}
+	if virus == "" {
+		return nil
+	}
+	logWarnf("virusscan: %q is infected by %s", dest, virus)
+	if conf.VirusScan.Action == "quarantine" {
+		if err = quarantineUpload(fd, dest); err != nil {
+			logErrorf("virusscan: failed to quarantine %q: %v", dest, err)
+		}
+	}
+	return infectedError{name: filepath.Base(dest), virus: virus}
+}
+
+// quarantineUpload copies an infected upload into the quarantine directory,
+// under its arrival time and its destination in the gallery, such as
+// 1565450245000000000-gallery_a_b.jpg
+func quarantineUpload(fd *os.File, dest string) error {
+	dir := conf.VirusScan.Quarantine
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), unsafeNameChars.ReplaceAllString(dest, "_"))
+	out, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, fd)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	fd.Seek(0, io.SeekStart)
+	return err
+}
+
+// clamdScanner sends files to a clamd daemon with the INSTREAM command, so
+// the daemon does not need access to the files of the gallery
+type clamdScanner struct {
+	address string
+}
+
+// clamdChunkSize is the size of the chunks of the files sent to clamd
+const clamdChunkSize = 64 << 10
+
+func (c clamdScanner) scan(ctx context.Context, fd *os.File) (string, error) {
+	network, address := "tcp", c.address
+	if strings.HasPrefix(address, unixPrefix) {
+		network, address = "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := fd.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	// a chunk of length zero ends the stream
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	// clamd replies "stream: OK", "stream: <virus> FOUND", or an error
+	reply = strings.TrimSpace(strings.TrimPrefix(strings.TrimRight(reply, "\x00"), "stream:"))
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// commandScanner runs a command on the files, which exits with the status
+// 0 if they are clean and 1 if they are infected
+type commandScanner struct {
+	args []string
+}
+
+func (c commandScanner) scan(ctx context.Context, fd *os.File) (string, error) {
+	path, err := filepath.Abs(fd.Name())
+	if err != nil {
+		return "", err
+	}
+	args := make([]string, 0, len(c.args)+1)
+	replaced := false
+	for _, arg := range c.args {
+		if strings.Contains(arg, "{file}") {
+			arg, replaced = strings.Replace(arg, "{file}", path, -1), true
+		}
+		args = append(args, arg)
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	err = cmd.Run()
+	if err == nil {
+		return "", nil
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		// clamscan prints "<file>: <virus> FOUND"
+		report := strings.TrimSpace(out.String())
+		if i := strings.LastIndex(report, ": "); i >= 0 {
+			report = report[i+2:]
+		}
+		report = strings.TrimSuffix(report, " FOUND")
+		if report == "" {
+			report = "an unknown virus"
+		}
+		return report, nil
+	}
+	return "", fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+}
+
+// spoolUpload returns the content of an uploaded file as a file on disk,
+// which the scanners read, copying it into a temporary file if it was
+// kept in memory. The returned function removes the temporary file.
+func spoolUpload(src io.Reader) (*os.File, func(), error) {
+	if fd, ok := src.(*os.File); ok {
+		return fd, func() {}, nil
+	}
+	fd, err := ioutil.TempFile("", "galilego-upload-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+	if _, err = io.Copy(fd, src); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err = fd.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return fd, cleanup, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+)
+
+// warmQueueSize is the number of images waiting for their thumbnails to be
+// generated, beyond which new images are not warmed
+const warmQueueSize = 1000
+
+// defaultWarmWidths are the widths of the thumbnails of the slideshow
+var defaultWarmWidths = []uint{300, 1200}
+
+// warmConf sets the thumbnails generated in the background for the images
+// added to the gallery, so they are cached before anyone views them.
+//
+//	warm:
+//	  widths: [300, 1200, 200]
+type warmConf struct {
+	// Widths of the thumbnails, those of the slideshow by default
+	Widths []uint
+	// Disabled turns warming off, thumbnails are then generated when
+	// they are first requested
+	Disabled bool
+}
+
+var warmQueue = make(chan string, warmQueueSize)
+
+// warmWidths returns the widths of the thumbnails to generate
+func warmWidths() []uint {
+	if len(conf.Warm.Widths) == 0 {
+		return defaultWarmWidths
+	}
+	return conf.Warm.Widths
+}
+
+// queueWarm adds an image to the queue of thumbnails to generate. The image
+// is skipped if the queue is full, its thumbnails are then generated when
+// they are first requested.
+func queueWarm(path string) {
+	if conf.Warm.Disabled || !isImage(path) {
+		return
+	}
+	select {
+	case warmQueue <- path:
+	default:
+		logWarnf("warm: queue is full, skipping %q", path)
+	}
+}
+
+// warmCache generates the thumbnails of the queued images. Thumbnails are
+// requested from getImage, one at a time like those of clients, so warming
+// never resizes more than one image at once.
+func warmCache() {
+	for path := range warmQueue {
+		for _, width := range warmWidths() {
+			img := Image{
+				ctx:        context.Background(),
+				path:       path,
+				size:       width,
+				returnchan: make(chan Image),
+			}
+			reqimage <- img
+			img = <-img.returnchan
+			close(img.returnchan)
+			if img.fd != nil {
+				img.fd.Close()
+			}
+			if img.err != nil {
+				logErrorf("warm: failed to generate %q at width %d: %v", path, width, img.err)
+				break
+			}
+		}
+	}
+}